@@ -0,0 +1,484 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/american-factory-os/glowplug/service"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// configKeys maps the listen flags to their config file keys. Environment
+// variables are GLOWPLUG_ followed by the key in upper case with . and -
+// replaced by _, e.g. GLOWPLUG_REDIS_URL or GLOWPLUG_MQTT_PASSWORD
+var configKeys = map[string]string{
+	"broker":                         "mqtt.url",
+	"mqtt-version":                   "mqtt.version",
+	"mqtt-client-id":                 "mqtt.client-id",
+	"mqtt-session-expiry":            "mqtt.session-expiry",
+	"mqtt-topic-aliases":             "mqtt.topic-aliases",
+	"mqtt-username":                  "mqtt.username",
+	"mqtt-password":                  "mqtt.password",
+	"mqtt-password-file":             "mqtt.password-file",
+	"mqtt-ca":                        "mqtt.ca",
+	"mqtt-cert":                      "mqtt.cert",
+	"mqtt-key":                       "mqtt.key",
+	"mqtt-insecure-skip-verify":      "mqtt.insecure-skip-verify",
+	"mqtt-keepalive":                 "mqtt.keepalive",
+	"mqtt-max-reconnect-interval":    "mqtt.max-reconnect-interval",
+	"rebirth-on-reconnect":           "mqtt.rebirth-on-reconnect",
+	"host-id":                        "mqtt.host-id",
+	"source":                         "sources",
+	"subscribe":                      "filters.subscribe",
+	"include":                        "filters.include",
+	"exclude":                        "filters.exclude",
+	"share-group":                    "cluster.share-group",
+	"instance-id":                    "cluster.instance-id",
+	"node-lease":                     "cluster.node-lease",
+	"workers":                        "pipeline.workers",
+	"queue-size":                     "pipeline.queue-size",
+	"overflow":                       "pipeline.overflow",
+	"sink":                           "sinks",
+	"sink-queue-size":                "sink-queue.size",
+	"sink-overflow":                  "sink-queue.overflow",
+	"batch-size":                     "sink-queue.batch-size",
+	"batch-interval":                 "sink-queue.batch-interval",
+	"data-dir":                       "buffer.dir",
+	"buffer-max-mb":                  "buffer.max-mb",
+	"buffer-max-age":                 "buffer.max-age",
+	"publish":                        "publish.url",
+	"publish-version":                "publish.version",
+	"publish-client-id":              "publish.client-id",
+	"publish-session-expiry":         "publish.session-expiry",
+	"publish-topic-aliases":          "publish.topic-aliases",
+	"publish-username":               "publish.username",
+	"publish-password":               "publish.password",
+	"publish-password-file":          "publish.password-file",
+	"publish-ca":                     "publish.ca",
+	"publish-cert":                   "publish.cert",
+	"publish-key":                    "publish.key",
+	"publish-insecure-skip-verify":   "publish.insecure-skip-verify",
+	"publish-keepalive":              "publish.keepalive",
+	"publish-max-reconnect-interval": "publish.max-reconnect-interval",
+	"publish-format":                 "publish.format",
+	"publish-delivery":               "publish.delivery",
+	"redis":                          "redis.url",
+	"redis-layout":                   "redis.layout",
+	"redis-expire":                   "redis.expire",
+	"redis-expire-after":             "redis.expire-after",
+	"redis-key-template":             "redis.key-template",
+	"redis-key-case":                 "redis.key-case",
+	"redis-key-replace":              "redis.key-replace",
+	"topic-template":                 "topic.template",
+	"topic-case":                     "topic.case",
+	"topic-replace":                  "topic.replace",
+	"mapping":                        "mapping.file",
+	"http":                           "http.port",
+	"websocket-max-clients":          "http.websocket-max-clients",
+	"reload-token":                   "http.reload-token",
+	"shutdown-timeout":               "shutdown.timeout",
+}
+
+// configMappingRulesKey holds mapping rules in the config file, it has no flag
+const configMappingRulesKey = "mapping.rules"
+
+// configRedacted replaces secrets printed by config print
+const configRedacted = "xxxxx"
+
+// configCmd groups commands that check the config file
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Check the glowplug config file",
+	Long: `The config file holds the settings of the listen command in YAML, JSON or
+TOML, by default $HOME/.glowplug.yaml. Flags and GLOWPLUG_* environment
+variables override the config file, and the config commands accept the same
+flags as the listen command.`,
+}
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the config file without connecting to any broker or redis",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		logger := service.NewLogger()
+
+		opts, err := listenOpts(cmd)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if err := opts.Validate(); err != nil {
+			logger.Fatal(err)
+		}
+
+		if used := viper.ConfigFileUsed(); len(used) > 0 {
+			fmt.Println(used, "is valid")
+		} else {
+			fmt.Println("no config file, the flags and environment are valid")
+		}
+	},
+}
+
+// configPrintCmd represents the config print command
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the config merged with the flags and environment, secrets are redacted",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		logger := service.NewLogger()
+
+		if err := loadConfig(cmd); err != nil {
+			logger.Fatal(err)
+		}
+
+		settings := redactConfig("", viper.AllSettings())
+		if err := yaml.NewEncoder(os.Stdout).Encode(settings); err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+// loadConfig binds the listen flags to their config keys, and sets the flags
+// that are not on the command line to the values of the environment or the
+// config file. Lists of sources and sinks are read by configList. Flags set
+// by an earlier call and not on the command line are reset first, so keys
+// removed from the config file fall back to their defaults.
+func loadConfig(cmd *cobra.Command) error {
+	for name, key := range configKeys {
+		f := cmd.Flags().Lookup(name)
+		if f == nil {
+			continue
+		}
+		if err := viper.BindPFlag(key, f); err != nil {
+			return err
+		}
+	}
+
+	if commandLine == nil {
+		commandLine = map[string]bool{}
+		for name := range configKeys {
+			if f := cmd.Flags().Lookup(name); f != nil {
+				commandLine[name] = f.Changed
+				if slice, ok := f.Value.(pflag.SliceValue); ok && !f.Changed {
+					sliceDefaults[name] = slice.GetSlice()
+				}
+			}
+		}
+	} else {
+		for name := range configKeys {
+			f := cmd.Flags().Lookup(name)
+			if f == nil || !f.Changed || commandLine[name] {
+				continue
+			}
+			if err := resetFlag(f); err != nil {
+				return fmt.Errorf("unable to reset flag %s, %w", name, err)
+			}
+		}
+	}
+
+	for name, key := range configKeys {
+		f := cmd.Flags().Lookup(name)
+		if f == nil || f.Changed || !viper.IsSet(key) || key == configKeys["source"] || key == configKeys["sink"] {
+			continue
+		}
+		// a password file is preferred to a password of the config file or environment
+		if strings.HasSuffix(name, "-password") && len(viper.GetString(key+"-file")) > 0 {
+			continue
+		}
+		if err := setFlag(cmd.Flags(), f, key); err != nil {
+			return fmt.Errorf("invalid config %s, %w", key, err)
+		}
+	}
+	return nil
+}
+
+// setFlag sets a flag to the value of a config key
+func setFlag(flags *pflag.FlagSet, f *pflag.Flag, key string) error {
+	if slice, ok := f.Value.(pflag.SliceValue); ok {
+		if err := slice.Replace(viper.GetStringSlice(key)); err != nil {
+			return err
+		}
+		f.Changed = true
+		return nil
+	}
+	return flags.Set(f.Name, viper.GetString(key))
+}
+
+// commandLine records which listen flags are set on the command line, and
+// sliceDefaults the defaults of the other list flags
+var (
+	commandLine   map[string]bool
+	sliceDefaults = map[string][]string{}
+)
+
+// resetFlag sets a flag back to its default
+func resetFlag(f *pflag.Flag) error {
+	if slice, ok := f.Value.(pflag.SliceValue); ok {
+		if err := slice.Replace(sliceDefaults[f.Name]); err != nil {
+			return err
+		}
+	} else if err := f.Value.Set(f.DefValue); err != nil {
+		return err
+	}
+	f.Changed = false
+	return nil
+}
+
+// reloadMu serializes reloads of the config file
+var reloadMu sync.Mutex
+
+// reloadOpts rereads the config file and returns the service options of the
+// listen flags, flags on the command line still override the config file
+func reloadOpts(cmd *cobra.Command) (service.Opts, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	var notFound viper.ConfigFileNotFoundError
+	if err := viper.ReadInConfig(); err != nil && !errors.As(err, &notFound) {
+		return service.Opts{}, fmt.Errorf("unable to read config file, %w", err)
+	}
+	return listenOpts(cmd)
+}
+
+// configList returns the entries of a list flag, or of its config key where
+// entries are strings in the format of the flag or maps
+func configList(cmd *cobra.Command, name string) ([]interface{}, error) {
+	key := configKeys[name]
+	if cmd.Flags().Changed(name) || !viper.IsSet(key) {
+		specs, err := cmd.Flags().GetStringArray(name)
+		if err != nil {
+			return nil, err
+		}
+		return stringsToList(specs), nil
+	}
+
+	switch v := viper.Get(key).(type) {
+	case []interface{}:
+		return v, nil
+	case []string:
+		return stringsToList(v), nil
+	case string:
+		// environment variables separate entries by spaces
+		return stringsToList(strings.Fields(v)), nil
+	default:
+		return nil, fmt.Errorf("invalid config %s, expected a list", key)
+	}
+}
+
+func stringsToList(specs []string) []interface{} {
+	list := make([]interface{}, len(specs))
+	for i, spec := range specs {
+		list[i] = spec
+	}
+	return list
+}
+
+// sourceConfig is a named source of the config file
+type sourceConfig struct {
+	Name         string   `mapstructure:"name"`
+	URL          string   `mapstructure:"url"`
+	Username     string   `mapstructure:"username"`
+	Password     string   `mapstructure:"password"`
+	PasswordFile string   `mapstructure:"password-file"`
+	ClientID     string   `mapstructure:"client-id"`
+	CA           string   `mapstructure:"ca"`
+	Cert         string   `mapstructure:"cert"`
+	Key          string   `mapstructure:"key"`
+	Subscribe    []string `mapstructure:"subscribe"`
+	Include      []string `mapstructure:"include"`
+	Exclude      []string `mapstructure:"exclude"`
+}
+
+// configSources returns the named sources of --source or the config file,
+// they use the broker options, subscriptions and scope of opts unless a
+// config entry sets its own
+func configSources(cmd *cobra.Command, opts service.Opts) ([]service.Source, error) {
+	entries, err := configList(cmd, "source")
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []service.Source
+	for i, entry := range entries {
+		var config sourceConfig
+		if spec, ok := entry.(string); ok {
+			source, err := service.ParseSource(spec)
+			if err != nil {
+				return nil, err
+			}
+			config.Name, config.URL = source.Name, source.URL
+		} else if err := decodeConfig(entry, &config); err != nil {
+			return nil, fmt.Errorf("invalid config source %d, %w", i+1, err)
+		}
+
+		source := service.Source{
+			Name:          config.Name,
+			URL:           config.URL,
+			Broker:        sourceBrokerOpts(opts.MQTTBroker, config.Name),
+			Subscriptions: opts.Subscriptions,
+			Scope:         opts.Scope,
+		}
+		if len(config.ClientID) > 0 {
+			source.Broker.ClientID = config.ClientID
+		}
+		if len(config.CA) > 0 {
+			source.Broker.CAFile = config.CA
+		}
+		if len(config.Cert) > 0 || len(config.Key) > 0 {
+			source.Broker.CertFile, source.Broker.KeyFile = config.Cert, config.Key
+		}
+		// the environment overrides the credentials of the config file
+		if len(source.Broker.Username) == 0 {
+			source.Broker.Username = config.Username
+		}
+		if len(source.Broker.Password) == 0 {
+			source.Broker.Password = config.Password
+			if len(config.PasswordFile) > 0 {
+				if source.Broker.Password, err = readPasswordFile(config.PasswordFile); err != nil {
+					return nil, fmt.Errorf("unable to read password file of source %s, %w", config.Name, err)
+				}
+			}
+		}
+		if len(config.Subscribe) > 0 {
+			source.Subscriptions = nil
+			for _, spec := range config.Subscribe {
+				sub, err := service.ParseSubscription(spec)
+				if err != nil {
+					return nil, err
+				}
+				source.Subscriptions = append(source.Subscriptions, sub)
+			}
+		}
+		if len(config.Include) > 0 || len(config.Exclude) > 0 {
+			source.Scope = service.Scope{Include: config.Include, Exclude: config.Exclude}
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// configSinks returns the sinks of --sink or the config file, where a map
+// entry holds the type, name and options of a sink
+func configSinks(cmd *cobra.Command) ([]service.SinkConfig, error) {
+	entries, err := configList(cmd, "sink")
+	if err != nil {
+		return nil, err
+	}
+
+	var sinks []service.SinkConfig
+	for _, entry := range entries {
+		if spec, ok := entry.(string); ok {
+			sink, err := service.ParseSinkConfig(spec)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+			continue
+		}
+
+		values, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid config sinks, expected type[,key=value...] or a map")
+		}
+		sink := service.SinkConfig{Options: map[string]string{}}
+		for key, value := range values {
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				return nil, fmt.Errorf("invalid config sink option %s, expected a value", key)
+			}
+			switch key {
+			case "type":
+				sink.Type = fmt.Sprint(value)
+			case "name":
+				sink.Name = fmt.Sprint(value)
+			default:
+				sink.Options[key] = fmt.Sprint(value)
+			}
+		}
+		if len(sink.Type) == 0 {
+			return nil, fmt.Errorf("invalid config sinks, missing type")
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// configMappingRules returns the mapping rules of the config file
+func configMappingRules() ([]service.MappingRule, error) {
+	var rules []service.MappingRule
+	if !viper.IsSet(configMappingRulesKey) {
+		return nil, nil
+	}
+	if err := decodeConfig(viper.Get(configMappingRulesKey), &rules); err != nil {
+		return nil, fmt.Errorf("invalid config %s, %w", configMappingRulesKey, err)
+	}
+	return rules, nil
+}
+
+// decodeConfig decodes a config file value, unknown keys are an error
+func decodeConfig(input interface{}, output interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           output,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
+}
+
+// readPasswordFile returns the first line of a password file
+func readPasswordFile(path string) (string, error) {
+	password, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(string(password), "\n")
+	return strings.TrimRight(line, "\r"), nil
+}
+
+// redactConfig returns settings with passwords, tokens and the credentials of
+// URLs replaced
+func redactConfig(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			redacted[k] = redactConfig(k, e)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, e := range v {
+			redacted[i] = redactConfig(key, e)
+		}
+		return redacted
+	case []string:
+		redacted := make([]string, len(v))
+		for i, e := range v {
+			redacted[i] = service.RedactURL(e)
+		}
+		return redacted
+	case string:
+		if (strings.HasSuffix(key, "password") || strings.HasSuffix(key, "token")) && len(v) > 0 {
+			return configRedacted
+		}
+		return service.RedactURL(v)
+	}
+	return value
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configPrintCmd)
+	addListenFlags(configCmd)
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/american-factory-os/glowplug/service"
+	"github.com/spf13/cobra"
+)
+
+// mappingCmd represents the mapping dry-run command
+var mappingCmd = &cobra.Command{
+	Use:   "mapping",
+	Short: "Print how mapping rules rewrite the known Sparkplug namespace",
+	Long: `This command is a dry run of a mapping rules file. It reads the Sparkplug
+namespace glowplug has stored in Redis and prints the group, node, device and
+metric each metric is mapped to, or if it is dropped. Nothing is changed.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+
+		logger := service.NewLogger()
+
+		mapper, err := service.LoadMapper(cmd.Flag("mapping").Value.String())
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		rdb, err := service.NewRedis(cmd.Flag("redis").Value.String())
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer (*rdb).Close()
+
+		ids, err := service.KnownNamespace(context.Background(), *rdb)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		changed := 0
+		for _, id := range ids {
+			result, err := mapper.Apply(id)
+			switch {
+			case err != nil:
+				fmt.Printf("%s => error: %v\n", id, err)
+			case result.Drop:
+				fmt.Printf("%s => dropped (%s)\n", id, strings.Join(result.Rules, ", "))
+			case result.Identity != id:
+				fmt.Printf("%s => %s (%s)\n", id, result.Identity, strings.Join(result.Rules, ", "))
+			default:
+				if all, _ := cmd.Flags().GetBool("all"); all {
+					fmt.Printf("%s => unchanged\n", id)
+				}
+				continue
+			}
+			changed++
+		}
+
+		logger.Printf("%d of %d known metrics are mapped", changed, len(ids))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mappingCmd)
+	mappingCmd.Flags().StringP("mapping", "m", "", "YAML or JSON file of mapping rules")
+	mappingCmd.Flags().StringP("redis", "r", "redis://localhost:6379/0", "Redis URL where glowplug stores Sparkplug data")
+	mappingCmd.Flags().Bool("all", false, "Also print metrics that are not changed by any rule")
+	mappingCmd.MarkFlagRequired("mapping")
+}
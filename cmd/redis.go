@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/american-factory-os/glowplug/service"
+	"github.com/spf13/cobra"
+)
+
+// redisCmd groups commands that manage glowplug data in redis
+var redisCmd = &cobra.Command{
+	Use:   "redis",
+	Short: "Manage glowplug data in Redis",
+}
+
+// redisPruneCmd represents the redis prune command
+var redisPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove Redis keys of edge nodes that have not been seen recently",
+	Long: `This command removes the metric keys under the glowplug prefix for edge
+nodes that have not published a birth or data message within the given window.
+
+Only nodes seen by a version of glowplug that tracks node activity are pruned.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+
+		logger := service.NewLogger()
+
+		olderThan, err := cmd.Flags().GetDuration("older-than")
+		if err != nil {
+			logger.Fatalf("invalid window: %v", err)
+		}
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		rdb, err := service.NewRedis(cmd.Flag("redis").Value.String())
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer (*rdb).Close()
+
+		result, err := service.PruneRedis(context.Background(), *rdb, olderThan, dryRun, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		if dryRun {
+			logger.Printf("dry run, would prune %d nodes and %d keys", len(result.Nodes), result.Keys)
+		} else {
+			logger.Printf("pruned %d nodes and %d keys", len(result.Nodes), result.Keys)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(redisCmd)
+	redisCmd.AddCommand(redisPruneCmd)
+	redisCmd.PersistentFlags().StringP("redis", "r", "redis://localhost:6379/0", "Redis URL where glowplug stores Sparkplug data")
+	redisPruneCmd.Flags().Duration("older-than", 0, "Prune nodes that have not been seen within this window, e.g. 72h")
+	redisPruneCmd.Flags().Bool("dry-run", false, "Print the nodes that would be pruned without removing anything")
+	redisPruneCmd.MarkFlagRequired("older-than")
+}
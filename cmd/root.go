@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -38,7 +40,7 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.glowplug.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "YAML, JSON or TOML config file, default $HOME/.glowplug.yaml, .json or .toml")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -55,16 +57,24 @@ func initConfig() {
 		home, err := os.UserHomeDir()
 		cobra.CheckErr(err)
 
-		// Search config in home directory with name ".glowplug" (without extension).
+		// Search config in home directory with name ".glowplug", the
+		// extension selects the format
 		viper.AddConfigPath(home)
-		viper.SetConfigType("json")
 		viper.SetConfigName(".glowplug")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// read in environment variables that match, e.g. GLOWPLUG_REDIS_URL for redis.url
+	viper.SetEnvPrefix("glowplug")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	viper.AutomaticEnv()
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
+	err := viper.ReadInConfig()
+	var notFound viper.ConfigFileNotFoundError
+	switch {
+	case err == nil:
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	case !errors.As(err, &notFound):
+		cobra.CheckErr(fmt.Errorf("unable to read config file, %w", err))
 	}
 }
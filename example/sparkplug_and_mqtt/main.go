@@ -7,92 +7,71 @@ import (
 
 	"github.com/american-factory-os/glowplug/sparkplug"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"google.golang.org/protobuf/proto"
 )
 
-func uint64TimeNow() uint64 {
-	return uint64(time.Now().UTC().UnixNano())
-}
-
-func floatPayloadMetric(name string, value float32, seq uint64) *sparkplug.Payload {
-	return &sparkplug.Payload{
-		Seq:       seq,
-		Timestamp: uint64TimeNow(),
-		Metrics: []*sparkplug.Payload_Metric{
-			{
-				Name: name,
-				Value: &sparkplug.Payload_Metric_FloatValue{
-					FloatValue: value,
-				},
-				Datatype: sparkplug.DataType_Float.Uint32(),
-			},
-		},
+// temperature returns the metrics of the temperature sensor, the payload
+// builder sets the datatype matching each value
+func temperature(celsius float32) []*sparkplug.Payload_Metric {
+	metrics, err := sparkplug.NewPayload().
+		Float("Current/Celsius", celsius).
+		FloatArray("Recent/Celsius", celsius-0.2, celsius-0.1, celsius).
+		Metrics()
+	if err != nil {
+		panic(err)
 	}
+	return metrics
 }
 
 func main() {
-	mqtt.ERROR = log.New(os.Stdout, "", 0)
+	logger := log.New(os.Stdout, "", 0)
+	mqtt.ERROR = logger
 	opts := mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("localhost-test")
 	opts.SetKeepAlive(2 * time.Second)
 	opts.SetPingTimeout(1 * time.Second)
 
-	c := mqtt.NewClient(opts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	}
-
-	// our example sparkplug message payload
+	// our example edge node, it publishes its NBIRTH with bdSeq on connect
+	// and registers the NDEATH as last will
 	groupId := "Plant1:Area3:Line4:Cell2"
 	edgeNodeId := "Heater"
 	deviceId := "TempSensor"
 	value := float32(98.6)
 
-	// device birth
-	birthTopic := sparkplug.DeviceBirthTopic(groupId, edgeNodeId, deviceId)
-	dBirthPayload := floatPayloadMetric("Current/Celsius", value, 0)
-	birthBytes, err := proto.Marshal(dBirthPayload)
+	node, err := sparkplug.NewEdgeNode(logger, sparkplug.NewPahoTransport(opts), sparkplug.EdgeNodeOpts{
+		GroupId:    groupId,
+		EdgeNodeId: edgeNodeId,
+		Aliases:    true,
+		OnDeviceCommand: func(deviceId string, metrics []*sparkplug.Payload_Metric) {
+			for _, metric := range metrics {
+				logger.Println("command for", deviceId, metric.Name)
+			}
+		},
+	})
 	if err != nil {
 		panic(err)
 	}
-	token := c.Publish(birthTopic, 0, false, birthBytes)
-	token.Wait()
 
-	// device data
-	seq := uint64(0)
+	// device birth
+	if err := node.AddDevice(deviceId, temperature(value)); err != nil {
+		panic(err)
+	}
+	if err := node.Connect(); err != nil {
+		panic(err)
+	}
+	defer node.Disconnect()
+
+	// device data, only changed values are published
 	for i := 0; i < 5; i++ {
 		value = value + 0.1
-
-		dataTopic := sparkplug.DeviceDataTopic(groupId, edgeNodeId, deviceId)
-		dDataPayload := floatPayloadMetric("Current/Celsius", value, seq)
-		bytes, err := proto.Marshal(dDataPayload)
-		if err != nil {
-			panic(err)
+		if err := node.PublishDeviceData(deviceId, temperature(value)...); err != nil {
+			logger.Println(err)
 		}
-		token := c.Publish(dataTopic, 0, false, bytes)
-		token.Wait()
-
-		seq = sparkplug.NextSequenceNumber(seq)
 
 		// sleeping 1s between data points...
 		time.Sleep(1 * time.Second)
 	}
 
-	// sleeping 1s before device death...
-	time.Sleep(1 * time.Second)
-
 	// publish device death
-	deathTopic := sparkplug.DeviceDeathTopic(groupId, edgeNodeId, deviceId)
-	dDeathPayload := sparkplug.Payload{
-		Seq:       uint64(1),
-		Timestamp: uint64TimeNow(),
-	}
-	deathBytes, err := proto.Marshal(&dDeathPayload)
-	if err != nil {
+	if err := node.RemoveDevice(deviceId); err != nil {
 		panic(err)
 	}
-
-	token = c.Publish(deathTopic, 0, false, deathBytes)
-	token.Wait()
-
-	defer c.Disconnect(250)
 }
@@ -240,7 +240,11 @@ func MetricValueToJsonType(metric *sparkplug.Payload_Metric) (JsonType, error) {
 	case "Int32":
 		return newJsonNumber(int32(metric.GetIntValue())), nil
 	case "Int64":
-		return newJsonNumber(int64(metric.GetIntValue())), nil
+		// the spec uses long_value, some edge nodes send int_value
+		if _, ok := metric.Value.(*sparkplug.Payload_Metric_IntValue); ok {
+			return newJsonNumber(int64(metric.GetIntValue())), nil
+		}
+		return newJsonNumber(int64(metric.GetLongValue())), nil
 	case "UInt8":
 		fallthrough
 	case "UInt16":
@@ -248,6 +252,10 @@ func MetricValueToJsonType(metric *sparkplug.Payload_Metric) (JsonType, error) {
 	case "UInt32":
 		fallthrough
 	case "UInt64":
+		// the spec uses int_value up to UInt32, some edge nodes send long_value
+		if _, ok := metric.Value.(*sparkplug.Payload_Metric_IntValue); ok {
+			return newJsonNumber(uint64(metric.GetIntValue())), nil
+		}
 		return newJsonNumber(uint64(metric.GetLongValue())), nil
 	case "Float":
 		return newJsonNumber(float32(metric.GetFloatValue())), nil
@@ -256,7 +264,10 @@ func MetricValueToJsonType(metric *sparkplug.Payload_Metric) (JsonType, error) {
 	case "Boolean":
 		return newJsonBool(metric.GetBooleanValue()), nil
 	case "DateTime":
-		return newJsonNumber(int64(metric.GetIntValue())), nil
+		if _, ok := metric.Value.(*sparkplug.Payload_Metric_IntValue); ok {
+			return newJsonNumber(int64(metric.GetIntValue())), nil
+		}
+		return newJsonNumber(int64(metric.GetLongValue())), nil
 	case "String":
 		fallthrough
 	case "Text":
@@ -269,12 +280,6 @@ func MetricValueToJsonType(metric *sparkplug.Payload_Metric) (JsonType, error) {
 		fallthrough
 	case "File":
 		return newJsonString(string(metric.GetBytesValue())), nil
-	case "Template":
-		fallthrough
-	case "PropertySet":
-		fallthrough
-	case "PropertySetList":
-		fallthrough
 	case "Int8Array":
 		fallthrough
 	case "Int16Array":
@@ -300,6 +305,12 @@ func MetricValueToJsonType(metric *sparkplug.Payload_Metric) (JsonType, error) {
 	case "StringArray":
 		fallthrough
 	case "DateTimeArray":
+		return arrayToJsonType(sparkplug.DataType(datatype), metric.GetBytesValue())
+	case "Template":
+		fallthrough
+	case "PropertySet":
+		fallthrough
+	case "PropertySetList":
 		fallthrough
 	case "Unknown":
 		fallthrough
@@ -309,6 +320,41 @@ func MetricValueToJsonType(metric *sparkplug.Payload_Metric) (JsonType, error) {
 
 }
 
+// arrayToJsonType decodes the bytes value of an array metric
+func arrayToJsonType(datatype sparkplug.DataType, data []byte) (JsonType, error) {
+	values, err := sparkplug.DecodeArray(datatype, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s, %w", datatype, err)
+	}
+	switch a := values.(type) {
+	case []int8:
+		return newJsonArray(a)
+	case []int16:
+		return newJsonArray(a)
+	case []int32:
+		return newJsonArray(a)
+	case []int64:
+		return newJsonArray(a)
+	case []uint8:
+		return newJsonArray(a)
+	case []uint16:
+		return newJsonArray(a)
+	case []uint32:
+		return newJsonArray(a)
+	case []uint64:
+		return newJsonArray(a)
+	case []float32:
+		return newJsonArray(a)
+	case []float64:
+		return newJsonArray(a)
+	case []bool:
+		return newJsonArray(a)
+	case []string:
+		return newJsonArray(a)
+	}
+	return nil, fmt.Errorf("sparkplug datatype %s is currently unsupported", datatype)
+}
+
 // NodeValueToJsonType will convert a OPC UA Node type to a JSON type,
 // one of: number, string, boolean, array
 func NodeValueToJsonType(variant *ua.Variant) (JsonType, error) {
@@ -6,7 +6,9 @@ import (
 	"math"
 	"testing"
 
+	"github.com/american-factory-os/glowplug/sparkplug"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewJsonNumber(t *testing.T) {
@@ -149,3 +151,29 @@ func TestNewJsonNil(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "null", string(jtBytes))
 }
+
+func TestMetricValueToJsonType(t *testing.T) {
+	metrics, err := sparkplug.NewPayload().
+		Int64("Int64", -5).
+		UInt32("UInt32", math.MaxUint32).
+		Int16Array("Int16Array", -1, 2).
+		BooleanArray("BooleanArray", true, false).
+		StringArray("StringArray", "a", "b").
+		Metrics()
+	require.NoError(t, err)
+
+	expected := []string{"-5", "4294967295", "[-1,2]", "[true,false]", `["a","b"]`}
+	for i, metric := range metrics {
+		jt, err := MetricValueToJsonType(metric)
+		require.NoError(t, err, metric.Name)
+		assert.Equal(t, expected[i], jt.String(), metric.Name)
+	}
+
+	// values of other edge nodes in the other integer field
+	jt, err := MetricValueToJsonType(&sparkplug.Payload_Metric{Datatype: sparkplug.DataType_UInt64.Uint32(), Value: &sparkplug.Payload_Metric_LongValue{LongValue: math.MaxUint64}})
+	require.NoError(t, err)
+	assert.Equal(t, "18446744073709551615", jt.String())
+
+	_, err = MetricValueToJsonType(&sparkplug.Payload_Metric{Datatype: sparkplug.DataType_Int32Array.Uint32(), Value: &sparkplug.Payload_Metric_BytesValue{BytesValue: []byte{1}}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultNodeLease is how long an instance owns an edge node after its last message
+const DefaultNodeLease = 30 * time.Second
+
+const (
+	// prefix of the keys that hold the instance owning an edge node
+	nodeOwnerPrefix = "glowplug:node_owner"
+	// prefix of the lists of messages forwarded to an instance
+	inboxPrefix = "glowplug:inbox"
+	// how long an instance waits for forwarded messages before checking if it stopped
+	inboxPollTimeout = time.Second
+)
+
+// ClusterOpts configures glowplug instances that share the messages of a
+// broker. Each edge node is processed by one instance at a time, messages of
+// nodes owned by another instance are forwarded to it through redis.
+type ClusterOpts struct {
+	// ShareGroup subscribes with $share/<group>/, empty disables clustering
+	ShareGroup string
+	// InstanceID identifies this instance, defaults to <hostname>-<pid>
+	InstanceID string
+	// NodeLease is how long an instance owns an edge node after its last
+	// message, defaults to DefaultNodeLease
+	NodeLease time.Duration
+}
+
+// Enabled returns true when instances share a subscription
+func (o ClusterOpts) Enabled() bool {
+	return len(o.ShareGroup) > 0
+}
+
+// Validate returns an error if the cluster options are invalid
+func (o ClusterOpts) Validate() error {
+	if strings.ContainsAny(o.ShareGroup, "/+#") {
+		return fmt.Errorf("invalid share group %s, must not contain /, + or #", o.ShareGroup)
+	}
+	if o.NodeLease != 0 && o.NodeLease < time.Second {
+		return fmt.Errorf("node lease must be at least 1s")
+	}
+	return nil
+}
+
+// filter returns the shared subscription of a topic filter
+func (o ClusterOpts) filter(topicFilter string) string {
+	if !o.Enabled() {
+		return topicFilter
+	}
+	return "$share/" + o.ShareGroup + "/" + topicFilter
+}
+
+// defaultInstanceID returns <hostname>-<pid>
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "glowplug"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// nodeOwnerKey returns the key holding the instance owning an edge node
+func nodeOwnerKey(nodeKey string) string {
+	return nodeOwnerPrefix + keyDelimiter + nodeKey
+}
+
+// inboxKey returns the list of messages forwarded to an instance
+func inboxKey(instance string) string {
+	return inboxPrefix + keyDelimiter + instance
+}
+
+// claimNodeScript sets the owner of a node when it has no owner or is
+// already owned by the instance, and returns the owner
+var claimNodeScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if not owner or owner == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return ARGV[1]
+end
+return owner
+`)
+
+// nodeOwner is a cached owner of an edge node
+type nodeOwner struct {
+	instance string
+	recheck  time.Time
+}
+
+// forwardedMessage is a message forwarded to the instance owning its node
+type forwardedMessage struct {
+	Topic    string `json:"topic"`
+	Source   string `json:"source,omitempty"`
+	Payload  []byte `json:"payload"`
+	Received int64  `json:"received"`
+}
+
+// cluster partitions edge nodes between glowplug instances
+type cluster struct {
+	opts   ClusterOpts
+	rdb    redis.UniversalClient
+	logger *log.Logger
+	owners sync.Map
+}
+
+// newCluster returns a cluster for the options, or nil when clustering is disabled
+func newCluster(logger *log.Logger, rdb *redis.UniversalClient, opts ClusterOpts) (*cluster, error) {
+	if !opts.Enabled() {
+		return nil, nil
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if rdb == nil {
+		return nil, fmt.Errorf("shared subscriptions require redis to partition edge nodes")
+	}
+	if len(opts.InstanceID) == 0 {
+		opts.InstanceID = defaultInstanceID()
+	}
+	if opts.NodeLease == 0 {
+		opts.NodeLease = DefaultNodeLease
+	}
+	return &cluster{
+		opts:   opts,
+		rdb:    *rdb,
+		logger: logger,
+	}, nil
+}
+
+// owner returns the instance owning an edge node, claiming it when it has no
+// owner. Ownership is renewed after half of the lease and the owner of nodes
+// owned by other instances is checked again after a quarter of the lease.
+func (c *cluster) owner(ctx context.Context, nodeKey string, now time.Time) (string, error) {
+	if cached, ok := c.owners.Load(nodeKey); ok {
+		owner := cached.(nodeOwner)
+		if now.Before(owner.recheck) {
+			return owner.instance, nil
+		}
+	}
+
+	instance, err := claimNodeScript.Run(ctx, c.rdb, []string{nodeOwnerKey(nodeKey)},
+		c.opts.InstanceID, c.opts.NodeLease.Milliseconds()).Text()
+	if err != nil {
+		return "", fmt.Errorf("unable to claim edge node %s, %w", nodeKey, err)
+	}
+
+	recheck := now.Add(c.opts.NodeLease / 4)
+	if instance == c.opts.InstanceID {
+		recheck = now.Add(c.opts.NodeLease / 2)
+	}
+
+	if previous, ok := c.owners.Load(nodeKey); !ok || previous.(nodeOwner).instance != instance {
+		c.logger.Printf("edge node %s is owned by instance %s\n", nodeKey, instance)
+	}
+	c.owners.Store(nodeKey, nodeOwner{instance: instance, recheck: recheck})
+
+	return instance, nil
+}
+
+// forward queues a message for the instance owning its node, the queue
+// expires with the lease so messages for a failed instance are not kept
+func (c *cluster) forward(ctx context.Context, instance string, msg Message) error {
+	data, err := json.Marshal(forwardedMessage{
+		Topic:    msg.Topic,
+		Source:   msg.Source,
+		Payload:  msg.Payload,
+		Received: msg.Received.UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, inboxKey(instance), data)
+		pipe.PExpire(ctx, inboxKey(instance), c.opts.NodeLease)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to forward message on %s to instance %s, %w", msg.Topic, instance, err)
+	}
+	return nil
+}
+
+// receive passes messages forwarded by other instances to handler until done is closed
+func (c *cluster) receive(done <-chan struct{}, handler func(Message)) {
+	key := inboxKey(c.opts.InstanceID)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		values, err := c.rdb.BLPop(context.TODO(), inboxPollTimeout, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			select {
+			case <-done:
+				return
+			case <-time.After(inboxPollTimeout):
+			}
+			c.logger.Println("unable to receive forwarded messages,", err)
+			continue
+		}
+
+		// values holds the key followed by the message
+		for _, value := range values[1:] {
+			var fwd forwardedMessage
+			if err := json.Unmarshal([]byte(value), &fwd); err != nil {
+				c.logger.Println("invalid forwarded message,", err)
+				continue
+			}
+			handler(Message{
+				Topic:     fwd.Topic,
+				Source:    fwd.Source,
+				Payload:   fwd.Payload,
+				Received:  time.UnixMilli(fwd.Received),
+				forwarded: true,
+			})
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newClusterTestWorker returns a worker of a share group using miniredis
+func newClusterTestWorker(t *testing.T, mr *miniredis.Miniredis, instance string) *worker {
+	t.Helper()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{mr.Addr()}})
+	t.Cleanup(func() { rdb.Close() })
+
+	logger := log.New(io.Discard, "", 0)
+	opts := ClusterOpts{ShareGroup: "glowplug", InstanceID: instance, NodeLease: 10 * time.Second}
+	sink, err := newRedisSink(logger, SINK_REDIS, rdb, RedisOpts{Layout: REDIS_LAYOUT_SET, ExpirePolicy: REDIS_EXPIRE_NONE})
+	require.NoError(t, err)
+	wIface, err := NewWorker(logger, WorkerOpts{Redis: &rdb, Cluster: opts, Sinks: []Sink{sink}})
+	require.NoError(t, err)
+	return wIface.(*worker)
+}
+
+func aliasedMetric(metric *sparkplug.Payload_Metric, alias uint64) *sparkplug.Payload_Metric {
+	metric.Alias = alias
+	return metric
+}
+
+func TestResolveAliases(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	a := newClusterTestWorker(t, mr, "a")
+	b := newClusterTestWorker(t, mr, "b")
+
+	require.NoError(t, processQueued(a, testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", aliasedMetric(floatMetric("Voltage", 230), 1))))
+	require.NoError(t, processQueued(a, testResult(t, "spBv1.0/Plant1/DBIRTH/Heater/TempSensor", aliasedMetric(floatMetric("Celsius", 98.6), 2))))
+
+	// data metrics sent with an alias only
+	require.NoError(t, processQueued(a, testResult(t, "spBv1.0/Plant1/DDATA/Heater/TempSensor", aliasedMetric(floatMetric("", 99.1), 2))))
+	assert.Equal(t, "99.1", (*a.rdb).Get(ctx, testDeviceMetricKey).Val())
+
+	// another instance takes over the node using the tables in redis
+	require.NoError(t, processQueued(b, testResult(t, "spBv1.0/Plant1/NDATA/Heater", aliasedMetric(floatMetric("", 231), 1))))
+	assert.Equal(t, "231", (*b.rdb).Get(ctx, testNodeMetricKey).Val())
+
+	// a rebirth replaces the tables
+	require.NoError(t, processQueued(b, testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", aliasedMetric(floatMetric("Voltage", 230), 3))))
+	err := processQueued(b, testResult(t, "spBv1.0/Plant1/NDATA/Heater", aliasedMetric(floatMetric("", 231), 1)))
+	assert.ErrorContains(t, err, "unknown alias 1")
+}
+
+func TestRestoreMisses(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	a := newClusterTestWorker(t, mr, "a")
+	b := newClusterTestWorker(t, mr, "b")
+	data := func() error {
+		return processQueued(b, testResult(t, "spBv1.0/Plant1/NDATA/Heater", aliasedMetric(floatMetric("", 231), 1)))
+	}
+
+	// a node missing in redis is not looked up again on every message
+	assert.ErrorContains(t, data(), "unknown alias 1")
+	require.NoError(t, processQueued(a, testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", aliasedMetric(floatMetric("Voltage", 230), 1))))
+	assert.ErrorContains(t, data(), "unknown alias 1")
+
+	// it is looked up again after the retry interval
+	b.restoreMisses.Store(sparkplug.NodeKey{GroupId: "Plant1", EdgeNodeId: "Heater"}, time.Now().Add(-restoreRetryInterval))
+	require.NoError(t, data())
+	assert.Equal(t, "231", (*b.rdb).Get(ctx, testNodeMetricKey).Val())
+}
+
+func TestTrackSession(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newClusterTestWorker(t, mr, "a")
+	b := newClusterTestWorker(t, mr, "b")
+
+	birth := testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", floatMetric("Voltage", 230),
+		&sparkplug.Payload_Metric{Name: "bdSeq", Datatype: sparkplug.DataType_Int64.Uint32(), Value: &sparkplug.Payload_Metric_LongValue{LongValue: 7}})
+	birth.Received = time.UnixMilli(1700000000000)
+	require.NoError(t, processQueued(a, birth))
+
+	data := testResult(t, "spBv1.0/Plant1/NDATA/Heater", floatMetric("Voltage", 231))
+	data.Payload.Seq = 1
+	data.Payload.Timestamp = 1700000001000
+	require.NoError(t, processQueued(b, data))
+
+	nodes := b.Nodes()
+	require.Len(t, nodes, 1)
+	node := nodes[0]
+	assert.Equal(t, sparkplug.NodeKey{GroupId: "Plant1", EdgeNodeId: "Heater"}, node.Key())
+	assert.True(t, node.Online)
+	assert.Equal(t, uint64(7), node.BdSeq)
+	assert.Equal(t, uint64(1), node.Seq)
+	assert.Equal(t, int64(1700000000000), node.Birth.UnixMilli())
+	assert.Equal(t, "b", node.Instance)
+
+	// redis keeps the session in the shape of Engine.Nodes
+	var stored sparkplug.NodeSession
+	require.NoError(t, json.Unmarshal([]byte(mr.HGet(HASH_NODE_SESSIONS, "plant1:heater")), &stored))
+	assert.Equal(t, "Heater", stored.EdgeNodeId)
+	assert.Equal(t, "b", stored.Instance)
+}
+
+func TestClusterOwner(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	a := newClusterTestWorker(t, mr, "a").cluster
+	b := newClusterTestWorker(t, mr, "b").cluster
+	now := time.Now()
+
+	owner, err := a.owner(ctx, "plant1:heater", now)
+	require.NoError(t, err)
+	assert.Equal(t, "a", owner)
+
+	owner, err = b.owner(ctx, "plant1:heater", now)
+	require.NoError(t, err)
+	assert.Equal(t, "a", owner)
+
+	// b forwards messages of the node to a
+	require.NoError(t, b.forward(ctx, "a", Message{Topic: "spBv1.0/Plant1/NDATA/Heater", Payload: []byte{1}, Received: now}))
+	done := make(chan struct{})
+	received := make(chan Message, 1)
+	go a.receive(done, func(msg Message) {
+		received <- msg
+	})
+	select {
+	case msg := <-received:
+		assert.Equal(t, "spBv1.0/Plant1/NDATA/Heater", msg.Topic)
+		assert.Equal(t, []byte{1}, msg.Payload)
+		assert.True(t, msg.forwarded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarded message not received")
+	}
+	close(done)
+
+	// b takes over the node when the lease of a expires
+	mr.FastForward(11 * time.Second)
+	owner, err = b.owner(ctx, "plant1:heater", now.Add(11*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, "b", owner)
+}
+
+func TestClusterOptsValidate(t *testing.T) {
+	assert.NoError(t, ClusterOpts{ShareGroup: "glowplug"}.Validate())
+	assert.Error(t, ClusterOpts{ShareGroup: "glow/plug"}.Validate())
+	assert.Error(t, ClusterOpts{ShareGroup: "glowplug", NodeLease: time.Millisecond}.Validate())
+	assert.Equal(t, "$share/glowplug/spBv1.0/#", ClusterOpts{ShareGroup: "glowplug"}.filter("spBv1.0/#"))
+	assert.Equal(t, "spBv1.0/#", ClusterOpts{}.filter("spBv1.0/#"))
+
+	_, err := newCluster(nil, nil, ClusterOpts{ShareGroup: "glowplug"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+)
+
+// subscribersSink is the name of the sink passing updates to the callbacks,
+// channels and last value cache of an engine
+const subscribersSink = "subscribers"
+
+// Engine decodes the Sparkplug messages fed to it, resolves aliases, tracks
+// edge node sessions, applies mapping rules and passes the metric updates and
+// session events to its sinks, callbacks and channels. It keeps the last
+// value of each metric. An engine does not connect to any broker, glowplug
+// and applications embedding it feed it the messages of their mqtt clients.
+type Engine struct {
+	worker      *worker
+	subscribers *subscribers
+}
+
+// NewEngine returns an engine writing to the sinks of opts, the redis client
+// of opts is owned by the caller and not closed by Stop
+func NewEngine(logger *log.Logger, opts WorkerOpts) (*Engine, error) {
+	subscribers := newSubscribers()
+	opts.Sinks = append(slices.Clone(opts.Sinks), subscribers)
+
+	// callbacks can't fail, they don't need a disk buffer
+	queues := maps.Clone(opts.SinkQueues)
+	if queues == nil {
+		queues = map[string]QueueOpts{}
+	}
+	queue := opts.SinkQueue
+	queue.Buffer = BufferOpts{}
+	queues[subscribersSink] = queue
+	opts.SinkQueues = queues
+
+	w, err := NewWorker(logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{worker: w.(*worker), subscribers: subscribers}, nil
+}
+
+// Start starts the sinks and decode workers, messages are accepted once it
+// returns
+func (e *Engine) Start() error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- e.worker.Run()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-e.worker.ready:
+		return nil
+	}
+}
+
+// Stop stops accepting messages and waits until the queued messages reached
+// the sinks or ctx is done, the channels of Metrics and Sessions are closed.
+// It returns an error wrapping ErrDataLost when messages or updates were dropped
+// or could not be written, calling it again does nothing and returns nil.
+func (e *Engine) Stop(ctx context.Context) error {
+	return e.worker.Stop(ctx)
+}
+
+// Feed passes a message received from a source broker now, source is the
+// name of the source and may be empty. A full engine applies the overflow
+// policy of the pipeline.
+func (e *Engine) Feed(source string, topic string, payload []byte) error {
+	return e.AddMessage(Message{Topic: topic, Source: source, Payload: payload, Received: time.Now()})
+}
+
+// AddMessage passes a message received from a source broker
+func (e *Engine) AddMessage(msg Message) error {
+	return e.worker.AddMessage(msg)
+}
+
+// OnMetric registers a callback for the metric updates. Callbacks and
+// channels receive the updates one at a time in order, a slow callback holds
+// up the others but not the sinks.
+func (e *Engine) OnMetric(f func(MetricUpdate)) {
+	e.subscribers.mu.Lock()
+	defer e.subscribers.mu.Unlock()
+	e.subscribers.onMetric = append(e.subscribers.onMetric, f)
+}
+
+// OnSession registers a callback for the births and deaths of edge nodes and devices
+func (e *Engine) OnSession(f func(SessionEvent)) {
+	e.subscribers.mu.Lock()
+	defer e.subscribers.mu.Unlock()
+	e.subscribers.onSession = append(e.subscribers.onSession, f)
+}
+
+// Metrics returns a channel of the metric updates holding up to size updates,
+// updates wait while it is full. It is closed by Stop.
+func (e *Engine) Metrics(size int) <-chan MetricUpdate {
+	ch := make(chan MetricUpdate, size)
+	e.subscribers.mu.Lock()
+	defer e.subscribers.mu.Unlock()
+	if e.subscribers.closed {
+		close(ch)
+	} else {
+		e.subscribers.metrics = append(e.subscribers.metrics, ch)
+	}
+	return ch
+}
+
+// Sessions returns a channel of the births and deaths holding up to size
+// events, events wait while it is full. It is closed by Stop.
+func (e *Engine) Sessions(size int) <-chan SessionEvent {
+	ch := make(chan SessionEvent, size)
+	e.subscribers.mu.Lock()
+	defer e.subscribers.mu.Unlock()
+	if e.subscribers.closed {
+		close(ch)
+	} else {
+		e.subscribers.sessions = append(e.subscribers.sessions, ch)
+	}
+	return ch
+}
+
+// LastValue returns the latest update of a metric by the name of its source
+// and its identity after mapping rules
+func (e *Engine) LastValue(source string, id MetricIdentity) (MetricUpdate, bool) {
+	e.subscribers.mu.RLock()
+	defer e.subscribers.mu.RUnlock()
+	u, ok := e.subscribers.last[lastValueKey{source: source, id: id}]
+	return u, ok
+}
+
+// LastValues returns the latest update of each metric, ordered by source and identity
+func (e *Engine) LastValues() []MetricUpdate {
+	e.subscribers.mu.RLock()
+	keys := make([]lastValueKey, 0, len(e.subscribers.last))
+	for key := range e.subscribers.last {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].source != keys[j].source {
+			return keys[i].source < keys[j].source
+		}
+		return keys[i].id.String() < keys[j].id.String()
+	})
+	values := make([]MetricUpdate, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, e.subscribers.last[key])
+	}
+	e.subscribers.mu.RUnlock()
+	return values
+}
+
+// Host returns the host application tracking the edge nodes of a source,
+// it publishes rebirth requests and STATE with the transport of the source
+func (e *Engine) Host(source string) (*sparkplug.HostApplication, error) {
+	return e.worker.host(source)
+}
+
+// Nodes returns the sessions of the edge nodes seen by the engine
+func (e *Engine) Nodes() []sparkplug.NodeSession {
+	return e.worker.Nodes()
+}
+
+// Sinks returns the stats of the sinks of the engine
+func (e *Engine) Sinks() []SinkStats {
+	return e.worker.Sinks()
+}
+
+// Pipeline returns the stats of the intake queue and decode workers
+func (e *Engine) Pipeline() PipelineStats {
+	return e.worker.Pipeline()
+}
+
+// Reload replaces the scopes and mapping rules of a running engine
+func (e *Engine) Reload(scopes map[string]Scope, mapper *Mapper) error {
+	return e.worker.Reload(scopes, mapper)
+}
+
+// lastValueKey identifies a metric of a source in the last value cache
+type lastValueKey struct {
+	source string
+	id     MetricIdentity
+}
+
+// subscribers is the sink of the callbacks, channels and last value cache of
+// an engine
+type subscribers struct {
+	mu        sync.RWMutex
+	onMetric  []func(MetricUpdate)
+	onSession []func(SessionEvent)
+	metrics   []chan MetricUpdate
+	sessions  []chan SessionEvent
+	closed    bool
+	last      map[lastValueKey]MetricUpdate
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{last: map[lastValueKey]MetricUpdate{}}
+}
+
+func (s *subscribers) Name() string {
+	return subscribersSink
+}
+
+func (s *subscribers) Start(ctx context.Context) error {
+	return nil
+}
+
+// Write caches the updates and passes them to the callbacks and channels
+func (s *subscribers) Write(ctx context.Context, updates []MetricUpdate) error {
+	s.mu.Lock()
+	for _, u := range updates {
+		s.last[lastValueKey{source: u.Topic.Source, id: identityFromTopic(u.Topic, u.Name)}] = u
+	}
+	callbacks, channels := s.onMetric, s.metrics
+	s.mu.Unlock()
+
+	for _, u := range updates {
+		for _, f := range callbacks {
+			f(u)
+		}
+		for _, ch := range channels {
+			select {
+			case ch <- u:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// Session passes a birth or death to the callbacks and channels
+func (s *subscribers) Session(ctx context.Context, event SessionEvent) error {
+	s.mu.RLock()
+	callbacks, channels := s.onSession, s.sessions
+	s.mu.RUnlock()
+
+	for _, f := range callbacks {
+		f(event)
+	}
+	for _, ch := range channels {
+		select {
+		case ch <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *subscribers) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close closes the channels, it is called after the last Write
+func (s *subscribers) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, ch := range s.metrics {
+		close(ch)
+	}
+	for _, ch := range s.sessions {
+		close(ch)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// testPublisher records published messages, the mqtt sink publishes concurrently
+type testPublisher struct {
+	mu        sync.Mutex
+	topics    []string
+	connected bool
+}
+
+func (p *testPublisher) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.topics = append(p.topics, topic)
+	return nil
+}
+
+func (p *testPublisher) IsConnected() bool { return p.connected }
+
+func TestEngine(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	publisher := &testPublisher{connected: true}
+	sink, err := NewMQTTSink(logger, "app", publisher, PublishOpts{})
+	require.NoError(t, err)
+
+	engine, err := NewEngine(logger, WorkerOpts{Sinks: []Sink{sink}})
+	require.NoError(t, err)
+	var births []SessionEvent
+	engine.OnSession(func(event SessionEvent) { births = append(births, event) })
+	var values []float32
+	engine.OnMetric(func(u MetricUpdate) { values = append(values, u.Metric.GetFloatValue()) })
+	metrics := engine.Metrics(10)
+	sessions := engine.Sessions(10)
+
+	// messages are rejected before the engine starts
+	assert.Error(t, engine.Feed("plant1", "spBv1.0/Plant1/NDATA/Heater", nil))
+	require.NoError(t, engine.Start())
+
+	feed := func(topic string, payload *sparkplug.Payload) {
+		t.Helper()
+		data, err := proto.Marshal(payload)
+		require.NoError(t, err)
+		require.NoError(t, engine.Feed("plant1", topic, data))
+	}
+	feed("spBv1.0/Plant1/NBIRTH/Heater", &sparkplug.Payload{Metrics: []*sparkplug.Payload_Metric{floatMetric("Voltage", 230)}})
+	feed("spBv1.0/Plant1/NDATA/Heater", &sparkplug.Payload{Seq: 1, Metrics: []*sparkplug.Payload_Metric{floatMetric("Voltage", 231)}})
+	require.NoError(t, engine.Stop(context.Background()))
+
+	assert.Equal(t, []float32{230, 231}, values)
+	require.Len(t, births, 1)
+	assert.Equal(t, sparkplug.NBIRTH, births[0].Topic.Command)
+
+	var received []MetricUpdate
+	for u := range metrics {
+		received = append(received, u)
+	}
+	assert.Len(t, received, 2)
+	event, ok := <-sessions
+	require.True(t, ok)
+	assert.Equal(t, "Heater", event.Topic.EdgeNodeId)
+	_, ok = <-sessions
+	assert.False(t, ok, "Stop closes the channels")
+
+	last, ok := engine.LastValue("plant1", MetricIdentity{Group: "Plant1", Node: "Heater", Metric: "Voltage"})
+	require.True(t, ok)
+	assert.Equal(t, float32(231), last.Metric.GetFloatValue())
+	assert.Len(t, engine.LastValues(), 1)
+	_, ok = engine.LastValue("plant2", MetricIdentity{Group: "Plant1", Node: "Heater", Metric: "Voltage"})
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"glowplug/Plant1/Heater/Voltage", "glowplug/Plant1/Heater/Voltage"}, publisher.topics)
+	assert.Len(t, engine.Nodes(), 1)
+}
+
+func TestEngineSinkQueues(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	// the callbacks never use a disk buffer
+	engine, err := NewEngine(logger, WorkerOpts{SinkQueue: QueueOpts{Buffer: BufferOpts{Dir: t.TempDir()}}})
+	require.NoError(t, err)
+	require.Len(t, engine.worker.sinks, 1)
+	assert.False(t, engine.worker.sinks[0].opts.Buffer.enabled())
+}
+
+func TestDecode(t *testing.T) {
+	payload, err := proto.Marshal(&sparkplug.Payload{Seq: 3, Metrics: []*sparkplug.Payload_Metric{floatMetric("Voltage", 230)}})
+	require.NoError(t, err)
+	received := time.UnixMilli(1700000000000)
+
+	result := Decode(Message{Topic: "spBv1.0/Plant1/NDATA/Heater", Source: "plant1", Payload: payload, Received: received})
+	require.NoError(t, result.Err)
+	assert.Equal(t, "plant1", result.Topic.Source)
+	assert.Equal(t, uint64(3), result.Payload.GetSeq())
+	assert.Equal(t, received, result.Received)
+
+	result = Decode(Message{Topic: "spBv1.0/STATE/scada", Payload: []byte(`{"online":true}`)})
+	require.NoError(t, result.Err)
+	assert.Nil(t, result.Payload)
+
+	assert.Error(t, Decode(Message{Topic: "not/sparkplug"}).Err)
+	assert.Error(t, Decode(Message{Topic: "spBv1.0/Plant1/NDATA/Heater", Payload: []byte{0xff}}).Err)
+
+	// compressed payloads are decompressed
+	compressed, err := sparkplug.NewPayload().Seq(4).Float("Voltage", 231).Compressed(sparkplug.COMPRESSION_GZIP)
+	require.NoError(t, err)
+	payload, err = proto.Marshal(compressed)
+	require.NoError(t, err)
+	result = Decode(Message{Topic: "spBv1.0/Plant1/NDATA/Heater", Payload: payload})
+	require.NoError(t, result.Err)
+	require.Len(t, result.Payload.Metrics, 1)
+	assert.Equal(t, "Voltage", result.Payload.Metrics[0].Name)
+	assert.Empty(t, result.Payload.Uuid)
+}
+
+func TestPublisherClient(t *testing.T) {
+	publisher := &testPublisher{}
+	client := &publisherClient{name: "app", publisher: publisher}
+	assert.Equal(t, BROKER_STATE_DISCONNECTED, client.Status().State)
+	publisher.connected = true
+	assert.Equal(t, BROKER_STATE_CONNECTED, client.Status().State)
+	assert.Error(t, client.Subscribe("spBv1.0/#", 0))
+}
@@ -2,31 +2,137 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/american-factory-os/glowplug/embed"
 	"github.com/american-factory-os/glowplug/sparkplug"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/redis/go-redis/v9"
 )
 
 type Glowplug interface {
 	Start(ctx context.Context) error
 	Stop() error
+	// Reload applies new options without dropping connections whose settings did not change
+	Reload(opts Opts) (ReloadResult, error)
+	// Engine processes the messages of the sources, e.g. to register callbacks before Start
+	Engine() *Engine
 }
 
 type Opts struct {
-	MQTTBrokerURL    string
+	MQTTBrokerURL string
+	// MQTTBroker configures the connection to the source broker
+	MQTTBroker BrokerOpts
+	// Subscriptions are the topic filters of the source broker, DefaultSubscriptions when empty
+	Subscriptions []Subscription
+	// Scope selects the groups, edge nodes and devices to process
+	Scope Scope
+	// Sources are named brokers read in addition to MQTTBrokerURL
+	Sources []Source
+	// Cluster shares the source subscriptions between glowplug instances
+	Cluster          ClusterOpts
 	PublishBrokerURL string
+	// PublishBroker configures the connection to the publish broker
+	PublishBroker    BrokerOpts
 	RedisURL         string
-	HTTPPort         int
+	RedisLayout      string
+	RedisExpire      string
+	RedisExpireAfter time.Duration
+	// RedisKeyFormat defaults to DefaultKeyFormat when the template is empty
+	RedisKeyFormat NamespaceFormat
+	// TopicFormat defaults to DefaultTopicFormat when the template is empty
+	TopicFormat NamespaceFormat
+	// PublishFormats select the payload format of published topics, in order
+	PublishFormats []PublishFormat
+	// PublishDeliveries select the QoS, retain and MQTT v5 properties of published topics, in order
+	PublishDeliveries []PublishDelivery
+	// Sinks are additional outputs created from the registered sink types
+	Sinks []SinkConfig
+	// Pipeline configures the intake queue and decode workers
+	Pipeline PipelineOpts
+	// SinkQueue configures the queue of each sink, the queue options of a
+	// sink config override it
+	SinkQueue QueueOpts
+	// MappingFile holds rules that rename, move or drop metrics
+	MappingFile string
+	// MappingRules are applied after the rules of MappingFile
+	MappingRules []MappingRule
+	// RebirthOnReconnect asks all known edge nodes for a new birth after the
+	// connection to the source broker was lost
+	RebirthOnReconnect bool
+	// HostId names glowplug in the STATE topic of each source when it is the
+	// primary host application of the edge nodes, no STATE is published when
+	// empty
+	HostId   string
+	HTTPPort int
+	// WebsocketMaxClients limits the clients of /ws, 0 is unlimited
+	WebsocketMaxClients int
+	// ReloadToken enables POST /reload, requests must send it as a bearer token
+	ReloadToken string
+	// LoadOpts returns the options applied by POST /reload, e.g. of a reread config file
+	LoadOpts func() (Opts, error)
+	// ShutdownTimeout is how long Stop waits for queued messages to reach the
+	// sinks, defaults to DefaultShutdownTimeout
+	ShutdownTimeout time.Duration
 }
 
+// DefaultShutdownTimeout is how long Stop drains the queues by default
+const DefaultShutdownTimeout = 30 * time.Second
+
+// httpShutdownTimeout is how long Stop waits for http requests in progress
+const httpShutdownTimeout = 5 * time.Second
+
+// Names of the brokers in logs and health reports
+const (
+	BROKER_SOURCE  = "source"
+	BROKER_PUBLISH = "publish"
+)
+
 type glowplug struct {
-	logger *log.Logger
-	opts   Opts
-	wp     Worker
-	broker mqtt.Client
+	logger        *log.Logger
+	engine        *Engine
+	rdb           redis.UniversalClient
+	publishBroker brokerClient
+	wss           WebsocketServer
+	redisSink     *redisSink
+	mqttSink      *mqttSink
+	// connect opens the connection to the broker of a source
+	connect func(source Source, will *sparkplug.Will, handler messageHandler, onReconnect func()) (brokerClient, error)
+	// transports publish the rebirth requests and STATE of the host
+	// application of each source with its connection
+	transportsMu sync.Mutex
+	transports   map[string]*sourceTransport
+
+	// mu guards opts and sources, which are replaced by Reload
+	mu       sync.RWMutex
+	opts     Opts
+	sources  []*sourceBroker
+	server   *http.Server
+	reloadMu sync.Mutex
+}
+
+// Glowplug health status
+const (
+	HEALTH_STATUS_OK       = "ok"
+	HEALTH_STATUS_DEGRADED = "degraded"
+)
+
+// Health reports the state of glowplug and its broker connections
+type Health struct {
+	// Status is degraded when a broker is not connected
+	Status  string         `json:"status"`
+	Brokers []BrokerStatus `json:"brokers"`
+	// Nodes counts the edge nodes seen
+	Nodes    int           `json:"nodes"`
+	Pipeline PipelineStats `json:"pipeline"`
+	Sinks    []SinkStats   `json:"sinks"`
 }
 
 // Start will start the glowplug service
@@ -34,69 +140,324 @@ func (g *glowplug) Start(ctx context.Context) error {
 
 	g.logger.Println("starting glowplug")
 
-	// subscribe to all sparkplug topics
-	topic := fmt.Sprintf("%s/#", sparkplug.SPB_NS)
-	if token := g.broker.Subscribe(topic, 0, nil); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("unable to subscribe to %s, %w", topic, token.Error())
+	g.mu.RLock()
+	opts, sources := g.opts, g.sources
+	g.mu.RUnlock()
+
+	// process messages before subscribing, so none are rejected
+	if err := g.engine.Start(); err != nil {
+		return err
+	}
+
+	// subscribe to sparkplug topics, shared with other instances in a cluster
+	for _, source := range sources {
+		g.attach(source)
+		for _, sub := range source.subscriptions() {
+			if err := g.subscribe(opts.Cluster, source, sub); err != nil {
+				return err
+			}
+		}
+		if len(source.Scope.Include) > 0 {
+			g.logger.Println(source.displayName(), "processing only", strings.Join(source.Scope.Include, ", "))
+		}
+		if len(source.Scope.Exclude) > 0 {
+			g.logger.Println(source.displayName(), "excluding", strings.Join(source.Scope.Exclude, ", "))
+		}
 	}
 
-	if len(g.opts.RedisURL) == 0 && len(g.opts.PublishBrokerURL) == 0 {
+	if len(opts.RedisURL) == 0 && len(opts.PublishBrokerURL) == 0 {
 		g.logger.Println("warning: no redis or publish broker is enabled, glowplug wont do anything")
 	}
 
-	if len(g.opts.PublishBrokerURL) > 0 {
-		g.logger.Println("publishing human readable data to broker", g.opts.PublishBrokerURL)
+	if len(opts.PublishBrokerURL) > 0 {
+		g.logger.Println("publishing human readable data to broker", RedactURL(opts.PublishBrokerURL))
 	} else {
 		g.logger.Println("enable publishing metrics to a broker, ex: --publish mqtt://localhost:1883")
 	}
 
-	if len(g.opts.RedisURL) > 0 {
-		g.logger.Println("using redis for metric storage", g.opts.RedisURL)
+	if len(opts.RedisURL) > 0 {
+		g.logger.Println("using redis for metric storage", RedactURL(opts.RedisURL))
+		if layout, _ := ParseRedisLayout(opts.RedisLayout); layout == REDIS_LAYOUT_HASH {
+			g.logger.Println("storing metric records in redis hashes")
+		}
+		if policy, _ := ParseRedisExpirePolicy(opts.RedisExpire); policy != REDIS_EXPIRE_NONE {
+			g.logger.Println("redis expire policy", policy, "after", opts.RedisExpireAfter)
+		}
 	} else {
 		g.logger.Println("enable publishing metric values to redis, ex: --redis redis://localhost:6379/0")
 	}
 
 	httpListenAddr := ""
-	if g.opts.HTTPPort > 0 {
-		g.logger.Println("http and websocket port enabled", g.opts.HTTPPort)
-		httpListenAddr = fmt.Sprintf("0.0.0.0:%d", g.opts.HTTPPort)
+	if opts.HTTPPort > 0 {
+		g.logger.Println("http and websocket port enabled", opts.HTTPPort)
+		httpListenAddr = fmt.Sprintf("0.0.0.0:%d", opts.HTTPPort)
 	} else {
 		g.logger.Println("enable http and websocket port to expose metrics, ex: --http 8080")
 	}
 
+	if len(httpListenAddr) > 0 {
+		g.serveHTTP(httpListenAddr)
+	}
+
+	g.logger.Println("glowplug started")
+	<-ctx.Done()
+
+	return nil
+}
+
+// Engine returns the engine processing the messages of the sources
+func (g *glowplug) Engine() *Engine {
+	return g.engine
+}
+
+// serveHTTP serves the web page, /health, /reload and /ws until Stop
+func (g *glowplug) serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", g.healthHandler)
+	mux.HandleFunc("/reload", g.reloadHandler)
+	mux.Handle("/ws", g.wss)
+	// Serve index.html for exactly "/" or "/index.html", 404 for other paths
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := w.Write([]byte(embed.GetIndexHTML())); err != nil {
+			g.logger.Printf("error serving index.html: %v", err)
+		}
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	g.mu.Lock()
+	g.server = server
+	g.mu.Unlock()
+
 	go func() {
-		err := g.wp.Run(httpListenAddr)
-		if err != nil {
-			g.logger.Fatal(err)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			g.logger.Fatalf("http server error: %v", err)
 		}
 	}()
+	g.logger.Println("http server started on", addr)
+}
 
-	g.logger.Println("glowplug started")
-	<-ctx.Done()
+// subscribe subscribes to a topic filter of a source, shared with other
+// instances in a cluster
+func (g *glowplug) subscribe(cluster ClusterOpts, source *sourceBroker, sub Subscription) error {
+	topic := cluster.filter(sub.Filter)
+	if cluster.Enabled() {
+		g.logger.Println(source.displayName(), "sharing subscription", topic, "with other glowplug instances")
+	} else {
+		g.logger.Println(source.displayName(), "subscribing to", topic, "qos", sub.QoS)
+	}
+	return source.broker.Subscribe(topic, sub.QoS)
+}
+
+// connectSource connects to the broker of a source with the STATE of its
+// host application as will, its messages are passed to the worker
+func (g *glowplug) connectSource(source Source) (*sourceBroker, error) {
+	g.logger.Println("connecting to mqtt broker", source.displayName(), RedactURL(source.URL), "version", mqttVersionName(source.Broker.Version))
+	host, err := g.engine.Host(source.Name)
+	if err != nil {
+		return nil, err
+	}
+	will, err := host.StateWill()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create STATE will, %w", err)
+	}
+	rebirth := g.opts.RebirthOnReconnect
+	onReconnect := func() {
+		if err := host.PublishState(true); err != nil {
+			g.logger.Println(source.displayName(), "unable to publish STATE,", err)
+		}
+		if !rebirth {
+			return
+		}
+		if err := host.RebirthAll(); err != nil {
+			g.logger.Println(source.displayName(), "unable to request rebirth,", err)
+		}
+	}
+	tls := source.Broker.tlsFiles()
+	broker, err := g.connect(source, will, g.msgHandler(source.Name), onReconnect)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceBroker{Source: source, broker: broker, tls: tls}, nil
+}
+
+// attach makes the connection of a source the transport of its host
+// application and publishes the online STATE, before subscribing to the
+// edge nodes
+func (g *glowplug) attach(source *sourceBroker) {
+	g.transport(source.Name).set(source.broker)
+	host, err := g.engine.Host(source.Name)
+	if err != nil {
+		g.logger.Println(source.displayName(), err)
+		return
+	}
+	if err := host.PublishState(true); err != nil {
+		g.logger.Println(source.displayName(), "unable to publish STATE,", err)
+	}
+}
+
+// transport returns the transport of the host application of a source
+func (g *glowplug) transport(source string) *sourceTransport {
+	g.transportsMu.Lock()
+	defer g.transportsMu.Unlock()
+	if g.transports == nil {
+		g.transports = map[string]*sourceTransport{}
+	}
+	t, ok := g.transports[source]
+	if !ok {
+		t = &sourceTransport{}
+		g.transports[source] = t
+	}
+	return t
+}
+
+// sourceTransport publishes with the connection of a source, which glowplug
+// opens and replaces when the source is reconnected by Reload. The host
+// application only publishes with it, messages are passed to its Process.
+type sourceTransport struct {
+	mu     sync.RWMutex
+	broker brokerClient
+}
+
+func (t *sourceTransport) set(broker brokerClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.broker = broker
+}
+
+func (t *sourceTransport) Connect(will *sparkplug.Will, onLost func(error)) error {
+	return fmt.Errorf("the connection of a source is opened by glowplug")
+}
 
+func (t *sourceTransport) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	t.mu.RLock()
+	broker := t.broker
+	t.mu.RUnlock()
+	if broker == nil {
+		return sparkplug.ErrNotConnected
+	}
+	return broker.Publish(publishMessage{topic: topic, qos: qos, retain: retain, payload: payload})
+}
+
+func (t *sourceTransport) Subscribe(topic string, qos byte, handler sparkplug.MessageHandler) error {
+	return fmt.Errorf("the subscriptions of a source are made by glowplug")
+}
+
+func (t *sourceTransport) Disconnect() error {
 	return nil
 }
 
-// Stop will stop the glowplug service
+// Stop will stop the glowplug service. It unsubscribes from the sources,
+// writes the queued messages to the sinks within the shutdown timeout,
+// publishes the offline STATE with a host id and disconnects, it returns an
+// error wrapping ErrDataLost if messages or updates were dropped or lost.
 func (g *glowplug) Stop() error {
 	g.logger.Println("stopping glowplug")
-	g.wp.Stop()
-	return nil
+
+	g.mu.RLock()
+	opts, sources, server := g.opts, g.sources, g.server
+	g.mu.RUnlock()
+
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			g.logger.Printf("http shutdown error: %v", err)
+		}
+		g.logger.Println("http server stopped")
+	}
+
+	// stop receiving messages, messages in flight are still accepted
+	for _, source := range sources {
+		for _, sub := range source.subscriptions() {
+			topic := opts.Cluster.filter(sub.Filter)
+			if err := source.broker.Unsubscribe(topic); err != nil {
+				g.logger.Println(source.displayName(), "unable to unsubscribe from", topic, err)
+			}
+		}
+	}
+
+	timeout := opts.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := g.engine.Stop(ctx)
+
+	// a clean disconnect doesn't publish the will, the offline STATE is
+	// published first when acting as primary host
+	for _, source := range sources {
+		host, hErr := g.engine.Host(source.Name)
+		if hErr == nil {
+			hErr = host.PublishState(false)
+		}
+		if hErr != nil {
+			g.logger.Println(source.displayName(), "unable to publish STATE,", hErr)
+		}
+		source.broker.Disconnect()
+	}
+	if g.rdb != nil {
+		g.rdb.Close()
+	}
+	g.logger.Println("glowplug stopped")
+	return err
 }
 
-// msgHandler is the default message handler for the glowplug service
-func (g *glowplug) msgHandler() mqtt.MessageHandler {
-	return func(client mqtt.Client, msg mqtt.Message) {
+// Health returns the state of glowplug and its broker connections
+func (g *glowplug) Health() Health {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 
-		cap, _ := g.wp.Capacity()
-		if cap == 0 {
-			g.logger.Println("dropping message, worker pool full")
-			return
+	health := Health{
+		Status:   HEALTH_STATUS_OK,
+		Nodes:    len(g.engine.Nodes()),
+		Pipeline: g.engine.Pipeline(),
+		Sinks:    g.engine.Sinks(),
+	}
+	brokers := make([]brokerClient, 0, len(g.sources)+1)
+	for _, source := range g.sources {
+		brokers = append(brokers, source.broker)
+	}
+	for _, broker := range append(brokers, g.publishBroker) {
+		if broker == nil {
+			continue
+		}
+		status := broker.Status()
+		if status.State != BROKER_STATE_CONNECTED {
+			health.Status = HEALTH_STATUS_DEGRADED
 		}
+		health.Brokers = append(health.Brokers, status)
+	}
+	return health
+}
+
+// healthHandler serves the health of glowplug as JSON, with status 503 when degraded
+func (g *glowplug) healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := g.Health()
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != HEALTH_STATUS_OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		g.logger.Println("unable to write health,", err)
+	}
+}
 
-		err := g.wp.AddMessage(Message{
-			topic:   msg.Topic(),
-			payload: msg.Payload(),
+// msgHandler is the default message handler for the glowplug service, source
+// is the name of the broker the messages are received from
+func (g *glowplug) msgHandler(source string) messageHandler {
+	return func(topic string, payload []byte) {
+		// a full worker pool applies the pipeline overflow policy
+		err := g.engine.AddMessage(Message{
+			Topic:    topic,
+			Source:   source,
+			Payload:  payload,
+			Received: time.Now(),
 		})
 
 		if err != nil {
@@ -105,23 +466,214 @@ func (g *glowplug) msgHandler() mqtt.MessageHandler {
 	}
 }
 
+// RedactURL hides passwords in a URL so it can be logged
+func RedactURL(rawURL string) string {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+
+	rest, rawQuery, hasQuery := strings.Cut(rest, "?")
+	if hasQuery {
+		if query, err := url.ParseQuery(rawQuery); err == nil {
+			for key := range query {
+				if strings.Contains(key, "password") {
+					query.Set(key, "xxxxx")
+				}
+			}
+			rawQuery = query.Encode()
+		}
+	}
+
+	authority, path, hasPath := strings.Cut(rest, "/")
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		if user, _, hasPassword := strings.Cut(authority[:i], ":"); hasPassword {
+			authority = user + ":xxxxx@" + authority[i+1:]
+		}
+	}
+
+	redacted := scheme + "://" + authority
+	if hasPath {
+		redacted += "/" + path
+	}
+	if hasQuery {
+		redacted += "?" + rawQuery
+	}
+	return redacted
+}
+
+// Validate returns an error if the options are invalid, without connecting
+// to any broker or redis
+func (o Opts) Validate() error {
+	if len(o.RedisURL) > 0 && len(o.RedisURL) <= 14 {
+		return fmt.Errorf("redis URL too short")
+	}
+
+	sources := o.sources()
+	if err := validateSources(sources); err != nil {
+		return err
+	}
+
+	if len(o.PublishBrokerURL) > 0 && len(o.PublishBrokerURL) <= 14 {
+		return fmt.Errorf("publish broker URL too short: %s", RedactURL(o.PublishBrokerURL))
+	}
+
+	if strings.ContainsAny(o.HostId, "/+#") {
+		return fmt.Errorf("invalid host id %q, must not contain /, + or #", o.HostId)
+	}
+
+	if o.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdown timeout %s, must not be negative", o.ShutdownTimeout)
+	}
+
+	if o.WebsocketMaxClients < 0 {
+		return fmt.Errorf("invalid websocket max clients %d, use 0 for unlimited", o.WebsocketMaxClients)
+	}
+
+	if _, err := o.redisOpts(); err != nil {
+		return err
+	}
+	if _, err := o.publishOpts(); err != nil {
+		return err
+	}
+	if err := o.PublishBroker.Validate(); err != nil {
+		return fmt.Errorf("invalid mqtt publish broker options, %w", err)
+	}
+
+	if o.Cluster.Enabled() {
+		if err := o.Cluster.Validate(); err != nil {
+			return err
+		}
+		for _, source := range sources {
+			if source.Broker.Version != MQTT_VERSION_5 {
+				return fmt.Errorf("shared subscriptions require mqtt version %d", MQTT_VERSION_5)
+			}
+		}
+		if len(o.RedisURL) == 0 {
+			return fmt.Errorf("shared subscriptions require redis to partition edge nodes")
+		}
+	}
+	if _, err := o.mapper(); err != nil {
+		return err
+	}
+
+	if err := o.Pipeline.Validate(); err != nil {
+		return err
+	}
+	if err := o.SinkQueue.Validate(); err != nil {
+		return err
+	}
+	sinkTypes := SinkTypes()
+	for _, config := range o.Sinks {
+		if !slices.Contains(sinkTypes, config.Type) {
+			return fmt.Errorf("unknown sink type %s, must be one of: %s", config.Type, strings.Join(sinkTypes, ", "))
+		}
+		if _, err := config.Queue(o.SinkQueue); err != nil {
+			return fmt.Errorf("invalid sink %s, %w", config.Type, err)
+		}
+	}
+	return nil
+}
+
+// keyFormat returns the redis key format, DefaultKeyFormat when the template is empty
+func (o Opts) keyFormat() NamespaceFormat {
+	if len(o.RedisKeyFormat.Template) == 0 {
+		return DefaultKeyFormat()
+	}
+	return o.RedisKeyFormat
+}
+
+// topicFormat returns the topic format, DefaultTopicFormat when the template is empty
+func (o Opts) topicFormat() NamespaceFormat {
+	if len(o.TopicFormat.Template) == 0 {
+		return DefaultTopicFormat()
+	}
+	return o.TopicFormat
+}
+
+// redisOpts returns the layout, expire policy and key namespace of the redis sink
+func (o Opts) redisOpts() (RedisOpts, error) {
+	var opts RedisOpts
+	var err error
+	if opts.Layout, err = ParseRedisLayout(o.RedisLayout); err != nil {
+		return opts, err
+	}
+	if opts.ExpirePolicy, err = ParseRedisExpirePolicy(o.RedisExpire); err != nil {
+		return opts, err
+	}
+	opts.ExpireAfter = o.RedisExpireAfter
+	if opts.Keys, err = NewNamespace(o.keyFormat()); err != nil {
+		return opts, fmt.Errorf("invalid redis key template, %w", err)
+	}
+	return opts, opts.Validate()
+}
+
+// publishOpts returns the topic namespace, formats and deliveries of the mqtt sink
+func (o Opts) publishOpts() (PublishOpts, error) {
+	topics, err := NewTopicNamespace(o.topicFormat())
+	if err != nil {
+		return PublishOpts{}, fmt.Errorf("invalid topic template, %w", err)
+	}
+	opts := PublishOpts{
+		Topics:     topics,
+		Formats:    o.PublishFormats,
+		Deliveries: o.PublishDeliveries,
+	}
+	return opts, opts.Validate()
+}
+
+// mapper returns the rules of MappingFile followed by MappingRules, nil
+// when there are none
+func (o Opts) mapper() (*Mapper, error) {
+	var rules []MappingRule
+	if len(o.MappingFile) > 0 {
+		fileRules, err := loadMappingRules(o.MappingFile)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+	rules = append(rules, o.MappingRules...)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return NewMapper(rules)
+}
+
 // New will create a new glowplug service
 func New(logger *log.Logger, opts Opts) (Glowplug, error) {
-	if len(opts.RedisURL) > 0 && len(opts.RedisURL) <= 14 {
-		return nil, fmt.Errorf("redis URL too short")
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	sources := opts.sources()
+
+	redisOpts, err := opts.redisOpts()
+	if err != nil {
+		return nil, err
+	}
+	publishOpts, err := opts.publishOpts()
+	if err != nil {
+		return nil, err
 	}
 
-	if len(opts.MQTTBrokerURL) <= 14 {
-		return nil, fmt.Errorf("mqtt broker URL too short: %s", opts.MQTTBrokerURL)
+	if len(sources) > 1 && (!strings.Contains(opts.keyFormat().Template, "{source}") || !strings.Contains(opts.topicFormat().Template, "{source}")) {
+		logger.Println("warning: identical group ids of different sources share redis keys and topics, add {source} to the redis key and topic templates")
+	}
+	if publishOpts.usesV5() && opts.PublishBroker.Version != MQTT_VERSION_5 {
+		logger.Println("warning: mqtt v5 publish properties are ignored by mqtt 3.1.1 brokers, use mqtt version 5 for the publish broker")
 	}
 
-	if len(opts.PublishBrokerURL) > 0 && len(opts.PublishBrokerURL) <= 14 {
-		return nil, fmt.Errorf("publish broker URL too short: %s", opts.PublishBrokerURL)
+	if len(opts.MappingFile) > 0 {
+		logger.Println("loading mapping rules", opts.MappingFile)
+	}
+	mapper, err := opts.mapper()
+	if err != nil {
+		return nil, err
 	}
 
 	var rdb *redis.UniversalClient
 	if len(opts.RedisURL) > 0 {
-		logger.Println("connecting to redis", opts.RedisURL)
+		logger.Println("connecting to redis", RedactURL(opts.RedisURL))
 		redisClient, err := NewRedis(opts.RedisURL)
 		if err != nil {
 			return nil, err
@@ -134,31 +686,95 @@ func New(logger *log.Logger, opts Opts) (Glowplug, error) {
 		opts:   opts,
 	}
 
-	logger.Println("connecting to mqtt broker", opts.MQTTBrokerURL)
-	handler := g.msgHandler()
-	broker, err := brokerClientFromURL(opts.MQTTBrokerURL, &handler)
-	if err != nil {
-		return nil, err
+	g.connect = func(source Source, will *sparkplug.Will, handler messageHandler, onReconnect func()) (brokerClient, error) {
+		return brokerClientFromURL(logger, source.displayName(), source.URL, source.Broker, will, handler, onReconnect)
+	}
+
+	scopes := map[string]Scope{}
+	for _, source := range sources {
+		scopes[source.Name] = source.Scope
+	}
+
+	var sinks []Sink
+	if rdb != nil {
+		redisSink, err := newRedisSink(logger, SINK_REDIS, *rdb, redisOpts)
+		if err != nil {
+			return nil, err
+		}
+		g.redisSink = redisSink
+		sinks = append(sinks, redisSink)
 	}
-	g.broker = broker
 
-	var publishBroker *mqtt.Client = nil
 	if len(opts.PublishBrokerURL) > 0 {
-		logger.Println("connecting to mqtt publish broker", opts.PublishBrokerURL)
-		pb, pErr := brokerClientFromURL(opts.PublishBrokerURL, nil)
+		logger.Println("connecting to mqtt publish broker", RedactURL(opts.PublishBrokerURL), "version", mqttVersionName(opts.PublishBroker.Version))
+		pb, pErr := brokerClientFromURL(logger, BROKER_PUBLISH, opts.PublishBrokerURL, opts.PublishBroker, nil, nil, nil)
 		if pErr != nil {
 			return nil, pErr
 		}
-		publishBroker = &pb
+		g.publishBroker = pb
+		mqttSink, err := newMQTTSink(logger, SINK_MQTT, pb, publishOpts)
+		if err != nil {
+			return nil, err
+		}
+		g.mqttSink = mqttSink
+		sinks = append(sinks, mqttSink)
 	}
 
-	wss := NewWebsocketServer(logger)
+	// browsers only show the latest values, drop old ones rather than wait for
+	// slow clients or replay them
+	g.wss = NewWebsocketServer(logger)
+	g.wss.SetMaxClients(opts.WebsocketMaxClients)
+	sinks = append(sinks, newWebsocketSink(g.wss))
+	websocketQueue := opts.SinkQueue
+	websocketQueue.Overflow = OVERFLOW_DROP_OLDEST
+	websocketQueue.Buffer = BufferOpts{}
+	sinkQueues := map[string]QueueOpts{SINK_WEBSOCKET: websocketQueue}
 
-	wp, err := NewWorker(logger, rdb, publishBroker, wss)
+	for _, config := range opts.Sinks {
+		logger.Println("adding sink", config.Type, config.Name)
+		queue, err := config.Queue(opts.SinkQueue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink %s, %w", config.Type, err)
+		}
+		sink, err := NewSink(logger, config)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+		sinkQueues[sink.Name()] = queue
+	}
+
+	engine, err := NewEngine(logger, WorkerOpts{
+		Redis:      rdb,
+		Cluster:    opts.Cluster,
+		Scopes:     scopes,
+		Mapper:     mapper,
+		Sinks:      sinks,
+		Pipeline:   opts.Pipeline,
+		SinkQueue:  opts.SinkQueue,
+		SinkQueues: sinkQueues,
+		HostId:     opts.HostId,
+		Transport: func(source string) sparkplug.Transport {
+			return g.transport(source)
+		},
+	})
 	if err != nil {
 		return nil, err
 	}
-	g.wp = wp
+	g.engine = engine
+	if rdb != nil {
+		g.rdb = *rdb
+	}
+
+	// the engine creates the host applications whose STATE is the will of
+	// the sources
+	for _, source := range sources {
+		sb, err := g.connectSource(source)
+		if err != nil {
+			return nil, err
+		}
+		g.sources = append(g.sources, sb)
+	}
 
 	return &g, nil
 }
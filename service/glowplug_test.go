@@ -0,0 +1,141 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptsValidate(t *testing.T) {
+	valid := Opts{MQTTBrokerURL: "mqtt://localhost:1883"}
+	require.NoError(t, valid.Validate())
+
+	tests := []struct {
+		name   string
+		modify func(o *Opts)
+	}{
+		{"no source", func(o *Opts) { o.MQTTBrokerURL = "" }},
+		{"short redis url", func(o *Opts) { o.RedisURL = "redis://x" }},
+		{"redis layout", func(o *Opts) { o.RedisLayout = "list" }},
+		{"key template", func(o *Opts) { o.RedisKeyFormat = NamespaceFormat{Template: "{nope}"} }},
+		{"publish format", func(o *Opts) { o.PublishFormats = []PublishFormat{{Format: "xml"}} }},
+		{"publish broker", func(o *Opts) { o.PublishBroker = BrokerOpts{Version: 4} }},
+		{"cluster without redis", func(o *Opts) {
+			o.Cluster = ClusterOpts{ShareGroup: "glowplug"}
+			o.MQTTBroker.Version = MQTT_VERSION_5
+		}},
+		{"mapping file", func(o *Opts) { o.MappingFile = "/nonexistent/mapping.yaml" }},
+		{"mapping rule", func(o *Opts) {
+			o.MappingRules = []MappingRule{{Name: "bad", Match: MappingMatch{Metric: "(", Regex: true}}}
+		}},
+		{"pipeline", func(o *Opts) { o.Pipeline.Workers = -1 }},
+		{"websocket max clients", func(o *Opts) { o.WebsocketMaxClients = -1 }},
+		{"shutdown timeout", func(o *Opts) { o.ShutdownTimeout = -time.Second }},
+		{"host id", func(o *Opts) { o.HostId = "glowplug/1" }},
+		{"sink type", func(o *Opts) { o.Sinks = []SinkConfig{{Type: "nope"}} }},
+		{"sink queue", func(o *Opts) {
+			o.Sinks = []SinkConfig{{Type: SINK_JSONL, Options: map[string]string{SINK_OPTION_OVERFLOW: "spill"}}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := valid
+			tt.modify(&opts)
+			assert.Error(t, opts.Validate())
+		})
+	}
+}
+
+func TestOptsMapper(t *testing.T) {
+	mapper, err := Opts{}.mapper()
+	require.NoError(t, err)
+	assert.Nil(t, mapper)
+
+	// inline rules apply after the rules of the mapping file
+	temperature := "Temperature"
+	mapper, err = Opts{
+		MappingFile:  writeMappingRules(t, testMappingRules),
+		MappingRules: []MappingRule{{Name: "inline", Match: MappingMatch{Metric: "Temp*"}, Set: MappingSet{Metric: &temperature}}},
+	}.mapper()
+	require.NoError(t, err)
+	require.NotNil(t, mapper)
+	assert.Equal(t, "inline", mapper.rules[len(mapper.rules)-1].Name)
+}
+
+func TestStop(t *testing.T) {
+	opts := Opts{Sources: []Source{{Name: "plant1", URL: "mqtt://plant1:1883"}}}
+	g, brokers := newReloadGlowplug(t, opts)
+	require.NoError(t, g.engine.Start())
+
+	require.NoError(t, g.Stop())
+	assert.Empty(t, brokers["plant1"].subscriptions)
+	assert.True(t, brokers["plant1"].disconnected)
+	assert.Empty(t, brokers["plant1"].published)
+
+	// acting as host the offline STATE is published before disconnecting
+	opts.HostId = "glowplug"
+	g, brokers = newReloadGlowplug(t, opts)
+	require.NoError(t, g.engine.Start())
+	require.NoError(t, g.Stop())
+	published := brokers["plant1"].published
+	require.Len(t, published, 2)
+	assert.Equal(t, "spBv1.0/STATE/glowplug", published[1].topic)
+	assert.True(t, published[1].retain)
+	var state sparkplug.HostState
+	require.NoError(t, json.Unmarshal(published[1].payload, &state))
+	assert.False(t, state.Online)
+}
+
+func TestSourceHostApplication(t *testing.T) {
+	opts := Opts{
+		Sources: []Source{
+			{Name: "plant1", URL: "mqtt://plant1:1883"},
+			{Name: "plant2", URL: "mqtt://plant2:1883"},
+		},
+		HostId:             "glowplug",
+		RebirthOnReconnect: true,
+	}
+	g, brokers := newReloadGlowplug(t, opts)
+	plant1, plant2 := brokers["plant1"], brokers["plant2"]
+
+	// the offline STATE is the will, the online STATE is published before subscribing
+	require.NotNil(t, plant1.will)
+	assert.Equal(t, "spBv1.0/STATE/glowplug", plant1.will.Topic)
+	assert.True(t, plant1.will.Retain)
+	var will sparkplug.HostState
+	require.NoError(t, json.Unmarshal(plant1.will.Payload, &will))
+	assert.False(t, will.Online)
+	require.Len(t, plant1.published, 1)
+	assert.Equal(t, "spBv1.0/STATE/glowplug", plant1.published[0].topic)
+	var state sparkplug.HostState
+	require.NoError(t, json.Unmarshal(plant1.published[0].payload, &state))
+	assert.True(t, state.Online)
+	assert.Equal(t, will.Timestamp, state.Timestamp)
+
+	birth := testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", floatMetric("Voltage", 230))
+	birth.Topic.Source = "plant1"
+	require.NoError(t, g.engine.worker.processResult(birth))
+
+	// after reconnecting the STATE is published again and the nodes of the
+	// source are asked for a rebirth
+	plant1.onReconnect()
+	require.Len(t, plant1.published, 3)
+	assert.Equal(t, "spBv1.0/STATE/glowplug", plant1.published[1].topic)
+	assert.Equal(t, "spBv1.0/Plant1/NCMD/Heater", plant1.published[2].topic)
+	plant2.onReconnect()
+	assert.Len(t, plant2.published, 2)
+
+	// without a host id glowplug only asks for rebirths
+	opts.HostId = ""
+	g, brokers = newReloadGlowplug(t, opts)
+	assert.Nil(t, brokers["plant1"].will)
+	assert.Empty(t, brokers["plant1"].published)
+	require.NoError(t, g.engine.worker.processResult(birth))
+	brokers["plant1"].onReconnect()
+	require.Len(t, brokers["plant1"].published, 1)
+	assert.Equal(t, "spBv1.0/Plant1/NCMD/Heater", brokers["plant1"].published[0].topic)
+}
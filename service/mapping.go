@@ -0,0 +1,328 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// HASH_NAMESPACE maps each metric key to the Sparkplug identity it was received as
+const HASH_NAMESPACE = "glowplug:namespace"
+
+// MetricIdentity identifies a metric in the Sparkplug namespace
+type MetricIdentity struct {
+	Group  string `json:"group" yaml:"group"`
+	Node   string `json:"node" yaml:"node"`
+	Device string `json:"device,omitempty" yaml:"device,omitempty"`
+	Metric string `json:"metric" yaml:"metric"`
+}
+
+// String returns the identity as group/node[/device] metric
+func (id MetricIdentity) String() string {
+	var b strings.Builder
+	b.WriteString(id.Group)
+	b.WriteString("/")
+	b.WriteString(id.Node)
+	if len(id.Device) > 0 {
+		b.WriteString("/")
+		b.WriteString(id.Device)
+	}
+	b.WriteString(" ")
+	b.WriteString(id.Metric)
+	return b.String()
+}
+
+// identityFromTopic returns the identity of a metric received on a sparkplug topic
+func identityFromTopic(topic sparkplug.Topic, metricName string) MetricIdentity {
+	id := MetricIdentity{
+		Group:  topic.GroupId,
+		Node:   topic.EdgeNodeId,
+		Metric: metricName,
+	}
+	if topic.HasDevice {
+		id.Device = topic.DeviceId
+	}
+	return id
+}
+
+// topic returns a sparkplug topic for the identity using the command of a source topic
+func (id MetricIdentity) topic(source sparkplug.Topic) sparkplug.Topic {
+	source.GroupId = id.Group
+	source.EdgeNodeId = id.Node
+	source.DeviceId = id.Device
+	source.HasDevice = len(id.Device) > 0
+	return source
+}
+
+// MappingMatch selects metrics by their group, node, device and metric name.
+// Patterns are globs where * matches any text and ? a single character, or
+// regular expressions when Regex is true. An empty pattern matches anything.
+type MappingMatch struct {
+	Group  string `yaml:"group"`
+	Node   string `yaml:"node"`
+	Device string `yaml:"device"`
+	Metric string `yaml:"metric"`
+	Regex  bool   `yaml:"regex"`
+}
+
+// MappingSet rewrites the identity of a matched metric. Values may reference
+// the current identity with ${group}, ${node}, ${device} and ${metric}, and
+// named capture groups of regex patterns with ${name}. Setting device to an
+// empty string turns a device metric into a node metric.
+type MappingSet struct {
+	Group  *string `yaml:"group"`
+	Node   *string `yaml:"node"`
+	Device *string `yaml:"device"`
+	Metric *string `yaml:"metric"`
+}
+
+// MappingRule rewrites or drops the metrics it matches. Rules are applied in
+// order and the first matching rule wins unless it sets Continue.
+type MappingRule struct {
+	Name     string       `yaml:"name"`
+	Match    MappingMatch `yaml:"match"`
+	Set      MappingSet   `yaml:"set"`
+	Drop     bool         `yaml:"drop"`
+	Continue bool         `yaml:"continue"`
+}
+
+// MappingResult is the outcome of applying mapping rules to a metric
+type MappingResult struct {
+	Identity MetricIdentity
+	Drop     bool
+	// Rules holds the names of the rules that matched
+	Rules []string
+}
+
+// compiledRule is a MappingRule with compiled patterns
+type compiledRule struct {
+	MappingRule
+	group, node, device, metric *regexp.Regexp
+}
+
+// Mapper applies mapping rules to metrics, results are cached by identity
+type Mapper struct {
+	rules []compiledRule
+	cache sync.Map
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// compilePattern compiles a glob or regex pattern, an empty pattern returns nil
+func compilePattern(pattern string, isRegex bool) (*regexp.Regexp, error) {
+	if len(pattern) == 0 {
+		return nil, nil
+	}
+	if !isRegex {
+		pattern = globToRegexp(pattern)
+	}
+	return regexp.Compile(pattern)
+}
+
+// NewMapper validates and compiles mapping rules
+func NewMapper(rules []MappingRule) (*Mapper, error) {
+	m := &Mapper{}
+
+	for i, rule := range rules {
+		if len(rule.Name) == 0 {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+
+		set := rule.Set
+		if !rule.Drop && set.Group == nil && set.Node == nil && set.Device == nil && set.Metric == nil {
+			return nil, fmt.Errorf("mapping %s must set a value or drop metrics", rule.Name)
+		}
+		for field, value := range map[string]*string{"group": set.Group, "node": set.Node, "metric": set.Metric} {
+			if value != nil && len(*value) == 0 {
+				return nil, fmt.Errorf("mapping %s can not set an empty %s", rule.Name, field)
+			}
+		}
+
+		c := compiledRule{MappingRule: rule}
+		var err error
+		for _, p := range []struct {
+			pattern string
+			re      **regexp.Regexp
+		}{
+			{rule.Match.Group, &c.group},
+			{rule.Match.Node, &c.node},
+			{rule.Match.Device, &c.device},
+			{rule.Match.Metric, &c.metric},
+		} {
+			if *p.re, err = compilePattern(p.pattern, rule.Match.Regex); err != nil {
+				return nil, fmt.Errorf("mapping %s has an invalid pattern, %w", rule.Name, err)
+			}
+		}
+
+		m.rules = append(m.rules, c)
+	}
+
+	return m, nil
+}
+
+// mappingFile is the format of a mapping rules file
+type mappingFile struct {
+	Rules []MappingRule `yaml:"rules"`
+}
+
+// LoadMapper reads mapping rules from a YAML or JSON file
+func LoadMapper(path string) (*Mapper, error) {
+	rules, err := loadMappingRules(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMapper(rules)
+}
+
+// loadMappingRules reads the rules of a mapping rules file
+func loadMappingRules(path string) ([]MappingRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mapping rules, %w", err)
+	}
+
+	var file mappingFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse mapping rules %s, %w", path, err)
+	}
+	return file.Rules, nil
+}
+
+// match returns the named captures of a rule when it matches an identity
+func (c *compiledRule) match(id MetricIdentity) (map[string]string, bool) {
+	captures := map[string]string{}
+	for _, p := range []struct {
+		re    *regexp.Regexp
+		value string
+	}{
+		{c.group, id.Group},
+		{c.node, id.Node},
+		{c.device, id.Device},
+		{c.metric, id.Metric},
+	} {
+		if p.re == nil {
+			continue
+		}
+		m := p.re.FindStringSubmatch(p.value)
+		if m == nil {
+			return nil, false
+		}
+		for i, name := range p.re.SubexpNames() {
+			if len(name) > 0 {
+				captures[name] = m[i]
+			}
+		}
+	}
+	return captures, true
+}
+
+// Apply maps a metric identity through the rules
+func (m *Mapper) Apply(id MetricIdentity) (MappingResult, error) {
+	if m == nil || len(m.rules) == 0 {
+		return MappingResult{Identity: id}, nil
+	}
+
+	if cached, ok := m.cache.Load(id); ok {
+		return cached.(MappingResult), nil
+	}
+
+	result := MappingResult{Identity: id}
+	for i := range m.rules {
+		rule := &m.rules[i]
+		captures, ok := rule.match(result.Identity)
+		if !ok {
+			continue
+		}
+
+		result.Rules = append(result.Rules, rule.Name)
+
+		if rule.Drop {
+			result.Drop = true
+			break
+		}
+
+		current := result.Identity
+		expand := func(value *string, target *string) {
+			if value == nil {
+				return
+			}
+			*target = os.Expand(*value, func(name string) string {
+				switch name {
+				case "group":
+					return current.Group
+				case "node":
+					return current.Node
+				case "device":
+					return current.Device
+				case "metric":
+					return current.Metric
+				}
+				return captures[name]
+			})
+		}
+		expand(rule.Set.Group, &result.Identity.Group)
+		expand(rule.Set.Node, &result.Identity.Node)
+		expand(rule.Set.Device, &result.Identity.Device)
+		expand(rule.Set.Metric, &result.Identity.Metric)
+
+		if len(result.Identity.Group) == 0 || len(result.Identity.Node) == 0 || len(result.Identity.Metric) == 0 {
+			return result, fmt.Errorf("mapping %s rewrote %s to an empty group, node or metric", rule.Name, id)
+		}
+
+		if !rule.Continue {
+			break
+		}
+	}
+
+	m.cache.Store(id, result)
+	return result, nil
+}
+
+// KnownNamespace returns the identities of the metrics glowplug has stored in
+// redis, as they were received before any mapping rules, sorted by name
+func KnownNamespace(ctx context.Context, rdb redis.UniversalClient) ([]MetricIdentity, error) {
+	fields, err := rdb.HGetAll(ctx, HASH_NAMESPACE).Result()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known namespace, %w", err)
+	}
+
+	ids := make([]MetricIdentity, 0, len(fields))
+	for key, value := range fields {
+		var id MetricIdentity
+		if err := json.Unmarshal([]byte(value), &id); err != nil {
+			return nil, fmt.Errorf("invalid namespace entry for %s, %w", key, err)
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+
+	return ids, nil
+}
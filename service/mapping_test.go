@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMappingRules = `
+rules:
+  - name: drop diagnostics
+    match:
+      metric: "Diagnostics/*"
+    drop: true
+  - name: temperature
+    match:
+      metric: "(?i)^temp(erature)?(_c)?$"
+      regex: true
+    set:
+      metric: Temperature
+  - name: move sensors
+    match:
+      group: "Plant1:*"
+      device: "Sensor?"
+      regex: false
+    set:
+      group: "Plant1:Area9"
+      device: "${device}-moved"
+    continue: true
+  - name: prefix line
+    match:
+      group: "^(?P<site>[^:]+):Area9$"
+      regex: true
+    set:
+      metric: "${site}/${metric}"
+`
+
+func writeMappingRules(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0o600))
+	return path
+}
+
+func TestMapperApply(t *testing.T) {
+	mapper, err := LoadMapper(writeMappingRules(t, testMappingRules))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		id    MetricIdentity
+		want  MetricIdentity
+		drop  bool
+		rules []string
+	}{
+		{
+			name:  "drop",
+			id:    MetricIdentity{Group: "Plant1", Node: "Heater", Metric: "Diagnostics/Uptime"},
+			drop:  true,
+			rules: []string{"drop diagnostics"},
+		},
+		{
+			name:  "rename regex",
+			id:    MetricIdentity{Group: "Plant1", Node: "Heater", Metric: "TEMP_C"},
+			want:  MetricIdentity{Group: "Plant1", Node: "Heater", Metric: "Temperature"},
+			rules: []string{"temperature"},
+		},
+		{
+			name:  "move and continue",
+			id:    MetricIdentity{Group: "Plant1:Area3", Node: "Heater", Device: "Sensor1", Metric: "Pressure"},
+			want:  MetricIdentity{Group: "Plant1:Area9", Node: "Heater", Device: "Sensor1-moved", Metric: "Plant1/Pressure"},
+			rules: []string{"move sensors", "prefix line"},
+		},
+		{
+			name: "unchanged",
+			id:   MetricIdentity{Group: "Plant2", Node: "Heater", Device: "Sensor1", Metric: "Pressure"},
+			want: MetricIdentity{Group: "Plant2", Node: "Heater", Device: "Sensor1", Metric: "Pressure"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// apply twice to exercise the cache
+			for i := 0; i < 2; i++ {
+				result, err := mapper.Apply(tt.id)
+				require.NoError(t, err)
+				assert.Equal(t, tt.drop, result.Drop)
+				assert.Equal(t, tt.rules, result.Rules)
+				if !tt.drop {
+					assert.Equal(t, tt.want, result.Identity)
+				}
+			}
+		})
+	}
+
+	var nilMapper *Mapper
+	id := MetricIdentity{Group: "g", Node: "n", Metric: "m"}
+	result, err := nilMapper.Apply(id)
+	require.NoError(t, err)
+	assert.Equal(t, id, result.Identity)
+}
+
+func TestNewMapperInvalid(t *testing.T) {
+	empty := ""
+	tests := []struct {
+		name  string
+		rules []MappingRule
+	}{
+		{name: "no action", rules: []MappingRule{{Match: MappingMatch{Metric: "x"}}}},
+		{name: "empty node", rules: []MappingRule{{Set: MappingSet{Node: &empty}}}},
+		{name: "invalid regex", rules: []MappingRule{{Match: MappingMatch{Metric: "(", Regex: true}, Drop: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMapper(tt.rules)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := LoadMapper(writeMappingRules(t, "rules: [nope"))
+	assert.Error(t, err)
+}
+
+func TestWorkerMapping(t *testing.T) {
+	ctx := context.Background()
+	w, _, rdb := newRedisTestWorker(t, RedisOpts{Layout: REDIS_LAYOUT_SET, ExpirePolicy: REDIS_EXPIRE_NONE})
+	mapper, err := LoadMapper(writeMappingRules(t, testMappingRules))
+	require.NoError(t, err)
+	w.mapper.Store(mapper)
+
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant1/NBIRTH/Heater",
+		floatMetric("temp", 98.6),
+		floatMetric("Diagnostics/Uptime", 10),
+	)))
+
+	assert.Equal(t, "98.6", rdb.Get(ctx, "glowplug:plant1:heater:temperature").Val())
+	assert.Equal(t, int64(0), rdb.Exists(ctx, "glowplug:plant1:heater:temp", "glowplug:plant1:heater:diagnostics:uptime").Val())
+
+	ids, err := KnownNamespace(ctx, rdb)
+	require.NoError(t, err)
+	assert.Equal(t, []MetricIdentity{{Group: "Plant1", Node: "Heater", Metric: "temp"}}, ids)
+}
@@ -2,8 +2,11 @@ package service
 
 import (
 	"fmt"
+	"log"
+	"math"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/american-factory-os/glowplug/sparkplug"
@@ -15,13 +18,20 @@ const (
 	topicPrefix    = "glowplug"
 )
 
+// Message is a mqtt message received from a source broker
 type Message struct {
-	topic   string
-	payload []byte
+	Topic string
+	// Source is the name of the source broker the message was received from
+	Source   string
+	Payload  []byte
+	Received time.Time
+	// forwarded is true for messages forwarded by another instance that
+	// received them on a shared subscription
+	forwarded bool
 }
 
 // The URL format should be scheme://host:port Where "scheme" is one of:
-// "mqtt", "tcp", "ssl", or "ws", "host" is the ip-address (or hostname)
+// "mqtt", "tcp", "ssl", "tls", "mqtts" or "ws", "host" is the ip-address (or hostname)
 // and "port" is the port on which the broker is accepting connections
 // Default values for hostname is "127.0.0.1", for schema is "tcp://".
 // An example broker URI would look like: tcp://foobar.com:1883
@@ -35,7 +45,7 @@ func validateBrokerURI(rawURL string) (bool, error) {
 		return false, err
 	}
 
-	if u.Scheme != "tcp" && u.Scheme != "ssl" && u.Scheme != "ws" && u.Scheme != "mqtt" {
+	if u.Scheme != "tcp" && u.Scheme != "ws" && u.Scheme != "mqtt" && !isTLSScheme(u.Scheme) {
 		return false, fmt.Errorf("invalid scheme: %s", u.Scheme)
 	}
 
@@ -50,51 +60,292 @@ func validateBrokerURI(rawURL string) (bool, error) {
 	return true, nil
 }
 
-// normalizeTopicName ensures mqtt topics keys are in a standard format
-func normalizeTopicName(ns string) string {
-	return strings.ReplaceAll(ns, ":", "/")
+// validateTopicFilter returns an error if a mqtt topic filter is invalid
+func validateTopicFilter(filter string) error {
+	if len(filter) == 0 {
+		return fmt.Errorf("topic filter is empty")
+	}
+	levels := strings.Split(filter, topicDelimiter)
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("invalid topic filter %s, # must be the last level", filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("invalid topic filter %s, + must be a whole level", filter)
+		}
+	}
+	return nil
+}
+
+// topicMatchesFilter returns true if a topic matches a mqtt topic filter
+// with + and # wildcards
+func topicMatchesFilter(filter, topic string) bool {
+	filterLevels := strings.Split(filter, topicDelimiter)
+	topicLevels := strings.Split(topic, topicDelimiter)
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
 }
 
-// topicFromSparkplugMetric returns a topic for a given SparkplugB metric
-func topicFromSparkplugMetric(topic sparkplug.Topic, metric *sparkplug.Payload_Metric) string {
+// MQTT protocol versions
+const (
+	MQTT_VERSION_3 = 3
+	MQTT_VERSION_5 = 5
+)
+
+const (
+	// DefaultKeepAlive is the default keep alive of broker connections
+	DefaultKeepAlive = 30 * time.Second
+	// DefaultMaxReconnectInterval is the default longest wait between reconnects
+	DefaultMaxReconnectInterval = time.Minute
+
+	brokerConnectTimeout = 10 * time.Second
+	brokerPingTimeout    = 10 * time.Second
+	// reconnects start after reconnectMinInterval and back off exponentially
+	reconnectMinInterval = time.Second
+)
 
-	var b strings.Builder
-	b.WriteString(topicPrefix)
-	b.WriteString(topicDelimiter)
+// BrokerOpts configures the connection to a mqtt broker
+type BrokerOpts struct {
+	// Version is MQTT_VERSION_3 (3.1.1) or MQTT_VERSION_5, default 3
+	Version int
+	// ClientID defaults to a random glowplug-<n> id
+	ClientID string
+	// SessionExpiry keeps a v5 session on the broker after a disconnect
+	SessionExpiry time.Duration
+	// TopicAliases is the most v5 topic aliases used when publishing, the
+	// broker may allow fewer
+	TopicAliases int
+	// Username and Password authenticate with the broker, the user info of
+	// the broker URL is used when no username is set
+	Username string
+	Password string
+	// CAFile is a PEM file of the certificate authorities that sign the
+	// broker certificate, the system pool is used when empty
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key for mutual TLS
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify accepts any broker certificate, for testing only
+	InsecureSkipVerify bool
+	// KeepAlive defaults to DefaultKeepAlive
+	KeepAlive time.Duration
+	// MaxReconnectInterval is the longest wait between reconnects, defaults
+	// to DefaultMaxReconnectInterval
+	MaxReconnectInterval time.Duration
+}
+
+// Validate returns an error if the broker options are invalid
+func (o BrokerOpts) Validate() error {
+	switch o.Version {
+	case 0, MQTT_VERSION_3, MQTT_VERSION_5:
+	default:
+		return fmt.Errorf("invalid mqtt version %d, must be one of: %d, %d", o.Version, MQTT_VERSION_3, MQTT_VERSION_5)
+	}
+	if o.SessionExpiry < 0 || o.SessionExpiry > math.MaxUint32*time.Second {
+		return fmt.Errorf("invalid mqtt session expiry %s", o.SessionExpiry)
+	}
+	if o.TopicAliases < 0 || o.TopicAliases > math.MaxUint16 {
+		return fmt.Errorf("invalid mqtt topic aliases %d, must be between 0 and %d", o.TopicAliases, math.MaxUint16)
+	}
+	if o.KeepAlive != 0 && (o.KeepAlive < time.Second || o.KeepAlive > math.MaxUint16*time.Second) {
+		return fmt.Errorf("invalid mqtt keep alive %s", o.KeepAlive)
+	}
+	if o.MaxReconnectInterval != 0 && o.MaxReconnectInterval < reconnectMinInterval {
+		return fmt.Errorf("mqtt max reconnect interval must be at least %s", reconnectMinInterval)
+	}
+	if o.Version != MQTT_VERSION_5 && o.SessionExpiry > 0 {
+		return fmt.Errorf("mqtt session expiry requires mqtt version %d", MQTT_VERSION_5)
+	}
+	return nil
+}
 
-	b.WriteString(topic.GroupId)
-	b.WriteString(topicDelimiter)
-	b.WriteString(topic.EdgeNodeId)
-	if topic.HasDevice {
-		b.WriteString(topicDelimiter)
-		b.WriteString(topic.DeviceId)
+// mqttVersionName returns the protocol name of a mqtt version
+func mqttVersionName(version int) string {
+	if version == MQTT_VERSION_5 {
+		return "5"
 	}
+	return "3.1.1"
+}
 
-	b.WriteString(topicDelimiter)
-	b.WriteString(normalizeTopicName(metric.Name))
+// messageHandler is called with each message received from a broker
+type messageHandler func(topic string, payload []byte)
 
-	return normalizeTopicName(b.String())
+// brokerClient is a connection to a mqtt 3.1.1 or v5 broker. Clients
+// reconnect when the connection is lost and restore their subscriptions.
+type brokerClient interface {
+	Subscribe(filter string, qos byte) error
+	Unsubscribe(filter string) error
+	Publish(msg publishMessage) error
+	Disconnect()
+	Status() BrokerStatus
 }
 
-// brokerClientFromURL returns a mqtt.Client from a given URL
-func brokerClientFromURL(rawURL string, handler *mqtt.MessageHandler) (mqtt.Client, error) {
+// brokerClientFromURL connects to a mqtt broker with will as last will when
+// it is not nil, messages of subscriptions are passed to handler when it is
+// not nil, and onReconnect is called when the connection is made again after
+// it was lost. The name of the broker is used in logs and status reports.
+func brokerClientFromURL(logger *log.Logger, name string, rawURL string, opts BrokerOpts, will *sparkplug.Will, handler messageHandler, onReconnect func()) (brokerClient, error) {
 
 	if _, err := validateBrokerURI(rawURL); err != nil {
 		return nil, err
 	}
 
-	randClientID := fmt.Sprintf("glowplug-%d", time.Now().UnixNano())
-	mqttOpts := mqtt.NewClientOptions().AddBroker(rawURL).SetClientID(randClientID)
-	mqttOpts.SetKeepAlive(2 * time.Second)
-	mqttOpts.SetPingTimeout(1 * time.Second)
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if len(opts.ClientID) == 0 {
+		opts.ClientID = fmt.Sprintf("glowplug-%d", time.Now().UnixNano())
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = DefaultKeepAlive
+	}
+	if opts.MaxReconnectInterval == 0 {
+		opts.MaxReconnectInterval = DefaultMaxReconnectInterval
+	}
+
+	state := newConnectionState(logger, name, rawURL, opts.Version, onReconnect)
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg, err := opts.tlsConfig(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// credentials are passed separately so they are not part of the broker address
+	opts.Username, opts.Password = opts.credentials(u)
+	u.User = nil
+
+	if opts.Version == MQTT_VERSION_5 {
+		return newV5BrokerClient(logger, u, opts, tlsCfg, will, handler, state)
+	}
+
+	c := &v3BrokerClient{
+		connectionState: state,
+		subscriptions:   map[string]byte{},
+	}
+
+	mqttOpts := mqtt.NewClientOptions().AddBroker(u.String()).SetClientID(opts.ClientID)
+	mqttOpts.SetKeepAlive(opts.KeepAlive)
+	mqttOpts.SetPingTimeout(min(opts.KeepAlive, brokerPingTimeout))
+	mqttOpts.SetAutoReconnect(true)
+	mqttOpts.SetConnectRetry(true)
+	mqttOpts.SetConnectRetryInterval(reconnectMinInterval)
+	mqttOpts.SetMaxReconnectInterval(opts.MaxReconnectInterval)
+	mqttOpts.SetOnConnectHandler(func(client mqtt.Client) {
+		state.set(BROKER_STATE_CONNECTED, nil)
+		c.resubscribe()
+	})
+	mqttOpts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		state.set(BROKER_STATE_DISCONNECTED, err)
+	})
+	mqttOpts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		state.set(BROKER_STATE_RECONNECTING, nil)
+	})
+
+	if len(opts.Username) > 0 {
+		mqttOpts.SetUsername(opts.Username)
+		mqttOpts.SetPassword(opts.Password)
+	}
+
+	if tlsCfg != nil {
+		mqttOpts.SetTLSConfig(tlsCfg)
+	}
+
+	if will != nil {
+		mqttOpts.SetBinaryWill(will.Topic, will.Payload, will.QoS, will.Retain)
+	}
 
 	if handler != nil {
-		mqttOpts.SetDefaultPublishHandler(*handler)
+		mqttOpts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+			handler(msg.Topic(), msg.Payload())
+		})
 	}
 
-	broker := mqtt.NewClient(mqttOpts)
-	if token := broker.Connect(); token.Wait() && token.Error() != nil {
+	c.client = mqtt.NewClient(mqttOpts)
+
+	// the first connection is retried until brokerConnectTimeout
+	token := c.client.Connect()
+	if !token.WaitTimeout(brokerConnectTimeout) {
+		c.client.Disconnect(0)
+		return nil, fmt.Errorf("unable to connect to mqtt broker %s, timed out after %s", u.Host, brokerConnectTimeout)
+	}
+	if token.Error() != nil {
 		return nil, token.Error()
 	}
-	return broker, nil
+	return c, nil
+}
+
+// v3BrokerClient is a mqtt 3.1.1 connection
+type v3BrokerClient struct {
+	*connectionState
+	client        mqtt.Client
+	mu            sync.Mutex
+	subscriptions map[string]byte
+}
+
+// resubscribe restores subscriptions after a reconnect, the session of a
+// mqtt 3.1.1 connection is not kept by the broker
+func (c *v3BrokerClient) resubscribe() {
+	c.mu.Lock()
+	subscriptions := make(map[string]byte, len(c.subscriptions))
+	for filter, qos := range c.subscriptions {
+		subscriptions[filter] = qos
+	}
+	c.mu.Unlock()
+
+	for filter, qos := range subscriptions {
+		if err := c.subscribe(filter, qos); err != nil {
+			c.logger.Println(err)
+		}
+	}
+}
+
+func (c *v3BrokerClient) Subscribe(filter string, qos byte) error {
+	c.mu.Lock()
+	c.subscriptions[filter] = qos
+	c.mu.Unlock()
+	return c.subscribe(filter, qos)
+}
+
+func (c *v3BrokerClient) subscribe(filter string, qos byte) error {
+	if token := c.client.Subscribe(filter, qos, nil); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to subscribe to %s, %w", filter, token.Error())
+	}
+	return nil
+}
+
+func (c *v3BrokerClient) Unsubscribe(filter string) error {
+	c.mu.Lock()
+	delete(c.subscriptions, filter)
+	c.mu.Unlock()
+	if token := c.client.Unsubscribe(filter); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to unsubscribe from %s, %w", filter, token.Error())
+	}
+	return nil
+}
+
+func (c *v3BrokerClient) Publish(msg publishMessage) error {
+	if token := c.client.Publish(msg.topic, msg.qos, msg.retain, msg.payload); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to publish to %s, %w", msg.topic, token.Error())
+	}
+	return nil
+}
+
+func (c *v3BrokerClient) Disconnect() {
+	c.client.Disconnect(250)
 }
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Broker connection states
+const (
+	BROKER_STATE_CONNECTING   = "connecting"
+	BROKER_STATE_CONNECTED    = "connected"
+	BROKER_STATE_RECONNECTING = "reconnecting"
+	BROKER_STATE_DISCONNECTED = "disconnected"
+)
+
+// BrokerStatus reports the connection state of a broker
+type BrokerStatus struct {
+	// Name is source or publish
+	Name string `json:"name"`
+	// URL is the broker URL without passwords
+	URL     string `json:"url"`
+	Version string `json:"version"`
+	State   string `json:"state"`
+	// Since is when the broker entered the state
+	Since time.Time `json:"since"`
+	// Reconnects counts the connections after the first one
+	Reconnects int    `json:"reconnects"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// connectionState tracks and logs the state of a broker connection
+type connectionState struct {
+	mu          sync.Mutex
+	logger      *log.Logger
+	status      BrokerStatus
+	connected   bool
+	onReconnect func()
+}
+
+// newConnectionState returns the state of a connection that is connecting,
+// onReconnect is called when the connection is made again after it was lost
+func newConnectionState(logger *log.Logger, name string, rawURL string, version int, onReconnect func()) *connectionState {
+	return &connectionState{
+		logger: logger,
+		status: BrokerStatus{
+			Name:    name,
+			URL:     RedactURL(rawURL),
+			Version: mqttVersionName(version),
+			State:   BROKER_STATE_CONNECTING,
+			Since:   time.Now(),
+		},
+		onReconnect: onReconnect,
+	}
+}
+
+// set changes the state of the connection, err is the reason the connection
+// was lost or could not be made
+func (s *connectionState) set(state string, err error) {
+	s.mu.Lock()
+
+	if state == s.status.State && err == nil {
+		s.mu.Unlock()
+		return
+	}
+
+	reconnected := false
+	if state == BROKER_STATE_CONNECTED {
+		if s.connected {
+			s.status.Reconnects++
+			reconnected = true
+		}
+		s.connected = true
+	}
+
+	if state != s.status.State {
+		s.status.Since = time.Now()
+	}
+	s.status.State = state
+	if err != nil {
+		s.status.LastError = err.Error()
+		s.logger.Printf("mqtt %s broker %s %s, %v\n", s.status.Name, s.status.URL, state, err)
+	} else {
+		s.logger.Printf("mqtt %s broker %s %s\n", s.status.Name, s.status.URL, state)
+	}
+
+	onReconnect := s.onReconnect
+	s.mu.Unlock()
+
+	if reconnected && onReconnect != nil {
+		go onReconnect()
+	}
+}
+
+// Status returns the current status of the connection
+func (s *connectionState) Status() BrokerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
@@ -30,6 +30,12 @@ func TestValidateMqttURL(t *testing.T) {
 			want:    true,
 			wantErr: false,
 		},
+		{
+			name:    "valid mqtts url",
+			args:    args{"mqtts://localhost:8883"},
+			want:    true,
+			wantErr: false,
+		},
 		{
 			name:    "invalid wss url",
 			args:    args{"wss://localhost:1883"},
@@ -76,3 +82,27 @@ func TestValidateMqttURL(t *testing.T) {
 		})
 	}
 }
+
+func TestTopicMatchesFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"glowplug/#", "glowplug/Plant1/Heater/Celsius", true},
+		{"glowplug/#", "glowplug", true},
+		{"glowplug/+/Heater/#", "glowplug/Plant1/Heater/Celsius", true},
+		{"glowplug/+/Heater", "glowplug/Plant1/Heater/Celsius", false},
+		{"glowplug/+", "glowplug/Plant1", true},
+		{"glowplug/Plant1/Heater", "glowplug/Plant1/Heater", true},
+		{"glowplug/Plant2/#", "glowplug/Plant1/Heater", false},
+		{"glowplug/Plant1/Heater/Celsius", "glowplug/Plant1/Heater", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			if got := topicMatchesFilter(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("topicMatchesFilter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// isTLSScheme returns true for broker URL schemes that connect with TLS
+func isTLSScheme(scheme string) bool {
+	return scheme == "ssl" || scheme == "tls" || scheme == "mqtts"
+}
+
+// usesTLS returns true when any TLS option is set
+func (o BrokerOpts) usesTLS() bool {
+	return len(o.CAFile) > 0 || len(o.CertFile) > 0 || len(o.KeyFile) > 0 || o.InsecureSkipVerify
+}
+
+// tlsFiles returns a hash of the contents of the TLS files, so a reload can
+// tell a certificate rotated under the same path from an unchanged one
+func (o BrokerOpts) tlsFiles() string {
+	if !o.usesTLS() {
+		return ""
+	}
+	h := sha256.New()
+	for _, name := range []string{o.CAFile, o.CertFile, o.KeyFile} {
+		if len(name) == 0 {
+			continue
+		}
+		// an unreadable file fails the connection, which reports it
+		data, _ := os.ReadFile(name)
+		fmt.Fprintf(h, "%s:%d:", name, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// credentials returns the username and password of a broker connection,
+// from the user info of the broker URL when no username is set
+func (o BrokerOpts) credentials(u *url.URL) (username string, password string) {
+	if len(o.Username) > 0 || u.User == nil {
+		return o.Username, o.Password
+	}
+	password, _ = u.User.Password()
+	return u.User.Username(), password
+}
+
+// tlsConfig returns the TLS configuration of a broker connection, nil when
+// the broker URL does not use TLS
+func (o BrokerOpts) tlsConfig(u *url.URL) (*tls.Config, error) {
+	if !isTLSScheme(u.Scheme) {
+		if o.usesTLS() {
+			return nil, fmt.Errorf("mqtt tls options require a ssl://, tls:// or mqtts:// broker URL")
+		}
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if len(o.CAFile) > 0 {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read mqtt ca file, %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt ca file %s contains no PEM certificates", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(o.CertFile) > 0 || len(o.KeyFile) > 0 {
+		if len(o.CertFile) == 0 || len(o.KeyFile) == 0 {
+			return nil, fmt.Errorf("mqtt client certificate requires both a cert and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load mqtt client certificate, %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
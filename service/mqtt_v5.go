@@ -0,0 +1,407 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// reasonCodeNames describes the mqtt v5 reason codes a broker may return
+// when it rejects a subscription or publish, or disconnects a client
+var reasonCodeNames = map[byte]string{
+	0x04: "disconnect with will message",
+	0x10: "no matching subscribers",
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x87: "not authorized",
+	0x89: "server busy",
+	0x8B: "server shutting down",
+	0x8D: "keep alive timeout",
+	0x8E: "session taken over",
+	0x8F: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x93: "receive maximum exceeded",
+	0x94: "topic alias invalid",
+	0x95: "packet too large",
+	0x96: "message rate too high",
+	0x97: "quota exceeded",
+	0x98: "administrative action",
+	0x99: "payload format invalid",
+	0x9A: "retain not supported",
+	0x9B: "qos not supported",
+	0x9C: "use another server",
+	0x9D: "server moved",
+	0x9E: "shared subscriptions not supported",
+	0x9F: "connection rate exceeded",
+	0xA0: "maximum connect time",
+	0xA1: "subscription identifiers not supported",
+	0xA2: "wildcard subscriptions not supported",
+}
+
+// reasonCodeText formats a mqtt v5 reason code and optional reason string
+func reasonCodeText(code byte, reason string) string {
+	text := fmt.Sprintf("reason code 0x%02X", code)
+	if name, ok := reasonCodeNames[code]; ok {
+		text += " " + name
+	}
+	if len(reason) > 0 {
+		text += ": " + reason
+	}
+	return text
+}
+
+// topicAliases assigns mqtt v5 topic aliases to published topics. An alias
+// is only used without its topic once the broker has received both together,
+// and all aliases are forgotten when the connection is replaced.
+type topicAliases struct {
+	mu       sync.Mutex
+	max      uint16
+	conn     uint64
+	aliases  map[string]uint16
+	pending  map[string]uint16
+	inflight map[*paho.Publish]aliasLookup
+}
+
+// aliasLookup is the connection a publish looked up its alias on
+type aliasLookup struct {
+	conn  uint64
+	known bool
+}
+
+// reset forgets all aliases for a new connection that allows max aliases
+func (a *topicAliases) reset(max uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.max = max
+	a.conn++
+	a.aliases = map[string]uint16{}
+	a.pending = map[string]uint16{}
+}
+
+// lookup returns the alias of a topic, 0 when no alias is available, and
+// whether the broker already knows the alias
+func (a *topicAliases) lookup(topic string) (alias uint16, known bool, conn uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if alias, ok := a.aliases[topic]; ok {
+		return alias, true, a.conn
+	}
+
+	// publish the topic in full while another publish registers its alias
+	if _, ok := a.pending[topic]; ok {
+		return 0, false, a.conn
+	}
+
+	next := len(a.aliases) + len(a.pending) + 1
+	if next > int(a.max) {
+		return 0, false, a.conn
+	}
+
+	alias = uint16(next)
+	a.pending[topic] = alias
+	return alias, false, a.conn
+}
+
+// confirm marks an alias as known by the broker after it was published
+// together with its topic, or retires it when the publish failed
+func (a *topicAliases) confirm(topic string, conn uint64, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if conn != a.conn {
+		return
+	}
+
+	alias, pending := a.pending[topic]
+	if !pending {
+		return
+	}
+	delete(a.pending, topic)
+	if ok {
+		a.aliases[topic] = alias
+	} else {
+		// keep the alias reserved so numbers are never reused for another topic
+		a.aliases[topic] = 0
+	}
+}
+
+// track remembers the alias lookup of a publish until it is sent
+func (a *topicAliases) track(p *paho.Publish, conn uint64, known bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inflight == nil {
+		a.inflight = map[*paho.Publish]aliasLookup{}
+	}
+	a.inflight[p] = aliasLookup{conn: conn, known: known}
+}
+
+// untrack forgets the alias lookup of a publish
+func (a *topicAliases) untrack(p *paho.Publish) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inflight, p)
+}
+
+// apply runs right before a publish is written to the connection. A known
+// alias is sent without its topic, but when the connection was replaced since
+// the lookup the full topic is sent without an alias.
+func (a *topicAliases) apply(p *paho.Publish) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	lookup, ok := a.inflight[p]
+	if !ok || p.Properties == nil || p.Properties.TopicAlias == nil {
+		return
+	}
+	if lookup.conn != a.conn {
+		p.Properties.TopicAlias = nil
+		return
+	}
+	if lookup.known {
+		p.Topic = ""
+	}
+}
+
+// v5BrokerClient is a mqtt v5 connection, it reconnects and restores its
+// subscriptions when the connection is lost
+type v5BrokerClient struct {
+	*connectionState
+	host          string
+	opts          BrokerOpts
+	cm            *autopaho.ConnectionManager
+	aliases       topicAliases
+	mu            sync.Mutex
+	subscriptions map[string]byte
+}
+
+// newV5BrokerClient connects to a mqtt v5 broker
+func newV5BrokerClient(logger *log.Logger, u *url.URL, opts BrokerOpts, tlsCfg *tls.Config, will *sparkplug.Will, handler messageHandler, state *connectionState) (*v5BrokerClient, error) {
+	c := &v5BrokerClient{
+		connectionState: state,
+		host:            u.Host,
+		opts:            opts,
+		subscriptions:   map[string]byte{},
+	}
+	c.aliases.reset(0)
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		TlsCfg:                        tlsCfg,
+		KeepAlive:                     uint16(opts.KeepAlive / time.Second),
+		ReconnectBackoff:              reconnectBackoff(opts.MaxReconnectInterval),
+		CleanStartOnInitialConnection: opts.SessionExpiry == 0,
+		SessionExpiryInterval:         uint32(opts.SessionExpiry / time.Second),
+		ConnectTimeout:                brokerConnectTimeout,
+		ConnectPacketBuilder: func(cp *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			// forget aliases before publishes can reach the new connection
+			c.aliases.reset(0)
+			return cp, nil
+		},
+		OnConnectionUp: c.onConnectionUp,
+		OnConnectError: func(err error) {
+			if c.Status().State == BROKER_STATE_CONNECTING {
+				state.set(BROKER_STATE_CONNECTING, err)
+			} else {
+				state.set(BROKER_STATE_RECONNECTING, err)
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:    opts.ClientID,
+			PublishHook: c.aliases.apply,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					if handler != nil {
+						handler(pr.Packet.Topic, pr.Packet.Payload)
+					}
+					return true, nil
+				},
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				reason := ""
+				if d.Properties != nil {
+					reason = d.Properties.ReasonString
+				}
+				state.set(BROKER_STATE_DISCONNECTED, fmt.Errorf("disconnected by broker, %s", reasonCodeText(d.ReasonCode, reason)))
+			},
+			OnClientError: func(err error) {
+				state.set(BROKER_STATE_DISCONNECTED, err)
+			},
+		},
+	}
+
+	if len(opts.Username) > 0 {
+		cfg.ConnectUsername = opts.Username
+		cfg.ConnectPassword = []byte(opts.Password)
+	}
+
+	if will != nil {
+		cfg.WillMessage = &paho.WillMessage{Topic: will.Topic, Payload: will.Payload, QoS: will.QoS, Retain: will.Retain}
+	}
+
+	cm, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to mqtt broker %s, %w", c.host, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), brokerConnectTimeout)
+	defer cancel()
+	if err := cm.AwaitConnection(ctx); err != nil {
+		cm.Disconnect(context.Background())
+		return nil, fmt.Errorf("unable to connect to mqtt broker %s, %w", c.host, err)
+	}
+	c.cm = cm
+
+	return c, nil
+}
+
+// reconnectBackoff waits from reconnectMinInterval up to max between reconnects
+func reconnectBackoff(max time.Duration) autopaho.Backoff {
+	if max <= 2*reconnectMinInterval {
+		return autopaho.NewConstantBackoff(max)
+	}
+	return autopaho.NewExponentialBackoff(reconnectMinInterval, max, 2*reconnectMinInterval, 2)
+}
+
+// onConnectionUp resets topic aliases and restores subscriptions the broker
+// did not keep in a session
+func (c *v5BrokerClient) onConnectionUp(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+	c.set(BROKER_STATE_CONNECTED, nil)
+
+	max := uint16(0)
+	if connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+		max = *connack.Properties.TopicAliasMaximum
+	}
+	if int(max) > c.opts.TopicAliases {
+		max = uint16(c.opts.TopicAliases)
+	}
+	c.aliases.reset(max)
+
+	if connack.SessionPresent {
+		return
+	}
+
+	c.mu.Lock()
+	subscriptions := make(map[string]byte, len(c.subscriptions))
+	for filter, qos := range c.subscriptions {
+		subscriptions[filter] = qos
+	}
+	c.mu.Unlock()
+
+	for filter, qos := range subscriptions {
+		if err := c.subscribe(cm, filter, qos); err != nil {
+			c.logger.Println(err)
+		}
+	}
+}
+
+// subscribe sends a subscription and returns an error with the reason code
+// when the broker rejects it
+func (c *v5BrokerClient) subscribe(cm *autopaho.ConnectionManager, filter string, qos byte) error {
+	suback, err := cm.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: qos}},
+	})
+	if suback != nil && len(suback.Reasons) > 0 {
+		code := suback.Reasons[0]
+		if code >= 0x80 {
+			reason := ""
+			if suback.Properties != nil {
+				reason = suback.Properties.ReasonString
+			}
+			return fmt.Errorf("mqtt broker %s rejected subscription to %s, %s", c.host, filter, reasonCodeText(code, reason))
+		}
+		if code < qos {
+			c.logger.Printf("mqtt broker %s granted qos %d of %d for subscription to %s", c.host, code, qos, filter)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to %s, %w", filter, err)
+	}
+	return nil
+}
+
+func (c *v5BrokerClient) Subscribe(filter string, qos byte) error {
+	c.mu.Lock()
+	c.subscriptions[filter] = qos
+	c.mu.Unlock()
+	return c.subscribe(c.cm, filter, qos)
+}
+
+func (c *v5BrokerClient) Unsubscribe(filter string) error {
+	c.mu.Lock()
+	delete(c.subscriptions, filter)
+	c.mu.Unlock()
+	if _, err := c.cm.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: []string{filter}}); err != nil {
+		return fmt.Errorf("unable to unsubscribe from %s, %w", filter, err)
+	}
+	return nil
+}
+
+func (c *v5BrokerClient) Publish(msg publishMessage) error {
+	p := &paho.Publish{
+		Topic:   msg.topic,
+		QoS:     msg.qos,
+		Retain:  msg.retain,
+		Payload: msg.payload,
+		Properties: &paho.PublishProperties{
+			ContentType: msg.contentType,
+		},
+	}
+
+	if msg.messageExpiry > 0 {
+		expiry := uint32(msg.messageExpiry / time.Second)
+		p.Properties.MessageExpiry = &expiry
+	}
+
+	keys := make([]string, 0, len(msg.userProperties))
+	for key := range msg.userProperties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p.Properties.User.Add(key, msg.userProperties[key])
+	}
+
+	// the topic is left out in the publish hook, once the connection the
+	// publish is written to is known
+	alias, known, conn := c.aliases.lookup(msg.topic)
+	if alias > 0 {
+		p.Properties.TopicAlias = &alias
+		c.aliases.track(p, conn, known)
+		defer c.aliases.untrack(p)
+	}
+
+	pr, err := c.cm.Publish(context.Background(), p)
+	if alias > 0 && !known {
+		c.aliases.confirm(msg.topic, conn, err == nil)
+	}
+	if pr != nil && pr.ReasonCode >= 0x80 {
+		reason := ""
+		if pr.Properties != nil {
+			reason = pr.Properties.ReasonString
+		}
+		return fmt.Errorf("mqtt broker %s rejected publish to %s, %s", c.host, msg.topic, reasonCodeText(pr.ReasonCode, reason))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to publish to %s, %w", msg.topic, err)
+	}
+	return nil
+}
+
+func (c *v5BrokerClient) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	c.cm.Disconnect(ctx)
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicAliases(t *testing.T) {
+	var a topicAliases
+	a.reset(2)
+
+	// the first publish of a topic registers its alias
+	alias, known, conn := a.lookup("glowplug/a")
+	assert.Equal(t, uint16(1), alias)
+	assert.False(t, known)
+
+	// concurrent publishes use the full topic until the alias is confirmed
+	alias, known, _ = a.lookup("glowplug/a")
+	assert.Equal(t, uint16(0), alias)
+	assert.False(t, known)
+
+	a.confirm("glowplug/a", conn, true)
+	alias, known, _ = a.lookup("glowplug/a")
+	assert.Equal(t, uint16(1), alias)
+	assert.True(t, known)
+
+	// a failed registration retires the alias
+	alias, _, conn = a.lookup("glowplug/b")
+	assert.Equal(t, uint16(2), alias)
+	a.confirm("glowplug/b", conn, false)
+	alias, _, _ = a.lookup("glowplug/b")
+	assert.Equal(t, uint16(0), alias)
+
+	// no aliases are left
+	alias, _, _ = a.lookup("glowplug/c")
+	assert.Equal(t, uint16(0), alias)
+
+	// aliases of a previous connection are forgotten
+	_, _, conn = a.lookup("glowplug/c")
+	a.reset(2)
+	a.confirm("glowplug/c", conn, true)
+	alias, known, _ = a.lookup("glowplug/a")
+	assert.Equal(t, uint16(1), alias)
+	assert.False(t, known)
+}
+
+func TestTopicAliasesReconnect(t *testing.T) {
+	var a topicAliases
+	a.reset(2)
+	_, _, conn := a.lookup("glowplug/a")
+	a.confirm("glowplug/a", conn, true)
+
+	publish := func() *paho.Publish {
+		alias, known, conn := a.lookup("glowplug/a")
+		p := &paho.Publish{Topic: "glowplug/a", Properties: &paho.PublishProperties{TopicAlias: &alias}}
+		a.track(p, conn, known)
+		return p
+	}
+
+	// a known alias is sent without its topic
+	p := publish()
+	a.apply(p)
+	assert.Equal(t, "", p.Topic)
+	assert.Equal(t, uint16(1), *p.Properties.TopicAlias)
+	a.untrack(p)
+
+	// a publish racing a reconnect sends its full topic to the new connection
+	p = publish()
+	a.reset(0)
+	a.apply(p)
+	assert.Equal(t, "glowplug/a", p.Topic)
+	assert.Nil(t, p.Properties.TopicAlias)
+	a.untrack(p)
+	assert.Empty(t, a.inflight)
+}
+
+func TestBrokerOptsValidate(t *testing.T) {
+	assert.NoError(t, BrokerOpts{}.Validate())
+	assert.NoError(t, BrokerOpts{Version: MQTT_VERSION_5, SessionExpiry: time.Hour, TopicAliases: 10}.Validate())
+	assert.Error(t, BrokerOpts{Version: 4}.Validate())
+	assert.Error(t, BrokerOpts{Version: MQTT_VERSION_3, SessionExpiry: time.Hour}.Validate())
+	assert.Error(t, BrokerOpts{Version: MQTT_VERSION_5, TopicAliases: -1}.Validate())
+}
+
+func TestReasonCodeText(t *testing.T) {
+	assert.Equal(t, "reason code 0x87 not authorized: acl denied", reasonCodeText(0x87, "acl denied"))
+	assert.Equal(t, "reason code 0xFE", reasonCodeText(0xFE, ""))
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+)
+
+// Namespace case conversions
+const (
+	NAMESPACE_CASE_NONE  = "none"
+	NAMESPACE_CASE_LOWER = "lower"
+	NAMESPACE_CASE_UPPER = "upper"
+)
+
+// Placeholders available in a namespace template
+const (
+	placeholderSource = "source"
+	placeholderGroup  = "group"
+	placeholderNode   = "node"
+	placeholderDevice = "device"
+	placeholderMetric = "metric"
+)
+
+// placeholderRegexp matches {name}, {name.N} and {name.*}
+var placeholderRegexp = regexp.MustCompile(`\{([a-z]+)(?:\.(\*|-?[0-9]+))?\}`)
+
+// NamespaceFormat describes how Redis keys or MQTT topics are built from a
+// Sparkplug topic and metric name.
+//
+// The template is split into segments by the delimiter, and each segment
+// contains literal text and placeholders:
+//
+//	{source}    the name of the source broker, empty for an unnamed source
+//	{group}     the group id, e.g. Plant1:Area3
+//	{group.N}   segment N of the group id split on GroupSeparator, negative N counts from the end
+//	{group.*}   all segments of the group id, each becomes a segment
+//	{node}      the edge node id
+//	{device}    the device id, empty for node metrics
+//	{metric}    the metric name, e.g. Current/Celsius
+//	{metric.N}  segment N of the metric name split on MetricSeparator
+//	{metric.*}  all segments of the metric name, each becomes a segment
+//
+// Segments that render empty, such as {device} for node metrics, are left out.
+type NamespaceFormat struct {
+	Template        string
+	Delimiter       string
+	GroupSeparator  string
+	MetricSeparator string
+	// Case is one of none, lower or upper
+	Case string
+	// Replace holds pairs of old and new strings replaced in every segment
+	Replace []string
+}
+
+// DefaultKeyFormat returns the format of glowplug redis keys, e.g.
+// glowplug:plant1:area3:line4:cell2:heater:tempsensor:current:celsius
+func DefaultKeyFormat() NamespaceFormat {
+	return NamespaceFormat{
+		Template:        keyPrefix + ":{group.*}:{node}:{device}:{metric.*}",
+		Delimiter:       keyDelimiter,
+		GroupSeparator:  ":",
+		MetricSeparator: "/",
+		Case:            NAMESPACE_CASE_LOWER,
+		Replace:         []string{" ", "_"},
+	}
+}
+
+// DefaultTopicFormat returns the format of glowplug mqtt topics, e.g.
+// glowplug/Plant1/Area3/Line4/Cell2/Heater/TempSensor/Current/Celsius
+func DefaultTopicFormat() NamespaceFormat {
+	return NamespaceFormat{
+		Template:        topicPrefix + "/{group.*}/{node}/{device}/{metric.*}",
+		Delimiter:       topicDelimiter,
+		GroupSeparator:  ":",
+		MetricSeparator: "/",
+		Case:            NAMESPACE_CASE_NONE,
+		Replace:         []string{":", "/"},
+	}
+}
+
+// ParseReplacePairs parses old=new pairs into a list of replacements
+func ParseReplacePairs(pairs []string) ([]string, error) {
+	replace := make([]string, 0, len(pairs)*2)
+	for _, pair := range pairs {
+		old, new, ok := strings.Cut(pair, "=")
+		if !ok || len(old) == 0 {
+			return nil, fmt.Errorf("invalid replacement %q, expected old=new", pair)
+		}
+		replace = append(replace, old, new)
+	}
+	return replace, nil
+}
+
+// namespacePart is literal text or a placeholder within a segment
+type namespacePart struct {
+	literal string
+	name    string
+	index   int
+	indexed bool
+	all     bool
+}
+
+// Namespace renders Redis keys or MQTT topics from a NamespaceFormat
+type Namespace struct {
+	format   NamespaceFormat
+	segments [][]namespacePart
+	replacer *strings.Replacer
+}
+
+// NewNamespace parses and validates a NamespaceFormat
+func NewNamespace(format NamespaceFormat) (*Namespace, error) {
+
+	if len(format.Template) == 0 {
+		return nil, fmt.Errorf("namespace template is empty")
+	}
+	if len(format.Delimiter) == 0 {
+		return nil, fmt.Errorf("namespace delimiter is empty")
+	}
+	if len(format.GroupSeparator) == 0 {
+		format.GroupSeparator = ":"
+	}
+	if len(format.MetricSeparator) == 0 {
+		format.MetricSeparator = "/"
+	}
+	switch format.Case {
+	case "":
+		format.Case = NAMESPACE_CASE_NONE
+	case NAMESPACE_CASE_NONE, NAMESPACE_CASE_LOWER, NAMESPACE_CASE_UPPER:
+	default:
+		return nil, fmt.Errorf("invalid namespace case %s, must be one of: %s, %s, %s", format.Case,
+			NAMESPACE_CASE_NONE, NAMESPACE_CASE_LOWER, NAMESPACE_CASE_UPPER)
+	}
+	if len(format.Replace)%2 != 0 {
+		return nil, fmt.Errorf("namespace replacements must be pairs of old and new strings")
+	}
+
+	ns := &Namespace{
+		format:   format,
+		replacer: strings.NewReplacer(format.Replace...),
+	}
+
+	hasMetric := false
+	for _, segment := range strings.Split(format.Template, format.Delimiter) {
+		if len(segment) == 0 {
+			return nil, fmt.Errorf("namespace template %s contains an empty segment", format.Template)
+		}
+
+		var parts []namespacePart
+		last := 0
+		for _, m := range placeholderRegexp.FindAllStringSubmatchIndex(segment, -1) {
+			if m[0] > last {
+				parts = append(parts, namespacePart{literal: segment[last:m[0]]})
+			}
+			last = m[1]
+
+			part := namespacePart{name: segment[m[2]:m[3]]}
+			switch part.name {
+			case placeholderGroup, placeholderMetric:
+			case placeholderSource, placeholderNode, placeholderDevice:
+				if m[4] >= 0 {
+					return nil, fmt.Errorf("namespace placeholder {%s} has no segments", part.name)
+				}
+			default:
+				return nil, fmt.Errorf("unknown namespace placeholder {%s}", part.name)
+			}
+
+			if m[4] >= 0 {
+				if index := segment[m[4]:m[5]]; index == "*" {
+					if len(segment) != m[1]-m[0] {
+						return nil, fmt.Errorf("namespace placeholder %s must be a whole segment", segment[m[0]:m[1]])
+					}
+					part.all = true
+				} else {
+					part.index, _ = strconv.Atoi(index)
+					part.indexed = true
+				}
+			}
+
+			if part.name == placeholderMetric {
+				hasMetric = true
+			}
+			parts = append(parts, part)
+		}
+		if last < len(segment) {
+			parts = append(parts, namespacePart{literal: segment[last:]})
+		}
+
+		for _, part := range parts {
+			if strings.ContainsAny(part.literal, "{}") {
+				return nil, fmt.Errorf("namespace template segment %s is invalid", segment)
+			}
+		}
+
+		ns.segments = append(ns.segments, parts)
+	}
+
+	if !hasMetric {
+		return nil, fmt.Errorf("namespace template %s must contain a {metric} placeholder", format.Template)
+	}
+
+	return ns, nil
+}
+
+// segmentAt returns segment i of a list, negative i counts from the end
+func segmentAt(segments []string, i int) string {
+	if i < 0 {
+		i = len(segments) + i
+	}
+	if i < 0 || i >= len(segments) {
+		return ""
+	}
+	return segments[i]
+}
+
+// Render returns the key or topic for a metric of a sparkplug topic
+func (ns *Namespace) Render(topic sparkplug.Topic, metricName string) string {
+
+	values := map[string]string{
+		placeholderSource: topic.Source,
+		placeholderGroup:  topic.GroupId,
+		placeholderNode:   topic.EdgeNodeId,
+		placeholderMetric: metricName,
+	}
+	if topic.HasDevice {
+		values[placeholderDevice] = topic.DeviceId
+	}
+
+	split := func(name string) []string {
+		switch name {
+		case placeholderGroup:
+			return strings.Split(topic.GroupId, ns.format.GroupSeparator)
+		case placeholderMetric:
+			return strings.Split(metricName, ns.format.MetricSeparator)
+		}
+		return nil
+	}
+
+	var rendered []string
+	for _, parts := range ns.segments {
+		if len(parts) == 1 && parts[0].all {
+			for _, s := range split(parts[0].name) {
+				if s = ns.replacer.Replace(s); len(s) > 0 {
+					rendered = append(rendered, s)
+				}
+			}
+			continue
+		}
+
+		var b strings.Builder
+		for _, part := range parts {
+			switch {
+			case len(part.name) == 0:
+				b.WriteString(part.literal)
+			case part.indexed:
+				b.WriteString(segmentAt(split(part.name), part.index))
+			default:
+				b.WriteString(values[part.name])
+			}
+		}
+
+		if s := ns.replacer.Replace(b.String()); len(s) > 0 {
+			rendered = append(rendered, s)
+		}
+	}
+
+	result := strings.Join(rendered, ns.format.Delimiter)
+
+	switch ns.format.Case {
+	case NAMESPACE_CASE_LOWER:
+		return strings.ToLower(result)
+	case NAMESPACE_CASE_UPPER:
+		return strings.ToUpper(result)
+	}
+	return result
+}
+
+// NewTopicNamespace returns a namespace for mqtt topics, it may not contain
+// wildcards and always uses the mqtt topic delimiter
+func NewTopicNamespace(format NamespaceFormat) (*Namespace, error) {
+	if format.Delimiter != topicDelimiter {
+		return nil, fmt.Errorf("topic namespace delimiter must be %s", topicDelimiter)
+	}
+	if strings.ContainsAny(format.Template, "+#") {
+		return nil, fmt.Errorf("topic namespace template %s must not contain wildcards", format.Template)
+	}
+	if strings.HasPrefix(format.Template, "$") {
+		return nil, fmt.Errorf("topic namespace template %s must not start with $", format.Template)
+	}
+	return NewNamespace(format)
+}
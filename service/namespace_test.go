@@ -0,0 +1,145 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceRender(t *testing.T) {
+	deviceTopic := sparkplug.Topic{
+		Command:    sparkplug.DDATA,
+		GroupId:    "Plant1:Area3:Line4:Cell2",
+		EdgeNodeId: "Heater",
+		DeviceId:   "TempSensor",
+		HasDevice:  true,
+	}
+	nodeTopic := sparkplug.Topic{
+		Command:    sparkplug.NBIRTH,
+		GroupId:    "Plant1:Area3:Line4:Cell2",
+		EdgeNodeId: "Heater",
+	}
+
+	tests := []struct {
+		name   string
+		format NamespaceFormat
+		topic  sparkplug.Topic
+		metric string
+		want   string
+	}{
+		{
+			name:   "default key",
+			format: DefaultKeyFormat(),
+			topic:  deviceTopic,
+			metric: "Current/Celsius",
+			want:   "glowplug:plant1:area3:line4:cell2:heater:tempsensor:current:celsius",
+		},
+		{
+			name:   "default key node metric with spaces",
+			format: DefaultKeyFormat(),
+			topic:  nodeTopic,
+			metric: "Node Control/Rebirth",
+			want:   "glowplug:plant1:area3:line4:cell2:heater:node_control:rebirth",
+		},
+		{
+			name:   "default topic",
+			format: DefaultTopicFormat(),
+			topic:  deviceTopic,
+			metric: "Current/Celsius",
+			want:   "glowplug/Plant1/Area3/Line4/Cell2/Heater/TempSensor/Current/Celsius",
+		},
+		{
+			name:   "source topic",
+			format: NamespaceFormat{Template: "glowplug/{source}/{group.*}/{node}/{device}/{metric.*}", Delimiter: "/"},
+			topic:  sparkplug.Topic{Source: "plant1", GroupId: "Line4", EdgeNodeId: "Heater"},
+			metric: "Current/Celsius",
+			want:   "glowplug/plant1/Line4/Heater/Current/Celsius",
+		},
+		{
+			name:   "unnamed source left out",
+			format: NamespaceFormat{Template: "glowplug:{source}:{group}:{node}:{metric}", Delimiter: ":"},
+			topic:  nodeTopic,
+			metric: "Voltage",
+			want:   "glowplug:Plant1:Area3:Line4:Cell2:Heater:Voltage",
+		},
+		{
+			name: "uns without prefix",
+			format: NamespaceFormat{
+				Template:  "{group.0}/{group.1}/{group.2}/{group.3}/{device}/{metric}",
+				Delimiter: "/",
+			},
+			topic:  deviceTopic,
+			metric: "Current/Celsius",
+			want:   "Plant1/Area3/Line4/Cell2/TempSensor/Current/Celsius",
+		},
+		{
+			name: "last segments and literals",
+			format: NamespaceFormat{
+				Template:  "site-{group.0}:{node}:{metric.-1}",
+				Delimiter: ":",
+				Case:      NAMESPACE_CASE_UPPER,
+				Replace:   []string{"-", "_"},
+			},
+			topic:  deviceTopic,
+			metric: "Current/Celsius",
+			want:   "SITE_PLANT1:HEATER:CELSIUS",
+		},
+		{
+			name: "missing segments are left out",
+			format: NamespaceFormat{
+				Template:  "{group.5}/{node}/{device}/{metric}",
+				Delimiter: "/",
+			},
+			topic:  nodeTopic,
+			metric: "Uptime",
+			want:   "Heater/Uptime",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, err := NewNamespace(tt.format)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ns.Render(tt.topic, tt.metric))
+		})
+	}
+}
+
+func TestNewNamespaceInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		format NamespaceFormat
+	}{
+		{name: "empty template", format: NamespaceFormat{Delimiter: "/"}},
+		{name: "empty delimiter", format: NamespaceFormat{Template: "{metric}"}},
+		{name: "no metric", format: NamespaceFormat{Template: "{group}/{node}", Delimiter: "/"}},
+		{name: "unknown placeholder", format: NamespaceFormat{Template: "{site}/{metric}", Delimiter: "/"}},
+		{name: "node segments", format: NamespaceFormat{Template: "{node.0}/{metric}", Delimiter: "/"}},
+		{name: "partial wildcard", format: NamespaceFormat{Template: "x{group.*}/{metric}", Delimiter: "/"}},
+		{name: "empty segment", format: NamespaceFormat{Template: "{group}//{metric}", Delimiter: "/"}},
+		{name: "unbalanced brace", format: NamespaceFormat{Template: "{group/{metric}", Delimiter: "/"}},
+		{name: "invalid case", format: NamespaceFormat{Template: "{metric}", Delimiter: "/", Case: "title"}},
+		{name: "odd replacements", format: NamespaceFormat{Template: "{metric}", Delimiter: "/", Replace: []string{" "}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewNamespace(tt.format)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := NewTopicNamespace(NamespaceFormat{Template: "uns/+/{metric}", Delimiter: "/"})
+	assert.Error(t, err)
+	_, err = NewTopicNamespace(NamespaceFormat{Template: "uns:{metric}", Delimiter: ":"})
+	assert.Error(t, err)
+}
+
+func TestParseReplacePairs(t *testing.T) {
+	replace, err := ParseReplacePairs([]string{" =_", ":=/"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{" ", "_", ":", "/"}, replace)
+
+	_, err = ParseReplacePairs([]string{"nope"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy is what a queue does with an item when it is full
+type OverflowPolicy string
+
+const (
+	// OVERFLOW_BLOCK waits for room in the queue, slowing down its producer
+	OVERFLOW_BLOCK OverflowPolicy = "block"
+	// OVERFLOW_DROP_NEWEST drops the item that does not fit
+	OVERFLOW_DROP_NEWEST OverflowPolicy = "drop-newest"
+	// OVERFLOW_DROP_OLDEST drops the oldest queued item to make room
+	OVERFLOW_DROP_OLDEST OverflowPolicy = "drop-oldest"
+)
+
+// ParseOverflowPolicy returns an OverflowPolicy from a string, an empty
+// string returns def
+func ParseOverflowPolicy(s string, def OverflowPolicy) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(strings.ToLower(s)); p {
+	case "":
+		return def, nil
+	case OVERFLOW_BLOCK, OVERFLOW_DROP_NEWEST, OVERFLOW_DROP_OLDEST:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid overflow policy %s, must be one of: %s, %s, %s", s,
+			OVERFLOW_BLOCK, OVERFLOW_DROP_NEWEST, OVERFLOW_DROP_OLDEST)
+	}
+}
+
+// Pipeline defaults
+const (
+	DEFAULT_SINK_QUEUE_SIZE = 1000
+	DEFAULT_BATCH_SIZE      = 500
+	// laneQueueSize is the number of messages waiting for each decode worker
+	laneQueueSize = 64
+)
+
+// PipelineOpts configures the intake queue of the messages received from the
+// brokers and the workers decoding them
+type PipelineOpts struct {
+	// Workers decode and process messages in parallel, the messages of an edge
+	// node are processed in order by the same worker. Defaults to the number of CPUs.
+	Workers int
+	// QueueSize is the number of received messages waiting to be decoded,
+	// defaults to 100 per CPU
+	QueueSize int
+	// Overflow applies when the queue is full, defaults to drop-newest
+	Overflow OverflowPolicy
+}
+
+// withDefaults returns the options with zero values replaced by defaults
+func (o PipelineOpts) withDefaults() PipelineOpts {
+	if o.Workers == 0 {
+		o.Workers = runtime.NumCPU()
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = runtime.NumCPU() * 100
+	}
+	if len(o.Overflow) == 0 {
+		o.Overflow = OVERFLOW_DROP_NEWEST
+	}
+	return o
+}
+
+// Validate returns an error if the options are out of range
+func (o PipelineOpts) Validate() error {
+	if o.Workers < 0 {
+		return fmt.Errorf("invalid pipeline workers %d, must not be negative", o.Workers)
+	}
+	if o.QueueSize < 0 {
+		return fmt.Errorf("invalid pipeline queue size %d, must not be negative", o.QueueSize)
+	}
+	_, err := ParseOverflowPolicy(string(o.Overflow), OVERFLOW_DROP_NEWEST)
+	return err
+}
+
+// QueueOpts configures the queue between the workers and a sink
+type QueueOpts struct {
+	// Size is the number of payloads and session events waiting for the sink,
+	// defaults to DEFAULT_SINK_QUEUE_SIZE
+	Size int
+	// Overflow applies when the queue is full, defaults to block
+	Overflow OverflowPolicy
+	// BatchSize is the most metric updates passed to one Write, defaults to DEFAULT_BATCH_SIZE
+	BatchSize int
+	// BatchInterval is how long to wait for more updates before a Write,
+	// zero writes the updates queued so far without waiting
+	BatchInterval time.Duration
+	// Buffer stores updates on disk while the sink fails, disabled by default
+	Buffer BufferOpts
+}
+
+// withDefaults returns the options with zero values replaced by defaults
+func (o QueueOpts) withDefaults() QueueOpts {
+	if o.Size == 0 {
+		o.Size = DEFAULT_SINK_QUEUE_SIZE
+	}
+	if len(o.Overflow) == 0 {
+		o.Overflow = OVERFLOW_BLOCK
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	return o
+}
+
+// Validate returns an error if the options are out of range
+func (o QueueOpts) Validate() error {
+	if o.Size < 0 {
+		return fmt.Errorf("invalid sink queue size %d, must not be negative", o.Size)
+	}
+	if o.BatchSize < 0 {
+		return fmt.Errorf("invalid sink batch size %d, must not be negative", o.BatchSize)
+	}
+	if o.BatchInterval < 0 {
+		return fmt.Errorf("invalid sink batch interval %s, must not be negative", o.BatchInterval)
+	}
+	if _, err := ParseOverflowPolicy(string(o.Overflow), OVERFLOW_BLOCK); err != nil {
+		return err
+	}
+	return o.Buffer.Validate()
+}
+
+// PipelineStats reports the messages waiting in the intake queue and the
+// messages processed, dropped or failed since glowplug started
+type PipelineStats struct {
+	Workers   int    `json:"workers"`
+	Queued    int    `json:"queued"`
+	Size      int    `json:"size"`
+	Processed uint64 `json:"processed"`
+	Errors    uint64 `json:"errors"`
+	Dropped   uint64 `json:"dropped"`
+	// Violations counts the violations of the Sparkplug specification found
+	// in the processed messages
+	Violations uint64 `json:"violations"`
+}
+
+// queue is a bounded channel applying an overflow policy when it is full
+type queue[T any] struct {
+	ch      chan T
+	policy  OverflowPolicy
+	dropped atomic.Uint64
+
+	// mu prevents pushes to a closed channel, done is closed first to release
+	// pushes blocked on a full channel so close can take the lock
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newQueue[T any](size int, policy OverflowPolicy) *queue[T] {
+	return &queue[T]{ch: make(chan T, size), policy: policy, done: make(chan struct{})}
+}
+
+// push adds an item to the queue, it returns false when an item was dropped
+// or the queue is closed
+func (q *queue[T]) push(item T) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+
+	switch q.policy {
+	case OVERFLOW_BLOCK:
+		select {
+		case q.ch <- item:
+			return true
+		case <-q.done:
+			// the queue closed while it was full
+			q.dropped.Add(1)
+			return false
+		}
+	case OVERFLOW_DROP_OLDEST:
+		dropped := false
+		for {
+			select {
+			case q.ch <- item:
+				return !dropped
+			default:
+			}
+			select {
+			case <-q.ch:
+				q.dropped.Add(1)
+				dropped = true
+			default:
+			}
+		}
+	default:
+		select {
+		case q.ch <- item:
+			return true
+		default:
+			q.dropped.Add(1)
+			return false
+		}
+	}
+}
+
+// close stops accepting items, queued items can still be received. Blocked
+// pushes are dropped.
+func (q *queue[T]) close() {
+	q.once.Do(func() { close(q.done) })
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+// lane returns the decode worker of an edge node, so the messages of a node
+// are processed in order
+func lane(nodeKey string, lanes int) int {
+	h := fnv.New32a()
+	h.Write([]byte(nodeKey))
+	return int(h.Sum32() % uint32(lanes))
+}
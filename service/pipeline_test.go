@@ -0,0 +1,357 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	p, err := ParseOverflowPolicy("", OVERFLOW_BLOCK)
+	require.NoError(t, err)
+	assert.Equal(t, OVERFLOW_BLOCK, p)
+
+	p, err = ParseOverflowPolicy("Drop-Oldest", OVERFLOW_BLOCK)
+	require.NoError(t, err)
+	assert.Equal(t, OVERFLOW_DROP_OLDEST, p)
+
+	_, err = ParseOverflowPolicy("spill", OVERFLOW_BLOCK)
+	assert.Error(t, err)
+}
+
+func TestQueueOverflow(t *testing.T) {
+	drain := func(q *queue[int]) []int {
+		q.close()
+		var items []int
+		for item := range q.ch {
+			items = append(items, item)
+		}
+		return items
+	}
+
+	newest := newQueue[int](2, OVERFLOW_DROP_NEWEST)
+	assert.True(t, newest.push(1))
+	assert.True(t, newest.push(2))
+	assert.False(t, newest.push(3))
+	assert.Equal(t, uint64(1), newest.dropped.Load())
+	assert.Equal(t, []int{1, 2}, drain(newest))
+
+	oldest := newQueue[int](2, OVERFLOW_DROP_OLDEST)
+	assert.True(t, oldest.push(1))
+	assert.True(t, oldest.push(2))
+	assert.False(t, oldest.push(3))
+	assert.Equal(t, uint64(1), oldest.dropped.Load())
+	assert.Equal(t, []int{2, 3}, drain(oldest))
+
+	block := newQueue[int](1, OVERFLOW_BLOCK)
+	assert.True(t, block.push(1))
+	pushed := make(chan bool)
+	go func() { pushed <- block.push(2) }()
+	select {
+	case <-pushed:
+		t.Fatal("push to a full blocking queue returned")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Equal(t, 1, <-block.ch)
+	assert.True(t, <-pushed)
+	assert.Equal(t, uint64(0), block.dropped.Load())
+
+	closed := newQueue[int](1, OVERFLOW_BLOCK)
+	closed.close()
+	assert.False(t, closed.push(1))
+
+	// closing a full blocking queue drops the blocked push
+	full := newQueue[int](1, OVERFLOW_BLOCK)
+	assert.True(t, full.push(1))
+	go func() { pushed <- full.push(2) }()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []int{1}, drain(full))
+	assert.False(t, <-pushed)
+	assert.Equal(t, uint64(1), full.dropped.Load())
+}
+
+func TestLane(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		nodeKey := fmt.Sprintf("Plant1:Node%d", i)
+		l := lane(nodeKey, 8)
+		assert.GreaterOrEqual(t, l, 0)
+		assert.Less(t, l, 8)
+		assert.Equal(t, l, lane(nodeKey, 8))
+	}
+}
+
+// recordingSink records the batches and events it receives
+type recordingSink struct {
+	name    string
+	batches [][]MetricUpdate
+	events  []SessionEvent
+	// calls is the order of writes (W) and session events (S)
+	calls  string
+	closed bool
+}
+
+func (s *recordingSink) Name() string                    { return s.name }
+func (s *recordingSink) Start(ctx context.Context) error { return nil }
+func (s *recordingSink) Write(ctx context.Context, updates []MetricUpdate) error {
+	s.batches = append(s.batches, updates)
+	s.calls += "W"
+	return nil
+}
+func (s *recordingSink) Session(ctx context.Context, event SessionEvent) error {
+	s.events = append(s.events, event)
+	s.calls += "S"
+	return nil
+}
+func (s *recordingSink) Flush(ctx context.Context) error { return nil }
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func testUpdate(name string) MetricUpdate {
+	return MetricUpdate{Name: name, Payload: &sparkplug.Payload{}, Metric: &sparkplug.Payload_Metric{Name: name}}
+}
+
+func TestSinkRunnerBatches(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	sink := &recordingSink{name: "recording"}
+	r := newSinkRunner(logger, sink, QueueOpts{BatchSize: 3})
+
+	// queue items before the runner starts so they are read in one go
+	r.push(sinkItem{updates: []MetricUpdate{testUpdate("a")}})
+	r.push(sinkItem{updates: []MetricUpdate{testUpdate("b")}})
+	r.push(sinkItem{event: &SessionEvent{Topic: sparkplug.Topic{Command: sparkplug.NDEATH}}})
+	r.push(sinkItem{updates: []MetricUpdate{testUpdate("c"), testUpdate("d")}})
+	r.push(sinkItem{updates: []MetricUpdate{testUpdate("e")}})
+	r.push(sinkItem{updates: []MetricUpdate{testUpdate("f")}})
+
+	require.NoError(t, r.start(context.Background()))
+	r.stop()
+
+	var names [][]string
+	for _, batch := range sink.batches {
+		var batchNames []string
+		for _, u := range batch {
+			batchNames = append(batchNames, u.Name)
+		}
+		names = append(names, batchNames)
+	}
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d", "e"}, {"f"}}, names)
+	assert.Equal(t, "WSWW", sink.calls)
+	assert.True(t, sink.closed)
+
+	stats := r.stats()
+	assert.Equal(t, uint64(6), stats.Updates)
+	assert.Equal(t, uint64(1), stats.Events)
+}
+
+func TestSinkRunnerOverflow(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	r := newSinkRunner(logger, &recordingSink{name: "recording"}, QueueOpts{Size: 2, Overflow: OVERFLOW_DROP_OLDEST})
+
+	for i := 0; i < 5; i++ {
+		r.push(sinkItem{updates: []MetricUpdate{testUpdate(fmt.Sprint(i))}})
+	}
+	stats := r.stats()
+	assert.Equal(t, 2, stats.Queued)
+	assert.Equal(t, uint64(3), stats.Dropped)
+}
+
+func TestWorkerPipelineOrder(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	sink := &recordingSink{name: "recording"}
+	wIface, err := NewWorker(logger, WorkerOpts{
+		Sinks:    []Sink{sink},
+		Pipeline: PipelineOpts{Workers: 4, QueueSize: 1000, Overflow: OVERFLOW_BLOCK},
+	})
+	require.NoError(t, err)
+	w := wIface.(*worker)
+
+	go w.Run()
+	require.Eventually(t, w.started.Load, time.Second, time.Millisecond)
+
+	const nodes, messages = 5, 50
+	for i := 0; i < messages; i++ {
+		for n := 0; n < nodes; n++ {
+			metric := floatMetric("Count", float32(i))
+			payload, err := proto.Marshal(&sparkplug.Payload{Seq: uint64(i % 256), Metrics: []*sparkplug.Payload_Metric{metric}})
+			require.NoError(t, err)
+			require.NoError(t, w.AddMessage(Message{
+				Topic:    fmt.Sprintf("spBv1.0/Plant1/NDATA/Node%d", n),
+				Payload:  payload,
+				Received: time.Now(),
+			}))
+		}
+	}
+	require.NoError(t, w.Stop(context.Background()))
+
+	// the updates of each node arrive in the order they were received
+	last := map[string]float32{}
+	count := 0
+	for _, batch := range sink.batches {
+		for _, u := range batch {
+			value := u.Metric.GetFloatValue()
+			if previous, ok := last[u.Topic.EdgeNodeId]; ok {
+				assert.Equal(t, previous+1, value, "node %s", u.Topic.EdgeNodeId)
+			}
+			last[u.Topic.EdgeNodeId] = value
+			count++
+		}
+	}
+	assert.Equal(t, nodes*messages, count)
+	assert.True(t, sink.closed)
+
+	stats := w.Pipeline()
+	assert.Equal(t, uint64(nodes*messages), stats.Processed)
+	assert.Equal(t, uint64(0), stats.Dropped)
+}
+
+// stuckSink blocks writes until the context of the sink is done
+type stuckSink struct {
+	recordingSink
+}
+
+func (s *stuckSink) Write(ctx context.Context, updates []MetricUpdate) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestWorkerStop(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	payload, err := proto.Marshal(&sparkplug.Payload{Metrics: []*sparkplug.Payload_Metric{floatMetric("Count", 1)}})
+	require.NoError(t, err)
+	message := Message{Topic: "spBv1.0/Plant1/NDATA/Node1", Payload: payload, Received: time.Now()}
+
+	// failed writes without a disk buffer are lost
+	sink := &flakySink{recordingSink: recordingSink{name: "flaky"}, down: true}
+	wIface, err := NewWorker(logger, WorkerOpts{Sinks: []Sink{sink}})
+	require.NoError(t, err)
+	w := wIface.(*worker)
+	go w.Run()
+	require.Eventually(t, w.started.Load, time.Second, time.Millisecond)
+	require.NoError(t, w.AddMessage(message))
+	err = w.Stop(context.Background())
+	assert.ErrorIs(t, err, ErrDataLost)
+	assert.Equal(t, uint64(1), w.Sinks()[0].Lost)
+	assert.Error(t, w.AddMessage(message), "a stopped worker accepts no messages")
+	assert.NoError(t, w.Stop(context.Background()), "a second stop does nothing")
+
+	// writes are aborted after the deadline
+	stuck := &stuckSink{recordingSink: recordingSink{name: "stuck"}}
+	wIface, err = NewWorker(logger, WorkerOpts{Sinks: []Sink{stuck}})
+	require.NoError(t, err)
+	w = wIface.(*worker)
+	go w.Run()
+	require.Eventually(t, w.started.Load, time.Second, time.Millisecond)
+	require.NoError(t, w.AddMessage(message))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = w.Stop(ctx)
+	assert.ErrorIs(t, err, ErrDataLost)
+	assert.True(t, stuck.closed)
+
+	// a worker that never ran can be stopped twice as well
+	wIface, err = NewWorker(logger, WorkerOpts{Sinks: []Sink{&recordingSink{name: "idle"}}})
+	require.NoError(t, err)
+	assert.NoError(t, wIface.Stop(context.Background()))
+	assert.NoError(t, wIface.Stop(context.Background()))
+}
+
+func TestWorkerStopBlockedIntake(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	payload, err := proto.Marshal(&sparkplug.Payload{Metrics: []*sparkplug.Payload_Metric{floatMetric("Count", 1)}})
+	require.NoError(t, err)
+	message := Message{Topic: "spBv1.0/Plant1/NDATA/Node1", Payload: payload, Received: time.Now()}
+
+	// a stalled sink fills the sink and intake queues until AddMessage blocks
+	stuck := &stuckSink{recordingSink: recordingSink{name: "stuck"}}
+	wIface, err := NewWorker(logger, WorkerOpts{
+		Sinks:     []Sink{stuck},
+		Pipeline:  PipelineOpts{Workers: 1, QueueSize: 1, Overflow: OVERFLOW_BLOCK},
+		SinkQueue: QueueOpts{Size: 1, Overflow: OVERFLOW_BLOCK},
+	})
+	require.NoError(t, err)
+	w := wIface.(*worker)
+	go w.Run()
+	require.Eventually(t, w.started.Load, time.Second, time.Millisecond)
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		for w.AddMessage(message) == nil {
+		}
+	}()
+	require.Eventually(t, func() bool { return len(w.messages.ch) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stopped := make(chan error)
+	go func() { stopped <- w.Stop(ctx) }()
+	select {
+	case err := <-stopped:
+		assert.ErrorIs(t, err, ErrDataLost)
+	case <-time.After(stopGrace + time.Second):
+		t.Fatal("Stop hangs on a blocked intake queue")
+	}
+	<-blocked
+}
+
+// gatedSink blocks writes until gate is closed
+type gatedSink struct {
+	recordingSink
+	gate chan struct{}
+}
+
+func (s *gatedSink) Write(ctx context.Context, updates []MetricUpdate) error {
+	select {
+	case <-s.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.recordingSink.Write(ctx, updates)
+}
+
+func TestWorkerStopCountsDrops(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	payload, err := proto.Marshal(&sparkplug.Payload{Metrics: []*sparkplug.Payload_Metric{floatMetric("Count", 1)}})
+	require.NoError(t, err)
+	message := Message{Topic: "spBv1.0/Plant1/NDATA/Node1", Payload: payload, Received: time.Now()}
+
+	// slow holds up the decode worker so messages are still queued when
+	// Stop starts, they overflow the queue of dropping during the drain
+	slow := &gatedSink{recordingSink: recordingSink{name: "slow"}, gate: make(chan struct{})}
+	dropping := &gatedSink{recordingSink: recordingSink{name: "dropping"}, gate: make(chan struct{})}
+	wIface, err := NewWorker(logger, WorkerOpts{
+		Sinks:      []Sink{slow, dropping},
+		Pipeline:   PipelineOpts{Workers: 1, QueueSize: 10, Overflow: OVERFLOW_BLOCK},
+		SinkQueue:  QueueOpts{Size: 1, Overflow: OVERFLOW_BLOCK},
+		SinkQueues: map[string]QueueOpts{"dropping": {Size: 3, Overflow: OVERFLOW_DROP_NEWEST}},
+	})
+	require.NoError(t, err)
+	w := wIface.(*worker)
+	go w.Run()
+	require.Eventually(t, w.started.Load, time.Second, time.Millisecond)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.AddMessage(message))
+	}
+	require.Eventually(t, func() bool { return w.Sinks()[0].Queued == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, uint64(0), w.Sinks()[1].Dropped)
+
+	stopped := make(chan error)
+	go func() { stopped <- w.Stop(context.Background()) }()
+	require.Eventually(t, func() bool { return w.state.Load() == STATE_STOPPED }, time.Second, time.Millisecond)
+	close(slow.gate)
+	require.Eventually(t, func() bool { return w.Sinks()[1].Dropped > 0 }, time.Second, time.Millisecond)
+	close(dropping.gate)
+	err = <-stopped
+	assert.ErrorIs(t, err, ErrDataLost)
+	assert.Equal(t, uint64(0), w.Sinks()[1].Lost)
+}
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/american-factory-os/glowplug/json_type"
+	"github.com/american-factory-os/glowplug/sparkplug"
+)
+
+// Payload formats of metrics published to the publish broker
+const (
+	// PUBLISH_FORMAT_VALUE publishes the bare value, e.g. 98.6
+	PUBLISH_FORMAT_VALUE = "value"
+	// PUBLISH_FORMAT_JSON publishes a PublishEnvelope
+	PUBLISH_FORMAT_JSON = "json"
+	// PUBLISH_FORMAT_TEMPLATE publishes the output of a go text/template
+	PUBLISH_FORMAT_TEMPLATE = "template"
+)
+
+// Sparkplug property names that may hold the engineering unit of a metric
+var unitProperties = []string{"engUnit", "EngUnit", "engineeringUnit", "unit", "Unit"}
+
+// PublishEnvelope is the JSON payload of the json publish format, and the
+// data passed to a publish template
+type PublishEnvelope struct {
+	Value     json_type.JsonType `json:"value"`
+	Timestamp uint64             `json:"timestamp"`
+	Datatype  string             `json:"datatype"`
+	Quality   int64              `json:"quality"`
+	Unit      string             `json:"unit,omitempty"`
+	Source    string             `json:"source"`
+
+	// available to templates only
+	Topic  string `json:"-"`
+	Name   string `json:"-"`
+	Group  string `json:"-"`
+	Node   string `json:"-"`
+	Device string `json:"-"`
+}
+
+// PublishFormat selects the payload format of topics matching a filter
+type PublishFormat struct {
+	// Filter is a mqtt topic filter matched against published topics, empty matches all
+	Filter string
+	// Format is one of value, json or template
+	Format string
+	// Template is a go text/template used by the template format
+	Template string
+
+	tmpl *template.Template
+}
+
+// PublishDelivery selects how topics matching a filter are delivered
+type PublishDelivery struct {
+	// Filter is a mqtt topic filter matched against published topics, empty matches all
+	Filter string
+	QoS    byte
+	Retain bool
+	// MQTT v5 only, zero means the message never expires
+	MessageExpiry time.Duration
+	// MQTT v5 only, defaults to application/json for the json format
+	ContentType string
+	// MQTT v5 only, adds datatype and source topic user properties
+	UserProperties bool
+}
+
+// PublishOpts configures how the worker publishes metrics to the publish broker
+type PublishOpts struct {
+	Topics *Namespace
+	// Formats are matched in order, topics that match none use the value format
+	Formats []PublishFormat
+	// Deliveries are matched in order, topics that match none use QoS 0 without retain
+	Deliveries []PublishDelivery
+}
+
+// publishMessage is a metric ready to publish to the publish broker
+type publishMessage struct {
+	topic          string
+	payload        []byte
+	qos            byte
+	retain         bool
+	messageExpiry  time.Duration
+	contentType    string
+	userProperties map[string]string
+}
+
+// templateFuncs are available to publish templates
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// ParsePublishFormat parses [filter=]format, where format is value, json,
+// template:<go template> or template-file:<path>
+func ParsePublishFormat(s string) (PublishFormat, error) {
+	var f PublishFormat
+
+	spec := s
+	if filter, rest, ok := strings.Cut(s, "="); ok && !strings.HasPrefix(s, PUBLISH_FORMAT_TEMPLATE) {
+		f.Filter = filter
+		spec = rest
+	}
+
+	switch {
+	case spec == PUBLISH_FORMAT_VALUE, spec == PUBLISH_FORMAT_JSON:
+		f.Format = spec
+	case strings.HasPrefix(spec, PUBLISH_FORMAT_TEMPLATE+"-file:"):
+		path := strings.TrimPrefix(spec, PUBLISH_FORMAT_TEMPLATE+"-file:")
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return f, fmt.Errorf("unable to read publish template, %w", err)
+		}
+		f.Format = PUBLISH_FORMAT_TEMPLATE
+		f.Template = string(b)
+	case strings.HasPrefix(spec, PUBLISH_FORMAT_TEMPLATE+":"):
+		f.Format = PUBLISH_FORMAT_TEMPLATE
+		f.Template = strings.TrimPrefix(spec, PUBLISH_FORMAT_TEMPLATE+":")
+	default:
+		return f, fmt.Errorf("invalid publish format %s, must be one of: %s, %s, %s:<template>, %s-file:<path>", s,
+			PUBLISH_FORMAT_VALUE, PUBLISH_FORMAT_JSON, PUBLISH_FORMAT_TEMPLATE, PUBLISH_FORMAT_TEMPLATE)
+	}
+
+	return f, nil
+}
+
+// ParsePublishDelivery parses comma separated key=value pairs, with the keys
+// filter, qos, retain, expiry, content-type and user-properties, e.g.
+// filter=glowplug/Plant1/#,qos=1,retain=true,expiry=1h
+func ParsePublishDelivery(s string) (PublishDelivery, error) {
+	var d PublishDelivery
+
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return d, fmt.Errorf("invalid publish delivery %s, expected key=value pairs", s)
+		}
+
+		var err error
+		switch key {
+		case "filter":
+			d.Filter = value
+		case "qos":
+			var qos uint64
+			qos, err = strconv.ParseUint(value, 10, 8)
+			d.QoS = byte(qos)
+		case "retain":
+			d.Retain, err = strconv.ParseBool(value)
+		case "expiry":
+			d.MessageExpiry, err = time.ParseDuration(value)
+		case "content-type":
+			d.ContentType = value
+		case "user-properties":
+			d.UserProperties, err = strconv.ParseBool(value)
+		default:
+			return d, fmt.Errorf("invalid publish delivery key %s, must be one of: filter, qos, retain, expiry, content-type, user-properties", key)
+		}
+		if err != nil {
+			return d, fmt.Errorf("invalid publish delivery %s=%s, %w", key, value, err)
+		}
+	}
+
+	return d, nil
+}
+
+// usesV5 returns true if any delivery sets MQTT v5 properties
+func (o *PublishOpts) usesV5() bool {
+	for _, d := range o.Deliveries {
+		if d.MessageExpiry > 0 || len(d.ContentType) > 0 || d.UserProperties {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks and compiles the publish formats and deliveries
+func (o *PublishOpts) Validate() error {
+	for _, d := range o.Deliveries {
+		if len(d.Filter) > 0 {
+			if err := validateTopicFilter(d.Filter); err != nil {
+				return err
+			}
+		}
+		if d.QoS > 2 {
+			return fmt.Errorf("invalid publish qos %d for %s, must be 0, 1 or 2", d.QoS, d.Filter)
+		}
+		if d.MessageExpiry < 0 || d.MessageExpiry%time.Second != 0 {
+			return fmt.Errorf("invalid publish expiry %s for %s, must be whole seconds", d.MessageExpiry, d.Filter)
+		}
+	}
+
+	for i := range o.Formats {
+		f := &o.Formats[i]
+		if len(f.Filter) > 0 {
+			if err := validateTopicFilter(f.Filter); err != nil {
+				return err
+			}
+		}
+		switch f.Format {
+		case PUBLISH_FORMAT_VALUE, PUBLISH_FORMAT_JSON:
+		case PUBLISH_FORMAT_TEMPLATE:
+			tmpl, err := template.New(f.Filter).Funcs(templateFuncs).Option("missingkey=error").Parse(f.Template)
+			if err != nil {
+				return fmt.Errorf("invalid publish template for %s, %w", f.Filter, err)
+			}
+			f.tmpl = tmpl
+		default:
+			return fmt.Errorf("invalid publish format %s", f.Format)
+		}
+	}
+	return nil
+}
+
+// formatFor returns the first format matching a topic
+func (o *PublishOpts) formatFor(topic string) *PublishFormat {
+	for i := range o.Formats {
+		if len(o.Formats[i].Filter) == 0 || topicMatchesFilter(o.Formats[i].Filter, topic) {
+			return &o.Formats[i]
+		}
+	}
+	return nil
+}
+
+// deliveryFor returns the first delivery matching a topic
+func (o *PublishOpts) deliveryFor(topic string) PublishDelivery {
+	for _, d := range o.Deliveries {
+		if len(d.Filter) == 0 || topicMatchesFilter(d.Filter, topic) {
+			return d
+		}
+	}
+	return PublishDelivery{}
+}
+
+// message returns the message published to the publish broker for a metric
+func (o *PublishOpts) message(u MetricUpdate) (publishMessage, error) {
+	publishTopic := o.Topics.Render(u.Topic, u.Name)
+
+	payload, err := o.publishPayload(publishTopic, u)
+	if err != nil {
+		return publishMessage{}, err
+	}
+
+	d := o.deliveryFor(publishTopic)
+	msg := publishMessage{
+		topic:         publishTopic,
+		payload:       payload,
+		qos:           d.QoS,
+		retain:        d.Retain,
+		messageExpiry: d.MessageExpiry,
+		contentType:   d.ContentType,
+	}
+
+	if f := o.formatFor(publishTopic); len(msg.contentType) == 0 && f != nil && f.Format == PUBLISH_FORMAT_JSON {
+		msg.contentType = "application/json"
+	}
+
+	if d.UserProperties {
+		msg.userProperties = map[string]string{
+			"datatype": sparkplug.DataType_name[int32(u.Metric.Datatype)],
+			"source":   u.SourceTopic,
+		}
+	}
+
+	return msg, nil
+}
+
+// metricUnit returns the engineering unit property of a metric, usually
+// sent in its birth only
+func metricUnit(u MetricUpdate) string {
+	set := u.Properties
+	if set == nil {
+		set = u.Metric.GetProperties()
+	}
+	props := propertySetToMap(set)
+	for _, name := range unitProperties {
+		if unit, ok := props[name].(string); ok {
+			return unit
+		}
+	}
+	return ""
+}
+
+// publishPayload returns the payload published to a topic for a metric
+func (o *PublishOpts) publishPayload(publishTopic string, u MetricUpdate) ([]byte, error) {
+
+	f := o.formatFor(publishTopic)
+	if f == nil || f.Format == PUBLISH_FORMAT_VALUE {
+		return u.Value.Bytes(), nil
+	}
+
+	envelope := PublishEnvelope{
+		Value:     u.Value,
+		Timestamp: u.Timestamp(),
+		Datatype:  sparkplug.DataType_name[int32(u.Metric.Datatype)],
+		Quality:   metricQuality(u.Metric),
+		Unit:      metricUnit(u),
+		Source:    u.SourceTopic,
+		Topic:     publishTopic,
+		Name:      u.Name,
+		Group:     u.Topic.GroupId,
+		Node:      u.Topic.EdgeNodeId,
+		Device:    u.Topic.DeviceId,
+	}
+
+	if f.Format == PUBLISH_FORMAT_JSON {
+		return json.Marshal(envelope)
+	}
+
+	var b bytes.Buffer
+	if err := f.tmpl.Execute(&b, envelope); err != nil {
+		return nil, fmt.Errorf("unable to render publish template for %s, %w", publishTopic, err)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/american-factory-os/glowplug/json_type"
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePublishFormat(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    PublishFormat
+		wantErr bool
+	}{
+		{spec: "json", want: PublishFormat{Format: PUBLISH_FORMAT_JSON}},
+		{spec: "glowplug/Plant2/#=value", want: PublishFormat{Filter: "glowplug/Plant2/#", Format: PUBLISH_FORMAT_VALUE}},
+		{spec: "template:{{.Value}} {{.Unit}}", want: PublishFormat{Format: PUBLISH_FORMAT_TEMPLATE, Template: "{{.Value}} {{.Unit}}"}},
+		{spec: "glowplug/+/x=template:a=b", want: PublishFormat{Filter: "glowplug/+/x", Format: PUBLISH_FORMAT_TEMPLATE, Template: "a=b"}},
+		{spec: "xml", wantErr: true},
+		{spec: "template-file:/does/not/exist", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParsePublishFormat(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPublishOptsValidate(t *testing.T) {
+	assert.Error(t, (&PublishOpts{Formats: []PublishFormat{{Filter: "a/#/b", Format: PUBLISH_FORMAT_JSON}}}).Validate())
+	assert.Error(t, (&PublishOpts{Formats: []PublishFormat{{Format: PUBLISH_FORMAT_TEMPLATE, Template: "{{.Value"}}}).Validate())
+	assert.Error(t, (&PublishOpts{Formats: []PublishFormat{{Format: "xml"}}}).Validate())
+}
+
+func TestPublishPayload(t *testing.T) {
+	opts := PublishOpts{Formats: []PublishFormat{
+		{Filter: "glowplug/Plant2/#", Format: PUBLISH_FORMAT_VALUE},
+		{Filter: "glowplug/+/Heater/#", Format: PUBLISH_FORMAT_TEMPLATE, Template: `{{.Name}}={{.Value}}{{.Unit}} from {{.Node}}`},
+		{Format: PUBLISH_FORMAT_JSON},
+	}}
+	require.NoError(t, opts.Validate())
+
+	metric := floatMetric("Celsius", 98.5)
+	metric.Timestamp = 1700000000000
+	metric.Properties = &sparkplug.Payload_PropertySet{
+		Keys:   []string{"engUnit"},
+		Values: []*sparkplug.Payload_PropertyValue{{Value: &sparkplug.Payload_PropertyValue_StringValue{StringValue: "C"}}},
+	}
+	value, err := json_type.MetricValueToJsonType(metric)
+	require.NoError(t, err)
+
+	topic := sparkplug.Topic{GroupId: "Plant1", EdgeNodeId: "Heater", DeviceId: "TempSensor", HasDevice: true}
+	u := MetricUpdate{Topic: topic, Name: "Celsius", SourceTopic: "spBv1.0/Plant1/DDATA/Heater/TempSensor", Payload: &sparkplug.Payload{}, Metric: metric, Value: value}
+
+	payload, err := opts.publishPayload("glowplug/Plant2/Heater/Celsius", u)
+	require.NoError(t, err)
+	assert.Equal(t, "98.5", string(payload))
+
+	payload, err = opts.publishPayload("glowplug/Plant1/Heater/TempSensor/Celsius", u)
+	require.NoError(t, err)
+	assert.Equal(t, "Celsius=98.5C from Heater", string(payload))
+
+	payload, err = opts.publishPayload("glowplug/Plant1/Mixer/Celsius", u)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"value":98.5,"timestamp":1700000000000,"datatype":"Float","quality":192,"unit":"C","source":"spBv1.0/Plant1/DDATA/Heater/TempSensor"}`, string(payload))
+
+	// no formats publishes the bare value
+	payload, err = (&PublishOpts{}).publishPayload("glowplug/x", u)
+	require.NoError(t, err)
+	assert.Equal(t, "98.5", string(payload))
+
+	// data without properties has the unit of its birth
+	u.Properties = metric.Properties
+	u.Metric = floatMetric("Celsius", 99)
+	payload, err = opts.publishPayload("glowplug/Plant1/Heater/TempSensor/Celsius", u)
+	require.NoError(t, err)
+	assert.Equal(t, "Celsius=98.5C from Heater", string(payload))
+}
+
+func TestParsePublishDelivery(t *testing.T) {
+	d, err := ParsePublishDelivery("filter=glowplug/Plant1/#,qos=1,retain=true,expiry=1h,content-type=text/plain,user-properties=true")
+	require.NoError(t, err)
+	assert.Equal(t, PublishDelivery{
+		Filter:         "glowplug/Plant1/#",
+		QoS:            1,
+		Retain:         true,
+		MessageExpiry:  time.Hour,
+		ContentType:    "text/plain",
+		UserProperties: true,
+	}, d)
+
+	for _, spec := range []string{"qos", "qos=x", "retain=maybe", "expiry=soon", "priority=1"} {
+		_, err := ParsePublishDelivery(spec)
+		assert.Error(t, err, spec)
+	}
+
+	assert.Error(t, (&PublishOpts{Deliveries: []PublishDelivery{{QoS: 3}}}).Validate())
+	assert.Error(t, (&PublishOpts{Deliveries: []PublishDelivery{{MessageExpiry: 1500 * time.Millisecond}}}).Validate())
+	assert.Error(t, (&PublishOpts{Deliveries: []PublishDelivery{{Filter: "a/b#"}}}).Validate())
+}
+
+func TestPublishMessage(t *testing.T) {
+	topics, err := NewTopicNamespace(DefaultTopicFormat())
+	require.NoError(t, err)
+
+	opts := PublishOpts{
+		Topics:  topics,
+		Formats: []PublishFormat{{Filter: "glowplug/Plant1/#", Format: PUBLISH_FORMAT_JSON}},
+		Deliveries: []PublishDelivery{
+			{Filter: "glowplug/Plant1/#", QoS: 1, Retain: true, MessageExpiry: time.Minute, UserProperties: true},
+		},
+	}
+	require.NoError(t, opts.Validate())
+	assert.True(t, opts.usesV5())
+
+	metric := floatMetric("Celsius", 98.5)
+	value, err := json_type.MetricValueToJsonType(metric)
+	require.NoError(t, err)
+	u := MetricUpdate{Topic: sparkplug.Topic{GroupId: "Plant1", EdgeNodeId: "Heater"}, Name: "Celsius", SourceTopic: "spBv1.0/Plant1/NDATA/Heater", Payload: &sparkplug.Payload{}, Metric: metric, Value: value}
+
+	msg, err := opts.message(u)
+	require.NoError(t, err)
+	assert.Equal(t, "glowplug/Plant1/Heater/Celsius", msg.topic)
+	assert.Equal(t, byte(1), msg.qos)
+	assert.True(t, msg.retain)
+	assert.Equal(t, time.Minute, msg.messageExpiry)
+	assert.Equal(t, "application/json", msg.contentType)
+	assert.Equal(t, map[string]string{"datatype": "Float", "source": "spBv1.0/Plant1/NDATA/Heater"}, msg.userProperties)
+
+	u.Topic.GroupId = "Plant2"
+	msg, err = opts.message(u)
+	require.NoError(t, err)
+	assert.Equal(t, "98.5", string(msg.payload))
+	assert.Equal(t, byte(0), msg.qos)
+	assert.False(t, msg.retain)
+	assert.Empty(t, msg.contentType)
+	assert.Nil(t, msg.userProperties)
+}
@@ -2,8 +2,13 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/american-factory-os/glowplug/sparkplug"
 	"github.com/redis/go-redis/v9"
@@ -18,6 +23,35 @@ const (
 	keyPrefix    = "glowplug"
 )
 
+// RedisLayout determines how metric values are stored in redis
+type RedisLayout string
+
+const (
+	// REDIS_LAYOUT_SET stores the bare JSON value of a metric with SET
+	REDIS_LAYOUT_SET RedisLayout = "set"
+	// REDIS_LAYOUT_HASH stores a record of each metric in a redis hash
+	REDIS_LAYOUT_HASH RedisLayout = "hash"
+)
+
+// Sparkplug property name holding OPC style quality codes
+const propertyQuality = "Quality"
+
+// default quality when a metric has no quality property, OPC "good"
+const qualityGood = 192
+
+// ParseRedisLayout returns a RedisLayout from a string, an empty string
+// returns the default set layout
+func ParseRedisLayout(s string) (RedisLayout, error) {
+	switch RedisLayout(strings.ToLower(s)) {
+	case "", REDIS_LAYOUT_SET:
+		return REDIS_LAYOUT_SET, nil
+	case REDIS_LAYOUT_HASH:
+		return REDIS_LAYOUT_HASH, nil
+	default:
+		return "", fmt.Errorf("invalid redis layout %s, must be one of: %s, %s", s, REDIS_LAYOUT_SET, REDIS_LAYOUT_HASH)
+	}
+}
+
 // normalizeKey ensures redis keys are in a standard format
 func normalizeKey(ns string) string {
 	ns = strings.ReplaceAll(ns, " ", "_")
@@ -25,41 +59,244 @@ func normalizeKey(ns string) string {
 	return strings.ToLower(ns)
 }
 
-// keyFromSparkplugMetric returns a namespace for a given SparkplugB metric
-func keyFromSparkplugMetric(topic sparkplug.Topic, metric *sparkplug.Payload_Metric) string {
+// propertyValue returns the go value of a sparkplug property value
+func propertyValue(value *sparkplug.Payload_PropertyValue) interface{} {
+	if value == nil || value.IsNull {
+		return nil
+	}
+	switch v := value.Value.(type) {
+	case *sparkplug.Payload_PropertyValue_IntValue:
+		return v.IntValue
+	case *sparkplug.Payload_PropertyValue_LongValue:
+		return v.LongValue
+	case *sparkplug.Payload_PropertyValue_FloatValue:
+		return v.FloatValue
+	case *sparkplug.Payload_PropertyValue_DoubleValue:
+		return v.DoubleValue
+	case *sparkplug.Payload_PropertyValue_BooleanValue:
+		return v.BooleanValue
+	case *sparkplug.Payload_PropertyValue_StringValue:
+		return v.StringValue
+	case *sparkplug.Payload_PropertyValue_PropertysetValue:
+		return propertySetToMap(v.PropertysetValue)
+	default:
+		return nil
+	}
+}
+
+// propertySetToMap converts a sparkplug property set to a map of property names to values
+func propertySetToMap(ps *sparkplug.Payload_PropertySet) map[string]interface{} {
+	if ps == nil {
+		return nil
+	}
+	props := make(map[string]interface{}, len(ps.Keys))
+	for i, key := range ps.Keys {
+		if i >= len(ps.Values) {
+			break
+		}
+		props[key] = propertyValue(ps.Values[i])
+	}
+	return props
+}
+
+// metricQuality returns the quality property of a metric, defaults to good
+func metricQuality(metric *sparkplug.Payload_Metric) int64 {
+	props := propertySetToMap(metric.GetProperties())
+	switch q := props[propertyQuality].(type) {
+	case uint32:
+		return int64(int32(q))
+	case uint64:
+		return int64(q)
+	}
+	return qualityGood
+}
+
+// metricRecord returns the fields stored in a redis hash for a metric. The
+// properties are replaced by births and by data carrying properties, data
+// without properties keeps those of the birth, such as engUnit.
+func metricRecord(u MetricUpdate) (map[string]interface{}, error) {
+	metric := u.Metric
 
-	var b strings.Builder
-	b.WriteString(keyPrefix)
-	b.WriteString(keyDelimiter)
+	valueJSON, err := u.Value.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal value of %s, %w", metric.Name, err)
+	}
 
-	b.WriteString(topic.GroupId)
-	b.WriteString(keyDelimiter)
-	b.WriteString(topic.EdgeNodeId)
-	if topic.HasDevice {
-		b.WriteString(keyDelimiter)
-		b.WriteString(topic.DeviceId)
+	received := u.Received
+	if received.IsZero() {
+		received = time.Now()
 	}
 
-	b.WriteString(keyDelimiter)
-	b.WriteString(normalizeKey(metric.Name))
+	record := map[string]interface{}{
+		"value":     string(valueJSON),
+		"datatype":  sparkplug.DataType_name[int32(metric.Datatype)],
+		"timestamp": u.Timestamp(),
+		"received":  received.UnixMilli(),
+		"seq":       u.Payload.GetSeq(),
+		"quality":   metricQuality(metric),
+		"alias":     metric.GetAlias(),
+		"topic":     u.SourceTopic,
+		"status":    METRIC_STATUS_ONLINE,
+	}
 
-	return normalizeKey(b.String())
+	props := propertySetToMap(metric.GetProperties())
+	birth := u.Topic.Command == sparkplug.NBIRTH || u.Topic.Command == sparkplug.DBIRTH
+	if len(props) > 0 || birth {
+		properties := "{}"
+		if len(props) > 0 {
+			b, err := json.Marshal(props)
+			if err != nil {
+				return nil, fmt.Errorf("unable to marshal properties of %s, %w", metric.Name, err)
+			}
+			properties = string(b)
+		}
+		record["properties"] = properties
+	}
+	return record, nil
 }
 
-func NewRedis(url string) (*redis.UniversalClient, error) {
+// Query parameters glowplug reads from a redis URL, all other parameters are
+// passed to the go-redis URL parser, e.g. dial_timeout, pool_size
+const (
+	redisParamMasterName       = "master_name"
+	redisParamSentinelUsername = "sentinel_username"
+	redisParamSentinelPassword = "sentinel_password"
+	redisParamCluster          = "cluster"
+)
 
-	redisOpts, urlErr := redis.ParseURL(url)
-	if urlErr != nil {
-		return nil, fmt.Errorf("unable to parse redis URL, %w", urlErr)
+const defaultRedisPort = "6379"
+
+// redisOptionsFromURL parses a redis URL into options for a universal client.
+// The URL format extends the go-redis format to accept multiple addresses
+// and sentinel settings:
+//
+//	redis[s]://[[username]:password@]host[:port][,host[:port]...][/db][?options]
+//
+// A single address connects to a standalone server. Multiple addresses, or the
+// option cluster=true, connect to a Redis Cluster using the addresses as seeds.
+// The option master_name=<name> connects through Redis Sentinel using the
+// addresses as sentinels, with optional sentinel_username and sentinel_password.
+// The rediss scheme enables TLS, username and password are used for ACL auth.
+func redisOptionsFromURL(rawURL string) (opts *redis.UniversalOptions, cluster bool, err error) {
+
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return nil, false, fmt.Errorf("invalid redis URL, missing scheme")
+	}
+	if scheme != "redis" && scheme != "rediss" {
+		return nil, false, fmt.Errorf("invalid redis URL scheme: %s", scheme)
 	}
 
-	opts := redis.UniversalOptions{
-		Addrs: []string{redisOpts.Addr},
+	rest, rawQuery, _ := strings.Cut(rest, "?")
+	authority, path, _ := strings.Cut(rest, "/")
+
+	userInfo := ""
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userInfo = authority[:i+1]
+		authority = authority[i+1:]
+	}
+
+	var addrs []string
+	for _, host := range strings.Split(authority, ",") {
+		if len(host) == 0 {
+			return nil, false, fmt.Errorf("invalid redis URL, empty address")
+		}
+		if _, _, splitErr := net.SplitHostPort(host); splitErr != nil {
+			host = net.JoinHostPort(host, defaultRedisPort)
+		}
+		addrs = append(addrs, host)
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid redis URL options, %w", err)
+	}
+
+	masterName := query.Get(redisParamMasterName)
+	sentinelUsername := query.Get(redisParamSentinelUsername)
+	sentinelPassword := query.Get(redisParamSentinelPassword)
+	if v := query.Get(redisParamCluster); len(v) > 0 {
+		if cluster, err = strconv.ParseBool(v); err != nil {
+			return nil, false, fmt.Errorf("invalid redis URL option %s=%s", redisParamCluster, v)
+		}
+	}
+	for _, param := range []string{redisParamMasterName, redisParamSentinelUsername, redisParamSentinelPassword, redisParamCluster} {
+		query.Del(param)
+	}
+
+	// let go-redis parse credentials, db, tls and connection options
+	single := scheme + "://" + userInfo + addrs[0] + "/" + path
+	if len(query) > 0 {
+		single += "?" + query.Encode()
+	}
+	parsed, err := redis.ParseURL(single)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to parse redis URL, %w", err)
+	}
+
+	if len(masterName) == 0 && len(addrs) > 1 {
+		cluster = true
 	}
 
-	rdb := redis.NewUniversalClient(&opts)
+	if cluster && len(masterName) > 0 {
+		return nil, false, fmt.Errorf("redis URL can not use both %s and %s", redisParamCluster, redisParamMasterName)
+	}
+
+	if cluster && parsed.DB != 0 {
+		return nil, false, fmt.Errorf("redis cluster does not support selecting database %d", parsed.DB)
+	}
+
+	// the server name is inferred from each address when there is more than one
+	if parsed.TLSConfig != nil && len(addrs) > 1 {
+		parsed.TLSConfig.ServerName = ""
+	}
+
+	return &redis.UniversalOptions{
+		Addrs:            addrs,
+		ClientName:       parsed.ClientName,
+		DB:               parsed.DB,
+		Protocol:         parsed.Protocol,
+		Username:         parsed.Username,
+		Password:         parsed.Password,
+		SentinelUsername: sentinelUsername,
+		SentinelPassword: sentinelPassword,
+		MaxRetries:       parsed.MaxRetries,
+		MinRetryBackoff:  parsed.MinRetryBackoff,
+		MaxRetryBackoff:  parsed.MaxRetryBackoff,
+		DialTimeout:      parsed.DialTimeout,
+		ReadTimeout:      parsed.ReadTimeout,
+		WriteTimeout:     parsed.WriteTimeout,
+		PoolFIFO:         parsed.PoolFIFO,
+		PoolSize:         parsed.PoolSize,
+		PoolTimeout:      parsed.PoolTimeout,
+		MinIdleConns:     parsed.MinIdleConns,
+		MaxIdleConns:     parsed.MaxIdleConns,
+		MaxActiveConns:   parsed.MaxActiveConns,
+		ConnMaxIdleTime:  parsed.ConnMaxIdleTime,
+		ConnMaxLifetime:  parsed.ConnMaxLifetime,
+		TLSConfig:        parsed.TLSConfig,
+		MasterName:       masterName,
+	}, cluster, nil
+}
+
+// NewRedis returns a redis client for a standalone, sentinel or cluster
+// deployment, see redisOptionsFromURL for the URL format
+func NewRedis(url string) (*redis.UniversalClient, error) {
+
+	opts, cluster, err := redisOptionsFromURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var rdb redis.UniversalClient
+	if cluster {
+		// a single seed address would otherwise create a standalone client
+		rdb = redis.NewClusterClient(opts.Cluster())
+	} else {
+		rdb = redis.NewUniversalClient(opts)
+	}
 
-	err := rdb.Ping(context.TODO()).Err()
+	err = rdb.Ping(context.TODO()).Err()
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to redis, %w", err)
 	}
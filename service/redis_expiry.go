@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// ZSET_NODES scores each edge node by when it was last seen, in unix milliseconds
+	ZSET_NODES = "glowplug:nodes"
+	// ZSET_METRICS_UPDATED scores each metric key by when it was last updated, in unix milliseconds
+	ZSET_METRICS_UPDATED = "glowplug:metrics_updated"
+	// HASH_METRIC_STATUS holds the status of each metric key when using the set layout
+	HASH_METRIC_STATUS = "glowplug:metric_status"
+)
+
+// prefix of the hashes that map the metric keys of an edge node to their device id
+const nodeKeysPrefix = "glowplug:node_keys"
+
+// Metric status values stored in a hash record or in HASH_METRIC_STATUS
+const (
+	METRIC_STATUS_ONLINE  = "online"
+	METRIC_STATUS_OFFLINE = "offline"
+	METRIC_STATUS_STALE   = "stale"
+)
+
+// RedisExpirePolicy determines what happens to redis keys when an edge node
+// or device dies, or when a metric has not been updated in a while
+type RedisExpirePolicy string
+
+const (
+	// REDIS_EXPIRE_NONE keeps keys forever
+	REDIS_EXPIRE_NONE RedisExpirePolicy = "none"
+	// REDIS_EXPIRE_TTL sets a TTL on keys when they are written and when they die
+	REDIS_EXPIRE_TTL RedisExpirePolicy = "ttl"
+	// REDIS_EXPIRE_DELETE deletes keys when they die or become stale
+	REDIS_EXPIRE_DELETE RedisExpirePolicy = "delete"
+	// REDIS_EXPIRE_STALE marks keys offline when they die and stale when not updated
+	REDIS_EXPIRE_STALE RedisExpirePolicy = "stale"
+)
+
+// ParseRedisExpirePolicy returns a RedisExpirePolicy from a string, an empty
+// string returns the default none policy
+func ParseRedisExpirePolicy(s string) (RedisExpirePolicy, error) {
+	switch p := RedisExpirePolicy(strings.ToLower(s)); p {
+	case "":
+		return REDIS_EXPIRE_NONE, nil
+	case REDIS_EXPIRE_NONE, REDIS_EXPIRE_TTL, REDIS_EXPIRE_DELETE, REDIS_EXPIRE_STALE:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid redis expire policy %s, must be one of: %s, %s, %s, %s", s,
+			REDIS_EXPIRE_NONE, REDIS_EXPIRE_TTL, REDIS_EXPIRE_DELETE, REDIS_EXPIRE_STALE)
+	}
+}
+
+// RedisOpts configures how the worker stores metrics in redis
+type RedisOpts struct {
+	// Keys renders metric keys, defaults to DefaultKeyFormat
+	Keys         *Namespace
+	Layout       RedisLayout
+	ExpirePolicy RedisExpirePolicy
+	// ExpireAfter is the TTL of the ttl policy, and the age after which a metric
+	// is stale for the delete and stale policies. Zero disables stale detection.
+	ExpireAfter time.Duration
+}
+
+// Validate returns an error if the options are inconsistent
+func (o RedisOpts) Validate() error {
+	if o.ExpireAfter < 0 {
+		return fmt.Errorf("redis expire after must not be negative")
+	}
+	if o.ExpirePolicy == REDIS_EXPIRE_TTL && o.ExpireAfter < time.Second {
+		return fmt.Errorf("redis expire policy %s requires an expire after duration of at least 1s", REDIS_EXPIRE_TTL)
+	}
+	return nil
+}
+
+// tracksUpdates returns true when the time of each metric update is needed to find stale metrics
+func (o RedisOpts) tracksUpdates() bool {
+	return o.ExpireAfter > 0 && (o.ExpirePolicy == REDIS_EXPIRE_DELETE || o.ExpirePolicy == REDIS_EXPIRE_STALE)
+}
+
+// nodeKeyFromTopic returns the member of ZSET_NODES for the edge node of a
+// topic, prefixed with the name of its source broker when it has one
+func nodeKeyFromTopic(topic sparkplug.Topic) string {
+	if len(topic.Source) > 0 {
+		return normalizeKey(topic.Source + keyDelimiter + topic.GroupId + keyDelimiter + topic.EdgeNodeId)
+	}
+	return normalizeKey(topic.GroupId + keyDelimiter + topic.EdgeNodeId)
+}
+
+// nodeKeysHash returns the hash mapping metric keys of an edge node to their device id
+func nodeKeysHash(nodeKey string) string {
+	return nodeKeysPrefix + keyDelimiter + nodeKey
+}
+
+// setStatusScript sets the status field of a hash record only if the record still exists
+var setStatusScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HSET", KEYS[1], "status", ARGV[1])
+end
+return 0
+`)
+
+// sweepInterval returns how often stale metrics are looked for
+func sweepInterval(expireAfter time.Duration) time.Duration {
+	interval := expireAfter / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// trackMetric queues the bookkeeping commands for a metric update, topic and
+// source are the metric's identity as received, before any mapping rules
+func (s *redisSink) trackMetric(ctx context.Context, pipe redis.Pipeliner, topic sparkplug.Topic, source MetricIdentity, key string, trackNode bool, seen bool, now time.Time) {
+	nodeKey := nodeKeyFromTopic(topic)
+
+	if trackNode {
+		pipe.ZAdd(ctx, ZSET_NODES, redis.Z{Score: float64(now.UnixMilli()), Member: nodeKey})
+	}
+
+	if !seen {
+		pipe.HSet(ctx, nodeKeysHash(nodeKey), key, topic.DeviceId)
+		if identity, err := json.Marshal(source); err == nil {
+			pipe.HSet(ctx, HASH_NAMESPACE, key, identity)
+		}
+		s.nodeOfKey.Store(key, nodeKey)
+	}
+
+	if s.opts.tracksUpdates() {
+		pipe.ZAdd(ctx, ZSET_METRICS_UPDATED, redis.Z{Score: float64(now.UnixMilli()), Member: key})
+	}
+
+	if s.opts.ExpirePolicy == REDIS_EXPIRE_STALE && s.opts.Layout == REDIS_LAYOUT_SET {
+		pipe.HSet(ctx, HASH_METRIC_STATUS, key, METRIC_STATUS_ONLINE)
+	}
+
+	if s.opts.ExpirePolicy == REDIS_EXPIRE_TTL && s.opts.Layout == REDIS_LAYOUT_HASH {
+		pipe.Expire(ctx, key, s.opts.ExpireAfter)
+	}
+}
+
+// markStatus queues commands to set the status of metric keys
+func (s *redisSink) markStatus(ctx context.Context, pipe redis.Pipeliner, keys []string, status string) {
+	for _, key := range keys {
+		if s.opts.Layout == REDIS_LAYOUT_HASH {
+			setStatusScript.Eval(ctx, pipe, []string{key}, status)
+		} else {
+			pipe.HSet(ctx, HASH_METRIC_STATUS, key, status)
+		}
+	}
+}
+
+// deleteKeys queues commands to delete metric keys and their bookkeeping
+func deleteKeys(ctx context.Context, pipe redis.Pipeliner, nodeKey string, keys []string) {
+	for _, key := range keys {
+		pipe.Del(ctx, key)
+		pipe.HDel(ctx, HASH_METRIC_TYPES, key)
+		pipe.HDel(ctx, HASH_METRIC_STATUS, key)
+		pipe.HDel(ctx, HASH_NAMESPACE, key)
+		if len(nodeKey) > 0 {
+			pipe.HDel(ctx, nodeKeysHash(nodeKey), key)
+		}
+		pipe.ZRem(ctx, ZSET_METRICS_UPDATED, key)
+	}
+}
+
+// execPipeline runs queued commands and returns the first error
+func execPipeline(ctx context.Context, rdb redis.UniversalClient, queue func(pipe redis.Pipeliner)) error {
+	cmds, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		queue(pipe)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			return fmt.Errorf("redis cmd error %w", cmd.Err())
+		}
+	}
+	return nil
+}
+
+// processDeath applies the expire policy to the metric keys of a dead edge
+// node, including all of its devices, or of a dead device
+func (s *redisSink) processDeath(ctx context.Context, topic sparkplug.Topic) error {
+	rdb := s.rdb
+
+	nodeKey := nodeKeyFromTopic(topic)
+	owners, err := rdb.HGetAll(ctx, nodeKeysHash(nodeKey)).Result()
+	if err != nil {
+		return fmt.Errorf("unable to read keys of %s, %w", nodeKey, err)
+	}
+
+	var keys []string
+	for key, deviceId := range owners {
+		if topic.Command == sparkplug.NDEATH || deviceId == topic.DeviceId {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err = execPipeline(ctx, rdb, func(pipe redis.Pipeliner) {
+		switch s.opts.ExpirePolicy {
+		case REDIS_EXPIRE_DELETE:
+			deleteKeys(ctx, pipe, nodeKey, keys)
+		case REDIS_EXPIRE_TTL:
+			for _, key := range keys {
+				pipe.Expire(ctx, key, s.opts.ExpireAfter)
+			}
+			if s.opts.Layout == REDIS_LAYOUT_HASH {
+				s.markStatus(ctx, pipe, keys, METRIC_STATUS_OFFLINE)
+			}
+		case REDIS_EXPIRE_STALE:
+			s.markStatus(ctx, pipe, keys, METRIC_STATUS_OFFLINE)
+		default:
+			// hash records always report when their node is offline
+			if s.opts.Layout == REDIS_LAYOUT_HASH {
+				s.markStatus(ctx, pipe, keys, METRIC_STATUS_OFFLINE)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.opts.ExpirePolicy == REDIS_EXPIRE_DELETE {
+		// forget deleted keys so they are tracked again after a rebirth
+		for _, key := range keys {
+			s.seen.Delete(key)
+			s.nodeOfKey.Delete(key)
+		}
+	}
+
+	s.logger.Printf("%s %s, applied redis expire policy %s to %d keys\n", topic.Command, nodeKey, s.opts.ExpirePolicy, len(keys))
+
+	return nil
+}
+
+// sweepStaleMetrics deletes or marks metrics that have not been updated since
+// the expire after duration
+func (s *redisSink) sweepStaleMetrics(ctx context.Context, now time.Time) (int, error) {
+	if !s.opts.tracksUpdates() {
+		return 0, nil
+	}
+	rdb := s.rdb
+
+	cutoff := now.Add(-s.opts.ExpireAfter).UnixMilli()
+	keys, err := rdb.ZRangeByScore(ctx, ZSET_METRICS_UPDATED, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff, 10),
+	}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("unable to find stale metrics, %w", err)
+	}
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	if s.opts.ExpirePolicy == REDIS_EXPIRE_DELETE {
+		// the owning node is needed to clean up the node keys hash, keys
+		// written before a restart are left there until pruned
+		byNode := map[string][]string{}
+		for _, key := range keys {
+			nodeKey := ""
+			if v, ok := s.nodeOfKey.Load(key); ok {
+				nodeKey = v.(string)
+			}
+			byNode[nodeKey] = append(byNode[nodeKey], key)
+		}
+		err = execPipeline(ctx, rdb, func(pipe redis.Pipeliner) {
+			for nodeKey, nodeKeys := range byNode {
+				deleteKeys(ctx, pipe, nodeKey, nodeKeys)
+			}
+		})
+		for _, key := range keys {
+			s.seen.Delete(key)
+			s.nodeOfKey.Delete(key)
+		}
+	} else {
+		err = execPipeline(ctx, rdb, func(pipe redis.Pipeliner) {
+			s.markStatus(ctx, pipe, keys, METRIC_STATUS_STALE)
+			// stale metrics are tracked again on their next update
+			for _, key := range keys {
+				pipe.ZRem(ctx, ZSET_METRICS_UPDATED, key)
+			}
+		})
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// PruneResult reports what PruneRedis removed
+type PruneResult struct {
+	Nodes []string
+	Keys  int
+}
+
+// PruneRedis removes the metric keys of edge nodes that have not been seen
+// since olderThan, along with their bookkeeping under the glowplug prefix.
+// When dryRun is true nothing is removed.
+func PruneRedis(ctx context.Context, rdb redis.UniversalClient, olderThan time.Duration, dryRun bool, logger *log.Logger) (PruneResult, error) {
+	var result PruneResult
+
+	if olderThan <= 0 {
+		return result, fmt.Errorf("prune window must be greater than zero")
+	}
+
+	cutoff := time.Now().Add(-olderThan).UnixMilli()
+	nodes, err := rdb.ZRangeByScore(ctx, ZSET_NODES, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff, 10),
+	}).Result()
+	if err != nil {
+		return result, fmt.Errorf("unable to find nodes to prune, %w", err)
+	}
+
+	for _, nodeKey := range nodes {
+		keys, err := rdb.HKeys(ctx, nodeKeysHash(nodeKey)).Result()
+		if err != nil {
+			return result, fmt.Errorf("unable to read keys of %s, %w", nodeKey, err)
+		}
+
+		if logger != nil {
+			logger.Printf("pruning %s, %d keys\n", nodeKey, len(keys))
+		}
+
+		if !dryRun {
+			err = execPipeline(ctx, rdb, func(pipe redis.Pipeliner) {
+				deleteKeys(ctx, pipe, nodeKey, keys)
+				pipe.Del(ctx, nodeKeysHash(nodeKey), aliasesHash(nodeKey), nodeOwnerKey(nodeKey))
+				pipe.HDel(ctx, HASH_NODE_SESSIONS, nodeKey)
+				pipe.ZRem(ctx, ZSET_NODES, nodeKey)
+			})
+			if err != nil {
+				return result, fmt.Errorf("unable to prune %s, %w", nodeKey, err)
+			}
+		}
+
+		result.Nodes = append(result.Nodes, nodeKey)
+		result.Keys += len(keys)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRedisTestWorker(t *testing.T, opts RedisOpts) (*worker, *redisSink, redis.UniversalClient) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{mr.Addr()}})
+	t.Cleanup(func() { rdb.Close() })
+
+	logger := log.New(io.Discard, "", 0)
+	sink, err := newRedisSink(logger, SINK_REDIS, rdb, opts)
+	require.NoError(t, err)
+	wIface, err := NewWorker(logger, WorkerOpts{Redis: &rdb, Sinks: []Sink{sink}})
+	require.NoError(t, err)
+	return wIface.(*worker), sink, rdb
+}
+
+func testResult(t *testing.T, rawTopic string, metrics ...*sparkplug.Payload_Metric) Result {
+	t.Helper()
+	topic, err := sparkplug.ToTopic(rawTopic)
+	require.NoError(t, err)
+	return Result{
+		SourceTopic: rawTopic,
+		Topic:       topic,
+		Payload:     &sparkplug.Payload{Metrics: metrics},
+	}
+}
+
+// processQueued processes a result with a worker that is not running and
+// writes the items it queued for the sinks, as the sink runners would
+func processQueued(w *worker, result Result) error {
+	err := w.processResult(result)
+	ctx := context.Background()
+	for _, r := range w.sinks {
+		for len(r.queue.ch) > 0 {
+			if item := <-r.queue.ch; item.event != nil {
+				r.session(ctx, *item.event)
+			} else {
+				r.write(ctx, item.updates)
+			}
+		}
+	}
+	return err
+}
+
+func floatMetric(name string, value float32) *sparkplug.Payload_Metric {
+	return &sparkplug.Payload_Metric{
+		Name:     name,
+		Datatype: sparkplug.DataType_Float.Uint32(),
+		Value:    &sparkplug.Payload_Metric_FloatValue{FloatValue: value},
+	}
+}
+
+// birthNodeAndDevice stores one node metric and one device metric
+func birthNodeAndDevice(t *testing.T, w *worker) {
+	t.Helper()
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", floatMetric("Voltage", 230))))
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant1/DBIRTH/Heater/TempSensor", floatMetric("Celsius", 98.6))))
+}
+
+const (
+	testNodeMetricKey   = "glowplug:plant1:heater:voltage"
+	testDeviceMetricKey = "glowplug:plant1:heater:tempsensor:celsius"
+)
+
+func TestRedisOptsValidate(t *testing.T) {
+	assert.NoError(t, RedisOpts{ExpirePolicy: REDIS_EXPIRE_NONE}.Validate())
+	assert.NoError(t, RedisOpts{ExpirePolicy: REDIS_EXPIRE_DELETE}.Validate())
+	assert.NoError(t, RedisOpts{ExpirePolicy: REDIS_EXPIRE_TTL, ExpireAfter: time.Minute}.Validate())
+	assert.Error(t, RedisOpts{ExpirePolicy: REDIS_EXPIRE_TTL}.Validate())
+	assert.Error(t, RedisOpts{ExpireAfter: -time.Second}.Validate())
+
+	_, err := ParseRedisExpirePolicy("forever")
+	assert.Error(t, err)
+}
+
+func TestRedisExpireDeleteOnDeath(t *testing.T) {
+	ctx := context.Background()
+	w, _, rdb := newRedisTestWorker(t, RedisOpts{Layout: REDIS_LAYOUT_SET, ExpirePolicy: REDIS_EXPIRE_DELETE})
+	birthNodeAndDevice(t, w)
+
+	assert.Equal(t, int64(2), rdb.Exists(ctx, testNodeMetricKey, testDeviceMetricKey).Val())
+	assert.Equal(t, []string{"plant1:heater"}, rdb.ZRange(ctx, ZSET_NODES, 0, -1).Val())
+
+	// device death only removes device metrics
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant1/DDEATH/Heater/TempSensor")))
+	assert.Equal(t, int64(1), rdb.Exists(ctx, testNodeMetricKey).Val())
+	assert.Equal(t, int64(0), rdb.Exists(ctx, testDeviceMetricKey).Val())
+	assert.False(t, rdb.HExists(ctx, HASH_METRIC_TYPES, testDeviceMetricKey).Val())
+
+	// device metrics are tracked again after a rebirth
+	birthNodeAndDevice(t, w)
+	assert.True(t, rdb.HExists(ctx, HASH_METRIC_TYPES, testDeviceMetricKey).Val())
+
+	// node death removes all metrics of the node
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant1/NDEATH/Heater")))
+	assert.Equal(t, int64(0), rdb.Exists(ctx, testNodeMetricKey, testDeviceMetricKey).Val())
+	assert.Equal(t, int64(0), rdb.HLen(ctx, nodeKeysHash("plant1:heater")).Val())
+}
+
+func TestRedisExpireStale(t *testing.T) {
+	ctx := context.Background()
+	w, sink, rdb := newRedisTestWorker(t, RedisOpts{Layout: REDIS_LAYOUT_HASH, ExpirePolicy: REDIS_EXPIRE_STALE, ExpireAfter: time.Minute})
+	birthNodeAndDevice(t, w)
+
+	assert.Equal(t, METRIC_STATUS_ONLINE, rdb.HGet(ctx, testDeviceMetricKey, "status").Val())
+
+	// nothing is stale yet
+	n, err := sink.sweepStaleMetrics(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = sink.sweepStaleMetrics(ctx, time.Now().Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, METRIC_STATUS_STALE, rdb.HGet(ctx, testDeviceMetricKey, "status").Val())
+	assert.Equal(t, "98.6", rdb.HGet(ctx, testDeviceMetricKey, "value").Val())
+
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant1/NDEATH/Heater")))
+	assert.Equal(t, METRIC_STATUS_OFFLINE, rdb.HGet(ctx, testNodeMetricKey, "status").Val())
+	assert.Equal(t, METRIC_STATUS_OFFLINE, rdb.HGet(ctx, testDeviceMetricKey, "status").Val())
+}
+
+func TestRedisHashKeepsBirthProperties(t *testing.T) {
+	ctx := context.Background()
+	w, _, rdb := newRedisTestWorker(t, RedisOpts{Layout: REDIS_LAYOUT_HASH, ExpirePolicy: REDIS_EXPIRE_NONE})
+	voltage := floatMetric("Voltage", 230)
+	voltage.Properties = &sparkplug.Payload_PropertySet{
+		Keys:   []string{"engUnit"},
+		Values: []*sparkplug.Payload_PropertyValue{{Type: sparkplug.DataType_String.Uint32(), Value: &sparkplug.Payload_PropertyValue_StringValue{StringValue: "V"}}},
+	}
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", voltage)))
+	assert.JSONEq(t, `{"engUnit":"V"}`, rdb.HGet(ctx, testNodeMetricKey, "properties").Val())
+
+	data := testResult(t, "spBv1.0/Plant1/NDATA/Heater", floatMetric("Voltage", 231))
+	data.Payload.Seq = 1
+	require.NoError(t, processQueued(w, data))
+	assert.Equal(t, "231", rdb.HGet(ctx, testNodeMetricKey, "value").Val())
+	assert.JSONEq(t, `{"engUnit":"V"}`, rdb.HGet(ctx, testNodeMetricKey, "properties").Val())
+
+	// a new birth replaces the properties
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", floatMetric("Voltage", 230))))
+	assert.Equal(t, "{}", rdb.HGet(ctx, testNodeMetricKey, "properties").Val())
+}
+
+func TestRedisExpireTTL(t *testing.T) {
+	ctx := context.Background()
+	w, _, rdb := newRedisTestWorker(t, RedisOpts{Layout: REDIS_LAYOUT_SET, ExpirePolicy: REDIS_EXPIRE_TTL, ExpireAfter: time.Hour})
+	birthNodeAndDevice(t, w)
+
+	ttl := rdb.TTL(ctx, testDeviceMetricKey).Val()
+	assert.Greater(t, ttl, 59*time.Minute)
+	assert.LessOrEqual(t, ttl, time.Hour)
+}
+
+func TestPruneRedis(t *testing.T) {
+	ctx := context.Background()
+	w, _, rdb := newRedisTestWorker(t, RedisOpts{Layout: REDIS_LAYOUT_SET, ExpirePolicy: REDIS_EXPIRE_NONE})
+	birthNodeAndDevice(t, w)
+	require.NoError(t, processQueued(w, testResult(t, "spBv1.0/Plant2/NBIRTH/Mixer", floatMetric("RPM", 1200))))
+
+	// pretend Plant1 was last seen two days ago
+	rdb.ZAdd(ctx, ZSET_NODES, redis.Z{Score: float64(time.Now().Add(-48 * time.Hour).UnixMilli()), Member: "plant1:heater"})
+
+	result, err := PruneRedis(ctx, rdb, 24*time.Hour, true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plant1:heater"}, result.Nodes)
+	assert.Equal(t, 2, result.Keys)
+	assert.Equal(t, int64(2), rdb.Exists(ctx, testNodeMetricKey, testDeviceMetricKey).Val(), "dry run keeps keys")
+
+	result, err = PruneRedis(ctx, rdb, 24*time.Hour, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Keys)
+	assert.Equal(t, int64(0), rdb.Exists(ctx, testNodeMetricKey, testDeviceMetricKey).Val())
+	assert.Equal(t, int64(1), rdb.Exists(ctx, "glowplug:plant2:mixer:rpm").Val())
+	assert.Equal(t, []string{"plant2:mixer"}, rdb.ZRange(ctx, ZSET_NODES, 0, -1).Val())
+
+	_, err = PruneRedis(ctx, rdb, 0, false, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ReloadResult lists the changes applied by a reload, and the changed
+// settings that only apply after a restart
+type ReloadResult struct {
+	Applied []string `json:"applied"`
+	Restart []string `json:"restart,omitempty"`
+}
+
+// Reload applies new options to a running glowplug. Scopes, subscriptions,
+// mapping rules, redis key and topic templates, publish formats and
+// deliveries, websocket limits, the reload token and the shutdown timeout
+// change in place. Sources whose URL, broker options or TLS files changed are
+// reconnected, new sources connected and removed sources disconnected, other
+// connections are kept. Changes to redis, the publish broker, sinks, the
+// pipeline, the cluster or the http port are reported in Restart and not
+// applied.
+func (g *glowplug) Reload(opts Opts) (ReloadResult, error) {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	result := ReloadResult{Applied: []string{}}
+	if err := opts.Validate(); err != nil {
+		return result, err
+	}
+	mapper, err := opts.mapper()
+	if err != nil {
+		return result, err
+	}
+	redisOpts, err := opts.redisOpts()
+	if err != nil {
+		return result, err
+	}
+	publishOpts, err := opts.publishOpts()
+	if err != nil {
+		return result, err
+	}
+
+	g.mu.RLock()
+	current := g.opts
+	g.mu.RUnlock()
+	result.Restart = current.restartChanges(opts)
+
+	// validate the engine inputs before touching any connection
+	next := opts.sources()
+	scopes := map[string]Scope{}
+	for _, source := range next {
+		scopes[source.Name] = source.Scope
+	}
+	if err := validateScopes(scopes); err != nil {
+		return result, err
+	}
+
+	// connect new and changed sources first, so nothing changes when one fails
+	previous := map[string]*sourceBroker{}
+	for _, source := range g.sources {
+		previous[source.Name] = source
+	}
+	connected := map[string]*sourceBroker{}
+	// a broker closes the older of two connections with the same client id
+	// and publishes its will, so such sources are released before they
+	// connect again. They are down until the reload is done and are restored
+	// with their old settings when it fails.
+	released := map[string]*sourceBroker{}
+	// abort disconnects the connected sources of a failed reload
+	abort := func(err error) (ReloadResult, error) {
+		for _, c := range connected {
+			c.broker.Disconnect()
+		}
+		for _, old := range released {
+			g.restore(current.Cluster, old)
+		}
+		return result, err
+	}
+	for _, source := range next {
+		old, ok := previous[source.Name]
+		if ok && !old.changed(source) {
+			continue
+		}
+		if ok && len(source.Broker.ClientID) > 0 && source.Broker.ClientID == old.Broker.ClientID {
+			g.logger.Println(source.displayName(), "disconnecting before reconnecting with client id", source.Broker.ClientID)
+			old.broker.Disconnect()
+			released[source.Name] = old
+		}
+		sb, err := g.connectSource(source)
+		if err != nil {
+			return abort(fmt.Errorf("unable to connect source %s, %w", source.displayName(), err))
+		}
+		connected[source.Name] = sb
+	}
+
+	if err := g.engine.Reload(scopes, mapper); err != nil {
+		return abort(err)
+	}
+	for _, source := range next {
+		if old, ok := previous[source.Name]; ok && !reflect.DeepEqual(old.Scope, source.Scope) {
+			result.Applied = append(result.Applied, "scope of "+source.displayName())
+		}
+	}
+	if len(opts.MappingFile) > 0 || !reflect.DeepEqual(current.MappingRules, opts.MappingRules) {
+		result.Applied = append(result.Applied, "mapping rules")
+	}
+	// steps that can fail run before running sources are replaced
+	if g.mqttSink != nil && publishChanged(current, opts) {
+		if err := g.mqttSink.setOpts(publishOpts); err != nil {
+			return abort(err)
+		}
+		result.Applied = append(result.Applied, "publish topics and formats")
+	}
+
+	sources := make([]*sourceBroker, 0, len(next))
+	for _, source := range next {
+		old, ok := previous[source.Name]
+		delete(previous, source.Name)
+		sb, reconnected := connected[source.Name]
+		switch {
+		case reconnected && ok:
+			if _, ok := released[source.Name]; !ok {
+				old.broker.Disconnect()
+			}
+			result.Applied = append(result.Applied, "reconnected source "+source.displayName())
+		case reconnected:
+			result.Applied = append(result.Applied, "added source "+source.displayName())
+		default:
+			// the running connection is kept, Health may still read the old source
+			sb = &sourceBroker{Source: source, broker: old.broker, tls: old.tls}
+			if g.resubscribe(current.Cluster, old, source.subscriptions()) {
+				result.Applied = append(result.Applied, "subscriptions of "+source.displayName())
+			}
+		}
+		if reconnected {
+			g.attach(sb)
+			for _, sub := range source.subscriptions() {
+				if err := g.subscribe(current.Cluster, sb, sub); err != nil {
+					g.logger.Println(err)
+				}
+			}
+		}
+		sources = append(sources, sb)
+	}
+	for _, old := range previous {
+		old.broker.Disconnect()
+		result.Applied = append(result.Applied, "removed source "+old.displayName())
+	}
+
+	if g.redisSink != nil && !reflect.DeepEqual(current.keyFormat(), opts.keyFormat()) {
+		g.redisSink.setKeys(redisOpts.Keys)
+		result.Applied = append(result.Applied, "redis key template")
+	}
+	if current.WebsocketMaxClients != opts.WebsocketMaxClients {
+		g.wss.SetMaxClients(opts.WebsocketMaxClients)
+		result.Applied = append(result.Applied, "websocket limits")
+	}
+	if current.ReloadToken != opts.ReloadToken {
+		result.Applied = append(result.Applied, "reload token")
+	}
+	if current.ShutdownTimeout != opts.ShutdownTimeout {
+		result.Applied = append(result.Applied, "shutdown timeout")
+	}
+
+	g.mu.Lock()
+	g.opts = current.reloaded(opts)
+	g.sources = sources
+	g.mu.Unlock()
+
+	g.logger.Println("reloaded, applied:", listOrNone(result.Applied))
+	if len(result.Restart) > 0 {
+		g.logger.Println("warning: restart glowplug to apply changes to", strings.Join(result.Restart, ", "))
+	}
+	return result, nil
+}
+
+// restore connects a source released by a failed reload again with its old
+// settings and subscriptions
+func (g *glowplug) restore(cluster ClusterOpts, old *sourceBroker) {
+	sb, err := g.connectSource(old.Source)
+	if err != nil {
+		g.logger.Println("unable to restore source", old.displayName(), err)
+		return
+	}
+	g.attach(sb)
+	for _, sub := range old.subscriptions() {
+		if err := g.subscribe(cluster, sb, sub); err != nil {
+			g.logger.Println(err)
+		}
+	}
+	g.mu.Lock()
+	old.broker, old.tls = sb.broker, sb.tls
+	g.mu.Unlock()
+}
+
+// resubscribe changes the subscriptions of a connected source, it returns
+// true if they changed
+func (g *glowplug) resubscribe(cluster ClusterOpts, source *sourceBroker, subscriptions []Subscription) bool {
+	wanted := map[string]byte{}
+	for _, sub := range subscriptions {
+		wanted[sub.Filter] = sub.QoS
+	}
+
+	changed := false
+	for _, sub := range source.subscriptions() {
+		if _, ok := wanted[sub.Filter]; ok {
+			continue
+		}
+		topic := cluster.filter(sub.Filter)
+		g.logger.Println(source.displayName(), "unsubscribing from", topic)
+		if err := source.broker.Unsubscribe(topic); err != nil {
+			g.logger.Println(err)
+		}
+		changed = true
+	}
+
+	existing := map[string]byte{}
+	for _, sub := range source.subscriptions() {
+		existing[sub.Filter] = sub.QoS
+	}
+	for _, sub := range subscriptions {
+		if qos, ok := existing[sub.Filter]; ok && qos == sub.QoS {
+			continue
+		}
+		if err := g.subscribe(cluster, source, sub); err != nil {
+			g.logger.Println(err)
+		}
+		changed = true
+	}
+	return changed
+}
+
+// restartChanges returns the settings changed in next that Reload does not apply
+func (o Opts) restartChanges(next Opts) []string {
+	var changes []string
+	for _, c := range []struct {
+		name    string
+		changed bool
+	}{
+		{"redis", o.RedisURL != next.RedisURL || o.RedisLayout != next.RedisLayout || o.RedisExpire != next.RedisExpire || o.RedisExpireAfter != next.RedisExpireAfter},
+		{"publish broker", o.PublishBrokerURL != next.PublishBrokerURL || o.PublishBroker != next.PublishBroker},
+		{"cluster", o.Cluster != next.Cluster},
+		{"sinks", !reflect.DeepEqual(o.Sinks, next.Sinks)},
+		{"pipeline", o.Pipeline != next.Pipeline || o.SinkQueue != next.SinkQueue},
+		{"rebirth on reconnect", o.RebirthOnReconnect != next.RebirthOnReconnect},
+		{"host id", o.HostId != next.HostId},
+		{"http port", o.HTTPPort != next.HTTPPort},
+	} {
+		if c.changed {
+			changes = append(changes, c.name)
+		}
+	}
+	return changes
+}
+
+// reloaded returns o with the settings applied by Reload taken from next
+func (o Opts) reloaded(next Opts) Opts {
+	o.MQTTBrokerURL = next.MQTTBrokerURL
+	o.MQTTBroker = next.MQTTBroker
+	o.Subscriptions = next.Subscriptions
+	o.Scope = next.Scope
+	o.Sources = next.Sources
+	o.RedisKeyFormat = next.RedisKeyFormat
+	o.TopicFormat = next.TopicFormat
+	o.PublishFormats = next.PublishFormats
+	o.PublishDeliveries = next.PublishDeliveries
+	o.MappingFile = next.MappingFile
+	o.MappingRules = next.MappingRules
+	o.WebsocketMaxClients = next.WebsocketMaxClients
+	o.ReloadToken = next.ReloadToken
+	o.ShutdownTimeout = next.ShutdownTimeout
+	return o
+}
+
+// publishChanged returns true if the topics, formats or deliveries of
+// published metrics differ, compiled templates are ignored
+func publishChanged(o Opts, next Opts) bool {
+	if !reflect.DeepEqual(o.topicFormat(), next.topicFormat()) || !reflect.DeepEqual(o.PublishDeliveries, next.PublishDeliveries) {
+		return true
+	}
+	if len(o.PublishFormats) != len(next.PublishFormats) {
+		return true
+	}
+	for i, f := range o.PublishFormats {
+		n := next.PublishFormats[i]
+		if f.Filter != n.Filter || f.Format != n.Format || f.Template != n.Template {
+			return true
+		}
+	}
+	return false
+}
+
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "no changes"
+	}
+	return strings.Join(items, ", ")
+}
+
+// reloadHandler reloads glowplug with the options of LoadOpts on POST
+// requests authorized by the reload token
+func (g *glowplug) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	g.mu.RLock()
+	token, loadOpts := g.opts.ReloadToken, g.opts.LoadOpts
+	g.mu.RUnlock()
+
+	if len(token) == 0 || loadOpts == nil {
+		http.Error(w, "reload is disabled, set a reload token", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	opts, err := loadOpts()
+	if err != nil {
+		g.logger.Println("unable to reload,", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := g.Reload(opts)
+	if err != nil {
+		g.logger.Println("unable to reload,", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		g.logger.Println("unable to write reload result,", err)
+	}
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReloadGlowplug returns a started glowplug whose sources connect to test brokers
+func newReloadGlowplug(t *testing.T, opts Opts) (*glowplug, map[string]*testBroker) {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	brokers := map[string]*testBroker{}
+	g := &glowplug{logger: logger, wss: NewWebsocketServer(logger), opts: opts}
+	engine, err := NewEngine(logger, WorkerOpts{
+		HostId:    opts.HostId,
+		Transport: func(source string) sparkplug.Transport { return g.transport(source) },
+	})
+	require.NoError(t, err)
+	g.engine = engine
+
+	g.connect = func(source Source, will *sparkplug.Will, handler messageHandler, onReconnect func()) (brokerClient, error) {
+		if source.URL == "mqtt://unreachable:1883" {
+			return nil, errors.New("connection refused")
+		}
+		broker := &testBroker{
+			connectionState: newConnectionState(logger, source.displayName(), source.URL, source.Broker.Version, nil),
+			will:            will,
+			onReconnect:     onReconnect,
+		}
+		brokers[source.displayName()] = broker
+		return broker, nil
+	}
+	for _, source := range opts.sources() {
+		sb, err := g.connectSource(source)
+		require.NoError(t, err)
+		g.attach(sb)
+		for _, sub := range source.subscriptions() {
+			require.NoError(t, g.subscribe(opts.Cluster, sb, sub))
+		}
+		g.sources = append(g.sources, sb)
+	}
+	return g, brokers
+}
+
+func TestReload(t *testing.T) {
+	opts := Opts{
+		Sources: []Source{
+			{Name: "plant1", URL: "mqtt://plant1:1883", Subscriptions: []Subscription{{Filter: "spBv1.0/Plant1/#"}}},
+			{Name: "plant2", URL: "mqtt://plant2:1883"},
+		},
+	}
+	g, brokers := newReloadGlowplug(t, opts)
+	plant1, plant2 := brokers["plant1"], brokers["plant2"]
+
+	next := opts
+	next.Sources = []Source{
+		{Name: "plant1", URL: "mqtt://plant1:1883", Subscriptions: []Subscription{{Filter: "spBv1.0/Plant1/#", QoS: 1}, {Filter: "spBv1.0/Plant9/#"}}, Scope: Scope{Exclude: []string{"Plant1/Test/#"}}},
+		{Name: "plant3", URL: "mqtt://plant3:1883"},
+	}
+	next.WebsocketMaxClients = 10
+	next.HTTPPort = 8080
+	result, err := g.Reload(next)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"scope of plant1", "subscriptions of plant1", "added source plant3", "removed source plant2", "websocket limits"}, result.Applied)
+	assert.Equal(t, []string{"http port"}, result.Restart)
+
+	// the connection of plant1 is kept and its subscriptions changed
+	assert.Same(t, plant1, brokers["plant1"])
+	assert.False(t, plant1.disconnected)
+	assert.Equal(t, map[string]byte{"spBv1.0/Plant1/#": 1, "spBv1.0/Plant9/#": 0}, plant1.subscriptions)
+	assert.True(t, plant2.disconnected)
+	assert.Contains(t, brokers["plant3"].subscriptions, "spBv1.0/#")
+
+	// restart settings are not applied
+	assert.Equal(t, 0, g.opts.HTTPPort)
+	assert.Equal(t, 10, g.opts.WebsocketMaxClients)
+	require.Len(t, g.sources, 2)
+	assert.Equal(t, "plant3", g.sources[1].Name)
+
+	// changed broker settings reconnect the source
+	next.Sources[0].Broker.ClientID = "glowplug-2"
+	result, err = g.Reload(next)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reconnected source plant1"}, result.Applied)
+	assert.True(t, plant1.disconnected)
+	assert.NotSame(t, plant1, brokers["plant1"])
+	assert.Len(t, brokers["plant1"].subscriptions, 2)
+
+	// nothing changes when a source can't connect
+	plant3 := brokers["plant3"]
+	broken := next
+	broken.Sources = append([]Source{}, next.Sources...)
+	broken.Sources[1].URL = "mqtt://unreachable:1883"
+	_, err = g.Reload(broken)
+	assert.Error(t, err)
+	assert.False(t, plant3.disconnected)
+	assert.Equal(t, "mqtt://plant3:1883", g.sources[1].URL)
+
+	// a malformed scope is rejected before a source connects
+	malformed := next
+	malformed.Sources = append([]Source{}, next.Sources...)
+	malformed.Sources[1].URL = "mqtt://plant4:1883"
+	malformed.Sources[1].Scope = Scope{Include: []string{"Plant["}}
+	_, err = g.Reload(malformed)
+	assert.Error(t, err)
+	assert.NotContains(t, brokers, "plant4")
+	assert.False(t, plant3.disconnected)
+	assert.Same(t, plant3, g.sources[1].broker)
+
+	// invalid options are rejected
+	invalid := next
+	invalid.Sources = nil
+	_, err = g.Reload(invalid)
+	assert.Error(t, err)
+}
+
+func TestReloadClientID(t *testing.T) {
+	opts := Opts{Sources: []Source{{Name: "plant1", URL: "mqtt://plant1:1883", Broker: BrokerOpts{ClientID: "glowplug"}}}}
+	g, brokers := newReloadGlowplug(t, opts)
+	plant1 := brokers["plant1"]
+
+	// the old connection is closed before one with the same client id is made
+	connect := g.connect
+	oldConnected := false
+	g.connect = func(source Source, will *sparkplug.Will, handler messageHandler, onReconnect func()) (brokerClient, error) {
+		oldConnected = !brokers[source.Name].disconnected
+		return connect(source, will, handler, onReconnect)
+	}
+	next := opts
+	next.Sources = []Source{{Name: "plant1", URL: "mqtt://plant1b:1883", Broker: BrokerOpts{ClientID: "glowplug"}}}
+	result, err := g.Reload(next)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reconnected source plant1"}, result.Applied)
+	assert.False(t, oldConnected)
+	assert.True(t, plant1.disconnected)
+
+	// a released source is restored with its old settings when the reload fails
+	plant1 = brokers["plant1"]
+	broken := next
+	broken.Sources = []Source{{Name: "plant1", URL: "mqtt://unreachable:1883", Broker: BrokerOpts{ClientID: "glowplug"}}}
+	_, err = g.Reload(broken)
+	assert.Error(t, err)
+	assert.True(t, plant1.disconnected)
+	restored := brokers["plant1"]
+	assert.NotSame(t, plant1, restored)
+	assert.False(t, restored.disconnected)
+	assert.Contains(t, restored.subscriptions, "spBv1.0/#")
+	assert.Same(t, restored, g.sources[0].broker)
+	assert.Equal(t, "mqtt://plant1b:1883", g.sources[0].URL)
+}
+
+func TestReloadTLSFiles(t *testing.T) {
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, []byte("first"), 0o600))
+	opts := Opts{Sources: []Source{{Name: "plant1", URL: "mqtts://plant1:8883", Broker: BrokerOpts{CAFile: ca}}}}
+	g, brokers := newReloadGlowplug(t, opts)
+	plant1 := brokers["plant1"]
+
+	result, err := g.Reload(opts)
+	require.NoError(t, err)
+	assert.Empty(t, result.Applied)
+
+	// a certificate rotated under the same path reconnects the source
+	require.NoError(t, os.WriteFile(ca, []byte("second"), 0o600))
+	result, err = g.Reload(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reconnected source plant1"}, result.Applied)
+	assert.True(t, plant1.disconnected)
+}
+
+func TestReloadHandler(t *testing.T) {
+	opts := Opts{MQTTBrokerURL: "mqtt://localhost:1883"}
+	g, brokers := newReloadGlowplug(t, opts)
+
+	reload := func(method, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/reload", nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		g.reloadHandler(rec, req)
+		return rec
+	}
+
+	// disabled without a token
+	assert.Equal(t, http.StatusForbidden, reload(http.MethodPost, "").Code)
+
+	g.opts.ReloadToken = "secret"
+	g.opts.LoadOpts = func() (Opts, error) {
+		next := opts
+		next.ReloadToken = "secret"
+		next.Subscriptions = []Subscription{{Filter: "spBv1.0/Plant1/#"}}
+		return next, nil
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, reload(http.MethodGet, "secret").Code)
+	assert.Equal(t, http.StatusUnauthorized, reload(http.MethodPost, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, reload(http.MethodPost, "wrong").Code)
+
+	rec := reload(http.MethodPost, "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var result ReloadResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, []string{"subscriptions of " + BROKER_SOURCE}, result.Applied)
+	assert.Equal(t, map[string]byte{"spBv1.0/Plant1/#": 0}, brokers[BROKER_SOURCE].subscriptions)
+
+	g.opts.LoadOpts = func() (Opts, error) {
+		return Opts{}, errors.New("unable to read config")
+	}
+	assert.Equal(t, http.StatusBadRequest, reload(http.MethodPost, "secret").Code)
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/redis/go-redis/v9"
+)
+
+// HASH_NODE_SESSIONS holds the sparkplug session of each edge node as JSON,
+// so another glowplug instance can take over the node
+const HASH_NODE_SESSIONS = "glowplug:node_sessions"
+
+// prefix of the hashes that map the metric aliases of an edge node to their names
+const aliasesPrefix = "glowplug:aliases"
+
+// restoreRetryInterval is how long an edge node whose session or aliases were
+// missing in redis is not looked up again, unless it sends a birth
+const restoreRetryInterval = 10 * time.Second
+
+// aliasesHash returns the hash mapping metric aliases of an edge node to their names
+func aliasesHash(nodeKey string) string {
+	return aliasesPrefix + keyDelimiter + nodeKey
+}
+
+// restoreNode reads the session of an edge node unknown to the namespace
+// when glowplug instances share a subscription, and the alias table when a
+// metric is sent with an unknown alias. Another instance or a previous run
+// may have seen the birth. A node missing in redis is looked up again after
+// restoreRetryInterval or its next NBIRTH.
+func (w *worker) restoreNode(ctx context.Context, topic sparkplug.Topic, payload *sparkplug.Payload) error {
+	if w.rdb == nil {
+		return nil
+	}
+	key := sparkplug.NodeKeyFromTopic(topic)
+	if topic.Command == sparkplug.NBIRTH {
+		w.restoreMisses.Delete(key)
+	} else if missed, ok := w.restoreMisses.Load(key); ok && time.Since(missed.(time.Time)) < restoreRetryInterval {
+		return nil
+	}
+	nodeKey := nodeKeyFromTopic(topic)
+	rdb := *w.rdb
+
+	missing := false
+	if w.shared() && !w.namespace.Known(key) {
+		value, err := rdb.HGet(ctx, HASH_NODE_SESSIONS, nodeKey).Result()
+		switch {
+		case err == redis.Nil:
+			missing = true
+		case err != nil:
+			return fmt.Errorf("unable to read session of %s, %w", nodeKey, err)
+		default:
+			var session sparkplug.NodeSession
+			if err := json.Unmarshal([]byte(value), &session); err != nil {
+				return fmt.Errorf("invalid session of %s, %w", nodeKey, err)
+			}
+			if session.Instance != w.cluster.opts.InstanceID {
+				w.logger.Printf("taking over edge node %s from instance %s\n", nodeKey, session.Instance)
+			}
+			session.Source = topic.Source
+			w.namespace.Restore(session)
+		}
+	}
+
+	for _, metric := range payload.GetMetrics() {
+		if len(metric.Name) > 0 || metric.Alias == 0 {
+			continue
+		}
+		if _, ok := w.namespace.Alias(key, metric.Alias); !ok {
+			if err := w.loadAliases(ctx, key, nodeKey); err != nil {
+				return err
+			}
+			_, ok = w.namespace.Alias(key, metric.Alias)
+			missing = missing || !ok
+			break
+		}
+	}
+	if missing {
+		w.restoreMisses.Store(key, time.Now())
+	}
+	return nil
+}
+
+// loadAliases reads the alias table of a node from redis
+func (w *worker) loadAliases(ctx context.Context, key sparkplug.NodeKey, nodeKey string) error {
+	rdb := *w.rdb
+	fields, err := rdb.HGetAll(ctx, aliasesHash(nodeKey)).Result()
+	if err != nil {
+		return fmt.Errorf("unable to read aliases of %s, %w", nodeKey, err)
+	}
+
+	aliases := make(map[uint64]string, len(fields))
+	for field, name := range fields {
+		alias, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid alias %s of %s, %w", field, nodeKey, err)
+		}
+		aliases[alias] = name
+	}
+	w.namespace.LearnAliases(key, aliases)
+	return nil
+}
+
+// storeNode keeps the aliases of births in redis, so they survive a restart
+// or a takeover of the node, and the session when glowplug instances share a
+// subscription
+func (w *worker) storeNode(ctx context.Context, topic sparkplug.Topic, payload *sparkplug.Payload, session sparkplug.NodeSession) error {
+	if w.rdb == nil {
+		return nil
+	}
+	nodeKey := nodeKeyFromTopic(topic)
+	rdb := *w.rdb
+
+	if topic.Command == sparkplug.NBIRTH || topic.Command == sparkplug.DBIRTH {
+		fields := map[string]interface{}{}
+		for _, metric := range payload.GetMetrics() {
+			if metric.Alias != 0 && len(metric.Name) > 0 {
+				fields[strconv.FormatUint(metric.Alias, 10)] = metric.Name
+			}
+		}
+		replace := topic.Command == sparkplug.NBIRTH
+		if replace || len(fields) > 0 {
+			if _, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				if replace {
+					pipe.Del(ctx, aliasesHash(nodeKey))
+				}
+				if len(fields) > 0 {
+					pipe.HSet(ctx, aliasesHash(nodeKey), fields)
+				}
+				return nil
+			}); err != nil {
+				return fmt.Errorf("unable to store aliases of %s, %w", nodeKey, err)
+			}
+		}
+	}
+
+	if w.shared() {
+		value, err := json.Marshal(w.nodeSession(session))
+		if err != nil {
+			return err
+		}
+		if err := rdb.HSet(ctx, HASH_NODE_SESSIONS, nodeKey, value).Err(); err != nil {
+			return fmt.Errorf("unable to store session of %s, %w", nodeKey, err)
+		}
+	}
+	return nil
+}
+
+// shared returns true if sessions are shared with other glowplug instances
+func (w *worker) shared() bool {
+	return w.cluster != nil && w.rdb != nil
+}
+
+// nodeSession returns a session of the namespace with the instance and the
+// violations counted by this worker
+func (w *worker) nodeSession(session sparkplug.NodeSession) sparkplug.NodeSession {
+	session.Instance = ""
+	if w.shared() {
+		session.Instance = w.cluster.opts.InstanceID
+	}
+	session.Violations = 0
+	if count, ok := w.violations.Load(session.Key()); ok {
+		session.Violations = count.(*atomic.Uint64).Load()
+	}
+	return session
+}
+
+// Nodes returns the sessions of the edge nodes seen by the worker
+func (w *worker) Nodes() []sparkplug.NodeSession {
+	sessions := w.namespace.Nodes()
+	for i, session := range sessions {
+		sessions[i] = w.nodeSession(session)
+	}
+	return sessions
+}
@@ -0,0 +1,526 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/american-factory-os/glowplug/json_type"
+	"github.com/american-factory-os/glowplug/sparkplug"
+)
+
+// Built in sink types
+const (
+	SINK_REDIS     = "redis"
+	SINK_MQTT      = "mqtt"
+	SINK_WEBSOCKET = "websocket"
+	SINK_JSONL     = "jsonl"
+)
+
+// MetricUpdate is a metric ready for the sinks, after aliases are resolved
+// and mapping rules are applied
+type MetricUpdate struct {
+	// Topic and Name identify the metric after mapping rules
+	Topic sparkplug.Topic
+	Name  string
+	// Identity is the metric as received, before mapping rules
+	Identity MetricIdentity
+	// SourceTopic is the mqtt topic the payload was received on
+	SourceTopic string
+	Received    time.Time
+	Payload     *sparkplug.Payload
+	Metric      *sparkplug.Payload_Metric
+	Value       json_type.JsonType
+	// Properties of the metric from its birth or the last data carrying
+	// properties, such as engUnit
+	Properties *sparkplug.Payload_PropertySet
+}
+
+// Timestamp returns the timestamp of the metric, or of its payload
+func (u MetricUpdate) Timestamp() uint64 {
+	if ts := u.Metric.GetTimestamp(); ts != 0 {
+		return ts
+	}
+	return u.Payload.GetTimestamp()
+}
+
+// SessionEvent reports the birth or death of an edge node or device, the
+// topic command is one of NBIRTH, DBIRTH, NDEATH or DDEATH
+type SessionEvent struct {
+	Topic    sparkplug.Topic `json:"topic"`
+	Received time.Time       `json:"received"`
+}
+
+// Sink receives the metric updates and session events processed by glowplug.
+// The methods of a sink are called from one goroutine, reading the queue of
+// the sink, so a slow sink does not hold up the others.
+type Sink interface {
+	// Name identifies the sink in logs and health reports
+	Name() string
+	// Start is called once before the first write, ctx is done when glowplug stops
+	Start(ctx context.Context) error
+	// Write receives a batch of metrics, in order for each edge node
+	Write(ctx context.Context, updates []MetricUpdate) error
+	// Session receives births before their metrics and deaths
+	Session(ctx context.Context, event SessionEvent) error
+	// Flush writes buffered updates
+	Flush(ctx context.Context) error
+	// Close releases the resources of the sink after a final flush
+	Close() error
+}
+
+// SinkConfig configures a registered sink
+type SinkConfig struct {
+	Type string
+	// Name defaults to the type
+	Name    string
+	Options map[string]string
+}
+
+// SinkFactory creates a sink from its configuration
+type SinkFactory func(logger *log.Logger, config SinkConfig) (Sink, error)
+
+var (
+	sinkFactoriesMu sync.RWMutex
+	sinkFactories   = map[string]SinkFactory{}
+)
+
+// RegisterSink makes a sink type available to NewSink, registering a type
+// twice replaces the factory
+func RegisterSink(sinkType string, factory SinkFactory) {
+	sinkFactoriesMu.Lock()
+	defer sinkFactoriesMu.Unlock()
+	sinkFactories[sinkType] = factory
+}
+
+// SinkTypes returns the registered sink types
+func SinkTypes() []string {
+	sinkFactoriesMu.RLock()
+	defer sinkFactoriesMu.RUnlock()
+	types := make([]string, 0, len(sinkFactories))
+	for sinkType := range sinkFactories {
+		types = append(types, sinkType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewSink creates a sink of a registered type
+func NewSink(logger *log.Logger, config SinkConfig) (Sink, error) {
+	sinkFactoriesMu.RLock()
+	factory, ok := sinkFactories[config.Type]
+	sinkFactoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %s, must be one of: %s", config.Type, strings.Join(SinkTypes(), ", "))
+	}
+	if len(config.Name) == 0 {
+		config.Name = config.Type
+	}
+	// queue options apply to every sink type, they are read by Queue
+	options := make(map[string]string, len(config.Options))
+	for key, value := range config.Options {
+		if !isQueueOption(key) {
+			options[key] = value
+		}
+	}
+	config.Options = options
+	sink, err := factory(logger, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create sink %s, %w", config.Name, err)
+	}
+	return sink, nil
+}
+
+// ParseSinkConfig parses a sink as type[,name=<name>][,key=value...], e.g.
+// jsonl,path=/var/log/glowplug.jsonl
+func ParseSinkConfig(s string) (SinkConfig, error) {
+	pairs := strings.Split(s, ",")
+	config := SinkConfig{Type: strings.TrimSpace(pairs[0]), Options: map[string]string{}}
+	if len(config.Type) == 0 {
+		return config, fmt.Errorf("invalid sink %s, expected type[,key=value...]", s)
+	}
+
+	for _, pair := range pairs[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return config, fmt.Errorf("invalid sink %s, expected key=value pairs after the type", s)
+		}
+		if key == "name" {
+			config.Name = value
+			continue
+		}
+		config.Options[key] = value
+	}
+
+	return config, nil
+}
+
+// optionKeys returns an error for options a sink does not know
+func (c SinkConfig) optionKeys(known ...string) error {
+	for key := range c.Options {
+		found := false
+		for _, k := range known {
+			if k == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid %s sink option %s, must be one of: %s", c.Type, key, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// Queue options of every sink type
+const (
+	SINK_OPTION_QUEUE_SIZE     = "queue-size"
+	SINK_OPTION_OVERFLOW       = "overflow"
+	SINK_OPTION_BATCH_SIZE     = "batch-size"
+	SINK_OPTION_BATCH_INTERVAL = "batch-interval"
+	SINK_OPTION_BUFFER         = "buffer"
+	SINK_OPTION_BUFFER_MAX_MB  = "buffer-max-mb"
+	SINK_OPTION_BUFFER_MAX_AGE = "buffer-max-age"
+)
+
+func isQueueOption(key string) bool {
+	switch key {
+	case SINK_OPTION_QUEUE_SIZE, SINK_OPTION_OVERFLOW, SINK_OPTION_BATCH_SIZE, SINK_OPTION_BATCH_INTERVAL,
+		SINK_OPTION_BUFFER, SINK_OPTION_BUFFER_MAX_MB, SINK_OPTION_BUFFER_MAX_AGE:
+		return true
+	}
+	return false
+}
+
+// Queue returns the queue options of the sink, options it does not set are
+// taken from defaults
+func (c SinkConfig) Queue(defaults QueueOpts) (QueueOpts, error) {
+	opts := defaults
+	var err error
+	if size, ok := c.Options[SINK_OPTION_QUEUE_SIZE]; ok {
+		if opts.Size, err = strconv.Atoi(size); err != nil {
+			return opts, fmt.Errorf("invalid sink queue size %s, %w", size, err)
+		}
+	}
+	if overflow, ok := c.Options[SINK_OPTION_OVERFLOW]; ok {
+		if opts.Overflow, err = ParseOverflowPolicy(overflow, defaults.Overflow); err != nil {
+			return opts, err
+		}
+	}
+	if size, ok := c.Options[SINK_OPTION_BATCH_SIZE]; ok {
+		if opts.BatchSize, err = strconv.Atoi(size); err != nil {
+			return opts, fmt.Errorf("invalid sink batch size %s, %w", size, err)
+		}
+	}
+	if interval, ok := c.Options[SINK_OPTION_BATCH_INTERVAL]; ok {
+		if opts.BatchInterval, err = time.ParseDuration(interval); err != nil {
+			return opts, fmt.Errorf("invalid sink batch interval %s, %w", interval, err)
+		}
+	}
+	if buffer, ok := c.Options[SINK_OPTION_BUFFER]; ok {
+		enabled, err := strconv.ParseBool(buffer)
+		if err != nil {
+			return opts, fmt.Errorf("invalid sink buffer %s, %w", buffer, err)
+		}
+		if !enabled {
+			opts.Buffer.Dir = ""
+		} else if !opts.Buffer.enabled() {
+			return opts, fmt.Errorf("sink buffer requires a data directory")
+		}
+	}
+	if maxMB, ok := c.Options[SINK_OPTION_BUFFER_MAX_MB]; ok {
+		mb, err := strconv.ParseInt(maxMB, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid sink buffer max mb %s, %w", maxMB, err)
+		}
+		opts.Buffer.MaxBytes = mb << 20
+	}
+	if maxAge, ok := c.Options[SINK_OPTION_BUFFER_MAX_AGE]; ok {
+		if opts.Buffer.MaxAge, err = time.ParseDuration(maxAge); err != nil {
+			return opts, fmt.Errorf("invalid sink buffer max age %s, %w", maxAge, err)
+		}
+	}
+	return opts, opts.Validate()
+}
+
+// SinkStats reports the updates written by a sink and its errors
+type SinkStats struct {
+	Name    string `json:"name"`
+	Updates uint64 `json:"updates"`
+	Events  uint64 `json:"events"`
+	Errors  uint64 `json:"errors"`
+	// Queued payloads and events wait for the sink, Dropped were discarded by the overflow policy
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+	// Lost updates and events failed without a disk buffer to keep them
+	Lost uint64 `json:"lost"`
+	// LastError is the most recent error and when it happened
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// Buffer is the backlog on disk when the sink has a disk buffer
+	Buffer *BufferStats `json:"buffer,omitempty"`
+}
+
+// sinkItem is the metric updates of a payload or a session event
+type sinkItem struct {
+	updates []MetricUpdate
+	event   *SessionEvent
+}
+
+// sinkRunner feeds a sink from its own queue, so a slow sink does not hold
+// up the others, and counts its updates and errors. An error of one sink is
+// logged and does not stop the other sinks.
+type sinkRunner struct {
+	sink    Sink
+	logger  *log.Logger
+	opts    QueueOpts
+	queue   *queue[sinkItem]
+	done    chan struct{}
+	started bool
+	updates atomic.Uint64
+	events  atomic.Uint64
+	errors  atomic.Uint64
+	lost    atomic.Uint64
+
+	// wal buffers updates while the sink fails, they are replayed after
+	// nextReplay, retry doubles after each failed replay
+	wal        *wal
+	retry      time.Duration
+	nextReplay time.Time
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func newSinkRunner(logger *log.Logger, sink Sink, opts QueueOpts) *sinkRunner {
+	opts = opts.withDefaults()
+	return &sinkRunner{
+		sink:   sink,
+		logger: logger,
+		opts:   opts,
+		queue:  newQueue[sinkItem](opts.Size, opts.Overflow),
+		done:   make(chan struct{}),
+	}
+}
+
+// push queues an item for the sink
+func (r *sinkRunner) push(item sinkItem) {
+	if !r.queue.push(item) {
+		if n := r.queue.dropped.Load(); n%statReportInterval == 1 {
+			r.logger.Printf("sink %s: queue full, dropped %d payloads and events\n", r.sink.Name(), n)
+		}
+	}
+}
+
+// start feeds the sink until its queue is closed
+func (r *sinkRunner) start(ctx context.Context) error {
+	if err := r.openBuffer(); err != nil {
+		return err
+	}
+	if err := r.sink.Start(ctx); err != nil {
+		return err
+	}
+	r.started = true
+	go r.run(ctx)
+	return nil
+}
+
+// stop closes the queue and waits for the sink to write the queued items and close
+func (r *sinkRunner) stop() {
+	r.queue.close()
+	if r.started {
+		<-r.done
+		return
+	}
+	r.close(context.Background())
+}
+
+// close flushes and closes the sink, a backlog stays on disk for the next run
+func (r *sinkRunner) close(ctx context.Context) {
+	r.flush(ctx)
+	if err := r.sink.Close(); err != nil {
+		r.logger.Printf("unable to close sink %s, %v\n", r.sink.Name(), err)
+	}
+	if r.wal != nil {
+		if n := r.wal.len(); n > 0 {
+			r.logger.Printf("sink %s: %d records left in the disk buffer\n", r.sink.Name(), n)
+		}
+		if err := r.wal.close(); err != nil {
+			r.logger.Printf("unable to close buffer of sink %s, %v\n", r.sink.Name(), err)
+		}
+	}
+}
+
+func (r *sinkRunner) run(ctx context.Context) {
+	defer close(r.done)
+	flush := time.NewTicker(sinkFlushInterval)
+	defer flush.Stop()
+
+	var replay <-chan time.Time
+	if r.wal != nil {
+		ticker := time.NewTicker(bufferCheckInterval)
+		defer ticker.Stop()
+		replay = ticker.C
+	}
+
+	for {
+		select {
+		case <-flush.C:
+			r.flush(ctx)
+		case now := <-replay:
+			r.replay(ctx, now)
+		case item, ok := <-r.queue.ch:
+			if !ok || !r.batch(ctx, item) {
+				r.close(ctx)
+				return
+			}
+		}
+	}
+}
+
+// batch writes the updates of item together with the updates queued after
+// it, up to the batch size. Session events are passed in order between
+// batches. It returns false when the queue is closed.
+func (r *sinkRunner) batch(ctx context.Context, item sinkItem) bool {
+	var linger <-chan time.Time
+	if r.opts.BatchInterval > 0 {
+		timer := time.NewTimer(r.opts.BatchInterval)
+		defer timer.Stop()
+		linger = timer.C
+	}
+
+	var updates []MetricUpdate
+	open := true
+	for {
+		if item.event != nil {
+			r.write(ctx, updates)
+			updates = nil
+			r.session(ctx, *item.event)
+		} else {
+			updates = append(updates, item.updates...)
+		}
+		if len(updates) >= r.opts.BatchSize {
+			break
+		}
+
+		var more bool
+		if item, more, open = r.next(linger); !more {
+			break
+		}
+	}
+
+	r.write(ctx, updates)
+	return open
+}
+
+// next returns the next item if it is queued or arrives before linger fires,
+// more is false when there is no item and open is false when the queue is closed
+func (r *sinkRunner) next(linger <-chan time.Time) (item sinkItem, more bool, open bool) {
+	select {
+	case item, open = <-r.queue.ch:
+		return item, open, open
+	default:
+	}
+	if linger == nil {
+		return item, false, true
+	}
+	select {
+	case item, open = <-r.queue.ch:
+		return item, open, open
+	case <-linger:
+		return item, false, true
+	}
+}
+
+// fail counts and logs an error of the sink
+func (r *sinkRunner) fail(err error) {
+	r.errors.Add(1)
+	r.mu.Lock()
+	r.lastError = err.Error()
+	r.lastErrorAt = time.Now()
+	r.mu.Unlock()
+	r.logger.Printf("sink %s: %v\n", r.sink.Name(), err)
+}
+
+// write passes updates to the sink, or to its disk buffer while the sink
+// fails or has a backlog
+func (r *sinkRunner) write(ctx context.Context, updates []MetricUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+	if r.backlogged() {
+		r.buffer(sinkItem{updates: updates})
+		return
+	}
+	if err := r.sink.Write(ctx, updates); err != nil {
+		r.fail(err)
+		if r.wal != nil {
+			r.buffer(sinkItem{updates: updates})
+		} else {
+			r.lost.Add(uint64(len(updates)))
+		}
+		return
+	}
+	r.updates.Add(uint64(len(updates)))
+}
+
+// session passes an event to the sink, or to its disk buffer while the sink
+// fails or has a backlog
+func (r *sinkRunner) session(ctx context.Context, event SessionEvent) {
+	if r.backlogged() {
+		r.buffer(sinkItem{event: &event})
+		return
+	}
+	if err := r.sink.Session(ctx, event); err != nil {
+		r.fail(err)
+		if r.wal != nil {
+			r.buffer(sinkItem{event: &event})
+		} else {
+			r.lost.Add(1)
+		}
+		return
+	}
+	r.events.Add(1)
+}
+
+func (r *sinkRunner) flush(ctx context.Context) {
+	if err := r.sink.Flush(ctx); err != nil {
+		r.fail(err)
+	}
+	if r.wal != nil {
+		if err := r.wal.sync(); err != nil {
+			r.fail(fmt.Errorf("unable to sync disk buffer, %w", err))
+		}
+	}
+}
+
+func (r *sinkRunner) stats() SinkStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := SinkStats{
+		Name:      r.sink.Name(),
+		Updates:   r.updates.Load(),
+		Events:    r.events.Load(),
+		Errors:    r.errors.Load(),
+		Queued:    len(r.queue.ch),
+		Dropped:   r.queue.dropped.Load(),
+		Lost:      r.lost.Load(),
+		LastError: r.lastError,
+	}
+	if !r.lastErrorAt.IsZero() {
+		lastErrorAt := r.lastErrorAt
+		stats.LastErrorAt = &lastErrorAt
+	}
+	if r.wal != nil {
+		buffer := r.wal.stats()
+		stats.Buffer = &buffer
+	}
+	return stats
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// bufferCheckInterval is how often a sink with a backlog is retried
+	bufferCheckInterval = 250 * time.Millisecond
+	// bufferMaxRetryInterval is the longest wait between retries of a failing sink
+	bufferMaxRetryInterval = 30 * time.Second
+	// bufferReplayRecords is the most records replayed before reading the queue again
+	bufferReplayRecords = 100
+)
+
+// bufferedItem is a sinkItem stored in the disk buffer of a sink
+type bufferedItem struct {
+	Updates []bufferedUpdate `json:"updates,omitempty"`
+	Event   *SessionEvent    `json:"event,omitempty"`
+}
+
+// bufferedUpdate is a MetricUpdate with its metric encoded as protobuf, the
+// payload is reduced to its seq and timestamp
+type bufferedUpdate struct {
+	Topic       sparkplug.Topic `json:"topic"`
+	Name        string          `json:"name"`
+	Identity    MetricIdentity  `json:"identity"`
+	SourceTopic string          `json:"source_topic"`
+	Received    time.Time       `json:"received"`
+	Seq         uint64          `json:"seq"`
+	Timestamp   uint64          `json:"timestamp"`
+	Metric      []byte          `json:"metric"`
+	Properties  []byte          `json:"properties,omitempty"`
+}
+
+// encodeSinkItem encodes an item for the disk buffer
+func encodeSinkItem(item sinkItem) ([]byte, error) {
+	buffered := bufferedItem{Event: item.event}
+	for _, u := range item.updates {
+		metric, err := proto.Marshal(u.Metric)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode metric %s, %w", u.Name, err)
+		}
+		var properties []byte
+		if u.Properties != nil {
+			if properties, err = proto.Marshal(u.Properties); err != nil {
+				return nil, fmt.Errorf("unable to encode properties of %s, %w", u.Name, err)
+			}
+		}
+		buffered.Updates = append(buffered.Updates, bufferedUpdate{
+			Topic:       u.Topic,
+			Name:        u.Name,
+			Identity:    u.Identity,
+			SourceTopic: u.SourceTopic,
+			Received:    u.Received,
+			Seq:         u.Payload.GetSeq(),
+			Timestamp:   u.Payload.GetTimestamp(),
+			Metric:      metric,
+			Properties:  properties,
+		})
+	}
+	return json.Marshal(buffered)
+}
+
+// decodeSinkItem decodes an item of the disk buffer
+func decodeSinkItem(data []byte) (sinkItem, error) {
+	var buffered bufferedItem
+	if err := json.Unmarshal(data, &buffered); err != nil {
+		return sinkItem{}, err
+	}
+	item := sinkItem{event: buffered.Event}
+	for _, b := range buffered.Updates {
+		var metric sparkplug.Payload_Metric
+		if err := proto.Unmarshal(b.Metric, &metric); err != nil {
+			return sinkItem{}, fmt.Errorf("unable to decode metric %s, %w", b.Name, err)
+		}
+		value, err := PayloadMetricToJsonType(&metric)
+		if err != nil {
+			return sinkItem{}, err
+		}
+		var properties *sparkplug.Payload_PropertySet
+		if len(b.Properties) > 0 {
+			properties = &sparkplug.Payload_PropertySet{}
+			if err := proto.Unmarshal(b.Properties, properties); err != nil {
+				return sinkItem{}, fmt.Errorf("unable to decode properties of %s, %w", b.Name, err)
+			}
+		}
+		item.updates = append(item.updates, MetricUpdate{
+			Topic:       b.Topic,
+			Name:        b.Name,
+			Identity:    b.Identity,
+			SourceTopic: b.SourceTopic,
+			Received:    b.Received,
+			Payload:     &sparkplug.Payload{Seq: b.Seq, Timestamp: b.Timestamp},
+			Metric:      &metric,
+			Value:       value,
+			Properties:  properties,
+		})
+	}
+	return item, nil
+}
+
+// openBuffer opens the disk buffer of the sink, a backlog left by a previous
+// run is replayed before new updates
+func (r *sinkRunner) openBuffer() error {
+	if !r.opts.Buffer.enabled() {
+		return nil
+	}
+	w, err := openWAL(filepath.Join(r.opts.Buffer.Dir, r.sink.Name()), r.opts.Buffer)
+	if err != nil {
+		return err
+	}
+	r.wal = w
+	r.retry = bufferCheckInterval
+	if n := w.len(); n > 0 {
+		r.logger.Printf("sink %s: replaying %d buffered records\n", r.sink.Name(), n)
+	}
+	return nil
+}
+
+// backlogged returns true while the disk buffer holds records, new items are
+// buffered behind them to keep their order
+func (r *sinkRunner) backlogged() bool {
+	return r.wal != nil && r.wal.len() > 0
+}
+
+// buffer appends an item to the disk buffer
+func (r *sinkRunner) buffer(item sinkItem) {
+	if !r.backlogged() {
+		r.logger.Printf("sink %s: buffering to disk until the sink recovers\n", r.sink.Name())
+		r.nextReplay = time.Now().Add(r.retry)
+	}
+	data, err := encodeSinkItem(item)
+	if err == nil {
+		err = r.wal.append(data, time.Now())
+	}
+	if err != nil {
+		r.fail(fmt.Errorf("unable to buffer to disk, %w", err))
+		if item.event != nil {
+			r.lost.Add(1)
+		} else {
+			r.lost.Add(uint64(len(item.updates)))
+		}
+	}
+}
+
+// replay passes buffered records to the sink in order until the buffer is
+// empty, bufferReplayRecords were replayed or the sink fails again
+func (r *sinkRunner) replay(ctx context.Context, now time.Time) {
+	if n := r.wal.expire(now); n > 0 {
+		r.logger.Printf("sink %s: dropped %d buffered records older than %s\n", r.sink.Name(), n, r.opts.Buffer.MaxAge)
+	}
+	if !r.backlogged() || now.Before(r.nextReplay) {
+		return
+	}
+
+	records, err := r.wal.peek(bufferReplayRecords)
+	acked := 0
+	for _, record := range records {
+		item, dErr := decodeSinkItem(record.data)
+		if dErr != nil {
+			r.fail(fmt.Errorf("dropping invalid buffered record, %w", dErr))
+			acked++
+			continue
+		}
+		if err = r.deliverBuffered(ctx, item); err != nil {
+			break
+		}
+		acked++
+	}
+	if acked > 0 {
+		r.wal.ack(records[:acked])
+	}
+
+	if err != nil {
+		r.fail(err)
+		r.retry = min(r.retry*2, bufferMaxRetryInterval)
+		r.nextReplay = now.Add(r.retry)
+		return
+	}
+	r.retry = bufferCheckInterval
+	r.nextReplay = now
+	if !r.backlogged() {
+		r.logger.Printf("sink %s: recovered, buffer replayed\n", r.sink.Name())
+	}
+}
+
+// deliverBuffered passes a buffered item to the sink
+func (r *sinkRunner) deliverBuffered(ctx context.Context, item sinkItem) error {
+	if item.event != nil {
+		if err := r.sink.Session(ctx, *item.event); err != nil {
+			return err
+		}
+		r.events.Add(1)
+		return nil
+	}
+	if err := r.sink.Write(ctx, item.updates); err != nil {
+		return err
+	}
+	r.updates.Add(uint64(len(item.updates)))
+	return nil
+}
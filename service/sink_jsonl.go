@@ -0,0 +1,118 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/american-factory-os/glowplug/json_type"
+	"github.com/american-factory-os/glowplug/sparkplug"
+)
+
+func init() {
+	RegisterSink(SINK_JSONL, jsonlSinkFactory)
+}
+
+// jsonlRecord is a line written by the jsonl sink, a metric update or a
+// session event when Metric is empty
+type jsonlRecord struct {
+	Command   sparkplug.Command  `json:"command"`
+	Source    string             `json:"source,omitempty"`
+	Group     string             `json:"group"`
+	Node      string             `json:"node"`
+	Device    string             `json:"device,omitempty"`
+	Metric    string             `json:"metric,omitempty"`
+	Value     json_type.JsonType `json:"value,omitempty"`
+	Datatype  string             `json:"datatype,omitempty"`
+	Timestamp uint64             `json:"timestamp,omitempty"`
+	Received  int64              `json:"received"`
+}
+
+// jsonlSink appends metric updates and session events to a file as JSON lines
+type jsonlSink struct {
+	name string
+	file *os.File
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+// jsonlSinkFactory creates a jsonl sink with the option path, - writes to stdout
+func jsonlSinkFactory(logger *log.Logger, config SinkConfig) (Sink, error) {
+	if err := config.optionKeys("path"); err != nil {
+		return nil, err
+	}
+	path := config.Options["path"]
+	if len(path) == 0 {
+		return nil, fmt.Errorf("jsonl sink requires a path option")
+	}
+
+	file := os.Stdout
+	if path != "-" {
+		var err error
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open jsonl sink file, %w", err)
+		}
+	}
+
+	w := bufio.NewWriter(file)
+	return &jsonlSink{name: config.Name, file: file, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (s *jsonlSink) Name() string {
+	return s.name
+}
+
+func (s *jsonlSink) Start(ctx context.Context) error {
+	return nil
+}
+
+func (s *jsonlSink) Write(ctx context.Context, updates []MetricUpdate) error {
+	for _, u := range updates {
+		err := s.enc.Encode(jsonlRecord{
+			Command:   u.Topic.Command,
+			Source:    u.Topic.Source,
+			Group:     u.Topic.GroupId,
+			Node:      u.Topic.EdgeNodeId,
+			Device:    u.Topic.DeviceId,
+			Metric:    u.Name,
+			Value:     u.Value,
+			Datatype:  sparkplug.DataType_name[int32(u.Metric.Datatype)],
+			Timestamp: u.Timestamp(),
+			Received:  u.Received.UnixMilli(),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to write %s, %w", u.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *jsonlSink) Session(ctx context.Context, event SessionEvent) error {
+	return s.enc.Encode(jsonlRecord{
+		Command:  event.Topic.Command,
+		Source:   event.Topic.Source,
+		Group:    event.Topic.GroupId,
+		Node:     event.Topic.EdgeNodeId,
+		Device:   event.Topic.DeviceId,
+		Received: event.Received.UnixMilli(),
+	})
+}
+
+func (s *jsonlSink) Flush(ctx context.Context) error {
+	return s.w.Flush()
+}
+
+// Close flushes and closes the file
+func (s *jsonlSink) Close() error {
+	err := s.w.Flush()
+	if s.file != os.Stdout {
+		if cErr := s.file.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
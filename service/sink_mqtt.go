@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	RegisterSink(SINK_MQTT, mqttSinkFactory)
+}
+
+// DEFAULT_MQTT_INFLIGHT is the most publishes a mqtt sink waits for at once
+const DEFAULT_MQTT_INFLIGHT = 100
+
+// mqttSink publishes each metric to a human readable topic of a broker
+type mqttSink struct {
+	name   string
+	logger *log.Logger
+	broker brokerClient
+	// opts is replaced by setOpts
+	opts atomic.Pointer[PublishOpts]
+
+	// publishes run in the background, up to cap(inflight) at once. Flush
+	// waits for them and reports their errors.
+	inflight chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	failed   int
+	firstErr error
+}
+
+// newMQTTSink returns a sink publishing to broker, topics default to DefaultTopicFormat
+func newMQTTSink(logger *log.Logger, name string, broker brokerClient, opts PublishOpts) (*mqttSink, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Topics == nil {
+		topics, err := NewTopicNamespace(DefaultTopicFormat())
+		if err != nil {
+			return nil, err
+		}
+		opts.Topics = topics
+	}
+	s := &mqttSink{
+		name:     name,
+		logger:   logger,
+		broker:   broker,
+		inflight: make(chan struct{}, DEFAULT_MQTT_INFLIGHT),
+	}
+	s.opts.Store(&opts)
+	return s, nil
+}
+
+// Publisher publishes messages on a mqtt connection of the application. A
+// publisher with an IsConnected() bool method is not written to while it is
+// disconnected, so the updates can be buffered.
+type Publisher interface {
+	Publish(topic string, qos byte, retain bool, payload []byte) error
+}
+
+// NewMQTTSink returns a sink publishing metrics with a publisher of the
+// application, the mqtt v5 properties of deliveries are not sent. The
+// connection is not closed by the sink.
+func NewMQTTSink(logger *log.Logger, name string, publisher Publisher, opts PublishOpts) (Sink, error) {
+	sink, err := newMQTTSink(logger, name, &publisherClient{name: name, publisher: publisher}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// PahoPublisher returns a Publisher of a paho mqtt 3.1.1 client
+func PahoPublisher(client mqtt.Client) Publisher {
+	return pahoPublisher{client: client}
+}
+
+type pahoPublisher struct {
+	client mqtt.Client
+}
+
+func (p pahoPublisher) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	token := p.client.Publish(topic, qos, retain, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (p pahoPublisher) IsConnected() bool {
+	return p.client.IsConnected()
+}
+
+// publisherClient is the brokerClient of a Publisher, it only publishes
+type publisherClient struct {
+	name      string
+	publisher Publisher
+}
+
+func (c *publisherClient) Subscribe(filter string, qos byte) error {
+	return fmt.Errorf("publisher %s can't subscribe", c.name)
+}
+
+func (c *publisherClient) Unsubscribe(filter string) error {
+	return fmt.Errorf("publisher %s can't unsubscribe", c.name)
+}
+
+func (c *publisherClient) Publish(msg publishMessage) error {
+	return c.publisher.Publish(msg.topic, msg.qos, msg.retain, msg.payload)
+}
+
+// Disconnect leaves the connection to the application
+func (c *publisherClient) Disconnect() {}
+
+func (c *publisherClient) Status() BrokerStatus {
+	state := BROKER_STATE_CONNECTED
+	if p, ok := c.publisher.(interface{ IsConnected() bool }); ok && !p.IsConnected() {
+		state = BROKER_STATE_DISCONNECTED
+	}
+	return BrokerStatus{Name: c.name, State: state}
+}
+
+// setOpts replaces the topics, formats and deliveries of the published metrics
+func (s *mqttSink) setOpts(opts PublishOpts) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	s.opts.Store(&opts)
+	return nil
+}
+
+// mqttSinkFactory creates a mqtt sink with the options url, version,
+// topic-template, format, qos, retain and inflight
+func mqttSinkFactory(logger *log.Logger, config SinkConfig) (Sink, error) {
+	if err := config.optionKeys("url", "version", "topic-template", "format", "qos", "retain", "inflight"); err != nil {
+		return nil, err
+	}
+
+	topicFormat := DefaultTopicFormat()
+	if template, ok := config.Options["topic-template"]; ok {
+		topicFormat.Template = template
+	}
+	topics, err := NewTopicNamespace(topicFormat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic template, %w", err)
+	}
+	opts := PublishOpts{Topics: topics}
+
+	if format, ok := config.Options["format"]; ok {
+		f, err := ParsePublishFormat(format)
+		if err != nil {
+			return nil, err
+		}
+		opts.Formats = []PublishFormat{f}
+	}
+
+	var delivery PublishDelivery
+	if qos, ok := config.Options["qos"]; ok {
+		q, err := strconv.ParseUint(qos, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mqtt sink qos %s, %w", qos, err)
+		}
+		delivery.QoS = byte(q)
+	}
+	if retain, ok := config.Options["retain"]; ok {
+		if delivery.Retain, err = strconv.ParseBool(retain); err != nil {
+			return nil, fmt.Errorf("invalid mqtt sink retain %s, %w", retain, err)
+		}
+	}
+	opts.Deliveries = []PublishDelivery{delivery}
+
+	brokerOpts := BrokerOpts{Version: MQTT_VERSION_3}
+	if version, ok := config.Options["version"]; ok {
+		if brokerOpts.Version, err = strconv.Atoi(version); err != nil {
+			return nil, fmt.Errorf("invalid mqtt sink version %s, %w", version, err)
+		}
+	}
+
+	inflight := DEFAULT_MQTT_INFLIGHT
+	if n, ok := config.Options["inflight"]; ok {
+		if inflight, err = strconv.Atoi(n); err != nil || inflight < 1 {
+			return nil, fmt.Errorf("invalid mqtt sink inflight %s, must be a positive number", n)
+		}
+	}
+
+	url := config.Options["url"]
+	if len(url) == 0 {
+		return nil, fmt.Errorf("mqtt sink requires a url option")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	broker, err := brokerClientFromURL(logger, config.Name, url, brokerOpts, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := newMQTTSink(logger, config.Name, broker, opts)
+	if err != nil {
+		return nil, err
+	}
+	sink.inflight = make(chan struct{}, inflight)
+	return sink, nil
+}
+
+func (s *mqttSink) Name() string {
+	return s.name
+}
+
+func (s *mqttSink) Start(ctx context.Context) error {
+	return nil
+}
+
+// Write publishes each metric in the background, it waits when too many
+// publishes are in flight
+func (s *mqttSink) Write(ctx context.Context, updates []MetricUpdate) error {
+	// fail while disconnected so the updates can be buffered
+	if status := s.broker.Status(); status.State != BROKER_STATE_CONNECTED {
+		return fmt.Errorf("mqtt broker %s is %s", status.URL, status.State)
+	}
+
+	opts := s.opts.Load()
+	for _, u := range updates {
+		msg, err := opts.message(u)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case s.inflight <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.wg.Add(1)
+		go func(msg publishMessage) {
+			defer func() {
+				<-s.inflight
+				s.wg.Done()
+			}()
+			if err := s.broker.Publish(msg); err != nil {
+				s.mu.Lock()
+				if s.failed == 0 {
+					s.firstErr = err
+				}
+				s.failed++
+				s.mu.Unlock()
+			}
+		}(msg)
+	}
+	return nil
+}
+
+func (s *mqttSink) Session(ctx context.Context, event SessionEvent) error {
+	return nil
+}
+
+// Flush waits for the publishes in progress and returns their errors
+func (s *mqttSink) Flush(ctx context.Context) error {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%d publishes failed, %w", s.failed, s.firstErr)
+	s.failed, s.firstErr = 0, nil
+	return err
+}
+
+// Close disconnects from the broker
+func (s *mqttSink) Close() error {
+	s.wg.Wait()
+	s.broker.Disconnect()
+	return nil
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	RegisterSink(SINK_REDIS, redisSinkFactory)
+}
+
+// redisSink stores the last value of each metric in redis and publishes it
+// to a redis channel named after the key
+type redisSink struct {
+	name   string
+	logger *log.Logger
+	rdb    redis.UniversalClient
+	opts   RedisOpts
+	// keys starts as opts.Keys and is replaced by setKeys
+	keys atomic.Pointer[Namespace]
+	// owned is true when the sink created the client and closes it
+	owned     bool
+	seen      sync.Map
+	nodeOfKey sync.Map
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// newRedisSink returns a sink writing to rdb, keys default to DefaultKeyFormat
+func newRedisSink(logger *log.Logger, name string, rdb redis.UniversalClient, opts RedisOpts) (*redisSink, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Keys == nil {
+		keys, err := NewNamespace(DefaultKeyFormat())
+		if err != nil {
+			return nil, err
+		}
+		opts.Keys = keys
+	}
+	s := &redisSink{
+		name:   name,
+		logger: logger,
+		rdb:    rdb,
+		opts:   opts,
+	}
+	s.keys.Store(opts.Keys)
+	return s, nil
+}
+
+// NewRedisSink returns a sink storing metrics with a redis client of the
+// application, the client is not closed by the sink
+func NewRedisSink(logger *log.Logger, name string, rdb redis.UniversalClient, opts RedisOpts) (Sink, error) {
+	sink, err := newRedisSink(logger, name, rdb, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// setKeys replaces the key namespace, metrics are written to their new keys
+// from the next batch and the old keys are left to the expire policy
+func (s *redisSink) setKeys(keys *Namespace) {
+	s.keys.Store(keys)
+}
+
+// redisSinkFactory creates a redis sink with the options url, layout, expire,
+// expire-after, key-template and key-case
+func redisSinkFactory(logger *log.Logger, config SinkConfig) (Sink, error) {
+	if err := config.optionKeys("url", "layout", "expire", "expire-after", "key-template", "key-case"); err != nil {
+		return nil, err
+	}
+
+	var opts RedisOpts
+	var err error
+	if opts.Layout, err = ParseRedisLayout(config.Options["layout"]); err != nil {
+		return nil, err
+	}
+	if opts.ExpirePolicy, err = ParseRedisExpirePolicy(config.Options["expire"]); err != nil {
+		return nil, err
+	}
+	if after, ok := config.Options["expire-after"]; ok {
+		if opts.ExpireAfter, err = time.ParseDuration(after); err != nil {
+			return nil, fmt.Errorf("invalid redis expire after %s, %w", after, err)
+		}
+	}
+
+	format := DefaultKeyFormat()
+	if template, ok := config.Options["key-template"]; ok {
+		format.Template = template
+	}
+	if keyCase, ok := config.Options["key-case"]; ok {
+		format.Case = keyCase
+	}
+	if opts.Keys, err = NewNamespace(format); err != nil {
+		return nil, fmt.Errorf("invalid redis key template, %w", err)
+	}
+
+	url := config.Options["url"]
+	if len(url) == 0 {
+		return nil, fmt.Errorf("redis sink requires a url option")
+	}
+	rdb, err := NewRedis(url)
+	if err != nil {
+		return nil, err
+	}
+
+	sink, err := newRedisSink(logger, config.Name, *rdb, opts)
+	if err != nil {
+		(*rdb).Close()
+		return nil, err
+	}
+	sink.owned = true
+	return sink, nil
+}
+
+func (s *redisSink) Name() string {
+	return s.name
+}
+
+// Start looks for stale metrics in the background when the expire policy needs it
+func (s *redisSink) Start(ctx context.Context) error {
+	if s.opts.tracksUpdates() {
+		ctx, s.cancel = context.WithCancel(ctx)
+		s.done = make(chan struct{})
+		go s.sweep(ctx)
+	}
+	return nil
+}
+
+// sweep periodically looks for stale metrics until ctx is done
+func (s *redisSink) sweep(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(sweepInterval(s.opts.ExpireAfter))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := s.sweepStaleMetrics(ctx, now)
+			if err != nil {
+				s.logger.Println(err)
+			} else if n > 0 {
+				s.logger.Printf("applied redis expire policy %s to %d stale metrics\n", s.opts.ExpirePolicy, n)
+			}
+		}
+	}
+}
+
+// Write stores a batch of metrics in one pipeline
+func (s *redisSink) Write(ctx context.Context, updates []MetricUpdate) error {
+	now := time.Now()
+	keys := s.keys.Load()
+	// edge nodes are tracked once per batch
+	tracked := map[string]bool{}
+
+	var recordErr error
+	err := execPipeline(ctx, s.rdb, func(pipe redis.Pipeliner) {
+		for _, u := range updates {
+			key := keys.Render(u.Topic, u.Name)
+			typeName := sparkplug.DataType_name[int32(u.Metric.Datatype)]
+
+			_, seen := s.seen.Load(key)
+			if !seen {
+				s.seen.Store(key, true)
+				// save human readable metric type in a redis hash
+				pipe.HSet(ctx, HASH_METRIC_TYPES, key, typeName)
+			}
+
+			if s.opts.Layout == REDIS_LAYOUT_HASH {
+				// store a record of the metric in a redis hash
+				record, err := metricRecord(u)
+				if err != nil {
+					recordErr = err
+					continue
+				}
+				pipe.HSet(ctx, key, record)
+			} else {
+				// store the metric value in a redis set
+				var ttl time.Duration
+				if s.opts.ExpirePolicy == REDIS_EXPIRE_TTL {
+					ttl = s.opts.ExpireAfter
+				}
+				pipe.Set(ctx, key, u.Value, ttl)
+			}
+
+			// track when and where the metric was last seen, by the topic it was received on
+			topic := u.Identity.topic(u.Topic)
+			nodeKey := nodeKeyFromTopic(topic)
+			s.trackMetric(ctx, pipe, topic, u.Identity, key, !tracked[nodeKey], seen, now)
+			tracked[nodeKey] = true
+
+			// publish metric value to redis channel
+			pipe.Publish(ctx, key, u.Value)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return recordErr
+}
+
+// Session applies the expire policy when an edge node or device dies
+func (s *redisSink) Session(ctx context.Context, event SessionEvent) error {
+	if event.Topic.Command == sparkplug.NDEATH || event.Topic.Command == sparkplug.DDEATH {
+		return s.processDeath(ctx, event.Topic)
+	}
+	return nil
+}
+
+func (s *redisSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close stops looking for stale metrics and closes a client the sink created
+func (s *redisSink) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	if s.owned {
+		return s.rdb.Close()
+	}
+	return nil
+}
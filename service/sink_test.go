@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/american-factory-os/glowplug/json_type"
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSinkConfig(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    SinkConfig
+		wantErr bool
+	}{
+		{spec: "jsonl,path=-", want: SinkConfig{Type: "jsonl", Options: map[string]string{"path": "-"}}},
+		{spec: "redis, name=archive, url=redis://archive:6379/0", want: SinkConfig{Type: "redis", Name: "archive", Options: map[string]string{"url": "redis://archive:6379/0"}}},
+		{spec: "mqtt", want: SinkConfig{Type: "mqtt", Options: map[string]string{}}},
+		{spec: "jsonl,path", wantErr: true},
+		{spec: ",path=-", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseSinkConfig(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+
+	_, err := NewSink(logger, SinkConfig{Type: "kafka"})
+	assert.ErrorContains(t, err, "unknown sink type kafka")
+
+	_, err = NewSink(logger, SinkConfig{Type: SINK_JSONL, Options: map[string]string{"file": "-"}})
+	assert.ErrorContains(t, err, "invalid jsonl sink option file")
+
+	_, err = NewSink(logger, SinkConfig{Type: SINK_REDIS, Options: map[string]string{}})
+	assert.ErrorContains(t, err, "requires a url option")
+
+	sink, err := NewSink(logger, SinkConfig{Type: SINK_JSONL, Options: map[string]string{"path": filepath.Join(t.TempDir(), "out.jsonl")}})
+	require.NoError(t, err)
+	assert.Equal(t, SINK_JSONL, sink.Name())
+	assert.NoError(t, sink.Close())
+}
+
+func TestJsonlSink(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+
+	sink, err := NewSink(logger, SinkConfig{Type: SINK_JSONL, Name: "archive", Options: map[string]string{"path": path}})
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, sink.Start(ctx))
+
+	received := time.UnixMilli(1700000000500)
+	topic := sparkplug.Topic{Command: sparkplug.DDATA, GroupId: "Plant1", EdgeNodeId: "Heater", DeviceId: "TempSensor"}
+	metric := &sparkplug.Payload_Metric{
+		Name:      "Celsius",
+		Datatype:  uint32(sparkplug.DataType_Double),
+		Timestamp: 1700000000000,
+		Value:     &sparkplug.Payload_Metric_DoubleValue{DoubleValue: 42.5},
+	}
+	value, err := json_type.MetricValueToJsonType(metric)
+	require.NoError(t, err)
+
+	require.NoError(t, sink.Session(ctx, SessionEvent{Topic: sparkplug.Topic{Command: sparkplug.DBIRTH, GroupId: "Plant1", EdgeNodeId: "Heater", DeviceId: "TempSensor"}, Received: received}))
+	require.NoError(t, sink.Write(ctx, []MetricUpdate{{
+		Topic:    topic,
+		Name:     "Celsius",
+		Received: received,
+		Payload:  &sparkplug.Payload{},
+		Metric:   metric,
+		Value:    value,
+	}}))
+	require.NoError(t, sink.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 2)
+
+	assert.Equal(t, "DBIRTH", lines[0]["command"])
+	assert.NotContains(t, lines[0], "metric")
+
+	assert.Equal(t, "DDATA", lines[1]["command"])
+	assert.Equal(t, "TempSensor", lines[1]["device"])
+	assert.Equal(t, "Celsius", lines[1]["metric"])
+	assert.Equal(t, 42.5, lines[1]["value"])
+	assert.Equal(t, "Double", lines[1]["datatype"])
+	assert.Equal(t, float64(1700000000000), lines[1]["timestamp"])
+	assert.Equal(t, float64(1700000000500), lines[1]["received"])
+}
+
+// failingSink returns err from every call
+type failingSink struct {
+	err error
+}
+
+func (s *failingSink) Name() string                                            { return "failing" }
+func (s *failingSink) Start(ctx context.Context) error                         { return nil }
+func (s *failingSink) Write(ctx context.Context, updates []MetricUpdate) error { return s.err }
+func (s *failingSink) Session(ctx context.Context, event SessionEvent) error   { return s.err }
+func (s *failingSink) Flush(ctx context.Context) error                         { return s.err }
+func (s *failingSink) Close() error                                            { return nil }
+
+func TestSinkRunner(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	sink := &failingSink{}
+	r := newSinkRunner(logger, sink, QueueOpts{})
+	ctx := context.Background()
+
+	r.write(ctx, make([]MetricUpdate, 3))
+	r.session(ctx, SessionEvent{})
+	stats := r.stats()
+	assert.Equal(t, SinkStats{Name: "failing", Updates: 3, Events: 1}, stats)
+
+	sink.err = errors.New("connection refused")
+	r.write(ctx, make([]MetricUpdate, 2))
+	r.flush(ctx)
+	stats = r.stats()
+	assert.Equal(t, uint64(3), stats.Updates)
+	assert.Equal(t, uint64(2), stats.Errors)
+	assert.Equal(t, "connection refused", stats.LastError)
+	assert.NotNil(t, stats.LastErrorAt)
+}
+
+func TestNewWorkerDuplicateSink(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	_, err := NewWorker(logger, WorkerOpts{Sinks: []Sink{&failingSink{}, &failingSink{}}})
+	assert.ErrorContains(t, err, "failing")
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+)
+
+// websocketSink pushes each metric to the clients of the websocket server
+type websocketSink struct {
+	wss WebsocketServer
+}
+
+// newWebsocketSink returns a sink pushing to wss, which is served on /ws
+func newWebsocketSink(wss WebsocketServer) *websocketSink {
+	return &websocketSink{wss: wss}
+}
+
+func (s *websocketSink) Name() string {
+	return SINK_WEBSOCKET
+}
+
+func (s *websocketSink) Start(ctx context.Context) error {
+	return nil
+}
+
+// Write pushes the metrics while the websocket server is running
+func (s *websocketSink) Write(ctx context.Context, updates []MetricUpdate) error {
+	if !s.wss.IsRunning() {
+		return nil
+	}
+	for _, u := range updates {
+		topic := u.Topic
+		if err := s.wss.PushData(WebsocketMetricMessage{
+			Topic:     &topic,
+			Alias:     u.Metric.GetAlias(),
+			Name:      u.Name,
+			Value:     u.Value,
+			Timestamp: u.Metric.Timestamp,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *websocketSink) Session(ctx context.Context, event SessionEvent) error {
+	return nil
+}
+
+func (s *websocketSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (s *websocketSink) Close() error {
+	return nil
+}
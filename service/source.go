@@ -0,0 +1,117 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sourceNameRegexp matches names usable in redis keys, mqtt topics and environment variables
+var sourceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Source is a named broker glowplug reads Sparkplug messages from
+type Source struct {
+	// Name is available as the {source} namespace placeholder and in websocket messages
+	Name string
+	URL  string
+	// Broker configures the connection to the broker
+	Broker BrokerOpts
+	// Subscriptions are the topic filters of the broker, DefaultSubscriptions when empty
+	Subscriptions []Subscription
+	// Scope selects the groups, edge nodes and devices to process
+	Scope Scope
+}
+
+// ParseSource parses a source as name=url, e.g. plant1=mqtts://broker.plant1:8883
+func ParseSource(s string) (Source, error) {
+	name, url, ok := strings.Cut(s, "=")
+	if !ok {
+		return Source{}, fmt.Errorf("invalid source %s, expected name=url", RedactURL(s))
+	}
+	return Source{Name: strings.TrimSpace(name), URL: strings.TrimSpace(url)}, nil
+}
+
+// Validate returns an error if the name, URL, broker options or filters are invalid
+func (s Source) Validate() error {
+	if len(s.Name) > 0 && !sourceNameRegexp.MatchString(s.Name) {
+		return fmt.Errorf("invalid source name %s, use letters, digits, _ and -", s.Name)
+	}
+	if len(s.URL) <= 14 {
+		return fmt.Errorf("mqtt broker URL too short: %s", RedactURL(s.URL))
+	}
+	if err := s.Broker.Validate(); err != nil {
+		return fmt.Errorf("invalid mqtt broker options of source %s, %w", s.displayName(), err)
+	}
+	for _, sub := range s.Subscriptions {
+		if err := sub.Validate(); err != nil {
+			return err
+		}
+	}
+	return s.Scope.Validate()
+}
+
+// displayName returns the name of the source in logs and health reports
+func (s Source) displayName() string {
+	if len(s.Name) == 0 {
+		return BROKER_SOURCE
+	}
+	return s.Name
+}
+
+// subscriptions returns the topic filters of the source
+func (s Source) subscriptions() []Subscription {
+	if len(s.Subscriptions) == 0 {
+		return DefaultSubscriptions()
+	}
+	return s.Subscriptions
+}
+
+// sources returns the unnamed source of MQTTBrokerURL followed by the named sources
+func (o Opts) sources() []Source {
+	var sources []Source
+	if len(o.MQTTBrokerURL) > 0 {
+		sources = append(sources, Source{
+			URL:           o.MQTTBrokerURL,
+			Broker:        o.MQTTBroker,
+			Subscriptions: o.Subscriptions,
+			Scope:         o.Scope,
+		})
+	}
+	return append(sources, o.Sources...)
+}
+
+// validateSources returns an error if there are no sources, a source is
+// invalid or a name is used twice
+func validateSources(sources []Source) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("no mqtt source broker, set a broker URL or a source")
+	}
+	names := map[string]bool{}
+	for _, source := range sources {
+		if err := source.Validate(); err != nil {
+			return err
+		}
+		if names[source.Name] {
+			if len(source.Name) == 0 {
+				return fmt.Errorf("only one source may be unnamed")
+			}
+			return fmt.Errorf("duplicate source name %s", source.Name)
+		}
+		names[source.Name] = true
+	}
+	return nil
+}
+
+// sourceBroker is the connection to a source
+type sourceBroker struct {
+	Source
+	broker brokerClient
+	// tls is the hash of the TLS files the connection was made with
+	tls string
+}
+
+// changed returns true if source connects with other settings than the
+// connection, including the contents of its TLS files
+func (sb *sourceBroker) changed(source Source) bool {
+	return sb.URL != source.URL || sb.Broker != source.Broker || sb.tls != source.Broker.tlsFiles()
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+)
+
+// Subscription is a topic filter glowplug subscribes to on the source broker
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+// DefaultSubscriptions returns the subscription to all sparkplug topics
+func DefaultSubscriptions() []Subscription {
+	return []Subscription{{Filter: fmt.Sprintf("%s/#", sparkplug.SPB_NS)}}
+}
+
+// ParseSubscription parses a topic filter with an optional QoS, e.g.
+// spBv1.0/PlantA/# or spBv1.0/PlantA/#,qos=1
+func ParseSubscription(s string) (Subscription, error) {
+	filter, options, _ := strings.Cut(s, ",")
+	sub := Subscription{Filter: strings.TrimSpace(filter)}
+
+	if len(options) > 0 {
+		key, value, ok := strings.Cut(strings.TrimSpace(options), "=")
+		if !ok || key != "qos" {
+			return sub, fmt.Errorf("invalid subscription %s, expected filter[,qos=N]", s)
+		}
+		qos, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return sub, fmt.Errorf("invalid subscription qos %s, %w", value, err)
+		}
+		sub.QoS = byte(qos)
+	}
+
+	return sub, sub.Validate()
+}
+
+// Validate returns an error if the filter is not a sparkplug topic filter or the QoS is invalid
+func (s Subscription) Validate() error {
+	if err := validateTopicFilter(s.Filter); err != nil {
+		return err
+	}
+	if !topicMatchesFilter(strings.Split(s.Filter, topicDelimiter)[0], sparkplug.SPB_NS) {
+		return fmt.Errorf("invalid subscription %s, must start with %s/", s.Filter, sparkplug.SPB_NS)
+	}
+	if s.QoS > 2 {
+		return fmt.Errorf("invalid subscription qos %d, must be 0, 1 or 2", s.QoS)
+	}
+	return nil
+}
+
+// Scope selects the groups, edge nodes and devices glowplug processes. Patterns
+// are group[/node[/device]] with shell wildcards in each segment, e.g. PlantA/*
+// or Plant*/Heater/Temp*. Segments missing from a pattern match anything. Node
+// messages are included with any of their devices, but only excluded by
+// patterns without a device.
+type Scope struct {
+	// Include selects the messages to process, all when empty
+	Include []string
+	// Exclude drops messages even when they are included
+	Exclude []string
+}
+
+// Validate returns an error if a pattern is malformed
+func (s Scope) Validate() error {
+	for _, pattern := range append(append([]string{}, s.Include...), s.Exclude...) {
+		segments := strings.Split(pattern, topicDelimiter)
+		if len(pattern) == 0 || len(segments) > 3 {
+			return fmt.Errorf("invalid scope pattern %q, expected group[/node[/device]]", pattern)
+		}
+		for _, segment := range segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid scope pattern %q, %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the messages of a topic are in scope
+func (s Scope) Matches(topic *sparkplug.Topic) bool {
+	included := len(s.Include) == 0
+	for _, pattern := range s.Include {
+		if scopePatternMatches(pattern, topic, true) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+
+	for _, pattern := range s.Exclude {
+		if scopePatternMatches(pattern, topic, false) {
+			return false
+		}
+	}
+	return true
+}
+
+// scopePatternMatches matches each segment of a pattern with the group, node and
+// device of a topic, segments the topic does not have match when partial is true
+func scopePatternMatches(pattern string, topic *sparkplug.Topic, partial bool) bool {
+	values := []string{topic.GroupId, topic.EdgeNodeId, topic.DeviceId}
+	for i, segment := range strings.Split(pattern, topicDelimiter) {
+		if len(values[i]) == 0 {
+			if partial {
+				continue
+			}
+			return false
+		}
+		if ok, _ := path.Match(segment, values[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSubscription(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Subscription
+		wantErr bool
+	}{
+		{spec: "spBv1.0/PlantA/#", want: Subscription{Filter: "spBv1.0/PlantA/#"}},
+		{spec: "spBv1.0/+/NDATA/#, qos=1", want: Subscription{Filter: "spBv1.0/+/NDATA/#", QoS: 1}},
+		{spec: "+/PlantA/#,qos=2", want: Subscription{Filter: "+/PlantA/#", QoS: 2}},
+		{spec: "spBv1.0/PlantA/#,qos=3", wantErr: true},
+		{spec: "spBv1.0/PlantA/#,retain=true", wantErr: true},
+		{spec: "glowplug/#", wantErr: true},
+		{spec: "spBv1.0/#/NDATA", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseSubscription(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestScopeMatches(t *testing.T) {
+	node := &sparkplug.Topic{GroupId: "PlantA", Command: sparkplug.NDATA, EdgeNodeId: "Heater"}
+	device := &sparkplug.Topic{GroupId: "PlantA", Command: sparkplug.DDATA, EdgeNodeId: "Heater", DeviceId: "TempSensor"}
+	other := &sparkplug.Topic{GroupId: "PlantB", Command: sparkplug.DDATA, EdgeNodeId: "Heater", DeviceId: "Camera"}
+
+	tests := []struct {
+		name  string
+		scope Scope
+		topic *sparkplug.Topic
+		want  bool
+	}{
+		{name: "empty scope", scope: Scope{}, topic: other, want: true},
+		{name: "group included", scope: Scope{Include: []string{"PlantA"}}, topic: device, want: true},
+		{name: "group not included", scope: Scope{Include: []string{"PlantA"}}, topic: other, want: false},
+		{name: "wildcard group", scope: Scope{Include: []string{"Plant*/Heater"}}, topic: other, want: true},
+		{name: "device included", scope: Scope{Include: []string{"PlantA/Heater/Temp*"}}, topic: device, want: true},
+		{name: "node of included device", scope: Scope{Include: []string{"PlantA/Heater/Temp*"}}, topic: node, want: true},
+		{name: "device excluded", scope: Scope{Include: []string{"Plant*"}, Exclude: []string{"*/*/Camera"}}, topic: other, want: false},
+		{name: "node of excluded device", scope: Scope{Exclude: []string{"*/*/Camera"}}, topic: node, want: true},
+		{name: "node excluded", scope: Scope{Exclude: []string{"PlantA/Heater"}}, topic: device, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.scope.Matches(tt.topic))
+		})
+	}
+}
+
+func TestScopeValidate(t *testing.T) {
+	assert.NoError(t, Scope{Include: []string{"PlantA/*"}, Exclude: []string{"*/*/Camera?"}}.Validate())
+	assert.Error(t, Scope{Include: []string{"PlantA/Heater/Camera/Lens"}}.Validate())
+	assert.Error(t, Scope{Exclude: []string{"Plant[A"}}.Validate())
+	assert.Error(t, Scope{Include: []string{""}}.Validate())
+}
@@ -0,0 +1,537 @@
+package service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Buffer defaults
+const (
+	DEFAULT_BUFFER_MAX_BYTES     = 1 << 30
+	DEFAULT_BUFFER_SEGMENT_BYTES = 16 << 20
+)
+
+const (
+	walSegmentSuffix = ".seg"
+	walCursorFile    = "cursor"
+	// a record is its length, crc32 and append time in ms, followed by its data
+	walHeaderSize = 16
+	// walMaxRecord guards against reading a corrupt length
+	walMaxRecord = 256 << 20
+)
+
+// BufferOpts configures the disk buffer of a sink, which stores updates while
+// the sink is down and replays them in order once it recovers
+type BufferOpts struct {
+	// Dir holds a directory of segment files for each sink, empty disables the buffer
+	Dir string
+	// MaxBytes drops the oldest segments when the buffer grows larger,
+	// defaults to DEFAULT_BUFFER_MAX_BYTES
+	MaxBytes int64
+	// MaxAge drops segments last written longer ago, zero keeps them
+	MaxAge time.Duration
+	// SegmentBytes is the size of a segment file before a new one is started,
+	// defaults to DEFAULT_BUFFER_SEGMENT_BYTES or MaxBytes when smaller
+	SegmentBytes int64
+}
+
+// enabled returns true when a buffer directory is set
+func (o BufferOpts) enabled() bool {
+	return len(o.Dir) > 0
+}
+
+// withDefaults returns the options with zero values replaced by defaults
+func (o BufferOpts) withDefaults() BufferOpts {
+	if o.MaxBytes == 0 {
+		o.MaxBytes = DEFAULT_BUFFER_MAX_BYTES
+	}
+	if o.SegmentBytes == 0 {
+		o.SegmentBytes = DEFAULT_BUFFER_SEGMENT_BYTES
+	}
+	if o.SegmentBytes > o.MaxBytes {
+		o.SegmentBytes = o.MaxBytes
+	}
+	return o
+}
+
+// Validate returns an error if the options are out of range
+func (o BufferOpts) Validate() error {
+	if o.MaxBytes < 0 {
+		return fmt.Errorf("invalid buffer max bytes %d, must not be negative", o.MaxBytes)
+	}
+	if o.MaxAge < 0 {
+		return fmt.Errorf("invalid buffer max age %s, must not be negative", o.MaxAge)
+	}
+	if o.SegmentBytes < 0 {
+		return fmt.Errorf("invalid buffer segment bytes %d, must not be negative", o.SegmentBytes)
+	}
+	return nil
+}
+
+// BufferStats reports the backlog of a sink waiting on disk
+type BufferStats struct {
+	Records  int   `json:"records"`
+	Bytes    int64 `json:"bytes"`
+	Segments int   `json:"segments"`
+	// Oldest is when the oldest record waiting was buffered
+	Oldest *time.Time `json:"oldest,omitempty"`
+	// Dropped records exceeded the size or age limits
+	Dropped uint64 `json:"dropped"`
+}
+
+// walPosition is a position in the segments of a wal
+type walPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// walSegment is a segment file, records counts the records after the cursor
+type walSegment struct {
+	seq     uint64
+	size    int64
+	records int
+	// first is when the first record after the cursor was appended, last when
+	// the last record was appended
+	first time.Time
+	last  time.Time
+}
+
+// walRecord is a record read from a wal, end is the position after it
+type walRecord struct {
+	data []byte
+	end  walPosition
+}
+
+// wal is an append only queue of records in segment files. Records are read
+// from a cursor and removed when they are acknowledged. It is used from one
+// goroutine, except stats.
+type wal struct {
+	dir      string
+	opts     BufferOpts
+	segments []*walSegment
+	// file appends to the last segment
+	file    *os.File
+	cursor  walPosition
+	nextSeq uint64
+	records atomic.Int64
+	bytes   atomic.Int64
+	oldest  atomic.Int64
+	nsegs   atomic.Int64
+	dropped atomic.Uint64
+}
+
+// openWAL opens the wal in dir, counting the records left after the cursor
+// and truncating a partly written record at the end of the last segment
+func openWAL(dir string, opts BufferOpts) (*wal, error) {
+	opts = opts.withDefaults()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create buffer directory %s, %w", dir, err)
+	}
+	w := &wal{dir: dir, opts: opts, nextSeq: 1}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read buffer directory %s, %w", dir, err)
+	}
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	if data, err := os.ReadFile(filepath.Join(dir, walCursorFile)); err == nil {
+		if err := json.Unmarshal(data, &w.cursor); err != nil {
+			return nil, fmt.Errorf("invalid buffer cursor in %s, %w", dir, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read buffer cursor in %s, %w", dir, err)
+	}
+
+	for i, seq := range seqs {
+		w.nextSeq = seq + 1
+		path := w.segmentPath(seq)
+		if seq < w.cursor.Segment {
+			// read before the cursor was last saved
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("unable to remove buffer segment %s, %w", path, err)
+			}
+			continue
+		}
+
+		var offset int64
+		if seq == w.cursor.Segment {
+			offset = w.cursor.Offset
+		}
+		seg, err := scanSegment(path, seq, offset, i == len(seqs)-1)
+		if err != nil {
+			return nil, err
+		}
+		w.segments = append(w.segments, seg)
+	}
+
+	if len(w.segments) == 0 || w.segments[0].seq != w.cursor.Segment {
+		w.cursor = walPosition{}
+		if len(w.segments) > 0 {
+			w.cursor.Segment = w.segments[0].seq
+		}
+	}
+	w.compact()
+	w.updateStats()
+	return w, nil
+}
+
+// scanSegment counts the records of a segment after offset, a partly written
+// record at the end of the last segment is truncated
+func scanSegment(path string, seq uint64, offset int64, last bool) (*walSegment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open buffer segment %s, %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	seg := &walSegment{seq: seq, size: info.Size(), last: info.ModTime()}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	pos := offset
+	for pos < seg.size {
+		_, appended, n, err := readRecord(r)
+		if err != nil {
+			if !last {
+				return nil, fmt.Errorf("corrupt buffer segment %s at %d, %w", path, pos, err)
+			}
+			if err := f.Truncate(pos); err != nil {
+				return nil, fmt.Errorf("unable to truncate buffer segment %s, %w", path, err)
+			}
+			seg.size = pos
+			break
+		}
+		if seg.records == 0 {
+			seg.first = appended
+		}
+		seg.records++
+		pos += n
+	}
+	return seg, nil
+}
+
+// readRecord reads a record, returning its data, append time and size
+func readRecord(r io.Reader) ([]byte, time.Time, int64, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > walMaxRecord {
+		return nil, time.Time{}, 0, fmt.Errorf("record length %d too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, time.Time{}, 0, fmt.Errorf("record checksum mismatch")
+	}
+	appended := time.UnixMilli(int64(binary.BigEndian.Uint64(header[8:16])))
+	return data, appended, int64(walHeaderSize + length), nil
+}
+
+func (w *wal) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walSegmentSuffix))
+}
+
+// len returns the number of records after the cursor
+func (w *wal) len() int {
+	return int(w.records.Load())
+}
+
+// append adds a record, dropping the oldest segments beyond the size limit
+func (w *wal) append(data []byte, now time.Time) error {
+	if len(w.segments) == 0 || w.file == nil || w.segments[len(w.segments)-1].size >= w.opts.SegmentBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, walHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(now.UnixMilli()))
+	copy(buf[walHeaderSize:], data)
+
+	seg := w.segments[len(w.segments)-1]
+	n, err := w.file.Write(buf)
+	seg.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("unable to append to buffer segment %d, %w", seg.seq, err)
+	}
+	if seg.records == 0 {
+		seg.first = now
+	}
+	seg.records++
+	seg.last = now
+
+	for w.totalBytes() > w.opts.MaxBytes && len(w.segments) > 1 {
+		w.drop()
+	}
+	w.updateStats()
+	return nil
+}
+
+// rotate starts a new segment
+func (w *wal) rotate() error {
+	if w.file != nil {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		w.file = nil
+	}
+
+	seq := w.nextSeq
+	f, err := os.OpenFile(w.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to create buffer segment, %w", err)
+	}
+	w.file = f
+	w.nextSeq++
+	w.segments = append(w.segments, &walSegment{seq: seq})
+	if len(w.segments) == 1 {
+		w.cursor = walPosition{Segment: seq}
+	}
+	return nil
+}
+
+// drop removes the oldest segment with its unread records
+func (w *wal) drop() {
+	seg := w.segments[0]
+	if len(w.segments) == 1 && w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	os.Remove(w.segmentPath(seg.seq))
+	w.dropped.Add(uint64(seg.records))
+	w.segments = w.segments[1:]
+	w.cursor = walPosition{}
+	if len(w.segments) > 0 {
+		w.cursor.Segment = w.segments[0].seq
+	}
+	w.saveCursor()
+}
+
+// expire drops the segments last written longer than MaxAge ago
+func (w *wal) expire(now time.Time) int {
+	if w.opts.MaxAge == 0 {
+		return 0
+	}
+	dropped := 0
+	for len(w.segments) > 0 && now.Sub(w.segments[0].last) > w.opts.MaxAge {
+		dropped += w.segments[0].records
+		w.drop()
+	}
+	w.updateStats()
+	return dropped
+}
+
+// peek reads up to max records after the cursor without removing them
+func (w *wal) peek(max int) ([]walRecord, error) {
+	var records []walRecord
+	pos := w.cursor
+	for i := 0; i < len(w.segments) && len(records) < max; i++ {
+		seg := w.segments[i]
+		if seg.seq < pos.Segment {
+			continue
+		}
+		if seg.seq > pos.Segment {
+			pos = walPosition{Segment: seg.seq}
+		}
+		if pos.Offset >= seg.size {
+			continue
+		}
+
+		f, err := os.Open(w.segmentPath(seg.seq))
+		if err != nil {
+			return records, fmt.Errorf("unable to open buffer segment %d, %w", seg.seq, err)
+		}
+		if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return records, err
+		}
+		r := bufio.NewReader(f)
+		for pos.Offset < seg.size && len(records) < max {
+			data, _, n, err := readRecord(r)
+			if err != nil {
+				f.Close()
+				return records, fmt.Errorf("unable to read buffer segment %d at %d, %w", seg.seq, pos.Offset, err)
+			}
+			pos.Offset += n
+			records = append(records, walRecord{data: data, end: pos})
+		}
+		f.Close()
+	}
+	return records, nil
+}
+
+// ack removes the acknowledged records, which were returned by peek
+func (w *wal) ack(acked []walRecord) {
+	for _, record := range acked {
+		for _, seg := range w.segments {
+			if seg.seq == record.end.Segment {
+				seg.records--
+				break
+			}
+		}
+	}
+	w.cursor = acked[len(acked)-1].end
+	w.compact()
+	w.updateFirst()
+	w.saveCursor()
+	w.updateStats()
+}
+
+// compact removes the segments read to the end
+func (w *wal) compact() {
+	for len(w.segments) > 0 {
+		seg := w.segments[0]
+		read := seg.seq < w.cursor.Segment || (seg.seq == w.cursor.Segment && w.cursor.Offset >= seg.size)
+		if !read {
+			return
+		}
+		if len(w.segments) == 1 && w.file != nil {
+			w.file.Close()
+			w.file = nil
+		}
+		os.Remove(w.segmentPath(seg.seq))
+		w.segments = w.segments[1:]
+		// move a cursor at the end of the removed segment to the next one
+		if seg.seq == w.cursor.Segment || len(w.segments) == 0 {
+			w.cursor = walPosition{}
+			if len(w.segments) > 0 {
+				w.cursor.Segment = w.segments[0].seq
+			}
+		}
+	}
+}
+
+// updateFirst reads when the record at the cursor was appended
+func (w *wal) updateFirst() {
+	if len(w.segments) == 0 || w.segments[0].records == 0 {
+		return
+	}
+	f, err := os.Open(w.segmentPath(w.segments[0].seq))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(w.cursor.Offset, io.SeekStart); err != nil {
+		return
+	}
+	if _, appended, _, err := readRecord(f); err == nil {
+		w.segments[0].first = appended
+	}
+}
+
+// saveCursor stores the cursor so records are not replayed twice after a restart
+func (w *wal) saveCursor() {
+	data, err := json.Marshal(w.cursor)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(w.dir, walCursorFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err == nil {
+		os.Rename(path+".tmp", path)
+	}
+}
+
+func (w *wal) totalBytes() int64 {
+	var total int64
+	for _, seg := range w.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// updateStats publishes the backlog for stats
+func (w *wal) updateStats() {
+	records := 0
+	var oldest time.Time
+	for _, seg := range w.segments {
+		if seg.records > 0 && oldest.IsZero() {
+			oldest = seg.first
+		}
+		records += seg.records
+	}
+	w.records.Store(int64(records))
+	w.bytes.Store(w.totalBytes())
+	w.nsegs.Store(int64(len(w.segments)))
+	if oldest.IsZero() {
+		w.oldest.Store(0)
+	} else {
+		w.oldest.Store(oldest.UnixMilli())
+	}
+}
+
+// sync writes appended records to disk
+func (w *wal) sync() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// close syncs and closes the segment being appended to
+func (w *wal) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if cErr := w.file.Close(); err == nil {
+		err = cErr
+	}
+	w.file = nil
+	w.saveCursor()
+	return err
+}
+
+// stats returns the backlog of the wal, it is safe to call from any goroutine
+func (w *wal) stats() BufferStats {
+	stats := BufferStats{
+		Records:  int(w.records.Load()),
+		Bytes:    w.bytes.Load(),
+		Segments: int(w.nsegs.Load()),
+		Dropped:  w.dropped.Load(),
+	}
+	if oldest := w.oldest.Load(); oldest != 0 {
+		t := time.UnixMilli(oldest)
+		stats.Oldest = &t
+	}
+	return stats
+}
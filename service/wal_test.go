@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/american-factory-os/glowplug/json_type"
+	"github.com/american-factory-os/glowplug/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func walData(t *testing.T, records []walRecord) []string {
+	t.Helper()
+	var data []string
+	for _, r := range records {
+		data = append(data, string(r.data))
+	}
+	return data
+}
+
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+	now := time.UnixMilli(1700000000000)
+
+	w, err := openWAL(dir, BufferOpts{SegmentBytes: 64})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, w.append([]byte(fmt.Sprintf("record-%d", i)), now.Add(time.Duration(i)*time.Second)))
+	}
+	assert.Equal(t, 10, w.len())
+	stats := w.stats()
+	assert.Greater(t, stats.Segments, 1)
+	assert.Equal(t, now, *stats.Oldest)
+
+	records, err := w.peek(4)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record-0", "record-1", "record-2", "record-3"}, walData(t, records))
+	assert.Equal(t, 10, w.len(), "peek does not remove records")
+
+	w.ack(records[:3])
+	assert.Equal(t, 7, w.len())
+	assert.Equal(t, now.Add(3*time.Second), *w.stats().Oldest)
+	require.NoError(t, w.close())
+
+	// reopening continues after the acknowledged records
+	w, err = openWAL(dir, BufferOpts{SegmentBytes: 64})
+	require.NoError(t, err)
+	assert.Equal(t, 7, w.len())
+	require.NoError(t, w.append([]byte("record-10"), now))
+
+	records, err = w.peek(100)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record-3", "record-4", "record-5", "record-6", "record-7", "record-8", "record-9", "record-10"}, walData(t, records))
+
+	w.ack(records)
+	assert.Equal(t, 0, w.len())
+	assert.Equal(t, 0, w.stats().Segments)
+	require.NoError(t, w.close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentSuffix))
+	require.NoError(t, err)
+	assert.Empty(t, segments)
+}
+
+func TestWALLimits(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+
+	// each record is 24 bytes, a segment holds 2 records
+	w, err := openWAL(t.TempDir(), BufferOpts{MaxBytes: 96, SegmentBytes: 48})
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		require.NoError(t, w.append([]byte(fmt.Sprintf("record-%d", i)), now))
+	}
+	records, err := w.peek(100)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record-2", "record-3", "record-4", "record-5"}, walData(t, records))
+	assert.Equal(t, uint64(2), w.stats().Dropped)
+
+	w, err = openWAL(t.TempDir(), BufferOpts{MaxAge: time.Minute, SegmentBytes: 48})
+	require.NoError(t, err)
+	require.NoError(t, w.append([]byte("record-0"), now))
+	require.NoError(t, w.append([]byte("record-1"), now))
+	require.NoError(t, w.append([]byte("record-2"), now.Add(time.Minute)))
+	w.segments[0].last = now
+	w.segments[1].last = now.Add(time.Minute)
+
+	assert.Equal(t, 2, w.expire(now.Add(90*time.Second)))
+	records, err = w.peek(100)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record-2"}, walData(t, records))
+}
+
+func TestWALTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir, BufferOpts{})
+	require.NoError(t, err)
+	require.NoError(t, w.append([]byte("complete"), time.Now()))
+	require.NoError(t, w.close())
+
+	// a crash in the middle of an append leaves part of a record
+	f, err := os.OpenFile(w.segmentPath(1), os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = openWAL(dir, BufferOpts{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, w.len())
+	require.NoError(t, w.append([]byte("next"), time.Now()))
+	records, err := w.peek(100)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"complete", "next"}, walData(t, records))
+}
+
+func TestEncodeSinkItem(t *testing.T) {
+	metric := &sparkplug.Payload_Metric{
+		Name:      "Celsius",
+		Alias:     7,
+		Datatype:  uint32(sparkplug.DataType_Double),
+		Timestamp: 1700000000000,
+		Value:     &sparkplug.Payload_Metric_DoubleValue{DoubleValue: 42.5},
+	}
+	value, err := json_type.MetricValueToJsonType(metric)
+	require.NoError(t, err)
+	u := MetricUpdate{
+		Topic:       sparkplug.Topic{Source: "plant1", Command: sparkplug.DDATA, GroupId: "Plant1", EdgeNodeId: "Heater", DeviceId: "TempSensor"},
+		Name:        "Current/Celsius",
+		Identity:    MetricIdentity{Group: "Plant1", Node: "Heater", Device: "TempSensor", Metric: "Celsius"},
+		SourceTopic: "spBv1.0/Plant1/DDATA/Heater/TempSensor",
+		Received:    time.UnixMilli(1700000000500).UTC(),
+		Payload:     &sparkplug.Payload{Seq: 12, Timestamp: 1700000000000},
+		Metric:      metric,
+		Value:       value,
+		Properties: &sparkplug.Payload_PropertySet{
+			Keys:   []string{"engUnit"},
+			Values: []*sparkplug.Payload_PropertyValue{{Value: &sparkplug.Payload_PropertyValue_StringValue{StringValue: "C"}}},
+		},
+	}
+
+	data, err := encodeSinkItem(sinkItem{updates: []MetricUpdate{u}})
+	require.NoError(t, err)
+	item, err := decodeSinkItem(data)
+	require.NoError(t, err)
+	require.Len(t, item.updates, 1)
+	got := item.updates[0]
+	assert.Equal(t, u.Topic, got.Topic)
+	assert.Equal(t, u.Name, got.Name)
+	assert.Equal(t, u.Identity, got.Identity)
+	assert.Equal(t, u.SourceTopic, got.SourceTopic)
+	assert.True(t, u.Received.Equal(got.Received))
+	assert.Equal(t, uint64(12), got.Payload.GetSeq())
+	assert.Equal(t, uint64(7), got.Metric.GetAlias())
+	assert.Equal(t, u.Value.String(), got.Value.String())
+	assert.Equal(t, u.Timestamp(), got.Timestamp())
+	assert.Equal(t, "C", metricUnit(got))
+
+	event := &SessionEvent{Topic: sparkplug.Topic{Command: sparkplug.NDEATH, GroupId: "Plant1", EdgeNodeId: "Heater"}, Received: u.Received}
+	data, err = encodeSinkItem(sinkItem{event: event})
+	require.NoError(t, err)
+	item, err = decodeSinkItem(data)
+	require.NoError(t, err)
+	require.NotNil(t, item.event)
+	assert.Equal(t, event.Topic, item.event.Topic)
+}
+
+// flakySink fails while down is set
+type flakySink struct {
+	recordingSink
+	down bool
+}
+
+func (s *flakySink) Write(ctx context.Context, updates []MetricUpdate) error {
+	if s.down {
+		return errors.New("connection refused")
+	}
+	return s.recordingSink.Write(ctx, updates)
+}
+
+func (s *flakySink) Session(ctx context.Context, event SessionEvent) error {
+	if s.down {
+		return errors.New("connection refused")
+	}
+	return s.recordingSink.Session(ctx, event)
+}
+
+func TestSinkRunnerBuffer(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+	sink := &flakySink{recordingSink: recordingSink{name: "archive"}}
+	r := newSinkRunner(logger, sink, QueueOpts{Buffer: BufferOpts{Dir: dir}})
+	require.NoError(t, r.openBuffer())
+	ctx := context.Background()
+
+	r.write(ctx, []MetricUpdate{testUpdate("a")})
+	sink.down = true
+	r.write(ctx, []MetricUpdate{testUpdate("b")})
+	sink.down = false
+	// later updates wait behind the backlog to keep their order
+	r.session(ctx, SessionEvent{Topic: sparkplug.Topic{Command: sparkplug.NDEATH}})
+	r.write(ctx, []MetricUpdate{testUpdate("c")})
+	assert.Equal(t, "W", sink.calls)
+	assert.Equal(t, 3, r.stats().Buffer.Records)
+
+	// retries wait after the failure
+	now := time.Now()
+	r.replay(ctx, now)
+	assert.Equal(t, "W", sink.calls)
+
+	r.replay(ctx, now.Add(time.Minute))
+	assert.Equal(t, "WWSW", sink.calls)
+	assert.False(t, r.backlogged())
+
+	var names []string
+	for _, batch := range sink.batches {
+		for _, u := range batch {
+			names = append(names, u.Name)
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+
+	stats := r.stats()
+	assert.Equal(t, uint64(3), stats.Updates)
+	assert.Equal(t, uint64(1), stats.Events)
+	assert.Equal(t, uint64(1), stats.Errors)
+	assert.Equal(t, 0, stats.Buffer.Records)
+}
+
+func TestSinkRunnerBufferBackoff(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	sink := &flakySink{recordingSink: recordingSink{name: "archive"}, down: true}
+	r := newSinkRunner(logger, sink, QueueOpts{Buffer: BufferOpts{Dir: t.TempDir()}})
+	require.NoError(t, r.openBuffer())
+	ctx := context.Background()
+
+	r.write(ctx, []MetricUpdate{testUpdate("a")})
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Minute)
+		r.replay(ctx, now)
+	}
+	assert.Equal(t, bufferMaxRetryInterval, r.retry)
+	assert.Equal(t, 1, r.stats().Buffer.Records)
+	assert.Equal(t, uint64(11), r.stats().Errors)
+}
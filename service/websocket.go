@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 )
@@ -16,6 +17,8 @@ type WebsocketServer interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 	PushData(data WebsocketMetricMessage) error
 	IsRunning() bool
+	// SetMaxClients limits the connected clients, 0 is unlimited
+	SetMaxClients(n int)
 }
 
 type websocketServer struct {
@@ -25,6 +28,14 @@ type websocketServer struct {
 	clients  map[*websocket.Conn]bool // Map of active clients
 	mu       sync.RWMutex             // Mutex for thread-safe client access
 	running  bool                     // Indicates if the server is running
+	// maxClients limits the connected clients, 0 is unlimited
+	maxClients atomic.Int64
+}
+
+// SetMaxClients limits the connected clients, clients connected beyond a
+// lowered limit stay connected
+func (wss *websocketServer) SetMaxClients(n int) {
+	wss.maxClients.Store(int64(n))
 }
 
 // PushData sends data to the websocket server's channel
@@ -80,6 +91,16 @@ func (wss *websocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		wss.running = true
 	}
 
+	if max := wss.maxClients.Load(); max > 0 {
+		wss.mu.RLock()
+		clients := len(wss.clients)
+		wss.mu.RUnlock()
+		if int64(clients) >= max {
+			http.Error(w, "too many websocket clients", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	c, err := wss.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("error %s when upgrading connection to websocket", err)
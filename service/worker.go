@@ -5,323 +5,534 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
-	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/american-factory-os/glowplug/embed"
 	"github.com/american-factory-os/glowplug/sparkplug"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/redis/go-redis/v9"
-	"google.golang.org/protobuf/proto"
 )
 
 const statReportInterval = 1000
 
+// sinkFlushInterval is how often sinks are flushed
+const sinkFlushInterval = time.Second
+
 const (
 	STATE_STOPPED uint32 = 0
 	STATE_RUNNING uint32 = 1
 )
 
+// stopGrace is how long Stop waits for the sinks after aborting their writes
+const stopGrace = time.Second
+
+// ErrDataLost is returned by Stop when updates or messages could not be
+// written to a sink or its disk buffer before the shutdown deadline
+var ErrDataLost = errors.New("data lost during shutdown")
+
+// Result is a decoded Sparkplug message
 type Result struct {
-	err         error
-	sourceTopic string
-	payload     *sparkplug.Payload
-	topic       *sparkplug.Topic
+	// Err is set when the topic or payload is invalid
+	Err         error
+	SourceTopic string
+	Received    time.Time
+	// Payload is nil for STATE messages, which are not protobuf encoded
+	Payload *sparkplug.Payload
+	Topic   *sparkplug.Topic
+}
+
+// Decode parses the topic and payload of a message, the source of the
+// message is set in the topic
+func Decode(msg Message) Result {
+	topic, err := sparkplug.ToTopic(msg.Topic)
+	if err != nil {
+		return Result{SourceTopic: msg.Topic, Received: msg.Received, Err: err}
+	}
+	topic.Source = msg.Source
+	if topic.Command == sparkplug.STATE {
+		return Result{SourceTopic: msg.Topic, Received: msg.Received, Topic: topic}
+	}
+	return decodePayload(msg, topic)
+}
+
+// decodePayload unmarshals the payload of a message with a parsed topic,
+// compressed payloads are decompressed
+func decodePayload(msg Message, topic *sparkplug.Topic) Result {
+	payload, err := sparkplug.UnmarshalPayload(msg.Payload)
+	if err != nil {
+		return Result{SourceTopic: msg.Topic, Received: msg.Received, Topic: topic, Err: err}
+	}
+	return Result{
+		SourceTopic: msg.Topic,
+		Received:    msg.Received,
+		Payload:     payload,
+		Topic:       topic,
+	}
 }
 
 type Worker interface {
-	Run(httpListenAddr string) error
+	// Run starts the sinks and processes the queued messages until Stop
+	Run() error
 	AddMessage(msg Message) error
-	Stop()
+	// Stop stops accepting messages and waits until the queued messages reached
+	// the sinks or ctx is done, it returns an error wrapping ErrDataLost when
+	// updates could not be written
+	Stop(ctx context.Context) error
 	Capacity() (current int, size int)
+	// Nodes returns the sessions of the edge nodes seen by the worker
+	Nodes() []sparkplug.NodeSession
+	// Sinks returns the stats of the sinks of the worker
+	Sinks() []SinkStats
+	// Pipeline returns the stats of the intake queue and decode workers
+	Pipeline() PipelineStats
+	// Reload replaces the scopes and mapping rules of a running worker
+	Reload(scopes map[string]Scope, mapper *Mapper) error
+}
+
+// WorkerOpts configures the state and outputs of a worker
+type WorkerOpts struct {
+	// Redis shares aliases, sessions and edge node owners between instances,
+	// optional. It is owned by the caller and not closed by Stop.
+	Redis *redis.UniversalClient
+	// Cluster shares the source subscriptions between glowplug instances
+	Cluster ClusterOpts
+	// Scopes select the messages processed from each source by name
+	Scopes map[string]Scope
+	// Mapper renames, moves or drops metrics before they reach the sinks, optional
+	Mapper *Mapper
+	// Sinks receive the metric updates and session events
+	Sinks []Sink
+	// Pipeline configures the intake queue and decode workers
+	Pipeline PipelineOpts
+	// SinkQueue configures the queue of each sink, SinkQueues overrides it by sink name
+	SinkQueue  QueueOpts
+	SinkQueues map[string]QueueOpts
+	// HostId names the host application of each source in its STATE topic,
+	// no STATE is published when empty
+	HostId string
+	// Transport returns the transport a source publishes rebirth requests
+	// and its STATE with, optional. Sources without one only track the
+	// sessions of their edge nodes.
+	Transport func(source string) sparkplug.Transport
 }
 
 type worker struct {
-	state         *atomic.Uint32
-	logger        *log.Logger
-	size          int
-	messages      chan Message
-	results       chan Result
-	rdb           *redis.UniversalClient
-	publishBroker *mqtt.Client
-	total         uint64
-	errors        uint64
-	seen          sync.Map
-	wss           WebsocketServer
-	httpStop      chan bool
+	state    *atomic.Uint32
+	logger   *log.Logger
+	size     int
+	messages *queue[Message]
+	pipeline PipelineOpts
+	rdb      *redis.UniversalClient
+	sinks    []*sinkRunner
+	cluster  *cluster
+	// mapper and scopes are replaced by Reload
+	mapper atomic.Pointer[Mapper]
+	scopes atomic.Pointer[map[string]Scope]
+	// namespace tracks the sessions and aliases of the edge nodes, shared by
+	// the host applications of the sources
+	namespace *sparkplug.Namespace
+	hostId    string
+	transport func(source string) sparkplug.Transport
+	hostsMu   sync.Mutex
+	hosts     map[string]*sparkplug.HostApplication
+	total     atomic.Uint64
+	errors    atomic.Uint64
+	seen      sync.Map
+	// violations counts the violations of the Sparkplug specification by
+	// edge node, reported holds the requirements logged for each node
+	violations sync.Map
+	violated   atomic.Uint64
+	reported   sync.Map
+	// restoreMisses holds when the session or aliases of an edge node were
+	// last missing in redis
+	restoreMisses sync.Map
+	done          chan struct{}
+	// started is set and ready closed by Run once the sinks are started,
+	// drained is closed once the queued messages reached the sinks
+	started atomic.Bool
+	ready   chan struct{}
+	drained chan struct{}
+	cancel  context.CancelFunc
+	// stopped is set by the first Stop
+	stopped atomic.Bool
 }
 
-func (w *worker) Stop() {
+func (w *worker) Stop(ctx context.Context) error {
+	if !w.stopped.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	// anything lost from here on fails the shutdown
+	lost := w.lost()
 	w.state.Store(STATE_STOPPED)
 
-	// signal the http server to stop
-	w.httpStop <- true
+	// stop background tasks
+	close(w.done)
+
+	// close the intake queue, the queued messages are processed and written
+	// to the sinks before they close
+	w.messages.close()
+	pending := 0
+	if w.started.Load() {
+		select {
+		case <-w.drained:
+		case <-ctx.Done():
+			// abort the writes of the sinks, failed writes still go to their disk buffers
+			w.logger.Println("shutdown timed out, aborting sink writes")
+			w.cancel()
+			select {
+			case <-w.drained:
+			case <-time.After(stopGrace):
+				pending = len(w.messages.ch)
+				for _, r := range w.sinks {
+					pending += len(r.queue.ch)
+				}
+			}
+		}
+	} else {
+		for _, r := range w.sinks {
+			r.stop()
+		}
+	}
+
+	if w.cancel != nil {
+		w.cancel()
+	}
+
+	if lost = w.lost() - lost; lost > 0 || pending > 0 {
+		return fmt.Errorf("%w, %d messages, payloads, updates and events dropped or failed, %d messages and payloads still queued", ErrDataLost, lost, pending)
+	}
+	return nil
+}
 
-	// close the Message channel to stop processing
-	close(w.messages)
+// lost returns the messages and payloads dropped by the intake and sink
+// queues, the records dropped from disk buffers and the updates and events
+// the sinks failed to write or buffer
+func (w *worker) lost() uint64 {
+	lost := w.messages.dropped.Load()
+	for _, r := range w.sinks {
+		lost += r.lost.Load() + r.queue.dropped.Load()
+		if r.wal != nil {
+			lost += r.wal.dropped.Load()
+		}
+	}
+	return lost
+}
 
-	if w.rdb != nil {
-		rdb := *w.rdb
-		rdb.Close()
+// Sinks returns the stats of the sinks of the worker
+func (w *worker) Sinks() []SinkStats {
+	stats := make([]SinkStats, 0, len(w.sinks))
+	for _, r := range w.sinks {
+		stats = append(stats, r.stats())
 	}
-	if publishBroker, err := w.getPublishBroker(); err == nil {
-		defer publishBroker.Disconnect(250)
+	return stats
+}
+
+// Pipeline returns the stats of the intake queue and decode workers
+func (w *worker) Pipeline() PipelineStats {
+	return PipelineStats{
+		Workers:    w.pipeline.Workers,
+		Queued:     len(w.messages.ch),
+		Size:       w.size,
+		Processed:  w.total.Load(),
+		Errors:     w.errors.Load(),
+		Dropped:    w.messages.dropped.Load(),
+		Violations: w.violated.Load(),
 	}
 }
 
 func (w *worker) processResult(result Result) error {
 
-	if result.err != nil {
-		if strings.Contains(result.err.Error(), "invalid wire-format data") {
-			return fmt.Errorf("sparkplug %w from topic %s", result.err, result.sourceTopic)
+	if result.Err != nil {
+		if strings.Contains(result.Err.Error(), "invalid wire-format data") {
+			return fmt.Errorf("sparkplug %w from topic %s", result.Err, result.SourceTopic)
 		}
-		return fmt.Errorf("error processing message, %w", result.err)
+		return fmt.Errorf("error processing message, %w", result.Err)
 	}
 
-	if result.payload == nil {
+	if result.Topic == nil || result.Payload == nil {
 		return fmt.Errorf("no payload found")
 	}
+	topic := *result.Topic
+
+	ctx := context.TODO()
+	if err := w.restoreNode(ctx, topic, result.Payload); err != nil {
+		return err
+	}
+
+	host, err := w.host(topic.Source)
+	if err != nil {
+		return err
+	}
 
-	if result.payload.Metrics == nil {
+	// births and deaths reach the sinks through the callbacks of the host
+	w.validate(topic, result.Payload)
+	change := host.Process(topic, result.Payload, result.Received)
+	if change.Stale {
+		w.logger.Printf("ignoring %s of an earlier session of %s\n", topic.Command, nodeKeyFromTopic(topic))
 		return nil
 	}
+	if change.SeqGap {
+		w.logger.Printf("sequence gap in %s of %s, expected %d got %d\n", topic.Command, nodeKeyFromTopic(topic), change.Expected, result.Payload.GetSeq())
+	}
+	if len(change.UnknownAliases) > 0 {
+		return fmt.Errorf("unknown alias %d of edge node %s in %s, waiting for a birth", change.UnknownAliases[0], nodeKeyFromTopic(topic), topic.Command)
+	}
+	if err := w.storeNode(ctx, topic, result.Payload, change.Node); err != nil {
+		return err
+	}
 
-	if len(result.payload.Metrics) == 0 {
+	if topic.Command == sparkplug.NDEATH || topic.Command == sparkplug.DDEATH || len(result.Payload.Metrics) == 0 {
 		return nil
 	}
 
+	updates := make([]MetricUpdate, 0, len(result.Payload.Metrics))
+
 	// process each metric in the payload
-	for _, metric := range result.payload.Metrics {
+	for _, metric := range result.Payload.Metrics {
 		if len(metric.Name) == 0 {
 			return fmt.Errorf("empty metric name")
 		}
 
+		// apply mapping rules before the metric reaches the sinks
+		source := identityFromTopic(*result.Topic, metric.Name)
+		mapped, err := w.mapper.Load().Apply(source)
+		if err != nil {
+			return err
+		}
+		if mapped.Drop {
+			continue
+		}
+
 		// convert sparkplug datatype to json type
 		jsonType, err := PayloadMetricToJsonType(metric)
 		if err != nil {
 			return err
 		}
 
-		// redis key for the metric
-		key := keyFromSparkplugMetric(*result.topic, metric)
+		properties, _ := w.namespace.Properties(sparkplug.NodeKeyFromTopic(topic), topic.DeviceId, metric.Name)
 
 		// report new metric seen
-		typeName := sparkplug.DataType_name[int32(metric.Datatype)]
-		_, seen := w.seen.Load(key)
-		if !seen {
-			w.seen.Store(key, true)
-			w.logger.Printf("first seen: [%s] %s alias:%d %s:%s\n", result.sourceTopic, metric.Name, metric.Alias, typeName, jsonType)
-		}
-
-		// pipeline redis commands
-		if w.rdb != nil {
-			rdb := *w.rdb
-			if cmds, err := rdb.Pipelined(context.TODO(), func(pipeliner redis.Pipeliner) error {
-
-				if !seen {
-					// save human readable metric type in a redis hash
-					pipeliner.HSet(context.TODO(), HASH_METRIC_TYPES, key, typeName)
-				}
-
-				// store the metric value in a redis set
-				pipeliner.Set(context.TODO(), key, jsonType, 0)
-
-				// publish metric value to redis channel
-				pipeliner.Publish(context.TODO(), key, jsonType)
-
-				return nil
-			}); err != nil {
-				return err
-			} else {
-				for _, cmd := range cmds {
-					if cmd.Err() != nil && cmd.Err() != redis.Nil {
-						return fmt.Errorf("redis cmd error %w", cmd.Err())
-					}
-				}
+		seenKey := result.Topic.Source + " " + mapped.Identity.String()
+		if _, seen := w.seen.LoadOrStore(seenKey, true); !seen {
+			typeName := sparkplug.DataType_name[int32(metric.Datatype)]
+			w.logger.Printf("first seen: [%s] %s alias:%d %s:%s\n", result.SourceTopic, metric.Name, metric.Alias, typeName, jsonType)
+			if mapped.Identity != source {
+				w.logger.Printf("mapped: %s => %s\n", source, mapped.Identity)
 			}
 		}
 
-		if w.publishBroker != nil {
-
-			// publish metric value to mqtt
-			go func(topic *sparkplug.Topic, metric *sparkplug.Payload_Metric, worker *worker) {
-				metricTopic := topicFromSparkplugMetric(*topic, metric)
-				if publishBroker, err := worker.getPublishBroker(); err == nil {
-					if token := publishBroker.Publish(metricTopic, 0, false, jsonType.Bytes()); token.Wait() && token.Error() != nil {
-						log.Println("unable to publish to mqtt", metricTopic, token.Error())
-					}
-				}
+		updates = append(updates, MetricUpdate{
+			Topic:       mapped.Identity.topic(*result.Topic),
+			Name:        mapped.Identity.Metric,
+			Identity:    source,
+			SourceTopic: result.SourceTopic,
+			Received:    result.Received,
+			Payload:     result.Payload,
+			Metric:      metric,
+			Value:       jsonType,
+			Properties:  properties,
+		})
+	}
 
-			}(result.topic, metric, w)
-		}
+	if len(updates) > 0 {
+		w.dispatch(sinkItem{updates: updates})
+	}
 
-		// push data to websocket server
-		if w.wss.IsRunning() {
+	return nil
+}
 
-			w.wss.PushData(WebsocketMetricMessage{
-				Topic:     result.topic,
-				Alias:     metric.GetAlias(),
-				Name:      metric.GetName(),
-				Value:     jsonType,
-				Timestamp: metric.Timestamp,
-			})
+// validate counts the violations of the Sparkplug specification by a message,
+// the first violation of each requirement by an edge node is logged
+func (w *worker) validate(topic sparkplug.Topic, payload *sparkplug.Payload) {
+	violations := sparkplug.ValidatePayload(topic, payload, w.namespace)
+	if len(violations) == 0 {
+		return
+	}
+	key := sparkplug.NodeKeyFromTopic(topic)
+	count, _ := w.violations.LoadOrStore(key, &atomic.Uint64{})
+	count.(*atomic.Uint64).Add(uint64(len(violations)))
+	w.violated.Add(uint64(len(violations)))
+
+	nodeKey := nodeKeyFromTopic(topic)
+	for _, violation := range violations {
+		if _, logged := w.reported.LoadOrStore(nodeKey+" "+violation.Requirement, true); !logged {
+			w.logger.Printf("%s of %s breaks the sparkplug specification, %s\n", topic.Command, nodeKey, violation)
 		}
 	}
+}
 
-	return nil
+// session passes a birth or death to the sinks
+func (w *worker) session(event SessionEvent) {
+	w.dispatch(sinkItem{event: &event})
 }
 
-func (w *worker) processResults() error {
+// host returns the host application of a source, creating it
+func (w *worker) host(source string) (*sparkplug.HostApplication, error) {
+	w.hostsMu.Lock()
+	defer w.hostsMu.Unlock()
+	if host, ok := w.hosts[source]; ok {
+		return host, nil
+	}
+	host, err := w.newHost(source)
+	if err != nil {
+		return nil, err
+	}
+	w.hosts[source] = host
+	return host, nil
+}
 
-	for {
-		result, ok := <-w.results
+// newHost returns a host application tracking the edge nodes of a source in
+// the namespace of the worker
+func (w *worker) newHost(source string) (*sparkplug.HostApplication, error) {
+	var transport sparkplug.Transport
+	if w.transport != nil {
+		transport = w.transport(source)
+	}
+	birth := func(e sparkplug.BirthEvent) { w.session(SessionEvent{Topic: e.Topic, Received: e.Received}) }
+	death := func(e sparkplug.DeathEvent) { w.session(SessionEvent{Topic: e.Topic, Received: e.Received}) }
+	return sparkplug.NewHostApplication(w.logger, transport, sparkplug.HostApplicationOpts{
+		HostId:        w.hostId,
+		Source:        source,
+		Namespace:     w.namespace,
+		OnNodeBirth:   birth,
+		OnDeviceBirth: birth,
+		OnNodeDeath:   death,
+		OnDeviceDeath: death,
+	})
+}
 
-		if !ok {
-			return fmt.Errorf("channel closed, no longer processing results")
-		}
+// dispatch queues an item for each sink
+func (w *worker) dispatch(item sinkItem) {
+	for _, r := range w.sinks {
+		r.push(item)
+	}
+}
 
-		if w.state.Load() == STATE_STOPPED {
-			return fmt.Errorf("worker pool stopped, dropping result on topic %s", result.sourceTopic)
+// processLane decodes and processes the messages of a decode worker in order
+func (w *worker) processLane(messages <-chan laneMessage) {
+	for msg := range messages {
+		result := w.decode(msg)
+		if result == nil {
+			continue
 		}
 
-		err := w.processResult(result)
-		if err != nil {
+		if err := w.processResult(*result); err != nil {
 			w.logger.Println(err)
-			w.errors++
-		} else {
-			w.total++
+			w.errors.Add(1)
+			continue
 		}
 
-		if w.total > 0 && w.total%statReportInterval == 0 {
-			w.logger.Printf("processed %d messages, %d errors\n", w.total, w.errors)
+		if total := w.total.Add(1); total%statReportInterval == 0 {
+			w.logger.Printf("processed %d messages, %d errors, %d dropped\n", total, w.errors.Load(), w.messages.dropped.Load())
 		}
 	}
 }
 
-func (w *worker) getPublishBroker() (mqtt.Client, error) {
-	if w.publishBroker == nil {
-		return nil, errors.New("publish broker not available")
-	}
-
-	return *w.publishBroker, nil
+// laneMessage is a message with its parsed topic
+type laneMessage struct {
+	Message
+	parsed *sparkplug.Topic
 }
 
-func (w *worker) Run(httpListenAddr string) error {
-	w.state.Store(STATE_RUNNING)
-
-	go func() {
-		if len(httpListenAddr) > 0 {
-			// Create an HTTP server
-			server := &http.Server{
-				Addr:    httpListenAddr,
-				Handler: nil, // Use default handler
+// decode forwards the message of an edge node owned by another instance, or
+// returns the decoded payload of node and device commands
+func (w *worker) decode(msg laneMessage) *Result {
+	topic := msg.parsed
+
+	// forward messages of edge nodes owned by another instance
+	if w.cluster != nil && !msg.forwarded && len(topic.EdgeNodeId) > 0 {
+		owner, err := w.cluster.owner(context.TODO(), nodeKeyFromTopic(*topic), time.Now())
+		if err == nil && owner != w.cluster.opts.InstanceID {
+			err = w.cluster.forward(context.TODO(), owner, msg.Message)
+			if err == nil {
+				return nil
 			}
+		}
+		if err != nil {
+			// process the message here rather than dropping it
+			w.logger.Println(err)
+		}
+	}
 
-			// Serve index.html for the root path ("/")
-			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-				// Serve index.html for exactly "/" or "/index.html"
-				if r.URL.Path == "/" || r.URL.Path == "/index.html" {
-					w.Header().Set("Content-Type", "text/html; charset=utf-8")
-					if _, err := w.Write([]byte(embed.GetIndexHTML())); err != nil {
-						log.Printf("error serving index.html: %v", err)
-						http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-					}
-					return
-				}
-				// Return 404 for other paths (except WebSocket)
-				http.NotFound(w, r)
-			})
-
-			// Register WebSocket handler for "/ws"
-			http.Handle("/ws", w.wss)
-
-			// Start server in a goroutine
-			go func() {
-				if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					log.Fatalf("http server error: %v", err)
-				}
-			}()
-
-			// Log server started
-			w.logger.Println("http server started on", httpListenAddr)
+	// process node and device birth, data and death commands
+	switch topic.Command {
+	case sparkplug.NBIRTH, sparkplug.NDATA, sparkplug.DBIRTH, sparkplug.DDATA, sparkplug.NDEATH, sparkplug.DDEATH:
+	default:
+		return nil
+	}
 
-			// Wait for a signal
-			<-w.httpStop
-			w.logger.Println("received shutdown signal, stopping http server...")
+	result := decodePayload(msg.Message, topic)
+	return &result
+}
 
-			// Create a context with a timeout for graceful shutdown
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
+func (w *worker) Run() error {
+	w.state.Store(STATE_RUNNING)
 
-			// Perform graceful shutdown
-			if err := server.Shutdown(ctx); err != nil {
-				log.Printf("http shutdown error: %v", err)
-			}
-			w.logger.Println("http server stopped")
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	for _, r := range w.sinks {
+		if err := r.start(ctx); err != nil {
+			return fmt.Errorf("unable to start sink %s, %w", r.sink.Name(), err)
 		}
-	}()
-
-	go w.processResults()
+	}
 
-	for {
-		msg, ok := <-w.messages
+	// decode workers, the messages of an edge node always go to the same lane
+	var lanesDone sync.WaitGroup
+	lanes := make([]chan laneMessage, w.pipeline.Workers)
+	for i := range lanes {
+		lanes[i] = make(chan laneMessage, laneQueueSize)
+		lanesDone.Add(1)
+		go func(messages <-chan laneMessage) {
+			defer lanesDone.Done()
+			w.processLane(messages)
+		}(lanes[i])
+	}
+	w.started.Store(true)
+	close(w.ready)
 
-		if !ok {
-			return fmt.Errorf("channel closed, no longer processing messages")
+	// once the intake queue is closed, drain the lanes then the sinks
+	defer func() {
+		for _, l := range lanes {
+			close(l)
 		}
-
-		if w.state.Load() == STATE_STOPPED {
-			return fmt.Errorf("worker pool stopped, dropping message on topic %s", msg.topic)
+		lanesDone.Wait()
+		for _, r := range w.sinks {
+			r.stop()
 		}
+		close(w.drained)
+	}()
 
-		topic, tErr := sparkplug.ToTopic(msg.topic)
-		if tErr != nil {
-			w.results <- Result{
-				sourceTopic: msg.topic,
-				err:         tErr,
+	if w.cluster != nil {
+		go w.cluster.receive(w.done, func(msg Message) {
+			if err := w.AddMessage(msg); err != nil {
+				w.logger.Println("unable to process forwarded message,", err)
 			}
+		})
+	}
+
+	for msg := range w.messages.ch {
+		scopes := *w.scopes.Load()
+		topic, err := sparkplug.ToTopic(msg.Topic)
+		if err != nil {
+			w.logger.Printf("error processing message, %v\n", err)
+			w.errors.Add(1)
 			continue
 		}
+		topic.Source = msg.Source
 
-		var processCmd bool
-
-		// process node and device birth and data commands
-		switch topic.Command {
-		case sparkplug.NBIRTH:
-			fallthrough
-		case sparkplug.NDATA:
-			fallthrough
-		case sparkplug.DBIRTH:
-			fallthrough
-		case sparkplug.DDATA:
-			processCmd = true
-		default:
-			processCmd = false
+		// skip groups, nodes and devices out of the scope of the source
+		if !scopes[msg.Source].Matches(topic) {
+			continue
 		}
 
-		if processCmd {
-			var payload sparkplug.Payload
-			err := proto.Unmarshal(msg.payload, &payload)
-			if err != nil {
-				w.results <- Result{
-					sourceTopic: msg.topic,
-					err:         err,
-				}
-				continue
-			}
-
-			w.results <- Result{
-				err:         nil,
-				sourceTopic: msg.topic,
-				payload:     &payload,
-				topic:       topic,
-			}
-		}
+		lanes[lane(nodeKeyFromTopic(*topic), len(lanes))] <- laneMessage{Message: msg, parsed: topic}
 	}
+
+	// the intake queue is only closed by Stop
+	w.logger.Println("intake queue closed, draining the sinks")
+	return nil
 }
 
 func (w *worker) AddMessage(msg Message) error {
@@ -329,38 +540,116 @@ func (w *worker) AddMessage(msg Message) error {
 		return errors.New("worker pool stopped")
 	}
 
-	w.messages <- msg
+	if !w.messages.push(msg) {
+		if n := w.messages.dropped.Load(); n%statReportInterval == 1 {
+			w.logger.Printf("dropping messages, worker pool full, dropped %d\n", n)
+		}
+	}
 	return nil
 }
 
 // Capacity returns current message capacity and size
 func (w *worker) Capacity() (current int, size int) {
 	size = w.size
-	current = size - len(w.messages)
+	current = size - len(w.messages.ch)
 	if current < 0 {
 		current = 0
 	}
 	return
 }
 
-func NewWorker(logger *log.Logger, rdb *redis.UniversalClient, publishBroker *mqtt.Client, wss WebsocketServer) (Worker, error) {
+// Reload replaces the scopes and mapping rules of a running worker, messages
+// queued before are processed with the new ones
+func (w *worker) Reload(scopes map[string]Scope, mapper *Mapper) error {
+	if err := validateScopes(scopes); err != nil {
+		return err
+	}
+	w.scopes.Store(&scopes)
+	w.mapper.Store(mapper)
+	return nil
+}
+
+// validateScopes returns an error if a pattern of a scope is malformed
+func validateScopes(scopes map[string]Scope) error {
+	for _, scope := range scopes {
+		if err := scope.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	size := runtime.NumCPU() * 100
+func NewWorker(logger *log.Logger, opts WorkerOpts) (Worker, error) {
+
+	if err := validateScopes(opts.Scopes); err != nil {
+		return nil, err
+	}
+
+	cluster, err := newCluster(logger, opts.Redis, opts.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.Pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	pipeline := opts.Pipeline.withDefaults()
+
+	names := map[string]bool{}
+	sinks := make([]*sinkRunner, 0, len(opts.Sinks))
+	for _, sink := range opts.Sinks {
+		if names[sink.Name()] {
+			return nil, fmt.Errorf("duplicate sink name %s", sink.Name())
+		}
+		names[sink.Name()] = true
+
+		queueOpts, ok := opts.SinkQueues[sink.Name()]
+		if !ok {
+			queueOpts = opts.SinkQueue
+		}
+		if err := queueOpts.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid queue of sink %s, %w", sink.Name(), err)
+		}
+		// the disk buffer of a sink is a directory named after it
+		if queueOpts.Buffer.enabled() && !sourceNameRegexp.MatchString(sink.Name()) {
+			return nil, fmt.Errorf("invalid sink name %s for a disk buffer, use letters, digits, _ and -", sink.Name())
+		}
+		sinks = append(sinks, newSinkRunner(logger, sink, queueOpts))
+	}
+
+	size := pipeline.QueueSize
 
 	state := atomic.Uint32{}
 
 	state.Store(STATE_STOPPED)
 
-	return &worker{
-		state:         &state,
-		logger:        logger,
-		size:          size,
-		messages:      make(chan Message, size),
-		results:       make(chan Result, size),
-		rdb:           rdb,
-		publishBroker: publishBroker,
-		seen:          sync.Map{},
-		wss:           wss,
-		httpStop:      make(chan bool, 1),
-	}, nil
+	w := &worker{
+		state:     &state,
+		logger:    logger,
+		size:      size,
+		messages:  newQueue[Message](size, pipeline.Overflow),
+		pipeline:  pipeline,
+		rdb:       opts.Redis,
+		sinks:     sinks,
+		cluster:   cluster,
+		namespace: sparkplug.NewNamespace(),
+		hostId:    opts.HostId,
+		transport: opts.Transport,
+		hosts:     map[string]*sparkplug.HostApplication{},
+		seen:      sync.Map{},
+		done:      make(chan struct{}),
+		ready:     make(chan struct{}),
+		drained:   make(chan struct{}),
+	}
+	w.scopes.Store(&opts.Scopes)
+	w.mapper.Store(opts.Mapper)
+
+	// the host of messages without a source is created up front, which
+	// validates the host id
+	host, err := w.newHost("")
+	if err != nil {
+		return nil, err
+	}
+	w.hosts[""] = host
+	return w, nil
 }
@@ -1,22 +1,24 @@
 package service
 
 import (
+	"context"
 	"io"
 	"log"
 	"testing"
+
+	"github.com/american-factory-os/glowplug/sparkplug"
 )
 
 func TestWorkerCapacity(t *testing.T) {
 	logger := log.New(io.Discard, "", 0)
-	wIface, err := NewWorker(logger, nil, nil, nil)
+	wIface, err := NewWorker(logger, WorkerOpts{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
 	w := wIface.(*worker)
 	// reduce size for testing
-	w.messages = make(chan Message, 2)
-	w.results = make(chan Result, 2)
+	w.messages = newQueue[Message](2, OVERFLOW_DROP_NEWEST)
 	w.size = 2
 	w.state.Store(STATE_RUNNING)
 
@@ -25,7 +27,7 @@ func TestWorkerCapacity(t *testing.T) {
 		t.Fatalf("expected capacity %d, got %d", size, current)
 	}
 
-	if err := w.AddMessage(Message{topic: "test", payload: []byte("1")}); err != nil {
+	if err := w.AddMessage(Message{Topic: "test", Payload: []byte("1")}); err != nil {
 		t.Fatalf("unexpected add error: %v", err)
 	}
 
@@ -34,5 +36,34 @@ func TestWorkerCapacity(t *testing.T) {
 		t.Fatalf("expected capacity %d, got %d", size-1, current)
 	}
 
-	w.Stop()
+	if err := w.Stop(context.Background()); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+}
+
+func TestWorkerViolations(t *testing.T) {
+	wIface, err := NewWorker(log.New(io.Discard, "", 0), WorkerOpts{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := wIface.(*worker)
+
+	// a birth without timestamp and bdSeq, data with the wrong value field
+	if err := w.processResult(testResult(t, "spBv1.0/Plant1/NBIRTH/Heater", floatMetric("Voltage", 230))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := testResult(t, "spBv1.0/Plant1/NDATA/Heater", &sparkplug.Payload_Metric{Name: "Voltage", Value: &sparkplug.Payload_Metric_DoubleValue{DoubleValue: 231}})
+	data.Payload.Seq = 1
+	data.Payload.Timestamp = 1700000000000
+	if err := w.processResult(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	nodes := w.Nodes()
+	if len(nodes) != 1 || nodes[0].Violations != 3 {
+		t.Fatalf("expected 3 violations of one node, got %+v", nodes)
+	}
+	if violations := w.Pipeline().Violations; violations != 3 {
+		t.Fatalf("expected 3 violations, got %d", violations)
+	}
 }
@@ -0,0 +1,134 @@
+package sparkplug
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sparkplug B arrays are sent in the bytes_value of a metric. Numbers and
+// DateTime milliseconds are little endian, a BooleanArray is the number of
+// values as uint32 followed by the values packed in bits, most significant
+// bit first, and a StringArray is null terminated UTF-8 strings.
+
+type arrayNumber interface {
+	int8 | int16 | int32 | int64 | uint8 | uint16 | uint32 | uint64 | float32 | float64
+}
+
+// encodeNumbers encodes numbers in little endian
+func encodeNumbers[T arrayNumber](values []T) []byte {
+	var buf bytes.Buffer
+	// writing a slice of fixed size values to a buffer doesn't fail
+	_ = binary.Write(&buf, binary.LittleEndian, values)
+	return buf.Bytes()
+}
+
+// decodeNumbers decodes little endian numbers
+func decodeNumbers[T arrayNumber](data []byte) ([]T, error) {
+	var zero T
+	size := binary.Size(zero)
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("array of %d bytes is not a multiple of %d", len(data), size)
+	}
+	values := make([]T, len(data)/size)
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// encodeBooleans encodes a BooleanArray
+func encodeBooleans(values []bool) []byte {
+	data := make([]byte, 4+(len(values)+7)/8)
+	binary.LittleEndian.PutUint32(data, uint32(len(values)))
+	for i, value := range values {
+		if value {
+			data[4+i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return data
+}
+
+// decodeBooleans decodes a BooleanArray
+func decodeBooleans(data []byte) ([]bool, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("boolean array of %d bytes has no length", len(data))
+	}
+	count := binary.LittleEndian.Uint32(data)
+	if uint64(len(data)-4) < (uint64(count)+7)/8 {
+		return nil, fmt.Errorf("boolean array of %d bytes is too short for %d values", len(data), count)
+	}
+	values := make([]bool, count)
+	for i := range values {
+		values[i] = data[4+i/8]&(0x80>>(i%8)) != 0
+	}
+	return values, nil
+}
+
+// encodeStrings encodes a StringArray, strings can't contain a null character
+func encodeStrings(values []string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, value := range values {
+		if strings.IndexByte(value, 0) >= 0 {
+			return nil, fmt.Errorf("string array value %q contains a null character", value)
+		}
+		buf.WriteString(value)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeStrings decodes a StringArray
+func decodeStrings(data []byte) ([]string, error) {
+	if len(data) == 0 {
+		return []string{}, nil
+	}
+	if data[len(data)-1] != 0 {
+		return nil, fmt.Errorf("string array is not null terminated")
+	}
+	return strings.Split(string(data[:len(data)-1]), "\x00"), nil
+}
+
+// encodeDateTimes encodes a DateTimeArray as milliseconds since the epoch
+func encodeDateTimes(values []time.Time) []byte {
+	ms := make([]int64, len(values))
+	for i, value := range values {
+		ms[i] = value.UnixMilli()
+	}
+	return encodeNumbers(ms)
+}
+
+// DecodeArray decodes the bytes value of an array metric into a slice of the
+// element type of datatype, such as []int16 for Int16Array. DateTimeArray is
+// decoded into []int64 milliseconds since the epoch.
+func DecodeArray(datatype DataType, data []byte) (interface{}, error) {
+	switch datatype {
+	case DataType_Int8Array:
+		return decodeNumbers[int8](data)
+	case DataType_Int16Array:
+		return decodeNumbers[int16](data)
+	case DataType_Int32Array:
+		return decodeNumbers[int32](data)
+	case DataType_Int64Array, DataType_DateTimeArray:
+		return decodeNumbers[int64](data)
+	case DataType_UInt8Array:
+		return decodeNumbers[uint8](data)
+	case DataType_UInt16Array:
+		return decodeNumbers[uint16](data)
+	case DataType_UInt32Array:
+		return decodeNumbers[uint32](data)
+	case DataType_UInt64Array:
+		return decodeNumbers[uint64](data)
+	case DataType_FloatArray:
+		return decodeNumbers[float32](data)
+	case DataType_DoubleArray:
+		return decodeNumbers[float64](data)
+	case DataType_BooleanArray:
+		return decodeBooleans(data)
+	case DataType_StringArray:
+		return decodeStrings(data)
+	}
+	return nil, fmt.Errorf("datatype %s is not an array", datatype)
+}
@@ -0,0 +1,145 @@
+package sparkplug
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// COMPRESSED_UUID is the uuid of a payload with a compressed payload as body
+const COMPRESSED_UUID = "SPBV1.0_COMPRESSED"
+
+// ALGORITHM is the metric of a compressed payload naming its algorithm
+const ALGORITHM = "algorithm"
+
+// Compression is the algorithm of a compressed payload
+type Compression string
+
+const (
+	// COMPRESSION_DEFLATE is a zlib stream as written by the reference
+	// implementations, raw deflate data is read as well
+	COMPRESSION_DEFLATE Compression = "DEFLATE"
+	COMPRESSION_GZIP    Compression = "GZIP"
+)
+
+// MaxDecompressedSize is the largest payload Decompress inflates
+const MaxDecompressedSize = 64 << 20
+
+// ErrUnknownCompression is returned for algorithms other than DEFLATE and GZIP
+var ErrUnknownCompression = fmt.Errorf("unknown compression algorithm")
+
+// ParseCompression returns a Compression from its name, an empty name
+// returns no compression
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(strings.ToUpper(s)); c {
+	case "", COMPRESSION_DEFLATE, COMPRESSION_GZIP:
+		return c, nil
+	}
+	return "", fmt.Errorf("%w %s, must be one of: %s, %s", ErrUnknownCompression, s, COMPRESSION_DEFLATE, COMPRESSION_GZIP)
+}
+
+// IsCompressed returns true if payload holds a compressed payload
+func IsCompressed(payload *Payload) bool {
+	return payload.GetUuid() == COMPRESSED_UUID
+}
+
+// Compress returns a payload with payload compressed into its body, the
+// timestamp and seq are kept for receivers looking at the outer payload
+func Compress(payload *Payload, algorithm Compression) (*Payload, error) {
+	data, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal payload, %w", err)
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch algorithm {
+	case COMPRESSION_DEFLATE:
+		w = zlib.NewWriter(&buf)
+	case COMPRESSION_GZIP:
+		w = gzip.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnknownCompression, algorithm)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("unable to compress payload, %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("unable to compress payload, %w", err)
+	}
+
+	return &Payload{
+		Timestamp: payload.GetTimestamp(),
+		Seq:       payload.GetSeq(),
+		Uuid:      COMPRESSED_UUID,
+		Body:      buf.Bytes(),
+		Metrics: []*Payload_Metric{
+			{Name: ALGORITHM, Datatype: DataType_String.Uint32(), Value: &Payload_Metric_StringValue{StringValue: string(algorithm)}},
+		},
+	}, nil
+}
+
+// Decompress returns the payload compressed in the body of payload, payloads
+// that are not compressed are returned as is. Without an algorithm metric the
+// body is DEFLATE compressed.
+func Decompress(payload *Payload) (*Payload, error) {
+	if !IsCompressed(payload) {
+		return payload, nil
+	}
+	algorithm := COMPRESSION_DEFLATE
+	for _, metric := range payload.Metrics {
+		if metric.Name == ALGORITHM {
+			algorithm = Compression(strings.ToUpper(metric.GetStringValue()))
+		}
+	}
+
+	var r io.Reader
+	switch algorithm {
+	case COMPRESSION_DEFLATE:
+		zr, err := zlib.NewReader(bytes.NewReader(payload.Body))
+		if err != nil {
+			// raw deflate data without the zlib header
+			r = flate.NewReader(bytes.NewReader(payload.Body))
+		} else {
+			r = zr
+		}
+	case COMPRESSION_GZIP:
+		gr, err := gzip.NewReader(bytes.NewReader(payload.Body))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress payload, %w", err)
+		}
+		r = gr
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnknownCompression, algorithm)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress payload, %w", err)
+	}
+	if len(data) > MaxDecompressedSize {
+		return nil, fmt.Errorf("decompressed payload is larger than %d bytes", MaxDecompressedSize)
+	}
+
+	var inner Payload
+	if err := proto.Unmarshal(data, &inner); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal decompressed payload, %w", err)
+	}
+	return &inner, nil
+}
+
+// UnmarshalPayload unmarshals a protobuf payload, decompressing it when it
+// is compressed
+func UnmarshalPayload(data []byte) (*Payload, error) {
+	var payload Payload
+	if err := proto.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	return Decompress(&payload)
+}
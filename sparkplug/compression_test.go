@@ -0,0 +1,76 @@
+package sparkplug
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCompression(t *testing.T) {
+	inner, err := NewPayload().Seq(5).Float("Voltage", 230).StringArray("Names", "a", "b").Build()
+	require.NoError(t, err)
+
+	for _, algorithm := range []Compression{COMPRESSION_DEFLATE, COMPRESSION_GZIP} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			outer, err := Compress(inner, algorithm)
+			require.NoError(t, err)
+			assert.True(t, IsCompressed(outer))
+			assert.Equal(t, uint64(5), outer.Seq)
+			require.Len(t, outer.Metrics, 1)
+			assert.Equal(t, ALGORITHM, outer.Metrics[0].Name)
+			assert.Equal(t, string(algorithm), outer.Metrics[0].GetStringValue())
+
+			data, err := proto.Marshal(outer)
+			require.NoError(t, err)
+			decoded, err := UnmarshalPayload(data)
+			require.NoError(t, err)
+			assert.True(t, proto.Equal(inner, decoded))
+		})
+	}
+
+	// payloads that are not compressed are returned as is
+	decompressed, err := Decompress(inner)
+	require.NoError(t, err)
+	assert.Same(t, inner, decompressed)
+
+	_, err = Compress(inner, "LZ4")
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+}
+
+func TestDecompress(t *testing.T) {
+	data, err := proto.Marshal(&Payload{Seq: 7})
+	require.NoError(t, err)
+
+	// raw deflate data without the zlib header and algorithm metric
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	payload, err := Decompress(&Payload{Uuid: COMPRESSED_UUID, Body: buf.Bytes()})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), payload.Seq)
+
+	algorithm := &Payload_Metric{Name: ALGORITHM, Value: &Payload_Metric_StringValue{StringValue: "gzip"}}
+	_, err = Decompress(&Payload{Uuid: COMPRESSED_UUID, Body: buf.Bytes(), Metrics: []*Payload_Metric{algorithm}})
+	assert.Error(t, err)
+	algorithm.Value = &Payload_Metric_StringValue{StringValue: "BZIP2"}
+	_, err = Decompress(&Payload{Uuid: COMPRESSED_UUID, Body: buf.Bytes(), Metrics: []*Payload_Metric{algorithm}})
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+}
+
+func TestParseCompression(t *testing.T) {
+	c, err := ParseCompression("gzip")
+	require.NoError(t, err)
+	assert.Equal(t, COMPRESSION_GZIP, c)
+	c, err = ParseCompression("")
+	require.NoError(t, err)
+	assert.Empty(t, c)
+	_, err = ParseCompression("lz4")
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+}
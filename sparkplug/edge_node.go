@@ -0,0 +1,535 @@
+package sparkplug
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// BD_SEQ is the birth/death sequence metric of NBIRTH and NDEATH payloads
+	BD_SEQ = "bdSeq"
+	// NODE_CONTROL_REBIRTH is the NCMD metric requesting a new NBIRTH
+	NODE_CONTROL_REBIRTH = "Node Control/Rebirth"
+)
+
+// DefaultReconnectInterval is the wait between connection attempts of an
+// edge node after its connection was lost
+const DefaultReconnectInterval = 5 * time.Second
+
+var (
+	ErrNotConnected  = fmt.Errorf("not connected")
+	ErrUnknownMetric = fmt.Errorf("metric is not in the birth certificate")
+	ErrUnknownDevice = fmt.Errorf("unknown device")
+)
+
+// EdgeNodeOpts configures an edge node
+type EdgeNodeOpts struct {
+	GroupId    string
+	EdgeNodeId string
+	// Metrics of the NBIRTH with their initial values, each needs a name and
+	// a datatype. The bdSeq and Node Control/Rebirth metrics are added.
+	Metrics []*Payload_Metric
+	// Aliases assigns an alias to each metric in the births, DATA messages
+	// then identify metrics by alias instead of name
+	Aliases bool
+	// BdSeq of the first session, edge nodes persisting it across restarts set it
+	BdSeq uint64
+	// ReconnectInterval is the wait between connection attempts after the
+	// connection was lost, DefaultReconnectInterval if zero
+	ReconnectInterval time.Duration
+	// Compression compresses all published payloads, including the will,
+	// when set to DEFLATE or GZIP
+	Compression Compression
+	// OnNodeCommand is called with the metrics of NCMD messages, rebirth
+	// requests are handled by the edge node and not passed on
+	OnNodeCommand func(metrics []*Payload_Metric)
+	// OnDeviceCommand is called with the device id and metrics of DCMD messages
+	OnDeviceCommand func(deviceId string, metrics []*Payload_Metric)
+}
+
+// EdgeNode is a Sparkplug B edge node. It registers a NDEATH with bdSeq as
+// last will, publishes the NBIRTH and DBIRTHs on every connect, numbers its
+// messages, publishes metrics by exception and rebirths on request. Metric
+// names and aliases of commands are resolved before they reach the callbacks.
+type EdgeNode struct {
+	logger    *log.Logger
+	transport Transport
+	opts      EdgeNodeOpts
+
+	mu        sync.Mutex
+	node      *metricSet
+	devices   map[string]*metricSet
+	order     []string
+	nextAlias uint64
+	bdSeq     uint64
+	nextBdSeq uint64
+	seq       uint64
+	connected bool
+	session   int
+	done      chan struct{}
+}
+
+// metricSet holds the last reported metrics of an edge node or device
+type metricSet struct {
+	names   []string
+	metrics map[string]*Payload_Metric
+	aliases map[uint64]string
+}
+
+// NewEdgeNode returns an edge node publishing with transport, a nil logger
+// discards its logs
+func NewEdgeNode(logger *log.Logger, transport Transport, opts EdgeNodeOpts) (*EdgeNode, error) {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	if !validId(opts.GroupId) || !validId(opts.EdgeNodeId) {
+		return nil, fmt.Errorf("invalid group id %q or edge node id %q", opts.GroupId, opts.EdgeNodeId)
+	}
+	if opts.BdSeq > 255 {
+		return nil, fmt.Errorf("bdSeq must be between 0 and 255")
+	}
+	if opts.ReconnectInterval <= 0 {
+		opts.ReconnectInterval = DefaultReconnectInterval
+	}
+
+	n := &EdgeNode{
+		logger:    logger,
+		transport: transport,
+		opts:      opts,
+		devices:   map[string]*metricSet{},
+		nextBdSeq: opts.BdSeq,
+	}
+	for _, m := range opts.Metrics {
+		if m.GetName() == BD_SEQ || m.GetName() == NODE_CONTROL_REBIRTH {
+			return nil, fmt.Errorf("metric %s is added by the edge node", m.GetName())
+		}
+	}
+	node, err := n.newMetricSet(opts.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	n.node = node
+	return n, nil
+}
+
+// newMetricSet validates birth metrics and assigns their aliases
+func (n *EdgeNode) newMetricSet(metrics []*Payload_Metric) (*metricSet, error) {
+	set := &metricSet{metrics: map[string]*Payload_Metric{}, aliases: map[uint64]string{}}
+	for _, m := range metrics {
+		if len(m.GetName()) == 0 {
+			return nil, fmt.Errorf("birth metrics need a name")
+		}
+		if m.GetDatatype() == DataType_Unknown.Uint32() {
+			return nil, fmt.Errorf("metric %s has no datatype", m.GetName())
+		}
+		if _, ok := set.metrics[m.GetName()]; ok {
+			return nil, fmt.Errorf("duplicate metric %s", m.GetName())
+		}
+		metric := proto.Clone(m).(*Payload_Metric)
+		metric.Alias = 0
+		set.names = append(set.names, metric.Name)
+		set.metrics[metric.Name] = metric
+	}
+	if n.opts.Aliases {
+		for _, name := range set.names {
+			n.nextAlias++
+			set.metrics[name].Alias = n.nextAlias
+			set.aliases[n.nextAlias] = name
+		}
+	}
+	return set, nil
+}
+
+// BdSeq returns the bdSeq of the current or last session
+func (n *EdgeNode) BdSeq() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.bdSeq
+}
+
+// Connected returns true while the edge node has a session
+func (n *EdgeNode) Connected() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.connected
+}
+
+// Connect starts a session and publishes the births. A lost connection is
+// reconnected with the next bdSeq until Disconnect is called.
+func (n *EdgeNode) Connect() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.connected {
+		return nil
+	}
+	// stop reconnecting after a lost connection
+	if n.done != nil {
+		close(n.done)
+	}
+	n.done = make(chan struct{})
+	return n.connect()
+}
+
+func (n *EdgeNode) connect() error {
+	death, err := n.marshal(n.deathPayload(n.nextBdSeq))
+	if err != nil {
+		return fmt.Errorf("unable to marshal NDEATH, %w", err)
+	}
+	n.session++
+	session := n.session
+	will := &Will{Topic: EdgeNodeDeathTopic(n.opts.GroupId, n.opts.EdgeNodeId), Payload: death, QoS: 1}
+	if err := n.transport.Connect(will, func(err error) { n.connectionLost(session, err) }); err != nil {
+		return err
+	}
+	n.bdSeq = n.nextBdSeq
+	n.nextBdSeq = NextSequenceNumber(n.bdSeq)
+	n.connected = true
+
+	if err := n.start(); err != nil {
+		n.connected = false
+		n.transport.Disconnect()
+		return err
+	}
+	return nil
+}
+
+// start subscribes to the commands and publishes the births of a new session
+func (n *EdgeNode) start() error {
+	for _, topic := range []string{
+		EdgeNodeCommandTopic(n.opts.GroupId, n.opts.EdgeNodeId),
+		DeviceCommandTopic(n.opts.GroupId, n.opts.EdgeNodeId, "+"),
+	} {
+		if err := n.transport.Subscribe(topic, 1, n.command); err != nil {
+			return err
+		}
+	}
+	return n.birth()
+}
+
+// connectionLost reconnects after the connection of session was lost
+func (n *EdgeNode) connectionLost(session int, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if session != n.session || !n.connected {
+		return
+	}
+	n.logger.Println("edge node", n.opts.EdgeNodeId, "lost its connection,", err)
+	n.connected = false
+	go n.reconnect(n.done)
+}
+
+func (n *EdgeNode) reconnect(done chan struct{}) {
+	retry(done, n.opts.ReconnectInterval, func() error {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if closed(done) {
+			return nil
+		}
+		if err := n.connect(); err != nil {
+			n.logger.Println("edge node", n.opts.EdgeNodeId, "unable to reconnect,", err)
+			return err
+		}
+		n.logger.Println("edge node", n.opts.EdgeNodeId, "reconnected with bdSeq", n.bdSeq)
+		return nil
+	})
+}
+
+// Disconnect publishes the NDEATH and ends the session, it stops reconnecting
+func (n *EdgeNode) Disconnect() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.done != nil {
+		close(n.done)
+		n.done = nil
+	}
+	if !n.connected {
+		return nil
+	}
+	n.connected = false
+	var errs []error
+	if err := n.publish(EdgeNodeDeathTopic(n.opts.GroupId, n.opts.EdgeNodeId), 1, n.deathPayload(n.bdSeq)); err != nil {
+		errs = append(errs, err)
+	}
+	if err := n.transport.Disconnect(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// AddDevice adds a device with the metrics of its DBIRTH, the DBIRTH is
+// published at once when the edge node is connected
+func (n *EdgeNode) AddDevice(deviceId string, metrics []*Payload_Metric) error {
+	if !validId(deviceId) {
+		return fmt.Errorf("invalid device id %q", deviceId)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.devices[deviceId]; ok {
+		return fmt.Errorf("device %s already exists", deviceId)
+	}
+	set, err := n.newMetricSet(metrics)
+	if err != nil {
+		return err
+	}
+	n.devices[deviceId] = set
+	n.order = append(n.order, deviceId)
+	if !n.connected {
+		return nil
+	}
+	return n.deviceBirth(deviceId)
+}
+
+// RemoveDevice publishes the DDEATH of a device and removes it
+func (n *EdgeNode) RemoveDevice(deviceId string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.devices[deviceId]; !ok {
+		return fmt.Errorf("%w %s", ErrUnknownDevice, deviceId)
+	}
+	delete(n.devices, deviceId)
+	for i, id := range n.order {
+		if id == deviceId {
+			n.order = append(n.order[:i], n.order[i+1:]...)
+			break
+		}
+	}
+	if !n.connected {
+		return nil
+	}
+	topic := DeviceDeathTopic(n.opts.GroupId, n.opts.EdgeNodeId, deviceId)
+	return n.publish(topic, 0, &Payload{Timestamp: timestamp(), Seq: n.nextSeq()})
+}
+
+// PublishNodeData publishes the metrics whose value changed since they were
+// last reported in a NDATA. The metrics are identified by name and must be in
+// the NBIRTH. While disconnected the values are kept for the next birth and
+// ErrNotConnected is returned.
+func (n *EdgeNode) PublishNodeData(metrics ...*Payload_Metric) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.publishData(EdgeNodeDataTopic(n.opts.GroupId, n.opts.EdgeNodeId), n.node, metrics)
+}
+
+// PublishDeviceData publishes the metrics of a device whose value changed
+// since they were last reported in a DDATA, like PublishNodeData
+func (n *EdgeNode) PublishDeviceData(deviceId string, metrics ...*Payload_Metric) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	set, ok := n.devices[deviceId]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownDevice, deviceId)
+	}
+	return n.publishData(DeviceDataTopic(n.opts.GroupId, n.opts.EdgeNodeId, deviceId), set, metrics)
+}
+
+// Rebirth publishes a new NBIRTH and DBIRTHs with the current values, the
+// bdSeq stays the same and seq starts over at 0
+func (n *EdgeNode) Rebirth() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.connected {
+		return ErrNotConnected
+	}
+	return n.birth()
+}
+
+func (n *EdgeNode) publishData(topic string, set *metricSet, metrics []*Payload_Metric) error {
+	for _, m := range metrics {
+		if _, ok := set.metrics[m.GetName()]; !ok {
+			return fmt.Errorf("%w, %s", ErrUnknownMetric, m.GetName())
+		}
+	}
+
+	now := timestamp()
+	var changed []*Payload_Metric
+	for _, m := range metrics {
+		m = proto.Clone(m).(*Payload_Metric)
+		last := set.metrics[m.Name]
+		ts := m.Timestamp
+		if ts == 0 {
+			ts = now
+		}
+		if sameValue(last, m) {
+			continue
+		}
+		last.Value, last.IsNull, last.Timestamp = m.Value, m.IsNull, ts
+
+		// datatypes are only part of births
+		data := &Payload_Metric{Timestamp: ts, Value: m.Value, IsNull: m.IsNull}
+		if last.Alias > 0 {
+			data.Alias = last.Alias
+		} else {
+			data.Name = last.Name
+		}
+		changed = append(changed, data)
+	}
+	if !n.connected {
+		return ErrNotConnected
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return n.publish(topic, 0, &Payload{Timestamp: now, Seq: n.nextSeq(), Metrics: changed})
+}
+
+// birth publishes the NBIRTH and the DBIRTHs of all devices
+func (n *EdgeNode) birth() error {
+	now := timestamp()
+	n.seq = 0
+	metrics := []*Payload_Metric{
+		{Name: BD_SEQ, Timestamp: now, Datatype: DataType_Int64.Uint32(), Value: &Payload_Metric_LongValue{LongValue: n.bdSeq}},
+		{Name: NODE_CONTROL_REBIRTH, Timestamp: now, Datatype: DataType_Boolean.Uint32(), Value: &Payload_Metric_BooleanValue{BooleanValue: false}},
+	}
+	metrics = append(metrics, n.node.birthMetrics(now)...)
+	topic := EdgeNodeBirthTopic(n.opts.GroupId, n.opts.EdgeNodeId)
+	if err := n.publish(topic, 0, &Payload{Timestamp: now, Seq: n.nextSeq(), Metrics: metrics}); err != nil {
+		return err
+	}
+	for _, deviceId := range n.order {
+		if err := n.deviceBirth(deviceId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *EdgeNode) deviceBirth(deviceId string) error {
+	now := timestamp()
+	topic := DeviceBirthTopic(n.opts.GroupId, n.opts.EdgeNodeId, deviceId)
+	return n.publish(topic, 0, &Payload{Timestamp: now, Seq: n.nextSeq(), Metrics: n.devices[deviceId].birthMetrics(now)})
+}
+
+// birthMetrics returns copies of the metrics with names, aliases, datatypes
+// and current values
+func (s *metricSet) birthMetrics(now uint64) []*Payload_Metric {
+	metrics := make([]*Payload_Metric, 0, len(s.names))
+	for _, name := range s.names {
+		metric := proto.Clone(s.metrics[name]).(*Payload_Metric)
+		if metric.Timestamp == 0 {
+			metric.Timestamp = now
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+func (n *EdgeNode) deathPayload(bdSeq uint64) *Payload {
+	return &Payload{
+		Timestamp: timestamp(),
+		Metrics: []*Payload_Metric{
+			{Name: BD_SEQ, Datatype: DataType_Int64.Uint32(), Value: &Payload_Metric_LongValue{LongValue: bdSeq}},
+		},
+	}
+}
+
+// nextSeq returns the seq of the next message
+func (n *EdgeNode) nextSeq() uint64 {
+	seq := n.seq
+	n.seq = NextSequenceNumber(seq)
+	return seq
+}
+
+func (n *EdgeNode) publish(topic string, qos byte, payload *Payload) error {
+	data, err := n.marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to marshal payload for %s, %w", topic, err)
+	}
+	return n.transport.Publish(topic, qos, false, data)
+}
+
+// marshal returns the protobuf encoding of a payload, compressed when the
+// edge node compresses its payloads
+func (n *EdgeNode) marshal(payload *Payload) ([]byte, error) {
+	if len(n.opts.Compression) > 0 {
+		compressed, err := Compress(payload, n.opts.Compression)
+		if err != nil {
+			return nil, err
+		}
+		payload = compressed
+	}
+	return proto.Marshal(payload)
+}
+
+// command handles NCMD and DCMD messages
+func (n *EdgeNode) command(topic string, payload []byte) {
+	t, err := ToTopic(topic)
+	if err != nil {
+		n.logger.Println("unable to parse command topic", topic, err)
+		return
+	}
+	p, err := UnmarshalPayload(payload)
+	if err != nil {
+		n.logger.Println("unable to unmarshal command", topic, err)
+		return
+	}
+
+	n.mu.Lock()
+	set := n.node
+	if t.Command == DCMD {
+		set = n.devices[t.DeviceId]
+	}
+	if set == nil {
+		n.mu.Unlock()
+		n.logger.Println("command for unknown device", t.DeviceId)
+		return
+	}
+	metrics := make([]*Payload_Metric, 0, len(p.Metrics))
+	for _, m := range p.Metrics {
+		if len(m.Name) == 0 {
+			m.Name = set.aliases[m.Alias]
+		}
+		if known, ok := set.metrics[m.Name]; ok && m.Datatype == DataType_Unknown.Uint32() {
+			m.Datatype = known.Datatype
+		}
+		metrics = append(metrics, m)
+	}
+	n.mu.Unlock()
+
+	switch t.Command {
+	case NCMD:
+		rebirth := false
+		commands := metrics[:0]
+		for _, m := range metrics {
+			if m.Name == NODE_CONTROL_REBIRTH {
+				rebirth = rebirth || m.GetBooleanValue()
+				continue
+			}
+			commands = append(commands, m)
+		}
+		if rebirth {
+			if err := n.Rebirth(); err != nil {
+				n.logger.Println("unable to rebirth edge node", n.opts.EdgeNodeId, err)
+			}
+		}
+		if len(commands) > 0 && n.opts.OnNodeCommand != nil {
+			n.opts.OnNodeCommand(commands)
+		}
+	case DCMD:
+		if n.opts.OnDeviceCommand != nil {
+			n.opts.OnDeviceCommand(t.DeviceId, metrics)
+		}
+	}
+}
+
+// sameValue returns true if both metrics have the same value
+func sameValue(a, b *Payload_Metric) bool {
+	return proto.Equal(&Payload_Metric{Value: a.Value, IsNull: a.IsNull}, &Payload_Metric{Value: b.Value, IsNull: b.IsNull})
+}
+
+// validId returns true if id is a valid group, edge node or device id, any
+// non empty string without the MQTT topic separator and wildcards
+func validId(id string) bool {
+	return len(id) > 0 && !strings.ContainsAny(id, "/+#")
+}
+
+// timestamp returns the current time in milliseconds since the epoch
+func timestamp() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
@@ -0,0 +1,263 @@
+package sparkplug
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+type published struct {
+	topic   string
+	qos     byte
+	retain  bool
+	data    []byte
+	payload *Payload
+}
+
+// testTransport records the wills, subscriptions and published messages
+type testTransport struct {
+	mu        sync.Mutex
+	wills     []*Will
+	onLost    func(error)
+	handlers  map[string]MessageHandler
+	published []published
+	connected bool
+}
+
+func (t *testTransport) Connect(will *Will, onLost func(error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.wills = append(t.wills, will)
+	t.onLost = onLost
+	t.handlers = map[string]MessageHandler{}
+	t.connected = true
+	return nil
+}
+
+func (t *testTransport) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// STATE payloads are JSON, compressed payloads are decompressed
+	p := &Payload{}
+	if !strings.Contains(topic, "/"+string(STATE)+"/") {
+		var err error
+		if p, err = UnmarshalPayload(payload); err != nil {
+			return err
+		}
+	}
+	t.published = append(t.published, published{topic: topic, qos: qos, retain: retain, data: payload, payload: p})
+	return nil
+}
+
+func (t *testTransport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers[topic] = handler
+	return nil
+}
+
+func (t *testTransport) Disconnect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connected = false
+	return nil
+}
+
+// will returns the protobuf payload of a will
+func (t *testTransport) will(i int) *Payload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, err := UnmarshalPayload(t.wills[i].Payload)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// take returns and clears the published messages
+func (t *testTransport) take() []published {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.published
+	t.published = nil
+	return p
+}
+
+// send passes a command to the handler subscribed to filter
+func (t *testTransport) send(filter, topic string, payload *Payload) error {
+	data, err := proto.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	handler := t.handlers[filter]
+	t.mu.Unlock()
+	handler(topic, data)
+	return nil
+}
+
+func floatMetric(name string, value float32) *Payload_Metric {
+	return &Payload_Metric{Name: name, Datatype: DataType_Float.Uint32(), Value: &Payload_Metric_FloatValue{FloatValue: value}}
+}
+
+func TestEdgeNode(t *testing.T) {
+	transport := &testTransport{}
+	var nodeCommands, deviceCommands []*Payload_Metric
+	node, err := NewEdgeNode(nil, transport, EdgeNodeOpts{
+		GroupId:         "Plant1",
+		EdgeNodeId:      "Heater",
+		Metrics:         []*Payload_Metric{floatMetric("Voltage", 230)},
+		Aliases:         true,
+		BdSeq:           255,
+		OnNodeCommand:   func(metrics []*Payload_Metric) { nodeCommands = append(nodeCommands, metrics...) },
+		OnDeviceCommand: func(deviceId string, metrics []*Payload_Metric) { deviceCommands = append(deviceCommands, metrics...) },
+	})
+	require.NoError(t, err)
+	require.NoError(t, node.AddDevice("TempSensor", []*Payload_Metric{floatMetric("Celsius", 20)}))
+
+	// values are kept while disconnected
+	assert.ErrorIs(t, node.PublishNodeData(floatMetric("Voltage", 231)), ErrNotConnected)
+	require.NoError(t, node.Connect())
+
+	require.Len(t, transport.wills, 1)
+	assert.Equal(t, uint64(255), transport.will(0).Metrics[0].GetLongValue())
+	births := transport.take()
+	require.Len(t, births, 2)
+	assert.Equal(t, "spBv1.0/Plant1/NBIRTH/Heater", births[0].topic)
+	assert.Equal(t, uint64(0), births[0].payload.Seq)
+	nbirth := births[0].payload.Metrics
+	require.Len(t, nbirth, 3)
+	assert.Equal(t, BD_SEQ, nbirth[0].Name)
+	assert.Equal(t, uint64(255), nbirth[0].GetLongValue())
+	assert.Equal(t, NODE_CONTROL_REBIRTH, nbirth[1].Name)
+	assert.Equal(t, "Voltage", nbirth[2].Name)
+	assert.Equal(t, uint64(1), nbirth[2].Alias)
+	assert.Equal(t, float32(231), nbirth[2].GetFloatValue())
+	assert.Equal(t, "spBv1.0/Plant1/DBIRTH/Heater/TempSensor", births[1].topic)
+	assert.Equal(t, uint64(1), births[1].payload.Seq)
+	assert.Equal(t, uint64(2), births[1].payload.Metrics[0].Alias)
+
+	// report by exception
+	require.NoError(t, node.PublishNodeData(floatMetric("Voltage", 231)))
+	require.NoError(t, node.PublishDeviceData("TempSensor", floatMetric("Celsius", 21)))
+	data := transport.take()
+	require.Len(t, data, 1)
+	assert.Equal(t, "spBv1.0/Plant1/DDATA/Heater/TempSensor", data[0].topic)
+	assert.Equal(t, uint64(2), data[0].payload.Seq)
+	metric := data[0].payload.Metrics[0]
+	assert.Equal(t, uint64(2), metric.Alias)
+	assert.Empty(t, metric.Name)
+	assert.Zero(t, metric.Datatype)
+	assert.Equal(t, float32(21), metric.GetFloatValue())
+	assert.ErrorIs(t, node.PublishNodeData(floatMetric("Current", 1)), ErrUnknownMetric)
+	assert.ErrorIs(t, node.PublishDeviceData("Pump", floatMetric("Celsius", 1)), ErrUnknownDevice)
+
+	// commands by alias reach the callbacks, rebirths are handled
+	require.NoError(t, transport.send("spBv1.0/Plant1/DCMD/Heater/+", "spBv1.0/Plant1/DCMD/Heater/TempSensor",
+		&Payload{Metrics: []*Payload_Metric{{Alias: 2, Value: &Payload_Metric_FloatValue{FloatValue: 25}}}}))
+	require.Len(t, deviceCommands, 1)
+	assert.Equal(t, "Celsius", deviceCommands[0].Name)
+	assert.Equal(t, DataType_Float.Uint32(), deviceCommands[0].Datatype)
+
+	require.NoError(t, transport.send("spBv1.0/Plant1/NCMD/Heater", "spBv1.0/Plant1/NCMD/Heater",
+		&Payload{Metrics: []*Payload_Metric{{Name: NODE_CONTROL_REBIRTH, Value: &Payload_Metric_BooleanValue{BooleanValue: true}}}}))
+	assert.Empty(t, nodeCommands)
+	rebirth := transport.take()
+	require.Len(t, rebirth, 2)
+	assert.Equal(t, uint64(0), rebirth[0].payload.Seq)
+	assert.Equal(t, uint64(255), rebirth[0].payload.Metrics[0].GetLongValue())
+	assert.Equal(t, float32(21), rebirth[1].payload.Metrics[0].GetFloatValue())
+
+	// devices are born and die while connected
+	require.NoError(t, node.AddDevice("Pump", []*Payload_Metric{floatMetric("Flow", 1)}))
+	require.NoError(t, node.RemoveDevice("Pump"))
+	device := transport.take()
+	require.Len(t, device, 2)
+	assert.Equal(t, "spBv1.0/Plant1/DDEATH/Heater/Pump", device[1].topic)
+	assert.Equal(t, uint64(3), device[1].payload.Seq)
+
+	require.NoError(t, node.Disconnect())
+	death := transport.take()
+	require.Len(t, death, 1)
+	assert.Equal(t, "spBv1.0/Plant1/NDEATH/Heater", death[0].topic)
+	assert.Equal(t, byte(1), death[0].qos)
+	assert.Equal(t, uint64(255), death[0].payload.Metrics[0].GetLongValue())
+	assert.False(t, transport.connected)
+}
+
+func TestEdgeNodeReconnect(t *testing.T) {
+	transport := &testTransport{}
+	node, err := NewEdgeNode(nil, transport, EdgeNodeOpts{GroupId: "Plant1", EdgeNodeId: "Heater", ReconnectInterval: time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, node.Connect())
+	transport.take()
+
+	// a new session has the next bdSeq
+	transport.onLost(assert.AnError)
+	require.Eventually(t, node.Connected, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(1), node.BdSeq())
+	assert.Equal(t, uint64(1), transport.will(1).Metrics[0].GetLongValue())
+	births := transport.take()
+	require.Len(t, births, 1)
+	assert.Equal(t, uint64(1), births[0].payload.Metrics[0].GetLongValue())
+	require.NoError(t, node.Disconnect())
+}
+
+func TestEdgeNodeCompression(t *testing.T) {
+	transport := &testTransport{}
+	var commands []*Payload_Metric
+	node, err := NewEdgeNode(nil, transport, EdgeNodeOpts{
+		GroupId:       "Plant1",
+		EdgeNodeId:    "Heater",
+		Metrics:       []*Payload_Metric{floatMetric("Voltage", 230)},
+		Compression:   COMPRESSION_DEFLATE,
+		OnNodeCommand: func(metrics []*Payload_Metric) { commands = append(commands, metrics...) },
+	})
+	require.NoError(t, err)
+	require.NoError(t, node.Connect())
+
+	// the will and births are compressed
+	var will Payload
+	require.NoError(t, proto.Unmarshal(transport.wills[0].Payload, &will))
+	assert.True(t, IsCompressed(&will))
+	births := transport.take()
+	require.Len(t, births, 1)
+	var outer Payload
+	require.NoError(t, proto.Unmarshal(births[0].data, &outer))
+	assert.Equal(t, COMPRESSED_UUID, outer.Uuid)
+	assert.Equal(t, "Voltage", births[0].payload.Metrics[2].Name)
+
+	// compressed commands are decompressed
+	command, err := NewPayload().Float("Voltage", 240).Compressed(COMPRESSION_GZIP)
+	require.NoError(t, err)
+	require.NoError(t, transport.send("spBv1.0/Plant1/NCMD/Heater", "spBv1.0/Plant1/NCMD/Heater", command))
+	require.Len(t, commands, 1)
+	assert.Equal(t, float32(240), commands[0].GetFloatValue())
+	require.NoError(t, node.Disconnect())
+}
+
+func TestNewEdgeNode(t *testing.T) {
+	tests := []struct {
+		name string
+		opts EdgeNodeOpts
+	}{
+		{"group id", EdgeNodeOpts{GroupId: "Plant/1", EdgeNodeId: "Heater"}},
+		{"edge node id", EdgeNodeOpts{GroupId: "Plant1"}},
+		{"bdSeq", EdgeNodeOpts{GroupId: "Plant1", EdgeNodeId: "Heater", BdSeq: 256}},
+		{"metric name", EdgeNodeOpts{GroupId: "Plant1", EdgeNodeId: "Heater", Metrics: []*Payload_Metric{floatMetric("", 1)}}},
+		{"datatype", EdgeNodeOpts{GroupId: "Plant1", EdgeNodeId: "Heater", Metrics: []*Payload_Metric{{Name: "Voltage"}}}},
+		{"duplicate", EdgeNodeOpts{GroupId: "Plant1", EdgeNodeId: "Heater", Metrics: []*Payload_Metric{floatMetric("Voltage", 1), floatMetric("Voltage", 2)}}},
+		{"reserved", EdgeNodeOpts{GroupId: "Plant1", EdgeNodeId: "Heater", Metrics: []*Payload_Metric{floatMetric(BD_SEQ, 1)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEdgeNode(nil, &testTransport{}, tt.opts)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,443 @@
+package sparkplug
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultRebirthInterval is the least time between two rebirth requests of a
+// host application to the same edge node
+const DefaultRebirthInterval = 10 * time.Second
+
+// HostState is the JSON payload of the STATE messages of a host application
+type HostState struct {
+	Online    bool   `json:"online"`
+	Timestamp uint64 `json:"timestamp"`
+}
+
+// BirthEvent is the NBIRTH of an edge node or the DBIRTH of a device
+type BirthEvent struct {
+	Topic Topic
+	// Node is the session of the edge node after the birth
+	Node     NodeSession
+	Metrics  []*Payload_Metric
+	Received time.Time
+}
+
+// DeathEvent is the NDEATH of an edge node or the DDEATH of a device
+type DeathEvent struct {
+	Topic    Topic
+	Node     NodeSession
+	Received time.Time
+}
+
+// MetricChange is a metric of a birth or data message whose value changed
+type MetricChange struct {
+	Topic    Topic
+	Metric   *Payload_Metric
+	Received time.Time
+}
+
+// HostApplicationOpts configures a host application
+type HostApplicationOpts struct {
+	// HostId names the host application in its STATE topic. A host
+	// application without one publishes no STATE, such as one monitoring edge
+	// nodes that have another primary host.
+	HostId string
+	// Filters are the topic filters subscribed to, spBv1.0/# if empty
+	Filters []string
+	// Source is set in the topics of received messages, so the host
+	// applications of several brokers can share a Namespace
+	Source string
+	// Namespace is the state of the edge nodes, a new one if nil
+	Namespace *Namespace
+	// RebirthInterval is the least time between two rebirth requests to an
+	// edge node, DefaultRebirthInterval if zero
+	RebirthInterval time.Duration
+	// ReconnectInterval is the wait between connection attempts after the
+	// connection was lost, DefaultReconnectInterval if zero
+	ReconnectInterval time.Duration
+
+	OnNodeBirth   func(BirthEvent)
+	OnNodeDeath   func(DeathEvent)
+	OnDeviceBirth func(BirthEvent)
+	OnDeviceDeath func(DeathEvent)
+	// OnMetricChange is called for each metric whose value changed, including
+	// all metrics of births. Data of edge nodes and devices without a birth is
+	// not passed on.
+	OnMetricChange func(MetricChange)
+}
+
+// HostApplication is a Sparkplug B host application. It publishes its STATE
+// with a retained will, tracks the sessions, sequence numbers, aliases and
+// templates of the edge nodes in its Namespace and asks edge nodes for a
+// rebirth when their messages don't match their births. Callbacks are called
+// in the order of the messages.
+//
+// Applications that open their own connection pass StateWill as its will,
+// call PublishState once connected and pass the received messages to
+// Process, the transport is then only used to publish.
+type HostApplication struct {
+	logger    *log.Logger
+	transport Transport
+	opts      HostApplicationOpts
+	namespace *Namespace
+
+	mu        sync.Mutex
+	connected bool
+	session   int
+	done      chan struct{}
+	// timestamp of the STATE birth and will of the current session
+	timestamp uint64
+	rebirths  map[NodeKey]time.Time
+}
+
+// NewHostApplication returns a host application using transport, a nil
+// logger discards its logs
+func NewHostApplication(logger *log.Logger, transport Transport, opts HostApplicationOpts) (*HostApplication, error) {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	if len(opts.HostId) > 0 && !validId(opts.HostId) {
+		return nil, fmt.Errorf("invalid host id %q", opts.HostId)
+	}
+	if len(opts.Filters) == 0 {
+		opts.Filters = []string{SPB_NS + "/#"}
+	}
+	if opts.RebirthInterval <= 0 {
+		opts.RebirthInterval = DefaultRebirthInterval
+	}
+	if opts.ReconnectInterval <= 0 {
+		opts.ReconnectInterval = DefaultReconnectInterval
+	}
+	namespace := opts.Namespace
+	if namespace == nil {
+		namespace = NewNamespace()
+	}
+	return &HostApplication{
+		logger:    logger,
+		transport: transport,
+		opts:      opts,
+		namespace: namespace,
+		rebirths:  map[NodeKey]time.Time{},
+	}, nil
+}
+
+// Namespace returns the state of the edge nodes seen by the host application
+func (h *HostApplication) Namespace() *Namespace {
+	return h.namespace
+}
+
+// Connected returns true while the host application has a session
+func (h *HostApplication) Connected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connected
+}
+
+// Connect starts a session with the offline STATE as will, publishes the
+// online STATE and subscribes to the filters. A lost connection is
+// reconnected until Disconnect is called.
+func (h *HostApplication) Connect() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.connected {
+		return nil
+	}
+	if h.done != nil {
+		close(h.done)
+	}
+	h.done = make(chan struct{})
+	return h.connect()
+}
+
+func (h *HostApplication) connect() error {
+	will, err := h.stateWill()
+	if err != nil {
+		return err
+	}
+	h.session++
+	session := h.session
+	if err := h.transport.Connect(will, func(err error) { h.connectionLost(session, err) }); err != nil {
+		return err
+	}
+	h.connected = true
+
+	// the STATE is published before subscribing to the namespace
+	if len(h.opts.HostId) > 0 {
+		err = h.transport.Subscribe(HostStateTopic(h.opts.HostId), 1, h.handle)
+		if err == nil {
+			err = h.publishState(true)
+		}
+	}
+	for _, filter := range h.opts.Filters {
+		if err != nil {
+			break
+		}
+		err = h.transport.Subscribe(filter, 1, h.handle)
+	}
+	if err != nil {
+		h.connected = false
+		h.transport.Disconnect()
+		return err
+	}
+	return nil
+}
+
+// stateWill starts a STATE session, it returns its offline STATE or nil
+// without a host id
+func (h *HostApplication) stateWill() (*Will, error) {
+	if len(h.opts.HostId) == 0 {
+		return nil, nil
+	}
+	h.timestamp = timestamp()
+	payload, err := json.Marshal(HostState{Online: false, Timestamp: h.timestamp})
+	if err != nil {
+		return nil, err
+	}
+	return &Will{Topic: HostStateTopic(h.opts.HostId), Payload: payload, QoS: 1, Retain: true}, nil
+}
+
+// StateWill starts a STATE session and returns its offline STATE, the will
+// of a connection opened by the application rather than by Connect. It is
+// nil without a host id.
+func (h *HostApplication) StateWill() (*Will, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stateWill()
+}
+
+// PublishState publishes the online or offline STATE of the session of the
+// last StateWill, it does nothing without a host id
+func (h *HostApplication) PublishState(online bool) error {
+	if len(h.opts.HostId) == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.publishState(online)
+}
+
+func (h *HostApplication) publishState(online bool) error {
+	if len(h.opts.HostId) == 0 {
+		return nil
+	}
+	if h.transport == nil {
+		return ErrNotConnected
+	}
+	payload, err := json.Marshal(HostState{Online: online, Timestamp: h.timestamp})
+	if err != nil {
+		return err
+	}
+	return h.transport.Publish(HostStateTopic(h.opts.HostId), 1, true, payload)
+}
+
+// connectionLost reconnects after the connection of session was lost
+func (h *HostApplication) connectionLost(session int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if session != h.session || !h.connected {
+		return
+	}
+	h.logger.Println("host application", h.opts.HostId, "lost its connection,", err)
+	h.connected = false
+	done := h.done
+	go retry(done, h.opts.ReconnectInterval, func() error {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if closed(done) {
+			return nil
+		}
+		if err := h.connect(); err != nil {
+			h.logger.Println("host application", h.opts.HostId, "unable to reconnect,", err)
+			return err
+		}
+		h.logger.Println("host application", h.opts.HostId, "reconnected")
+		return nil
+	})
+}
+
+// Disconnect publishes the offline STATE and ends the session, it stops
+// reconnecting
+func (h *HostApplication) Disconnect() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done != nil {
+		close(h.done)
+		h.done = nil
+	}
+	if !h.connected {
+		return nil
+	}
+	h.connected = false
+	err := h.publishState(false)
+	if dErr := h.transport.Disconnect(); err == nil {
+		err = dErr
+	}
+	return err
+}
+
+// Rebirth asks an edge node to publish new births
+func (h *HostApplication) Rebirth(groupId string, edgeNodeId string) error {
+	if h.transport == nil {
+		return ErrNotConnected
+	}
+	payload, err := proto.Marshal(RebirthPayload(time.Now()))
+	if err != nil {
+		return fmt.Errorf("unable to marshal rebirth request, %w", err)
+	}
+	h.mu.Lock()
+	h.rebirths[NodeKey{GroupId: groupId, EdgeNodeId: edgeNodeId}] = time.Now()
+	h.mu.Unlock()
+	return h.transport.Publish(EdgeNodeCommandTopic(groupId, edgeNodeId), 0, false, payload)
+}
+
+// RebirthAll asks the known edge nodes of the source of the host application
+// for a rebirth, e.g. after messages were missed while disconnected
+func (h *HostApplication) RebirthAll() error {
+	var nodes []NodeSession
+	for _, node := range h.namespace.Nodes() {
+		if node.Source == h.opts.Source {
+			nodes = append(nodes, node)
+		}
+	}
+	h.logger.Printf("requesting rebirth of %d edge nodes\n", len(nodes))
+	var errs []error
+	for _, node := range nodes {
+		if err := h.Rebirth(node.GroupId, node.EdgeNodeId); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requestRebirth asks an edge node for a rebirth unless it was asked within
+// the rebirth interval or there is no transport to ask it
+func (h *HostApplication) requestRebirth(topic Topic, reason string) {
+	if h.transport == nil {
+		return
+	}
+	key := NodeKey{GroupId: topic.GroupId, EdgeNodeId: topic.EdgeNodeId}
+	h.mu.Lock()
+	last, asked := h.rebirths[key]
+	h.mu.Unlock()
+	if asked && time.Since(last) < h.opts.RebirthInterval {
+		return
+	}
+	h.logger.Printf("requesting rebirth of %s/%s, %s\n", topic.GroupId, topic.EdgeNodeId, reason)
+	if err := h.Rebirth(topic.GroupId, topic.EdgeNodeId); err != nil {
+		h.logger.Println("unable to request rebirth,", err)
+	}
+}
+
+// handle applies a message to the namespace and calls the callbacks
+func (h *HostApplication) handle(topic string, payload []byte) {
+	received := time.Now()
+	t, err := ToTopic(topic)
+	if err != nil {
+		h.logger.Println("ignoring message,", topic, err)
+		return
+	}
+	t.Source = h.opts.Source
+
+	switch t.Command {
+	case STATE:
+		h.state(t, payload)
+		return
+	case NBIRTH, NDEATH, NDATA, DBIRTH, DDEATH, DDATA:
+	default:
+		return
+	}
+
+	p, err := UnmarshalPayload(payload)
+	if err != nil {
+		h.logger.Println("unable to unmarshal payload of", topic, err)
+		return
+	}
+	h.Process(*t, p, received)
+}
+
+// Process applies a birth, data or death message to the namespace, asks for
+// a rebirth when the message doesn't match the births and calls the
+// callbacks. It is called for the messages received through Connect, and by
+// applications passing the messages of a connection of their own.
+func (h *HostApplication) Process(topic Topic, payload *Payload, received time.Time) Change {
+	change := h.namespace.Apply(topic, payload, received)
+	if change.Stale {
+		return change
+	}
+	if reason := change.Rebirth(); len(reason) > 0 {
+		h.requestRebirth(topic, reason)
+	}
+
+	switch topic.Command {
+	case NBIRTH, DBIRTH:
+		birth := BirthEvent{Topic: topic, Node: change.Node, Metrics: change.Metrics, Received: received}
+		if topic.Command == NBIRTH && h.opts.OnNodeBirth != nil {
+			h.opts.OnNodeBirth(birth)
+		}
+		if topic.Command == DBIRTH && h.opts.OnDeviceBirth != nil {
+			h.opts.OnDeviceBirth(birth)
+		}
+	case NDEATH, DDEATH:
+		death := DeathEvent{Topic: topic, Node: change.Node, Received: received}
+		if topic.Command == NDEATH && h.opts.OnNodeDeath != nil {
+			h.opts.OnNodeDeath(death)
+		}
+		if topic.Command == DDEATH && h.opts.OnDeviceDeath != nil {
+			h.opts.OnDeviceDeath(death)
+		}
+		return change
+	}
+
+	if change.Unborn || h.opts.OnMetricChange == nil {
+		return change
+	}
+	for _, metric := range change.Changed {
+		h.opts.OnMetricChange(MetricChange{Topic: topic, Metric: metric, Received: received})
+	}
+	return change
+}
+
+// state publishes the online STATE again when the will of the host
+// application was published while it is connected
+func (h *HostApplication) state(topic *Topic, payload []byte) {
+	if topic.ScadaNodeId != h.opts.HostId {
+		return
+	}
+	var state HostState
+	if err := json.Unmarshal(payload, &state); err != nil || state.Online {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.connected {
+		return
+	}
+	if err := h.publishState(true); err != nil {
+		h.logger.Println("unable to publish STATE,", err)
+	}
+}
+
+// RebirthPayload returns a NCMD payload with the Node Control/Rebirth metric
+func RebirthPayload(now time.Time) *Payload {
+	ts := uint64(now.UnixMilli())
+	return &Payload{
+		Timestamp: ts,
+		Metrics: []*Payload_Metric{
+			{
+				Name:      NODE_CONTROL_REBIRTH,
+				Timestamp: ts,
+				Datatype:  DataType_Boolean.Uint32(),
+				Value:     &Payload_Metric_BooleanValue{BooleanValue: true},
+			},
+		},
+	}
+}
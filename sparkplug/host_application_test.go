@@ -0,0 +1,184 @@
+package sparkplug
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostApplication(t *testing.T) {
+	transport := &testTransport{}
+	var births, deaths []string
+	var changes []MetricChange
+	host, err := NewHostApplication(nil, transport, HostApplicationOpts{
+		HostId:         "scada",
+		OnNodeBirth:    func(e BirthEvent) { births = append(births, e.Topic.EdgeNodeId) },
+		OnDeviceBirth:  func(e BirthEvent) { births = append(births, e.Topic.DeviceId) },
+		OnNodeDeath:    func(e DeathEvent) { deaths = append(deaths, e.Topic.EdgeNodeId) },
+		OnMetricChange: func(c MetricChange) { changes = append(changes, c) },
+	})
+	require.NoError(t, err)
+	require.NoError(t, host.Connect())
+
+	// the will and birth of the STATE share their timestamp
+	require.Len(t, transport.wills, 1)
+	will := transport.wills[0]
+	assert.Equal(t, "spBv1.0/STATE/scada", will.Topic)
+	assert.True(t, will.Retain)
+	var offline HostState
+	require.NoError(t, json.Unmarshal(will.Payload, &offline))
+	assert.False(t, offline.Online)
+	state := transport.take()
+	require.Len(t, state, 1)
+	assert.True(t, state[0].retain)
+	var online HostState
+	require.NoError(t, json.Unmarshal(state[0].data, &online))
+	assert.True(t, online.Online)
+	assert.Equal(t, offline.Timestamp, online.Timestamp)
+	assert.Contains(t, transport.handlers, "spBv1.0/#")
+
+	send := func(topic string, payload *Payload) {
+		t.Helper()
+		require.NoError(t, transport.send("spBv1.0/#", topic, payload))
+	}
+
+	// data without a birth is dropped and a rebirth requested once
+	send("spBv1.0/Plant1/NDATA/Heater", &Payload{Seq: 3, Metrics: []*Payload_Metric{floatMetric("Voltage", 230)}})
+	send("spBv1.0/Plant1/NDATA/Heater", &Payload{Seq: 4, Metrics: []*Payload_Metric{floatMetric("Voltage", 231)}})
+	assert.Empty(t, changes)
+	rebirth := transport.take()
+	require.Len(t, rebirth, 1)
+	assert.Equal(t, "spBv1.0/Plant1/NCMD/Heater", rebirth[0].topic)
+	assert.Equal(t, NODE_CONTROL_REBIRTH, rebirth[0].payload.Metrics[0].Name)
+	assert.True(t, rebirth[0].payload.Metrics[0].GetBooleanValue())
+
+	voltage := floatMetric("Voltage", 230)
+	voltage.Alias = 1
+	send("spBv1.0/Plant1/NBIRTH/Heater", &Payload{Seq: 0, Metrics: []*Payload_Metric{bdSeqMetric(1), voltage}})
+	send("spBv1.0/Plant1/DBIRTH/Heater/TempSensor", &Payload{Seq: 1, Metrics: []*Payload_Metric{floatMetric("Celsius", 20)}})
+	send("spBv1.0/Plant1/NDATA/Heater", &Payload{Seq: 2, Metrics: []*Payload_Metric{aliased(1, 230)}})
+	send("spBv1.0/Plant1/NDATA/Heater", &Payload{Seq: 3, Metrics: []*Payload_Metric{aliased(1, 232)}})
+	assert.Equal(t, []string{"Heater", "TempSensor"}, births)
+	require.Len(t, changes, 4)
+	assert.Equal(t, "Voltage", changes[3].Metric.Name)
+	assert.Equal(t, float32(232), changes[3].Metric.GetFloatValue())
+	assert.Empty(t, transport.take(), "no rebirth is requested for consistent messages")
+
+	// compressed payloads are decompressed
+	compressed, err := Compress(&Payload{Seq: 4, Metrics: []*Payload_Metric{aliased(1, 233)}}, COMPRESSION_DEFLATE)
+	require.NoError(t, err)
+	send("spBv1.0/Plant1/NDATA/Heater", compressed)
+	require.Len(t, changes, 5)
+	assert.Equal(t, float32(233), changes[4].Metric.GetFloatValue())
+
+	session, ok := host.Namespace().Node(NodeKey{GroupId: "Plant1", EdgeNodeId: "Heater"})
+	require.True(t, ok)
+	assert.Equal(t, uint64(4), session.Seq)
+
+	// stale deaths are ignored
+	send("spBv1.0/Plant1/NDEATH/Heater", &Payload{Metrics: []*Payload_Metric{bdSeqMetric(0)}})
+	assert.Empty(t, deaths)
+	send("spBv1.0/Plant1/NDEATH/Heater", &Payload{Metrics: []*Payload_Metric{bdSeqMetric(1)}})
+	assert.Equal(t, []string{"Heater"}, deaths)
+
+	// the online STATE is published again when the will was published
+	data, err := json.Marshal(HostState{Online: false, Timestamp: online.Timestamp})
+	require.NoError(t, err)
+	transport.handlers["spBv1.0/STATE/scada"]("spBv1.0/STATE/scada", data)
+	republished := transport.take()
+	require.Len(t, republished, 1)
+	assert.Equal(t, "spBv1.0/STATE/scada", republished[0].topic)
+
+	require.NoError(t, host.Disconnect())
+	offlineState := transport.take()
+	require.Len(t, offlineState, 1)
+	require.NoError(t, json.Unmarshal(offlineState[0].data, &offline))
+	assert.False(t, offline.Online)
+	assert.False(t, transport.connected)
+}
+
+func TestHostApplicationProcess(t *testing.T) {
+	// host applications of two brokers share a namespace
+	ns := NewNamespace()
+	plant1, plant2 := &testTransport{}, &testTransport{}
+	var births []string
+	host1, err := NewHostApplication(nil, plant1, HostApplicationOpts{
+		HostId:      "glowplug",
+		Source:      "plant1",
+		Namespace:   ns,
+		OnNodeBirth: func(e BirthEvent) { births = append(births, e.Topic.Source+" "+e.Topic.EdgeNodeId) },
+	})
+	require.NoError(t, err)
+	host2, err := NewHostApplication(nil, plant2, HostApplicationOpts{Source: "plant2", Namespace: ns})
+	require.NoError(t, err)
+	assert.Same(t, ns, host2.Namespace())
+
+	// the STATE of a connection opened by the application
+	will, err := host1.StateWill()
+	require.NoError(t, err)
+	assert.Equal(t, "spBv1.0/STATE/glowplug", will.Topic)
+	require.NoError(t, host1.PublishState(true))
+	state := plant1.take()
+	require.Len(t, state, 1)
+	var online, offline HostState
+	require.NoError(t, json.Unmarshal(state[0].data, &online))
+	require.NoError(t, json.Unmarshal(will.Payload, &offline))
+	assert.True(t, online.Online)
+	assert.Equal(t, offline.Timestamp, online.Timestamp)
+
+	// a host application without a host id publishes no STATE
+	will, err = host2.StateWill()
+	require.NoError(t, err)
+	assert.Nil(t, will)
+	require.NoError(t, host2.PublishState(true))
+	assert.Empty(t, plant2.take())
+
+	topic := func(s string, source string) Topic {
+		t.Helper()
+		parsed, err := ToTopic(s)
+		require.NoError(t, err)
+		parsed.Source = source
+		return *parsed
+	}
+	now := time.Now()
+	change := host1.Process(topic("spBv1.0/Plant1/NBIRTH/Heater", "plant1"), &Payload{Metrics: []*Payload_Metric{bdSeqMetric(0), floatMetric("Voltage", 230)}}, now)
+	assert.False(t, change.Unborn)
+	host2.Process(topic("spBv1.0/Plant1/NBIRTH/Heater", "plant2"), &Payload{Metrics: []*Payload_Metric{bdSeqMetric(0)}}, now)
+	assert.Equal(t, []string{"plant1 Heater"}, births)
+	assert.Len(t, ns.Nodes(), 2)
+
+	// rebirths go to the broker of the source
+	change = host2.Process(topic("spBv1.0/Plant1/NDATA/Pump", "plant2"), &Payload{Seq: 1}, now)
+	assert.Equal(t, "no birth certificate", change.Rebirth())
+	assert.Empty(t, plant1.take())
+	require.Len(t, plant2.take(), 1)
+
+	require.NoError(t, host1.RebirthAll())
+	rebirths := plant1.take()
+	require.Len(t, rebirths, 1)
+	assert.Equal(t, "spBv1.0/Plant1/NCMD/Heater", rebirths[0].topic)
+
+	// without a transport the namespace is tracked and no rebirth requested
+	monitor, err := NewHostApplication(nil, nil, HostApplicationOpts{})
+	require.NoError(t, err)
+	change = monitor.Process(topic("spBv1.0/Plant1/NDATA/Heater", ""), &Payload{Seq: 1}, now)
+	assert.True(t, change.Unborn)
+	assert.ErrorIs(t, monitor.Rebirth("Plant1", "Heater"), ErrNotConnected)
+}
+
+func TestNewHostApplication(t *testing.T) {
+	_, err := NewHostApplication(nil, &testTransport{}, HostApplicationOpts{HostId: "scada/1"})
+	assert.Error(t, err)
+}
+
+func TestRebirthPayload(t *testing.T) {
+	payload := RebirthPayload(time.UnixMilli(1700000000000))
+	require.Len(t, payload.Metrics, 1)
+	assert.Equal(t, uint64(1700000000000), payload.Timestamp)
+	assert.Equal(t, NODE_CONTROL_REBIRTH, payload.Metrics[0].Name)
+	assert.Equal(t, DataType_Boolean.Uint32(), payload.Metrics[0].Datatype)
+	assert.True(t, payload.Metrics[0].GetBooleanValue())
+}
@@ -0,0 +1,426 @@
+package sparkplug
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// NodeKey identifies an edge node, Source names the broker of the node for
+// applications reading from several brokers
+type NodeKey struct {
+	Source     string
+	GroupId    string
+	EdgeNodeId string
+}
+
+// NodeKeyFromTopic returns the key of the edge node of a topic
+func NodeKeyFromTopic(topic Topic) NodeKey {
+	return NodeKey{Source: topic.Source, GroupId: topic.GroupId, EdgeNodeId: topic.EdgeNodeId}
+}
+
+// NodeSession is the session of an edge node as seen by a host application
+type NodeSession struct {
+	Source     string `json:"source,omitempty"`
+	GroupId    string `json:"group_id"`
+	EdgeNodeId string `json:"edge_node_id"`
+	// Online is true between a NBIRTH and the NDEATH of its session
+	Online bool `json:"online"`
+	// BdSeq is the birth/death sequence of the last NBIRTH
+	BdSeq uint64 `json:"bdSeq"`
+	// Seq is the sequence number of the last message
+	Seq uint64 `json:"seq"`
+	// Birth is when the last NBIRTH was received, zero if none was seen
+	Birth time.Time `json:"birth"`
+	// Death is when the last NDEATH was received, zero if none was seen
+	Death time.Time `json:"death"`
+	// Instance names the host application that processed the last message,
+	// set by applications sharing edge nodes between instances
+	Instance string `json:"instance,omitempty"`
+	// Violations counts the violations of the Sparkplug specification in the
+	// messages of the node, set by applications validating them
+	Violations uint64 `json:"violations,omitempty"`
+}
+
+// Key returns the key of the edge node of the session
+func (s NodeSession) Key() NodeKey {
+	return NodeKey{Source: s.Source, GroupId: s.GroupId, EdgeNodeId: s.EdgeNodeId}
+}
+
+// Change is the effect of a message on a namespace
+type Change struct {
+	Topic Topic
+	// Node is the session of the edge node after the message
+	Node NodeSession
+	// Metrics of the message with names resolved from aliases, metrics with
+	// unknown aliases are left out
+	Metrics []*Payload_Metric
+	// Changed are the metrics whose value differs from the last known value,
+	// all metrics of a birth and no historical metrics
+	Changed []*Payload_Metric
+	// Stale is set for a NDEATH of an earlier session, it changes nothing
+	Stale bool
+	// Unborn is set for DATA and device messages of an edge node or device
+	// without a birth in the current session
+	Unborn bool
+	// SeqGap is set when seq is not the successor of the previous message,
+	// Expected is the seq that was expected
+	SeqGap   bool
+	Expected uint64
+	// UnknownAliases and UnknownTemplates are referenced but not in the births
+	UnknownAliases   []uint64
+	UnknownTemplates []string
+}
+
+// Rebirth returns the reason the edge node should be asked for a new birth,
+// empty if its state is consistent
+func (c Change) Rebirth() string {
+	switch {
+	case c.Unborn:
+		return "no birth certificate"
+	case len(c.UnknownAliases) > 0:
+		return "unknown metric alias"
+	case len(c.UnknownTemplates) > 0:
+		return "unknown template " + c.UnknownTemplates[0]
+	case c.SeqGap:
+		return "sequence gap"
+	}
+	return ""
+}
+
+// Namespace tracks the sessions, sequence numbers, metric aliases, template
+// definitions and last metric values of the edge nodes and devices of a
+// Sparkplug B namespace. It is safe for concurrent use.
+type Namespace struct {
+	mu    sync.RWMutex
+	nodes map[NodeKey]*nodeState
+}
+
+type nodeState struct {
+	// seen is set once a message of the node was applied or its session restored
+	seen      bool
+	session   NodeSession
+	aliases   map[uint64]string
+	templates map[string]*Payload_Template
+	metrics   map[string]*Payload_Metric
+	// properties of the metrics from their birth or the last data carrying them
+	properties map[string]*Payload_PropertySet
+	devices    map[string]*deviceState
+}
+
+type deviceState struct {
+	online     bool
+	metrics    map[string]*Payload_Metric
+	properties map[string]*Payload_PropertySet
+}
+
+func newDeviceState(online bool) *deviceState {
+	return &deviceState{online: online, metrics: map[string]*Payload_Metric{}, properties: map[string]*Payload_PropertySet{}}
+}
+
+// NewNamespace returns an empty namespace
+func NewNamespace() *Namespace {
+	return &Namespace{nodes: map[NodeKey]*nodeState{}}
+}
+
+// node returns the state of an edge node, creating it
+func (ns *Namespace) node(key NodeKey) *nodeState {
+	node, ok := ns.nodes[key]
+	if !ok {
+		node = &nodeState{
+			session:    NodeSession{Source: key.Source, GroupId: key.GroupId, EdgeNodeId: key.EdgeNodeId},
+			aliases:    map[uint64]string{},
+			templates:  map[string]*Payload_Template{},
+			metrics:    map[string]*Payload_Metric{},
+			properties: map[string]*Payload_PropertySet{},
+			devices:    map[string]*deviceState{},
+		}
+		ns.nodes[key] = node
+	}
+	return node
+}
+
+// Apply updates the namespace with a message of an edge node or device. The
+// names of metrics sent by alias and the datatypes of metrics sent without
+// one are set in payload. Deaths may have a nil payload.
+func (ns *Namespace) Apply(topic Topic, payload *Payload, received time.Time) Change {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	node := ns.node(NodeKeyFromTopic(topic))
+	change := Change{Topic: topic}
+	seen := node.seen
+	node.seen = true
+
+	switch topic.Command {
+	case NBIRTH:
+		bdSeq, _ := bdSeqOf(payload)
+		node.session.Online = true
+		node.session.BdSeq = bdSeq
+		node.session.Seq = payload.GetSeq()
+		node.session.Birth = received
+		node.aliases = map[uint64]string{}
+		node.templates = map[string]*Payload_Template{}
+		node.metrics = map[string]*Payload_Metric{}
+		node.properties = map[string]*Payload_PropertySet{}
+		// devices are born again after their edge node
+		node.devices = map[string]*deviceState{}
+		node.learn(payload.GetMetrics())
+		change.Metrics, change.Changed = node.record(&change, node.metrics, node.properties, payload.GetMetrics(), true)
+
+	case NDEATH:
+		// the will of an earlier session arrives after the new birth
+		if bdSeq, ok := bdSeqOf(payload); ok && !node.session.Birth.IsZero() && bdSeq != node.session.BdSeq {
+			change.Stale = true
+			break
+		}
+		node.session.Online = false
+		node.session.Death = received
+		for _, device := range node.devices {
+			device.online = false
+		}
+
+	default:
+		seq := payload.GetSeq()
+		if seen && seq != NextSequenceNumber(node.session.Seq%256) {
+			change.SeqGap = true
+			change.Expected = NextSequenceNumber(node.session.Seq % 256)
+		}
+		node.session.Seq = seq
+		change.Unborn = !node.session.Online
+
+		switch topic.Command {
+		case NDATA:
+			change.Metrics, change.Changed = node.record(&change, node.metrics, node.properties, payload.GetMetrics(), false)
+		case DBIRTH:
+			device := newDeviceState(true)
+			node.devices[topic.DeviceId] = device
+			node.learn(payload.GetMetrics())
+			change.Metrics, change.Changed = node.record(&change, device.metrics, device.properties, payload.GetMetrics(), true)
+		case DDATA:
+			device, ok := node.devices[topic.DeviceId]
+			if !ok {
+				device = newDeviceState(false)
+				node.devices[topic.DeviceId] = device
+			}
+			change.Unborn = change.Unborn || !device.online
+			change.Metrics, change.Changed = node.record(&change, device.metrics, device.properties, payload.GetMetrics(), false)
+		case DDEATH:
+			if device, ok := node.devices[topic.DeviceId]; ok {
+				device.online = false
+			}
+		}
+	}
+
+	change.Node = node.session
+	return change
+}
+
+// learn adds the aliases and template definitions of birth metrics
+func (node *nodeState) learn(metrics []*Payload_Metric) {
+	for _, metric := range metrics {
+		if metric.Alias != 0 && len(metric.Name) > 0 {
+			node.aliases[metric.Alias] = metric.Name
+		}
+		if template := metric.GetTemplateValue(); template != nil && template.IsDefinition && len(metric.Name) > 0 {
+			node.templates[metric.Name] = template
+		}
+	}
+}
+
+// record resolves the names of metrics, checks their template references and
+// keeps their values and properties, it returns the resolved and the changed
+// metrics
+func (node *nodeState) record(change *Change, values map[string]*Payload_Metric, properties map[string]*Payload_PropertySet, metrics []*Payload_Metric, birth bool) (resolved []*Payload_Metric, changed []*Payload_Metric) {
+	resolved = make([]*Payload_Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if len(metric.Name) == 0 && metric.Alias != 0 {
+			name, ok := node.aliases[metric.Alias]
+			if !ok {
+				change.UnknownAliases = append(change.UnknownAliases, metric.Alias)
+				continue
+			}
+			metric.Name = name
+		}
+		if template := metric.GetTemplateValue(); template != nil && !template.IsDefinition {
+			if _, ok := node.templates[template.TemplateRef]; !ok {
+				change.UnknownTemplates = append(change.UnknownTemplates, template.TemplateRef)
+			}
+		}
+		resolved = append(resolved, metric)
+
+		if last, ok := values[metric.Name]; ok && metric.Datatype == 0 {
+			metric.Datatype = last.Datatype
+		}
+		if metric.Properties != nil {
+			properties[metric.Name] = metric.Properties
+		}
+
+		if metric.IsHistorical {
+			continue
+		}
+		if last, ok := values[metric.Name]; birth || !ok || !sameValue(last, metric) {
+			changed = append(changed, metric)
+		}
+		values[metric.Name] = metric
+	}
+	return resolved, changed
+}
+
+// bdSeqOf returns the bdSeq metric of a NBIRTH or NDEATH payload
+func bdSeqOf(payload *Payload) (uint64, bool) {
+	for _, metric := range payload.GetMetrics() {
+		if metric.Name == BD_SEQ {
+			return metric.GetLongValue(), true
+		}
+	}
+	return 0, false
+}
+
+// Known returns true if a message of the edge node was applied or its
+// session restored
+func (ns *Namespace) Known(key NodeKey) bool {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	node, ok := ns.nodes[key]
+	return ok && node.seen
+}
+
+// Restore sets the session of an edge node tracked elsewhere, such as by
+// another instance of an application
+func (ns *Namespace) Restore(session NodeSession) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	node := ns.node(session.Key())
+	node.seen = true
+	node.session = session
+}
+
+// LearnAliases adds metric aliases of an edge node learned elsewhere
+func (ns *Namespace) LearnAliases(key NodeKey, aliases map[uint64]string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	node := ns.node(key)
+	for alias, name := range aliases {
+		node.aliases[alias] = name
+	}
+}
+
+// Alias returns the metric name of an alias of an edge node
+func (ns *Namespace) Alias(key NodeKey, alias uint64) (string, bool) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	node, ok := ns.nodes[key]
+	if !ok {
+		return "", false
+	}
+	name, ok := node.aliases[alias]
+	return name, ok
+}
+
+// alias returns the metric name of an alias, a nil namespace knows none
+func (ns *Namespace) alias(key NodeKey, alias uint64) (string, bool) {
+	if ns == nil {
+		return "", false
+	}
+	return ns.Alias(key, alias)
+}
+
+// metric returns the last value of a metric, a nil namespace knows none
+func (ns *Namespace) metric(key NodeKey, deviceId string, name string) (*Payload_Metric, bool) {
+	if ns == nil {
+		return nil, false
+	}
+	return ns.Metric(key, deviceId, name)
+}
+
+// Template returns a template definition of the NBIRTH of an edge node
+func (ns *Namespace) Template(key NodeKey, name string) (*Payload_Template, bool) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	node, ok := ns.nodes[key]
+	if !ok {
+		return nil, false
+	}
+	template, ok := node.templates[name]
+	return template, ok
+}
+
+// Metric returns the last value of a metric of an edge node, or of one of
+// its devices when deviceId is not empty
+func (ns *Namespace) Metric(key NodeKey, deviceId string, name string) (*Payload_Metric, bool) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	node, ok := ns.nodes[key]
+	if !ok {
+		return nil, false
+	}
+	values := node.metrics
+	if len(deviceId) > 0 {
+		device, ok := node.devices[deviceId]
+		if !ok {
+			return nil, false
+		}
+		values = device.metrics
+	}
+	metric, ok := values[name]
+	return metric, ok
+}
+
+// Properties returns the properties of a metric of an edge node, or of one of
+// its devices when deviceId is not empty, from its birth or the last data
+// carrying properties. Properties such as engUnit are usually only sent in
+// births.
+func (ns *Namespace) Properties(key NodeKey, deviceId string, name string) (*Payload_PropertySet, bool) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	node, ok := ns.nodes[key]
+	if !ok {
+		return nil, false
+	}
+	properties := node.properties
+	if len(deviceId) > 0 {
+		device, ok := node.devices[deviceId]
+		if !ok {
+			return nil, false
+		}
+		properties = device.properties
+	}
+	set, ok := properties[name]
+	return set, ok
+}
+
+// Node returns the session of an edge node
+func (ns *Namespace) Node(key NodeKey) (NodeSession, bool) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	node, ok := ns.nodes[key]
+	if !ok || !node.seen {
+		return NodeSession{}, false
+	}
+	return node.session, true
+}
+
+// Nodes returns the sessions of the edge nodes, ordered by source, group and node
+func (ns *Namespace) Nodes() []NodeSession {
+	ns.mu.RLock()
+	sessions := make([]NodeSession, 0, len(ns.nodes))
+	for _, node := range ns.nodes {
+		if node.seen {
+			sessions = append(sessions, node.session)
+		}
+	}
+	ns.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		a, b := sessions[i], sessions[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.GroupId != b.GroupId {
+			return a.GroupId < b.GroupId
+		}
+		return a.EdgeNodeId < b.EdgeNodeId
+	})
+	return sessions
+}
@@ -0,0 +1,127 @@
+package sparkplug
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bdSeqMetric(bdSeq uint64) *Payload_Metric {
+	return &Payload_Metric{Name: BD_SEQ, Datatype: DataType_Int64.Uint32(), Value: &Payload_Metric_LongValue{LongValue: bdSeq}}
+}
+
+func aliased(alias uint64, value float32) *Payload_Metric {
+	return &Payload_Metric{Alias: alias, Value: &Payload_Metric_FloatValue{FloatValue: value}}
+}
+
+func mustTopic(t *testing.T, topic string) Topic {
+	t.Helper()
+	parsed, err := ToTopic(topic)
+	require.NoError(t, err)
+	return *parsed
+}
+
+func TestNamespace(t *testing.T) {
+	ns := NewNamespace()
+	now := time.UnixMilli(1700000000000)
+	key := NodeKey{GroupId: "Plant1", EdgeNodeId: "Heater"}
+	nbirth := mustTopic(t, "spBv1.0/Plant1/NBIRTH/Heater")
+	ndata := mustTopic(t, "spBv1.0/Plant1/NDATA/Heater")
+	ddata := mustTopic(t, "spBv1.0/Plant1/DDATA/Heater/TempSensor")
+
+	// data before a birth is resolved by name and flagged
+	change := ns.Apply(ndata, &Payload{Seq: 4, Metrics: []*Payload_Metric{floatMetric("Voltage", 230)}}, now)
+	assert.True(t, change.Unborn)
+	assert.Equal(t, "no birth certificate", change.Rebirth())
+	assert.Len(t, change.Metrics, 1)
+	assert.True(t, ns.Known(key))
+
+	voltage := floatMetric("Voltage", 230)
+	voltage.Alias = 1
+	voltage.Properties = &Payload_PropertySet{Keys: []string{"engUnit"}, Values: []*Payload_PropertyValue{{Value: &Payload_PropertyValue_StringValue{StringValue: "V"}}}}
+	definition := &Payload_Metric{Name: "Motor", Datatype: DataType_Template.Uint32(), Value: &Payload_Metric_TemplateValue{TemplateValue: &Payload_Template{IsDefinition: true}}}
+	change = ns.Apply(nbirth, &Payload{Seq: 0, Metrics: []*Payload_Metric{bdSeqMetric(3), voltage, definition}}, now)
+	assert.Empty(t, change.Rebirth())
+	assert.True(t, change.Node.Online)
+	assert.Equal(t, uint64(3), change.Node.BdSeq)
+	assert.Equal(t, now, change.Node.Birth)
+	assert.Len(t, change.Changed, 3)
+	_, ok := ns.Template(key, "Motor")
+	assert.True(t, ok)
+
+	// aliases are resolved and unchanged values left out
+	payload := &Payload{Seq: 1, Metrics: []*Payload_Metric{aliased(1, 230), aliased(2, 1)}}
+	change = ns.Apply(ndata, payload, now)
+	assert.Equal(t, "Voltage", payload.Metrics[0].Name)
+	assert.Equal(t, DataType_Float.Uint32(), payload.Metrics[0].Datatype)
+	assert.Equal(t, []uint64{2}, change.UnknownAliases)
+	assert.Len(t, change.Metrics, 1)
+	assert.Empty(t, change.Changed)
+
+	change = ns.Apply(ndata, &Payload{Seq: 2, Metrics: []*Payload_Metric{aliased(1, 231)}}, now)
+	assert.Empty(t, change.Rebirth())
+	require.Len(t, change.Changed, 1)
+	last, ok := ns.Metric(key, "", "Voltage")
+	require.True(t, ok)
+	assert.Equal(t, float32(231), last.GetFloatValue())
+	// the properties of the birth are kept by data without properties
+	properties, ok := ns.Properties(key, "", "Voltage")
+	require.True(t, ok)
+	assert.Equal(t, []string{"engUnit"}, properties.Keys)
+
+	// sequence gaps and unknown templates
+	instance := &Payload_Metric{Name: "Pump", Value: &Payload_Metric_TemplateValue{TemplateValue: &Payload_Template{TemplateRef: "Pump"}}}
+	change = ns.Apply(ndata, &Payload{Seq: 5, Metrics: []*Payload_Metric{instance}}, now)
+	assert.True(t, change.SeqGap)
+	assert.Equal(t, uint64(3), change.Expected)
+	assert.Equal(t, []string{"Pump"}, change.UnknownTemplates)
+
+	// device data needs a device birth
+	change = ns.Apply(ddata, &Payload{Seq: 6, Metrics: []*Payload_Metric{floatMetric("Celsius", 20)}}, now)
+	assert.True(t, change.Unborn)
+	change = ns.Apply(mustTopic(t, "spBv1.0/Plant1/DBIRTH/Heater/TempSensor"), &Payload{Seq: 7, Metrics: []*Payload_Metric{floatMetric("Celsius", 20)}}, now)
+	assert.False(t, change.Unborn)
+	change = ns.Apply(ddata, &Payload{Seq: 8, Metrics: []*Payload_Metric{floatMetric("Celsius", 21)}}, now)
+	assert.Empty(t, change.Rebirth())
+	assert.Len(t, change.Changed, 1)
+
+	// the death of an earlier session is stale
+	ndeath := mustTopic(t, "spBv1.0/Plant1/NDEATH/Heater")
+	change = ns.Apply(ndeath, &Payload{Metrics: []*Payload_Metric{bdSeqMetric(2)}}, now)
+	assert.True(t, change.Stale)
+	assert.True(t, change.Node.Online)
+	change = ns.Apply(ndeath, &Payload{Metrics: []*Payload_Metric{bdSeqMetric(3)}}, now.Add(time.Second))
+	assert.False(t, change.Stale)
+	assert.False(t, change.Node.Online)
+	assert.Equal(t, now.Add(time.Second), change.Node.Death)
+	change = ns.Apply(ddata, &Payload{Seq: 9, Metrics: []*Payload_Metric{floatMetric("Celsius", 22)}}, now)
+	assert.True(t, change.Unborn)
+
+	assert.Len(t, ns.Nodes(), 1)
+}
+
+func TestNamespaceRestore(t *testing.T) {
+	ns := NewNamespace()
+	key := NodeKey{Source: "plant1", GroupId: "Plant1", EdgeNodeId: "Heater"}
+
+	// aliases learned elsewhere don't make a node known
+	ns.LearnAliases(key, map[uint64]string{1: "Voltage"})
+	assert.False(t, ns.Known(key))
+	name, ok := ns.Alias(key, 1)
+	require.True(t, ok)
+	assert.Equal(t, "Voltage", name)
+
+	ns.Restore(NodeSession{Source: "plant1", GroupId: "Plant1", EdgeNodeId: "Heater", Online: true, Seq: 9})
+	assert.True(t, ns.Known(key))
+	topic := mustTopic(t, "spBv1.0/Plant1/NDATA/Heater")
+	topic.Source = "plant1"
+	payload := &Payload{Seq: 10, Metrics: []*Payload_Metric{aliased(1, 230)}}
+	change := ns.Apply(topic, payload, time.Now())
+	assert.Empty(t, change.Rebirth())
+	assert.Equal(t, "Voltage", payload.Metrics[0].Name)
+	session, ok := ns.Node(key)
+	require.True(t, ok)
+	assert.Equal(t, uint64(10), session.Seq)
+}
@@ -0,0 +1,424 @@
+package sparkplug
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// PayloadBuilder builds a Sparkplug B payload, each metric method sets the
+// datatype and the matching value field of a metric:
+//
+//   - Int8, Int16, Int32, UInt8, UInt16 and UInt32 use int_value, signed values
+//     in two's complement
+//   - Int64, UInt64 and DateTime use long_value, DateTime in milliseconds
+//     since the epoch
+//   - String, Text and UUID use string_value
+//   - Bytes, File and all arrays use bytes_value, see DecodeArray
+//
+// The first error, such as a DataSet value of the wrong type, is returned by
+// Build.
+type PayloadBuilder struct {
+	payload *Payload
+	// timestamps are set when the payload is built
+	timestamps map[*Payload_Metric]bool
+	err        error
+}
+
+// NewPayload returns a builder of a payload with the current time as
+// timestamp
+func NewPayload() *PayloadBuilder {
+	return &PayloadBuilder{
+		payload:    &Payload{Timestamp: timestamp()},
+		timestamps: map[*Payload_Metric]bool{},
+	}
+}
+
+// Timestamp sets the timestamp of the payload, also used by metrics without
+// their own timestamp
+func (b *PayloadBuilder) Timestamp(t time.Time) *PayloadBuilder {
+	b.payload.Timestamp = uint64(t.UnixMilli())
+	return b
+}
+
+// Seq sets the sequence number of the payload
+func (b *PayloadBuilder) Seq(seq uint64) *PayloadBuilder {
+	b.payload.Seq = seq
+	return b
+}
+
+// Uuid sets the uuid of the payload, describing the content of the body
+func (b *PayloadBuilder) Uuid(uuid string) *PayloadBuilder {
+	b.payload.Uuid = uuid
+	return b
+}
+
+// Body sets the body of the payload
+func (b *PayloadBuilder) Body(body []byte) *PayloadBuilder {
+	b.payload.Body = body
+	return b
+}
+
+// Metric adds a metric as is
+func (b *PayloadBuilder) Metric(metric *Payload_Metric) *PayloadBuilder {
+	b.payload.Metrics = append(b.payload.Metrics, metric)
+	return b
+}
+
+// add adds a metric with a datatype and value, named unless name is empty
+func (b *PayloadBuilder) add(name string, datatype DataType, value isPayload_Metric_Value) *PayloadBuilder {
+	metric := &Payload_Metric{Name: name, Datatype: datatype.Uint32(), Value: value}
+	b.timestamps[metric] = true
+	return b.Metric(metric)
+}
+
+// last returns the last metric added, nil if none was
+func (b *PayloadBuilder) last(modifier string) *Payload_Metric {
+	if len(b.payload.Metrics) == 0 {
+		b.fail(fmt.Errorf("%s without a metric", modifier))
+		return nil
+	}
+	return b.payload.Metrics[len(b.payload.Metrics)-1]
+}
+
+func (b *PayloadBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Alias sets the alias of the last metric
+func (b *PayloadBuilder) Alias(alias uint64) *PayloadBuilder {
+	if metric := b.last("alias"); metric != nil {
+		metric.Alias = alias
+	}
+	return b
+}
+
+// At sets the timestamp of the last metric
+func (b *PayloadBuilder) At(t time.Time) *PayloadBuilder {
+	if metric := b.last("timestamp"); metric != nil {
+		metric.Timestamp = uint64(t.UnixMilli())
+		delete(b.timestamps, metric)
+	}
+	return b
+}
+
+// Historical marks the last metric as historical
+func (b *PayloadBuilder) Historical() *PayloadBuilder {
+	if metric := b.last("historical"); metric != nil {
+		metric.IsHistorical = true
+	}
+	return b
+}
+
+// Transient marks the last metric as transient
+func (b *PayloadBuilder) Transient() *PayloadBuilder {
+	if metric := b.last("transient"); metric != nil {
+		metric.IsTransient = true
+	}
+	return b
+}
+
+// Null adds a metric of datatype without a value
+func (b *PayloadBuilder) Null(name string, datatype DataType) *PayloadBuilder {
+	b.add(name, datatype, nil)
+	b.payload.Metrics[len(b.payload.Metrics)-1].IsNull = true
+	return b
+}
+
+func (b *PayloadBuilder) Int8(name string, value int8) *PayloadBuilder {
+	return b.add(name, DataType_Int8, &Payload_Metric_IntValue{IntValue: uint32(value)})
+}
+
+func (b *PayloadBuilder) Int16(name string, value int16) *PayloadBuilder {
+	return b.add(name, DataType_Int16, &Payload_Metric_IntValue{IntValue: uint32(value)})
+}
+
+func (b *PayloadBuilder) Int32(name string, value int32) *PayloadBuilder {
+	return b.add(name, DataType_Int32, &Payload_Metric_IntValue{IntValue: uint32(value)})
+}
+
+func (b *PayloadBuilder) Int64(name string, value int64) *PayloadBuilder {
+	return b.add(name, DataType_Int64, &Payload_Metric_LongValue{LongValue: uint64(value)})
+}
+
+func (b *PayloadBuilder) UInt8(name string, value uint8) *PayloadBuilder {
+	return b.add(name, DataType_UInt8, &Payload_Metric_IntValue{IntValue: uint32(value)})
+}
+
+func (b *PayloadBuilder) UInt16(name string, value uint16) *PayloadBuilder {
+	return b.add(name, DataType_UInt16, &Payload_Metric_IntValue{IntValue: uint32(value)})
+}
+
+func (b *PayloadBuilder) UInt32(name string, value uint32) *PayloadBuilder {
+	return b.add(name, DataType_UInt32, &Payload_Metric_IntValue{IntValue: value})
+}
+
+func (b *PayloadBuilder) UInt64(name string, value uint64) *PayloadBuilder {
+	return b.add(name, DataType_UInt64, &Payload_Metric_LongValue{LongValue: value})
+}
+
+func (b *PayloadBuilder) Float(name string, value float32) *PayloadBuilder {
+	return b.add(name, DataType_Float, &Payload_Metric_FloatValue{FloatValue: value})
+}
+
+func (b *PayloadBuilder) Double(name string, value float64) *PayloadBuilder {
+	return b.add(name, DataType_Double, &Payload_Metric_DoubleValue{DoubleValue: value})
+}
+
+func (b *PayloadBuilder) Boolean(name string, value bool) *PayloadBuilder {
+	return b.add(name, DataType_Boolean, &Payload_Metric_BooleanValue{BooleanValue: value})
+}
+
+func (b *PayloadBuilder) String(name string, value string) *PayloadBuilder {
+	return b.add(name, DataType_String, &Payload_Metric_StringValue{StringValue: value})
+}
+
+func (b *PayloadBuilder) Text(name string, value string) *PayloadBuilder {
+	return b.add(name, DataType_Text, &Payload_Metric_StringValue{StringValue: value})
+}
+
+func (b *PayloadBuilder) UUID(name string, value string) *PayloadBuilder {
+	return b.add(name, DataType_UUID, &Payload_Metric_StringValue{StringValue: value})
+}
+
+// DateTime adds a DateTime metric in milliseconds since the epoch
+func (b *PayloadBuilder) DateTime(name string, value time.Time) *PayloadBuilder {
+	return b.add(name, DataType_DateTime, &Payload_Metric_LongValue{LongValue: uint64(value.UnixMilli())})
+}
+
+func (b *PayloadBuilder) Bytes(name string, value []byte) *PayloadBuilder {
+	return b.add(name, DataType_Bytes, &Payload_Metric_BytesValue{BytesValue: value})
+}
+
+func (b *PayloadBuilder) File(name string, value []byte) *PayloadBuilder {
+	return b.add(name, DataType_File, &Payload_Metric_BytesValue{BytesValue: value})
+}
+
+func (b *PayloadBuilder) array(name string, datatype DataType, data []byte) *PayloadBuilder {
+	return b.add(name, datatype, &Payload_Metric_BytesValue{BytesValue: data})
+}
+
+func (b *PayloadBuilder) Int8Array(name string, values ...int8) *PayloadBuilder {
+	return b.array(name, DataType_Int8Array, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) Int16Array(name string, values ...int16) *PayloadBuilder {
+	return b.array(name, DataType_Int16Array, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) Int32Array(name string, values ...int32) *PayloadBuilder {
+	return b.array(name, DataType_Int32Array, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) Int64Array(name string, values ...int64) *PayloadBuilder {
+	return b.array(name, DataType_Int64Array, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) UInt8Array(name string, values ...uint8) *PayloadBuilder {
+	return b.array(name, DataType_UInt8Array, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) UInt16Array(name string, values ...uint16) *PayloadBuilder {
+	return b.array(name, DataType_UInt16Array, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) UInt32Array(name string, values ...uint32) *PayloadBuilder {
+	return b.array(name, DataType_UInt32Array, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) UInt64Array(name string, values ...uint64) *PayloadBuilder {
+	return b.array(name, DataType_UInt64Array, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) FloatArray(name string, values ...float32) *PayloadBuilder {
+	return b.array(name, DataType_FloatArray, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) DoubleArray(name string, values ...float64) *PayloadBuilder {
+	return b.array(name, DataType_DoubleArray, encodeNumbers(values))
+}
+
+func (b *PayloadBuilder) BooleanArray(name string, values ...bool) *PayloadBuilder {
+	return b.array(name, DataType_BooleanArray, encodeBooleans(values))
+}
+
+// StringArray adds a StringArray metric, the strings can't contain a null
+// character
+func (b *PayloadBuilder) StringArray(name string, values ...string) *PayloadBuilder {
+	data, err := encodeStrings(values)
+	if err != nil {
+		b.fail(fmt.Errorf("metric %s, %w", name, err))
+	}
+	return b.array(name, DataType_StringArray, data)
+}
+
+func (b *PayloadBuilder) DateTimeArray(name string, values ...time.Time) *PayloadBuilder {
+	return b.array(name, DataType_DateTimeArray, encodeDateTimes(values))
+}
+
+// DataSet adds a DataSet metric with a row for each slice of values, the Go
+// type of each value must match the datatype of its column, such as int16
+// for Int16 and time.Time for DateTime
+func (b *PayloadBuilder) DataSet(name string, columns []string, types []DataType, rows ...[]interface{}) *PayloadBuilder {
+	dataset := &Payload_DataSet{NumOfColumns: uint64(len(columns)), Columns: columns}
+	if len(types) != len(columns) {
+		b.fail(fmt.Errorf("dataset %s has %d columns and %d types", name, len(columns), len(types)))
+	}
+	for _, datatype := range types {
+		dataset.Types = append(dataset.Types, datatype.Uint32())
+	}
+	for i, values := range rows {
+		if len(values) != len(types) {
+			b.fail(fmt.Errorf("dataset %s row %d has %d values for %d columns", name, i, len(values), len(types)))
+			continue
+		}
+		row := &Payload_DataSet_Row{Elements: make([]*Payload_DataSet_DataSetValue, len(values))}
+		for j, value := range values {
+			element, err := dataSetValue(types[j], value)
+			if err != nil {
+				b.fail(fmt.Errorf("dataset %s row %d column %s, %w", name, i, columns[j], err))
+			}
+			row.Elements[j] = element
+		}
+		dataset.Rows = append(dataset.Rows, row)
+	}
+	return b.add(name, DataType_DataSet, &Payload_Metric_DatasetValue{DatasetValue: dataset})
+}
+
+// dataSetValue returns a DataSet value of datatype, DataSets only hold
+// numbers, booleans, strings and DateTimes
+func dataSetValue(datatype DataType, value interface{}) (*Payload_DataSet_DataSetValue, error) {
+	element := &Payload_DataSet_DataSetValue{}
+	ok := true
+	switch datatype {
+	case DataType_Int8:
+		var v int8
+		v, ok = value.(int8)
+		element.Value = &Payload_DataSet_DataSetValue_IntValue{IntValue: uint32(v)}
+	case DataType_Int16:
+		var v int16
+		v, ok = value.(int16)
+		element.Value = &Payload_DataSet_DataSetValue_IntValue{IntValue: uint32(v)}
+	case DataType_Int32:
+		var v int32
+		v, ok = value.(int32)
+		element.Value = &Payload_DataSet_DataSetValue_IntValue{IntValue: uint32(v)}
+	case DataType_Int64:
+		var v int64
+		v, ok = value.(int64)
+		element.Value = &Payload_DataSet_DataSetValue_LongValue{LongValue: uint64(v)}
+	case DataType_UInt8:
+		var v uint8
+		v, ok = value.(uint8)
+		element.Value = &Payload_DataSet_DataSetValue_IntValue{IntValue: uint32(v)}
+	case DataType_UInt16:
+		var v uint16
+		v, ok = value.(uint16)
+		element.Value = &Payload_DataSet_DataSetValue_IntValue{IntValue: uint32(v)}
+	case DataType_UInt32:
+		var v uint32
+		v, ok = value.(uint32)
+		element.Value = &Payload_DataSet_DataSetValue_IntValue{IntValue: v}
+	case DataType_UInt64:
+		var v uint64
+		v, ok = value.(uint64)
+		element.Value = &Payload_DataSet_DataSetValue_LongValue{LongValue: v}
+	case DataType_Float:
+		var v float32
+		v, ok = value.(float32)
+		element.Value = &Payload_DataSet_DataSetValue_FloatValue{FloatValue: v}
+	case DataType_Double:
+		var v float64
+		v, ok = value.(float64)
+		element.Value = &Payload_DataSet_DataSetValue_DoubleValue{DoubleValue: v}
+	case DataType_Boolean:
+		var v bool
+		v, ok = value.(bool)
+		element.Value = &Payload_DataSet_DataSetValue_BooleanValue{BooleanValue: v}
+	case DataType_String, DataType_Text, DataType_UUID:
+		var v string
+		v, ok = value.(string)
+		element.Value = &Payload_DataSet_DataSetValue_StringValue{StringValue: v}
+	case DataType_DateTime:
+		var v time.Time
+		v, ok = value.(time.Time)
+		element.Value = &Payload_DataSet_DataSetValue_LongValue{LongValue: uint64(v.UnixMilli())}
+	default:
+		return element, fmt.Errorf("datatype %s can't be in a dataset", datatype)
+	}
+	if !ok {
+		return element, fmt.Errorf("%T is not a %s value", value, datatype)
+	}
+	return element, nil
+}
+
+// TemplateDefinition adds the definition of a template with the metrics of
+// members as its members, definitions are published in NBIRTH
+func (b *PayloadBuilder) TemplateDefinition(name string, version string, members *PayloadBuilder) *PayloadBuilder {
+	return b.template(name, &Payload_Template{Version: version, IsDefinition: true}, members)
+}
+
+// Template adds an instance of the template definition named templateRef with
+// the metrics of members as its members
+func (b *PayloadBuilder) Template(name string, templateRef string, members *PayloadBuilder) *PayloadBuilder {
+	return b.template(name, &Payload_Template{TemplateRef: templateRef}, members)
+}
+
+func (b *PayloadBuilder) template(name string, template *Payload_Template, members *PayloadBuilder) *PayloadBuilder {
+	if members != nil {
+		if members.err != nil {
+			b.fail(fmt.Errorf("template %s, %w", name, members.err))
+		}
+		template.Metrics = members.payload.Metrics
+	}
+	return b.add(name, DataType_Template, &Payload_Metric_TemplateValue{TemplateValue: template})
+}
+
+// Build returns the payload, metrics without a timestamp of their own get the
+// timestamp of the payload
+func (b *PayloadBuilder) Build() (*Payload, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	for _, metric := range b.payload.Metrics {
+		if b.timestamps[metric] {
+			metric.Timestamp = b.payload.Timestamp
+		}
+	}
+	return b.payload, nil
+}
+
+// Compressed returns the built payload compressed with algorithm into the
+// body of a payload
+func (b *PayloadBuilder) Compressed(algorithm Compression) (*Payload, error) {
+	payload, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return Compress(payload, algorithm)
+}
+
+// Metrics returns the metrics of the built payload
+func (b *PayloadBuilder) Metrics() ([]*Payload_Metric, error) {
+	payload, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return payload.Metrics, nil
+}
+
+// Marshal returns the protobuf encoding of the built payload
+func (b *PayloadBuilder) Marshal() ([]byte, error) {
+	payload, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal payload, %w", err)
+	}
+	return data, nil
+}
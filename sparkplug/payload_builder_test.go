@@ -0,0 +1,147 @@
+package sparkplug
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPayloadBuilder(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	data, err := NewPayload().Timestamp(now).Seq(3).
+		Int8("Int8", -1).
+		Int64("Int64", math.MinInt64).
+		UInt32("UInt32", math.MaxUint32).Alias(7).
+		Float("Temp", 98.6).At(now.Add(time.Second)).
+		DateTime("DateTime", now).
+		UUID("UUID", "6ba7b810-9dad-11d1-80b4-00c04fd430c8").
+		Null("Missing", DataType_Double).
+		Int32Array("Buf", -1, 2).
+		Marshal()
+	require.NoError(t, err)
+
+	var payload Payload
+	require.NoError(t, proto.Unmarshal(data, &payload))
+	assert.Equal(t, uint64(3), payload.Seq)
+	assert.Equal(t, uint64(1700000000000), payload.Timestamp)
+	metrics := payload.Metrics
+	require.Len(t, metrics, 8)
+
+	assert.Equal(t, DataType_Int8.Uint32(), metrics[0].Datatype)
+	assert.Equal(t, uint32(0xffffffff), metrics[0].GetIntValue())
+	assert.Equal(t, int64(math.MinInt64), int64(metrics[1].GetLongValue()))
+	assert.Equal(t, uint32(math.MaxUint32), metrics[2].GetIntValue())
+	assert.Equal(t, uint64(7), metrics[2].Alias)
+	assert.Equal(t, float32(98.6), metrics[3].GetFloatValue())
+	assert.Equal(t, uint64(1700000001000), metrics[3].Timestamp)
+	assert.Equal(t, uint64(1700000000000), metrics[4].Timestamp)
+	assert.Equal(t, uint64(1700000000000), metrics[4].GetLongValue())
+	assert.Equal(t, DataType_UUID.Uint32(), metrics[5].Datatype)
+	assert.True(t, metrics[6].IsNull)
+	assert.Nil(t, metrics[6].Value)
+	assert.Equal(t, DataType_Int32Array.Uint32(), metrics[7].Datatype)
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00}, metrics[7].GetBytesValue())
+}
+
+func TestPayloadBuilderDataSet(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	payload, err := NewPayload().DataSet("Batch",
+		[]string{"Id", "Temp", "At"},
+		[]DataType{DataType_Int32, DataType_Float, DataType_DateTime},
+		[]interface{}{int32(1), float32(20.5), now},
+		[]interface{}{int32(2), float32(21), now},
+	).Build()
+	require.NoError(t, err)
+	dataset := payload.Metrics[0].GetDatasetValue()
+	require.NotNil(t, dataset)
+	assert.Equal(t, uint64(3), dataset.NumOfColumns)
+	assert.Equal(t, []uint32{DataType_Int32.Uint32(), DataType_Float.Uint32(), DataType_DateTime.Uint32()}, dataset.Types)
+	require.Len(t, dataset.Rows, 2)
+	assert.Equal(t, float32(21), dataset.Rows[1].Elements[1].GetFloatValue())
+	assert.Equal(t, uint64(1700000000000), dataset.Rows[1].Elements[2].GetLongValue())
+
+	// values must match the types of their columns
+	_, err = NewPayload().DataSet("Batch", []string{"Id"}, []DataType{DataType_Int32}, []interface{}{1}).Build()
+	assert.Error(t, err)
+	_, err = NewPayload().DataSet("Batch", []string{"Id"}, []DataType{DataType_Int32}, []interface{}{int32(1), int32(2)}).Build()
+	assert.Error(t, err)
+}
+
+func TestPayloadBuilderTemplate(t *testing.T) {
+	payload, err := NewPayload().
+		TemplateDefinition("Pump", "v1", NewPayload().Float("Flow", 0).Boolean("Running", false)).
+		Template("Pump1", "Pump", NewPayload().Float("Flow", 12.5).Boolean("Running", true)).
+		Build()
+	require.NoError(t, err)
+	require.Len(t, payload.Metrics, 2)
+	definition := payload.Metrics[0].GetTemplateValue()
+	assert.Equal(t, DataType_Template.Uint32(), payload.Metrics[0].Datatype)
+	assert.True(t, definition.IsDefinition)
+	assert.Equal(t, "v1", definition.Version)
+	instance := payload.Metrics[1].GetTemplateValue()
+	assert.Equal(t, "Pump", instance.TemplateRef)
+	require.Len(t, instance.Metrics, 2)
+	assert.True(t, instance.Metrics[1].GetBooleanValue())
+
+	_, err = NewPayload().Template("Pump1", "Pump", NewPayload().StringArray("Names", "a\x00b")).Build()
+	assert.Error(t, err)
+	_, err = NewPayload().Alias(1).Build()
+	assert.Error(t, err)
+}
+
+func TestArrays(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	payload, err := NewPayload().
+		Int8Array("Int8", -128, 127).
+		Int16Array("Int16", -2, 3).
+		Int64Array("Int64", math.MinInt64).
+		UInt8Array("UInt8", 255).
+		UInt16Array("UInt16", 65535).
+		UInt32Array("UInt32", 1, 2).
+		UInt64Array("UInt64", math.MaxUint64).
+		FloatArray("Float", 1.5, -2).
+		DoubleArray("Double", math.Pi).
+		BooleanArray("Boolean", false, false, true, true, false, true, false, false, true, true, false, true).
+		StringArray("String", "ABC", "hello", "").
+		DateTimeArray("DateTime", now).
+		Build()
+	require.NoError(t, err)
+
+	// examples of the Sparkplug B specification
+	metrics := payload.Metrics
+	assert.Equal(t, []byte{0x0c, 0x00, 0x00, 0x00, 0x34, 0xd0}, metrics[9].GetBytesValue())
+	assert.Equal(t, []byte("ABC\x00hello\x00\x00"), metrics[10].GetBytesValue())
+
+	expected := []interface{}{
+		[]int8{-128, 127},
+		[]int16{-2, 3},
+		[]int64{math.MinInt64},
+		[]uint8{255},
+		[]uint16{65535},
+		[]uint32{1, 2},
+		[]uint64{math.MaxUint64},
+		[]float32{1.5, -2},
+		[]float64{math.Pi},
+		[]bool{false, false, true, true, false, true, false, false, true, true, false, true},
+		[]string{"ABC", "hello", ""},
+		[]int64{1700000000000},
+	}
+	for i, metric := range metrics {
+		values, err := DecodeArray(DataType(metric.Datatype), metric.GetBytesValue())
+		require.NoError(t, err, metric.Name)
+		assert.Equal(t, expected[i], values, metric.Name)
+	}
+
+	_, err = DecodeArray(DataType_Int32Array, []byte{1, 2, 3})
+	assert.Error(t, err)
+	_, err = DecodeArray(DataType_BooleanArray, []byte{9, 0, 0, 0, 0xff})
+	assert.Error(t, err)
+	_, err = DecodeArray(DataType_StringArray, []byte("ABC"))
+	assert.Error(t, err)
+	_, err = DecodeArray(DataType_Int32, nil)
+	assert.Error(t, err)
+}
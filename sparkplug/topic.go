@@ -19,6 +19,9 @@ type Topic struct {
 	DeviceId    string  `json:"device_id"`
 	HasDevice   bool    `json:"has_device"`
 	ScadaNodeId string  `json:"scada_node_id,omitempty"`
+	// Source names the broker the topic was received from, applications that
+	// read from several brokers set it, it is not part of the topic
+	Source string `json:"source,omitempty"`
 }
 
 // ToTopic parses a MQTT topic into a Sparkplug topic data structure
@@ -135,3 +138,9 @@ func DeviceDeathTopic(groupId, edgeNodeId, deviceId string) string {
 func StateCommandTopic(scadaNodeId string) string {
 	return fmt.Sprintf("%s/%s", STATE, scadaNodeId)
 }
+
+// HostStateTopic returns the Sparkplug B 3.0 topic of the STATE messages of a host application
+// namespace/STATE/host_id
+func HostStateTopic(hostId string) string {
+	return fmt.Sprintf("%s/%s/%s", SPB_NS, STATE, hostId)
+}
@@ -0,0 +1,187 @@
+package sparkplug
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Will is the last will of a MQTT session
+type Will struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// MessageHandler handles a message received on a subscription
+type MessageHandler func(topic string, payload []byte)
+
+// Transport connects an edge node or host application to a MQTT server.
+// Each Connect starts a new clean session, a transport does not reconnect on
+// its own since the will of a Sparkplug session changes with every connection.
+type Transport interface {
+	// Connect starts a session with will as last will, onLost is called when
+	// the connection is lost
+	Connect(will *Will, onLost func(error)) error
+	Publish(topic string, qos byte, retain bool, payload []byte) error
+	Subscribe(topic string, qos byte, handler MessageHandler) error
+	// Disconnect ends the session without publishing the will
+	Disconnect() error
+}
+
+// retry calls connect every interval until it returns nil or done is closed
+func retry(done <-chan struct{}, interval time.Duration, connect func() error) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		if err := connect(); err == nil {
+			return
+		}
+	}
+}
+
+// closed returns true if done is closed
+func closed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// handlerQueueSize is the number of received messages a paho transport
+// holds while its handlers are busy
+const handlerQueueSize = 1024
+
+// pahoTransport is a Transport using the paho mqtt v3 client
+type pahoTransport struct {
+	mu       sync.Mutex
+	opts     *mqtt.ClientOptions
+	client   mqtt.Client
+	handlers chan func()
+	done     chan struct{}
+}
+
+// NewPahoTransport returns a transport creating a paho mqtt v3 client with
+// opts for every session. Auto reconnect is disabled and clean sessions are
+// used. Message handlers are called in order on a goroutine of their own, so
+// they may publish.
+func NewPahoTransport(opts *mqtt.ClientOptions) Transport {
+	return &pahoTransport{opts: opts}
+}
+
+// handle calls the handlers of a session in the order of their messages
+func handle(handlers <-chan func(), done <-chan struct{}) {
+	for {
+		select {
+		case f := <-handlers:
+			f()
+		case <-done:
+			return
+		}
+	}
+}
+
+// stop ends the handler goroutine of the current session
+func (t *pahoTransport) stop() {
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
+}
+
+func (t *pahoTransport) Connect(will *Will, onLost func(error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the client copies its options, changing them only affects the next session
+	t.opts.SetAutoReconnect(false)
+	t.opts.SetCleanSession(true)
+	if will != nil {
+		t.opts.SetBinaryWill(will.Topic, will.Payload, will.QoS, will.Retain)
+	}
+	t.opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		if onLost != nil {
+			onLost(err)
+		}
+	})
+
+	if t.client != nil {
+		t.client.Disconnect(0)
+		t.client = nil
+	}
+	t.stop()
+	client := mqtt.NewClient(t.opts)
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to connect, %w", token.Error())
+	}
+	t.client = client
+	t.handlers = make(chan func(), handlerQueueSize)
+	t.done = make(chan struct{})
+	go handle(t.handlers, t.done)
+	return nil
+}
+
+func (t *pahoTransport) connected() (mqtt.Client, error) {
+	client, _, _ := t.session()
+	if client == nil {
+		return nil, ErrNotConnected
+	}
+	return client, nil
+}
+
+// session returns the client and handler queue of the current session
+func (t *pahoTransport) session() (mqtt.Client, chan<- func(), <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.client, t.handlers, t.done
+}
+
+func (t *pahoTransport) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	client, err := t.connected()
+	if err != nil {
+		return err
+	}
+	token := client.Publish(topic, qos, retain, payload)
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to publish to %s, %w", topic, token.Error())
+	}
+	return nil
+}
+
+func (t *pahoTransport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	client, handlers, done := t.session()
+	if client == nil {
+		return ErrNotConnected
+	}
+	token := client.Subscribe(topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case handlers <- func() { handler(msg.Topic(), msg.Payload()) }:
+		case <-done:
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to subscribe to %s, %w", topic, token.Error())
+	}
+	return nil
+}
+
+func (t *pahoTransport) Disconnect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client == nil {
+		return nil
+	}
+	t.client.Disconnect(250)
+	t.client = nil
+	t.stop()
+	return nil
+}
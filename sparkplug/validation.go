@@ -1,6 +1,7 @@
 package sparkplug
 
 import (
+	"fmt"
 	"regexp"
 )
 
@@ -60,3 +61,189 @@ func IsValidSparkplugBTopic(topic string) bool {
 
 	return false
 }
+
+// Ids of the normative requirements of the Sparkplug B 3.0 specification
+// checked by ValidatePayload. The requirements that seq is present in births
+// and absent in deaths are not checked, Payload doesn't tell a missing seq
+// from seq 0.
+const (
+	REQ_SEQ_RANGE        = "tck-id-payloads-sequence-num-incrementing"
+	REQ_NBIRTH_BDSEQ     = "tck-id-payloads-nbirth-bdseq"
+	REQ_NDEATH_BDSEQ     = "tck-id-payloads-ndeath-bdseq"
+	REQ_NBIRTH_TIMESTAMP = "tck-id-payloads-nbirth-timestamp"
+	REQ_DBIRTH_TIMESTAMP = "tck-id-payloads-dbirth-timestamp"
+	REQ_NDATA_TIMESTAMP  = "tck-id-payloads-ndata-timestamp"
+	REQ_DDATA_TIMESTAMP  = "tck-id-payloads-ddata-timestamp"
+	REQ_NAME             = "tck-id-payloads-name-requirement"
+	REQ_ALIAS_BIRTH      = "tck-id-payloads-alias-birth-requirement"
+	REQ_ALIAS_UNIQUE     = "tck-id-payloads-alias-uniqueness"
+	REQ_DATATYPE         = "tck-id-payloads-metric-datatype-req"
+	REQ_DATATYPE_VALUE   = "tck-id-payloads-metric-datatype-value"
+)
+
+// Violation is a part of a message breaking a normative requirement of the
+// Sparkplug B specification
+type Violation struct {
+	// Requirement is the id of the requirement in the specification
+	Requirement string `json:"requirement"`
+	// Metric is the index of the metric in the payload, -1 for the payload
+	Metric  int    `json:"metric"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	if v.Metric < 0 {
+		return fmt.Sprintf("%s: %s", v.Requirement, v.Message)
+	}
+	return fmt.Sprintf("%s: metric %d %s", v.Requirement, v.Metric, v.Message)
+}
+
+// ValidatePayload checks a NBIRTH, NDEATH, NDATA, DBIRTH, DDEATH or DDATA
+// message against the Sparkplug B payload requirements. The namespace is the
+// state of the sessions before the message was applied, it is used to check
+// aliases and datatypes against earlier births and may be nil.
+func ValidatePayload(topic Topic, payload *Payload, ns *Namespace) []Violation {
+	var violations []Violation
+	fail := func(requirement string, metric int, format string, a ...interface{}) {
+		violations = append(violations, Violation{Requirement: requirement, Metric: metric, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if payload == nil {
+		payload = &Payload{}
+	}
+	birth := topic.Command == NBIRTH || topic.Command == DBIRTH
+	key := NodeKeyFromTopic(topic)
+
+	if topic.Command != NDEATH && payload.Seq > 255 {
+		fail(REQ_SEQ_RANGE, -1, "seq %d is not between 0 and 255", payload.Seq)
+	}
+
+	if requirement := timestampRequirement(topic.Command); len(requirement) > 0 && payload.Timestamp == 0 {
+		fail(requirement, -1, "payload has no timestamp")
+	}
+
+	if topic.Command == NBIRTH || topic.Command == NDEATH {
+		requirement := REQ_NBIRTH_BDSEQ
+		if topic.Command == NDEATH {
+			requirement = REQ_NDEATH_BDSEQ
+		}
+		if _, ok := bdSeqOf(payload); !ok {
+			fail(requirement, -1, "%s has no %s metric", topic.Command, BD_SEQ)
+		}
+	}
+
+	aliases := map[uint64]string{}
+	for i, metric := range payload.Metrics {
+		name := metric.Name
+		switch {
+		case birth && len(name) == 0 && metric.Alias != 0:
+			fail(REQ_ALIAS_BIRTH, i, "alias %d has no name in %s", metric.Alias, topic.Command)
+		case len(name) == 0 && metric.Alias == 0:
+			fail(REQ_NAME, i, "has no name or alias")
+		}
+
+		if birth && metric.Alias != 0 && len(name) > 0 {
+			if other, ok := aliases[metric.Alias]; ok && other != name {
+				fail(REQ_ALIAS_UNIQUE, i, "alias %d of %s is used by %s", metric.Alias, name, other)
+			}
+			aliases[metric.Alias] = name
+			// devices are born after their edge node and share its aliases
+			if other, ok := ns.alias(key, metric.Alias); ok && topic.Command == DBIRTH && other != name {
+				fail(REQ_ALIAS_UNIQUE, i, "alias %d of %s is used by %s", metric.Alias, name, other)
+			}
+		}
+		if !birth && len(name) == 0 && metric.Alias != 0 {
+			name, _ = ns.alias(key, metric.Alias)
+		}
+
+		datatype := DataType(metric.Datatype)
+		if birth && datatype == DataType_Unknown {
+			fail(REQ_DATATYPE, i, "%s has no datatype", name)
+			continue
+		}
+		// the datatype of data is the datatype of the birth
+		if datatype == DataType_Unknown && len(name) > 0 {
+			if last, ok := ns.metric(key, topic.DeviceId, name); ok {
+				datatype = DataType(last.Datatype)
+			}
+		}
+		if datatype == DataType_Unknown {
+			continue
+		}
+		if _, ok := DataType_name[int32(datatype)]; !ok {
+			fail(REQ_DATATYPE_VALUE, i, "%s has unknown datatype %d", name, datatype)
+			continue
+		}
+		if err := checkValue(datatype, metric); err != nil {
+			fail(REQ_DATATYPE_VALUE, i, "%s %s", name, err)
+		}
+	}
+	return violations
+}
+
+// timestampRequirement returns the requirement of a payload timestamp of a
+// message type, empty if none is required
+func timestampRequirement(command Command) string {
+	switch command {
+	case NBIRTH:
+		return REQ_NBIRTH_TIMESTAMP
+	case DBIRTH:
+		return REQ_DBIRTH_TIMESTAMP
+	case NDATA:
+		return REQ_NDATA_TIMESTAMP
+	case DDATA:
+		return REQ_DDATA_TIMESTAMP
+	}
+	return ""
+}
+
+// checkValue returns an error if the value field of a metric doesn't match
+// its datatype
+func checkValue(datatype DataType, metric *Payload_Metric) error {
+	if metric.Value == nil {
+		return nil
+	}
+	ok := true
+	switch datatype {
+	case DataType_Int8, DataType_Int16, DataType_Int32, DataType_UInt8, DataType_UInt16:
+		_, ok = metric.Value.(*Payload_Metric_IntValue)
+	case DataType_UInt32:
+		// long_value is common for UInt32 as well
+		switch metric.Value.(type) {
+		case *Payload_Metric_IntValue, *Payload_Metric_LongValue:
+		default:
+			ok = false
+		}
+	case DataType_Int64, DataType_UInt64, DataType_DateTime:
+		_, ok = metric.Value.(*Payload_Metric_LongValue)
+	case DataType_Float:
+		_, ok = metric.Value.(*Payload_Metric_FloatValue)
+	case DataType_Double:
+		_, ok = metric.Value.(*Payload_Metric_DoubleValue)
+	case DataType_Boolean:
+		_, ok = metric.Value.(*Payload_Metric_BooleanValue)
+	case DataType_String, DataType_Text, DataType_UUID:
+		_, ok = metric.Value.(*Payload_Metric_StringValue)
+	case DataType_Bytes, DataType_File:
+		_, ok = metric.Value.(*Payload_Metric_BytesValue)
+	case DataType_DataSet:
+		_, ok = metric.Value.(*Payload_Metric_DatasetValue)
+	case DataType_Template:
+		_, ok = metric.Value.(*Payload_Metric_TemplateValue)
+	case DataType_PropertySet, DataType_PropertySetList:
+		return fmt.Errorf("has datatype %s of properties", datatype)
+	default:
+		value, isBytes := metric.Value.(*Payload_Metric_BytesValue)
+		if !isBytes {
+			ok = false
+			break
+		}
+		if _, err := DecodeArray(datatype, value.BytesValue); err != nil {
+			return fmt.Errorf("has an invalid %s, %w", datatype, err)
+		}
+	}
+	if !ok {
+		return fmt.Errorf("has datatype %s and a %T", datatype, metric.Value)
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package sparkplug
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func TestIsValidSparkplugBTopic(t *testing.T) {
 	tests := []struct {
@@ -97,3 +103,68 @@ func TestIsValidSparkplugBTopic(t *testing.T) {
 		})
 	}
 }
+
+// requirements returns the requirement ids of violations
+func requirements(violations []Violation) []string {
+	ids := make([]string, 0, len(violations))
+	for _, v := range violations {
+		ids = append(ids, v.Requirement)
+	}
+	return ids
+}
+
+func TestValidatePayload(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	nbirth := mustTopic(t, "spBv1.0/Plant1/NBIRTH/Heater")
+	dbirth := mustTopic(t, "spBv1.0/Plant1/DBIRTH/Heater/TempSensor")
+	ndata := mustTopic(t, "spBv1.0/Plant1/NDATA/Heater")
+	ndeath := mustTopic(t, "spBv1.0/Plant1/NDEATH/Heater")
+
+	birth, err := NewPayload().Timestamp(now).Metric(bdSeqMetric(1)).Float("Voltage", 230).Alias(1).Build()
+	require.NoError(t, err)
+	assert.Empty(t, ValidatePayload(nbirth, birth, nil))
+	ns := NewNamespace()
+	ns.Apply(nbirth, birth, now)
+
+	tests := []struct {
+		name    string
+		topic   Topic
+		payload *Payload
+		want    []string
+	}{
+		{"seq out of range", ndata, &Payload{Timestamp: 1, Seq: 256}, []string{REQ_SEQ_RANGE}},
+		{"birth seq out of range", nbirth, &Payload{Timestamp: 1, Seq: 300, Metrics: []*Payload_Metric{bdSeqMetric(1)}}, []string{REQ_SEQ_RANGE}},
+		// the presence of seq is not known
+		{"death with seq", ndeath, &Payload{Seq: 2, Metrics: []*Payload_Metric{bdSeqMetric(1)}}, []string{}},
+		{"birth without bdSeq", nbirth, &Payload{Timestamp: 1}, []string{REQ_NBIRTH_BDSEQ}},
+		{"death without bdSeq", ndeath, nil, []string{REQ_NDEATH_BDSEQ}},
+		{"no timestamp", ndata, &Payload{Seq: 1}, []string{REQ_NDATA_TIMESTAMP}},
+		{"no name or alias", ndata, &Payload{Timestamp: 1, Metrics: []*Payload_Metric{{Value: &Payload_Metric_FloatValue{FloatValue: 1}}}}, []string{REQ_NAME}},
+		{"alias without name in birth", dbirth, &Payload{Timestamp: 1, Metrics: []*Payload_Metric{{Alias: 2, Datatype: DataType_Float.Uint32()}}}, []string{REQ_ALIAS_BIRTH}},
+		{"no datatype in birth", dbirth, &Payload{Timestamp: 1, Metrics: []*Payload_Metric{{Name: "Celsius", Value: &Payload_Metric_FloatValue{FloatValue: 1}}}}, []string{REQ_DATATYPE}},
+		{"duplicate alias", dbirth, &Payload{Timestamp: 1, Metrics: []*Payload_Metric{
+			{Name: "Celsius", Alias: 2, Datatype: DataType_Float.Uint32()},
+			{Name: "Fahrenheit", Alias: 2, Datatype: DataType_Float.Uint32()},
+		}}, []string{REQ_ALIAS_UNIQUE}},
+		{"alias of the edge node", dbirth, &Payload{Timestamp: 1, Metrics: []*Payload_Metric{{Name: "Celsius", Alias: 1, Datatype: DataType_Float.Uint32()}}}, []string{REQ_ALIAS_UNIQUE}},
+		{"value field of another datatype", dbirth, &Payload{Timestamp: 1, Metrics: []*Payload_Metric{
+			{Name: "Count", Datatype: DataType_Int64.Uint32(), Value: &Payload_Metric_IntValue{IntValue: 1}},
+		}}, []string{REQ_DATATYPE_VALUE}},
+		{"value field of the datatype of the birth", ndata, &Payload{Timestamp: 1, Metrics: []*Payload_Metric{
+			{Alias: 1, Value: &Payload_Metric_DoubleValue{DoubleValue: 1}},
+		}}, []string{REQ_DATATYPE_VALUE}},
+		{"invalid array", dbirth, &Payload{Timestamp: 1, Metrics: []*Payload_Metric{
+			{Name: "Buf", Datatype: DataType_Int32Array.Uint32(), Value: &Payload_Metric_BytesValue{BytesValue: []byte{1}}},
+		}}, []string{REQ_DATATYPE_VALUE}},
+		{"valid data", ndata, &Payload{Timestamp: 1, Seq: 1, Metrics: []*Payload_Metric{aliased(1, 231)}}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, requirements(ValidatePayload(tt.topic, tt.payload, ns)))
+		})
+	}
+
+	violation := ValidatePayload(ndata, &Payload{Metrics: []*Payload_Metric{{}}}, nil)
+	require.Len(t, violation, 2)
+	assert.Equal(t, REQ_NAME+": metric 0 has no name or alias", violation[1].String())
+}